@@ -0,0 +1,41 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/cobra"
+
+	"github.com/electrofelix/gin-demo/service"
+	"github.com/electrofelix/gin-demo/store"
+)
+
+// newCachingUserStore wraps the user store with a cache when enabled by
+// --cache-size, registering its hits and misses with reg to be served at
+// /metrics.
+func newCachingUserStore(ccmd *cobra.Command, next service.UserStore, reg prometheus.Registerer) (service.UserStore, error) {
+	size, err := ccmd.Flags().GetInt("cache-size")
+	if err != nil {
+		return nil, err
+	}
+
+	if size <= 0 {
+		return next, nil
+	}
+
+	ttl, err := ccmd.Flags().GetDuration("cache-ttl")
+	if err != nil {
+		return nil, err
+	}
+
+	negativeTTL, err := ccmd.Flags().GetDuration("cache-negative-ttl")
+	if err != nil {
+		return nil, err
+	}
+
+	cache := store.NewCachingUserStore(
+		next, store.WithCacheSize(size), store.WithCacheTTL(ttl), store.WithCacheNegativeTTL(negativeTTL),
+	)
+
+	store.RegisterCacheMetrics(reg, cache)
+
+	return cache, nil
+}
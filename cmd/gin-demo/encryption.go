@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/spf13/cobra"
+
+	"github.com/electrofelix/gin-demo/store"
+)
+
+// encryptableFields maps the names of user fields accepted by
+// --encrypted-fields to the attributes of the DynamoDB items.
+var encryptableFields = map[string]string{
+	"email":    "Email",
+	"name":     "Name",
+	"password": "Password",
+}
+
+func encryptableFieldNames() []string {
+	names := make([]string, 0, len(encryptableFields))
+	for name := range encryptableFields {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// encryptionOptions enables encryption of the DynamoDB store when given a
+// key file by --encryption-key-file.
+func encryptionOptions(ccmd *cobra.Command) ([]store.Option, error) {
+	path, err := ccmd.Flags().GetString("encryption-key-file")
+	if err != nil {
+		return nil, err
+	}
+
+	if path == "" {
+		return nil, nil
+	}
+
+	names, err := ccmd.Flags().GetStringSlice("encrypted-fields")
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make([]string, 0, len(names))
+
+	for _, name := range names {
+		field, ok := encryptableFields[name]
+		if !ok {
+			return nil, fmt.Errorf("unable to encrypt unknown field '%s'", name)
+		}
+
+		fields = append(fields, field)
+	}
+
+	if len(fields) == 0 {
+		return nil, errors.New("--encrypted-fields must name at least one field when encryption is enabled")
+	}
+
+	provider, err := store.NewKeyFileProvider(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return []store.Option{store.WithEncryption(provider, fields...)}, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodbstreams"
+	"github.com/spf13/cobra"
+
+	"github.com/electrofelix/gin-demo/entity"
+	"github.com/electrofelix/gin-demo/store"
+)
+
+func newEventsCmd() *cobra.Command {
+	cmd := cobra.Command{
+		Use:   "events",
+		Short: fmt.Sprintf("write the changes to users of the %s table to stdout as JSON lines", storeDynamoDB),
+		Long: fmt.Sprintf(`Write the changes to users of the %s table to stdout as JSON lines.
+
+Changes are read from the stream of the table, enabled by the migrations, in
+the order they were made to each user. The position of the consumer is
+recorded in the table under --consumer once the events have been written, so
+a stopped consumer resumes where it left off. Events are delivered at least
+once, an event written just before stopping may be written again, with the
+same id, on resuming. Only one consumer of each name may run at a time.
+
+Changes are kept in the stream for 24 hours, a consumer stopped for longer
+misses those that were removed.`, storeDynamoDB),
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE:         streamEvents,
+	}
+
+	cmd.Flags().String("consumer", "events", "name the position in the stream is recorded under")
+	cmd.Flags().Duration("poll-interval", time.Second, "time to wait for new changes once all have been read")
+	cmd.Flags().Int32("batch-size", 100, "number of changes to read between recording the position")
+	cmd.Flags().Bool("once", false, "exit once all changes have been read rather than waiting for more")
+
+	return &cmd
+}
+
+func streamEvents(ccmd *cobra.Command, args []string) error {
+	if err := requireDynamoDBStore(ccmd); err != nil {
+		return err
+	}
+
+	name, err := ccmd.Flags().GetString("consumer")
+	if err != nil {
+		return err
+	}
+
+	pollInterval, err := ccmd.Flags().GetDuration("poll-interval")
+	if err != nil {
+		return err
+	}
+
+	batchSize, err := ccmd.Flags().GetInt32("batch-size")
+	if err != nil {
+		return err
+	}
+
+	once, err := ccmd.Flags().GetBool("once")
+	if err != nil {
+		return err
+	}
+
+	userStore, err := newDynamoDBUserStore(ccmd)
+	if err != nil {
+		return err
+	}
+
+	awsCfg, err := loadAWSConfig(ccmd)
+	if err != nil {
+		return err
+	}
+
+	consumer := store.NewStreamConsumer(
+		userStore,
+		dynamodbstreams.NewFromConfig(awsCfg),
+		name,
+		store.WithConsumerPollInterval(pollInterval),
+		store.WithConsumerBatchSize(batchSize),
+	)
+
+	encoder := json.NewEncoder(ccmd.OutOrStdout())
+	handler := func(ctx context.Context, event entity.UserEvent) error {
+		return encoder.Encode(event)
+	}
+
+	if once {
+		_, err = consumer.Poll(ccmd.Context(), handler)
+
+		return err
+	}
+
+	return consumer.Run(ccmd.Context(), handler)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/electrofelix/gin-demo/entity"
+	"github.com/electrofelix/gin-demo/store"
+)
+
+func newExportCmd() *cobra.Command {
+	cmd := cobra.Command{
+		Use:   "export [FILE]",
+		Short: fmt.Sprintf("write all users of the %s table as JSONL to FILE or stdout", storeDynamoDB),
+		Long: fmt.Sprintf(`Write all users of the %s table as JSONL to FILE or stdout.
+
+Every user is exported including deleted users and their credentials, which
+hold the password hash and any MFA secret, so the output should be handled as
+carefully as the table itself. The audit trail is not exported.`, storeDynamoDB),
+		Args:         cobra.MaximumNArgs(1),
+		SilenceUsage: true,
+		RunE:         exportUsers,
+	}
+
+	cmd.Flags().Int("segments", 4, "number of segments of the table to scan in parallel")
+
+	return &cmd
+}
+
+func newRestoreCmd() *cobra.Command {
+	cmd := cobra.Command{
+		Use:          "restore FILE",
+		Short:        fmt.Sprintf("load users from an export into an empty %s table, reading stdin if FILE is -", storeDynamoDB),
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE:         restoreUsers,
+	}
+
+	cmd.Flags().Int("batch-size", 100, "number of users to read before writing them")
+
+	return &cmd
+}
+
+func exportUsers(ccmd *cobra.Command, args []string) error {
+	if err := requireDynamoDBStore(ccmd); err != nil {
+		return err
+	}
+
+	segments, err := ccmd.Flags().GetInt("segments")
+	if err != nil {
+		return err
+	}
+
+	userStore, err := newDynamoDBUserStore(ccmd)
+	if err != nil {
+		return err
+	}
+
+	out := ccmd.OutOrStdout()
+	if len(args) == 1 && args[0] != "-" {
+		file, err := os.Create(args[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		out = file
+	}
+
+	writer := bufio.NewWriter(out)
+	encoder := json.NewEncoder(writer)
+	count := 0
+
+	err = userStore.Export(ccmd.Context(), segments, func(user store.ExportedUser) error {
+		count++
+
+		return encoder.Encode(user)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(ccmd.ErrOrStderr(), "exported %d users\n", count)
+
+	return nil
+}
+
+func restoreUsers(ccmd *cobra.Command, args []string) error {
+	if err := requireDynamoDBStore(ccmd); err != nil {
+		return err
+	}
+
+	batchSize, err := ccmd.Flags().GetInt("batch-size")
+	if err != nil {
+		return err
+	}
+
+	if batchSize < 1 {
+		return errors.New("--batch-size must be at least 1")
+	}
+
+	in := ccmd.InOrStdin()
+	if args[0] != "-" {
+		file, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		in = file
+	}
+
+	userStore, err := newMigratedDynamoDBUserStore(ccmd)
+	if err != nil {
+		return err
+	}
+
+	empty, err := userStore.Empty(ccmd.Context())
+	if err != nil {
+		return err
+	}
+
+	if !empty {
+		return errors.New("users can only be restored into an empty table")
+	}
+
+	restored := 0
+	batch := make([]*store.ExportedUser, 0, batchSize)
+
+	flush := func() error {
+		for idx, err := range userStore.Load(ccmd.Context(), batch) {
+			if err != nil {
+				return fmt.Errorf("restoring user %s: %w", batch[idx].Id, err)
+			}
+		}
+
+		restored += len(batch)
+		batch = batch[:0]
+
+		return nil
+	}
+
+	err = readExport(in, func(user store.ExportedUser) error {
+		batch = append(batch, &user)
+
+		if len(batch) < batchSize {
+			return nil
+		}
+
+		return flush()
+	})
+	if err == nil {
+		err = flush()
+	}
+
+	fmt.Fprintf(ccmd.ErrOrStderr(), "restored %d users\n", restored)
+
+	return err
+}
+
+func readExport(in io.Reader, fn func(store.ExportedUser) error) error {
+	scanner := bufio.NewScanner(in)
+	line := 0
+
+	for scanner.Scan() {
+		line++
+
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var user store.ExportedUser
+		if err := json.Unmarshal([]byte(text), &user); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+
+		if user.Id == "" || user.Email == "" {
+			return fmt.Errorf("line %d: %w", line, entity.ErrUserInvalid)
+		}
+
+		if err := fn(user); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+func newFsckCmd() *cobra.Command {
+	cmd := cobra.Command{
+		Use:          "fsck",
+		Short:        fmt.Sprintf("check the email uniqueness items of the %s table are consistent with the users", storeDynamoDB),
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE:         fsck,
+	}
+
+	cmd.Flags().Bool("repair", false, "repair any problems found using conditional writes")
+
+	return &cmd
+}
+
+func fsck(ccmd *cobra.Command, args []string) error {
+	if err := requireDynamoDBStore(ccmd); err != nil {
+		return err
+	}
+
+	repair, err := ccmd.Flags().GetBool("repair")
+	if err != nil {
+		return err
+	}
+
+	userStore, err := newDynamoDBUserStore(ccmd)
+	if err != nil {
+		return err
+	}
+
+	report, err := userStore.Fsck(ccmd.Context(), repair)
+	if err != nil {
+		return err
+	}
+
+	out := ccmd.OutOrStdout()
+
+	fmt.Fprintf(out, "checked %d users and %d email items\n", report.Users, report.Emails)
+
+	for _, problem := range report.Problems {
+		fmt.Fprintln(out, problem)
+	}
+
+	if remaining := report.Unrepaired(); remaining > 0 {
+		return fmt.Errorf("%d problems remaining", remaining)
+	}
+
+	return nil
+}
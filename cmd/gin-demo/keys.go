@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/electrofelix/gin-demo/store"
+)
+
+func newKeysCmd() *cobra.Command {
+	cmd := cobra.Command{
+		Use:   "keys",
+		Short: "manage the keys encrypting user fields, given by --encryption-key-file",
+	}
+
+	addCmd := cobra.Command{
+		Use:   "add",
+		Short: "generate a new key and make it the current key, creating the key file if needed",
+		Long: `Generate a new key and make it the current key, creating the key file if needed.
+
+The updated key file must be deployed to every instance before running
+rotate, as instances without the new key cannot read items written with it.`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE:         addKey,
+	}
+
+	rotateCmd := cobra.Command{
+		Use:   "rotate",
+		Short: fmt.Sprintf("move all users and audit entries of the %s table to the current key", storeDynamoDB),
+		Long: fmt.Sprintf(`Move all users and audit entries of the %s table to the current key.
+
+Data keys wrapped by an old key are re-wrapped, and items written before
+encryption was enabled, or with other fields encrypted, are re-encrypted. Each
+write is conditional on the item being unchanged, so it is safe to run while
+serving requests. Progress is recorded in the table after each batch, and an
+interrupted rotation resumes where it stopped. Old keys must be kept in the
+key file until it completes.`, storeDynamoDB),
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE:         rotateKeys,
+	}
+
+	rotateCmd.Flags().Int32("batch-size", 100, "number of items to read between recording progress")
+
+	cmd.AddCommand(&addCmd, &rotateCmd)
+
+	return &cmd
+}
+
+func keyFilePath(ccmd *cobra.Command) (string, error) {
+	path, err := ccmd.Flags().GetString("encryption-key-file")
+	if err != nil {
+		return "", err
+	}
+
+	if path == "" {
+		return "", errors.New("--encryption-key-file is required")
+	}
+
+	return path, nil
+}
+
+func addKey(ccmd *cobra.Command, args []string) error {
+	path, err := keyFilePath(ccmd)
+	if err != nil {
+		return err
+	}
+
+	id, err := store.AddKeyFileKey(path)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(ccmd.OutOrStdout(), "added key %s to %s\n", id, path)
+
+	return nil
+}
+
+func rotateKeys(ccmd *cobra.Command, args []string) error {
+	if err := requireDynamoDBStore(ccmd); err != nil {
+		return err
+	}
+
+	if _, err := keyFilePath(ccmd); err != nil {
+		return err
+	}
+
+	batchSize, err := ccmd.Flags().GetInt32("batch-size")
+	if err != nil {
+		return err
+	}
+
+	userStore, err := newDynamoDBUserStore(ccmd)
+	if err != nil {
+		return err
+	}
+
+	rotator := store.NewKeyRotator(
+		userStore,
+		store.WithRotationBatchSize(batchSize),
+		store.WithRotationProgress(func(progress store.RotationProgress) {
+			fmt.Fprintln(ccmd.ErrOrStderr(), progress)
+		}),
+	)
+
+	progress, err := rotator.Rotate(ccmd.Context())
+	if err != nil {
+		return fmt.Errorf("rotation stopped, run again to resume: %w", err)
+	}
+
+	fmt.Fprintf(ccmd.OutOrStdout(), "rotation complete, %s\n", progress)
+
+	return nil
+}
+
+// newKeyRotationWorker returns a worker rotating keys every
+// --key-rotation-interval, or nil when it is disabled or there are no keys
+// to rotate.
+func newKeyRotationWorker(ccmd *cobra.Command) (func(context.Context), error) {
+	interval, err := ccmd.Flags().GetDuration("key-rotation-interval")
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := ccmd.Flags().GetString("encryption-key-file")
+	if err != nil {
+		return nil, err
+	}
+
+	if interval <= 0 || path == "" {
+		return nil, nil
+	}
+
+	if err := requireDynamoDBStore(ccmd); err != nil {
+		return nil, err
+	}
+
+	userStore, err := newDynamoDBUserStore(ccmd)
+	if err != nil {
+		return nil, err
+	}
+
+	rotator := store.NewKeyRotator(userStore)
+
+	return func(ctx context.Context) {
+		rotateKeysPeriodically(ctx, rotator, interval)
+	}, nil
+}
+
+// rotateKeysPeriodically runs the rotator at each interval until the context
+// is cancelled, so that items are moved to a new key once it is deployed
+// without running rotate by hand.
+func rotateKeysPeriodically(ctx context.Context, rotator *store.KeyRotator, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			progress, err := rotator.Rotate(ctx)
+			if err != nil {
+				log.Errorf("key rotation stopped, will resume: %v", err)
+
+				continue
+			}
+
+			if progress.Rewrapped+progress.Reencrypted > 0 {
+				log.Infof("key rotation complete, %s", progress)
+			}
+		}
+	}
+}
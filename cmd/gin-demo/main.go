@@ -3,17 +3,24 @@ package main
 import (
 	"context"
 	"fmt"
+	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodbstreams"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
 	"github.com/electrofelix/gin-demo/controller"
+	"github.com/electrofelix/gin-demo/entity"
+	"github.com/electrofelix/gin-demo/search"
 	"github.com/electrofelix/gin-demo/server"
 	"github.com/electrofelix/gin-demo/service"
 	"github.com/electrofelix/gin-demo/store"
@@ -28,6 +35,103 @@ func NewCmd() *cobra.Command {
 		RunE:         run,
 	}
 
+	cmd.PersistentFlags().String(
+		"store", storeDynamoDB,
+		fmt.Sprintf("user store backend to use, one of: %s, %s, %s", storeDynamoDB, storeMemory, storeSQL),
+	)
+	cmd.PersistentFlags().String(
+		"sql-driver", store.SQLDriverPostgres,
+		fmt.Sprintf("sql driver used by the %s store, one of: %s, %s", storeSQL, store.SQLDriverPostgres, store.SQLDriverSQLite),
+	)
+	cmd.PersistentFlags().String(
+		"sql-dsn", "", fmt.Sprintf("data source name used to connect with the %s store", storeSQL),
+	)
+
+	cmd.PersistentFlags().Bool(
+		"migrate-on-start", true,
+		fmt.Sprintf("apply any pending schema migrations when starting with the %s store", storeDynamoDB),
+	)
+
+	cmd.PersistentFlags().String(
+		"encryption-key-file", "",
+		fmt.Sprintf("key file to encrypt user fields in the %s store with, encryption is disabled without it", storeDynamoDB),
+	)
+	cmd.PersistentFlags().StringSlice(
+		"encrypted-fields", []string{"email", "name"},
+		fmt.Sprintf("user fields to encrypt when encryption is enabled, any of: %s", strings.Join(encryptableFieldNames(), ", ")),
+	)
+
+	cmd.PersistentFlags().String(
+		"search-index-file", "",
+		"file the search index is loaded from on start and saved to on stop, it holds user names and emails in the clear "+
+			"so cannot be used with --encryption-key-file",
+	)
+
+	cmd.Flags().StringSlice(
+		"trusted-proxies", nil,
+		"addresses or CIDRs of the proxies trusted to give the client address in X-Forwarded-For, "+
+			"by default none are and the address of the connection is recorded for logins and the audit trail",
+	)
+
+	cmd.Flags().StringSlice(
+		"tenants", []string{entity.DefaultTenant},
+		"tenants users can be managed for, unknown tenants are rejected and their users are never purged",
+	)
+	cmd.Flags().String(
+		"tenant-header", controller.DefaultTenantHeader,
+		"header naming the tenant of each request, any client can set it so it does not keep tenants apart, see --tenant-claim",
+	)
+	cmd.Flags().String(
+		"tenant-domain", "",
+		"domain whose subdomains name the tenant of each request, such as acme.example.com, instead of the header, "+
+			"any client can choose the host so it does not keep tenants apart, see --tenant-claim",
+	)
+	cmd.Flags().String(
+		"token-secret-file", "",
+		"file holding the secret bearer tokens are signed with using HS256, every request must carry a valid token when given",
+	)
+	cmd.Flags().String(
+		"token-issuer", "", "iss claim bearer tokens must have, any issuer sharing the secret is trusted when empty",
+	)
+	cmd.Flags().String(
+		"token-audience", "",
+		"audience the aud claim of bearer tokens must include, tokens issued for any service are accepted when empty",
+	)
+	cmd.Flags().String(
+		"tenant-claim", "",
+		"claim of the bearer token naming the tenant of each request, instead of the header or domain, requires --token-secret-file, "+
+			"tokens without it are rejected",
+	)
+	cmd.Flags().String(
+		"default-tenant", entity.DefaultTenant, "tenant of requests that do not name one, empty requires every request to",
+	)
+
+	cmd.Flags().Duration(
+		"delete-grace-period", service.DefaultDeleteGracePeriod,
+		"how long deleted users can be restored and keep their email reserved before being purged",
+	)
+	cmd.Flags().Duration(
+		"purge-interval", time.Hour, "how often to purge deleted users past the grace period, 0 disables purging",
+	)
+
+	cmd.Flags().Duration(
+		"key-rotation-interval", 0,
+		"how often to move encrypted users to the current key in the background, 0 disables the worker",
+	)
+
+	cmd.Flags().Duration(
+		"search-reindex-interval", time.Hour,
+		"how often to rebuild the search index from the store, picking up users written by other instances, 0 disables rebuilding",
+	)
+
+	cmd.Flags().Int("cache-size", 0, "number of users to cache in memory, 0 disables the cache")
+	cmd.Flags().Duration(
+		"cache-ttl", 30*time.Second, "how long users are cached, limiting how stale users written by other instances may be",
+	)
+	cmd.Flags().Duration("cache-negative-ttl", 5*time.Second, "how long users that do not exist are cached")
+
+	cmd.AddCommand(newMigrateCmd(), newFsckCmd(), newUsersCmd(), newExportCmd(), newRestoreCmd(), newKeysCmd(), newReindexCmd(), newEventsCmd())
+
 	return &cmd
 }
 
@@ -54,7 +158,9 @@ func loadAWSConfig(ccmd *cobra.Command) (aws.Config, error) {
 		config.WithEndpointResolver(
 			aws.EndpointResolverFunc(
 				func(service, region string) (aws.Endpoint, error) {
-					if service == dynamodb.ServiceID {
+					// dynamodb-local serves the stream of changes on the
+					// same endpoint as the tables
+					if service == dynamodb.ServiceID || service == dynamodbstreams.ServiceID {
 						return aws.Endpoint{
 							URL: "http://localhost:8000",
 						}, nil
@@ -74,6 +180,9 @@ func loadAWSConfig(ccmd *cobra.Command) (aws.Config, error) {
 				},
 			),
 		),
+		// the store retries with its own backoff and budget, retrying in the
+		// SDK as well would multiply the attempts made
+		config.WithRetryer(func() aws.Retryer { return aws.NopRetryer{} }),
 	)
 	if err != nil {
 		fmt.Fprintf(ccmd.ErrOrStderr(), "unable to load SDK config, %v", err)
@@ -85,24 +194,65 @@ func loadAWSConfig(ccmd *cobra.Command) (aws.Config, error) {
 }
 
 func run(ccmd *cobra.Command, args []string) error {
+	store, err := newInstrumentedUserStore(ccmd, prometheus.DefaultRegisterer)
+	if err != nil {
+		return err
+	}
 
-	awsCfg, err := loadAWSConfig(ccmd)
+	gracePeriod, err := ccmd.Flags().GetDuration("delete-grace-period")
 	if err != nil {
 		return err
 	}
 
-	dbClient := dynamodb.NewFromConfig(awsCfg)
+	purgeInterval, err := ccmd.Flags().GetDuration("purge-interval")
+	if err != nil {
+		return err
+	}
 
-	// table should be provided via a config option
-	store := store.NewUserStore(dbClient, "user-table")
-	err = store.InitializeTable(ccmd.Context())
+	reindexInterval, err := ccmd.Flags().GetDuration("search-reindex-interval")
 	if err != nil {
 		return err
 	}
 
-	s := server.New()
-	
-	controller.New(service.New(store), s.GetRouter())
+	rotateKeys, err := newKeyRotationWorker(ccmd)
+	if err != nil {
+		return err
+	}
+
+	tenantNames, err := tenants(ccmd)
+	if err != nil {
+		return err
+	}
+
+	tenantOptions, err := newTenantOptions(ccmd)
+	if err != nil {
+		return err
+	}
+
+	proxies, err := trustedProxies(ccmd)
+	if err != nil {
+		return err
+	}
+
+	s := server.New(server.WithTrustedProxies(proxies...))
+
+	store, err = newCachingUserStore(ccmd, store, prometheus.DefaultRegisterer)
+	if err != nil {
+		return err
+	}
+
+	index := search.NewIndex()
+	userService := service.New(
+		store, service.WithDeleteGracePeriod(gracePeriod), service.WithTenants(tenantNames...),
+		service.WithSearchIndex(index),
+	)
+
+	err = loadSearchIndex(ccmd, userService, index)
+	if err != nil {
+		return err
+	}
+
+	controller.New(userService, s.GetRouter(), tenantOptions...)
 
 	// register to allow some signals to provide a context that will indicate shutdown
 	quit := make(chan os.Signal, 1)
@@ -114,5 +264,42 @@ func run(ccmd *cobra.Command, args []string) error {
 		cancelFunc()
 	}()
 
-	return s.Start(ctx)
+	if purgeInterval > 0 {
+		go purgeDeletedUsers(ctx, userService, purgeInterval)
+	}
+
+	if rotateKeys != nil {
+		go rotateKeys(ctx)
+	}
+
+	if reindexInterval > 0 {
+		go reindexPeriodically(ctx, userService, reindexInterval)
+	}
+
+	err = s.Start(ctx)
+
+	saveSearchIndex(ccmd, index)
+
+	return err
+}
+
+// trustedProxies returns the proxies given by --trusted-proxies, each of
+// which must be an address or a CIDR.
+func trustedProxies(ccmd *cobra.Command) ([]string, error) {
+	proxies, err := ccmd.Flags().GetStringSlice("trusted-proxies")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, proxy := range proxies {
+		if net.ParseIP(proxy) != nil {
+			continue
+		}
+
+		if _, _, err := net.ParseCIDR(proxy); err != nil {
+			return nil, fmt.Errorf("--trusted-proxies must be addresses or CIDRs, not '%s'", proxy)
+		}
+	}
+
+	return proxies, nil
 }
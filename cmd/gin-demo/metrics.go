@@ -0,0 +1,22 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/cobra"
+
+	"github.com/electrofelix/gin-demo/service"
+	"github.com/electrofelix/gin-demo/store"
+)
+
+// newInstrumentedUserStore constructs the user store selected by --store,
+// registering metrics of its operations with reg to be served at /metrics.
+func newInstrumentedUserStore(ccmd *cobra.Command, reg prometheus.Registerer) (service.UserStore, error) {
+	metrics := store.NewMetrics(reg)
+
+	userStore, err := newUserStore(ccmd, store.WithMetrics(metrics))
+	if err != nil {
+		return nil, err
+	}
+
+	return store.NewMetricsUserStore(userStore, metrics), nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/electrofelix/gin-demo/store"
+)
+
+func newMigrateCmd() *cobra.Command {
+	cmd := cobra.Command{
+		Use:   "migrate",
+		Short: fmt.Sprintf("manage the schema of the %s table", storeDynamoDB),
+	}
+
+	cmd.AddCommand(
+		&cobra.Command{
+			Use:          "up",
+			Short:        "apply all pending schema migrations",
+			Args:         cobra.NoArgs,
+			SilenceUsage: true,
+			RunE:         migrateUp,
+		},
+		&cobra.Command{
+			Use:          "status",
+			Short:        "report the applied schema version and any pending migrations",
+			Args:         cobra.NoArgs,
+			SilenceUsage: true,
+			RunE:         migrateStatus,
+		},
+	)
+
+	return &cmd
+}
+
+func newMigrator(ccmd *cobra.Command) (*store.Migrator, error) {
+	backend, err := ccmd.Flags().GetString("store")
+	if err != nil {
+		return nil, err
+	}
+
+	if backend != storeDynamoDB {
+		return nil, fmt.Errorf("migrations only apply to the %s store", storeDynamoDB)
+	}
+
+	userStore, err := newDynamoDBUserStore(ccmd)
+	if err != nil {
+		return nil, err
+	}
+
+	return store.NewMigrator(userStore), nil
+}
+
+func migrateUp(ccmd *cobra.Command, args []string) error {
+	migrator, err := newMigrator(ccmd)
+	if err != nil {
+		return err
+	}
+
+	return migrator.Up(ccmd.Context())
+}
+
+func migrateStatus(ccmd *cobra.Command, args []string) error {
+	migrator, err := newMigrator(ccmd)
+	if err != nil {
+		return err
+	}
+
+	status, err := migrator.Status(ccmd.Context())
+	if err != nil {
+		return err
+	}
+
+	out := ccmd.OutOrStdout()
+
+	fmt.Fprintf(out, "current version: %d\nlatest version:  %d\n", status.Current, status.Latest)
+
+	for _, migration := range status.Pending {
+		fmt.Fprintf(out, "pending %d: %s\n", migration.Version, migration.Description)
+	}
+
+	return nil
+}
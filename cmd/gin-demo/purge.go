@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/electrofelix/gin-demo/service"
+)
+
+// purgeDeletedUsers periodically removes users whose deletion grace period
+// has expired, until the context is cancelled.
+func purgeDeletedUsers(ctx context.Context, svc *service.UserService, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			purged, err := svc.Purge(ctx)
+			if err != nil {
+				log.Errorf("purge of deleted users failed after %d removed: %v", purged, err)
+
+				continue
+			}
+
+			if purged > 0 {
+				log.Infof("purged %d deleted users", purged)
+			}
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/electrofelix/gin-demo/entity"
+	"github.com/electrofelix/gin-demo/search"
+	"github.com/electrofelix/gin-demo/service"
+)
+
+func newReindexCmd() *cobra.Command {
+	cmd := cobra.Command{
+		Use:   "reindex",
+		Short: "rebuild the search index file given by --search-index-file from the users in the store",
+		Long: `Rebuild the search index file given by --search-index-file from the users in the store.
+
+Users written without going through the service, such as by users import or
+restore, are only found by search once the index is rebuilt. Instances load
+the file when they start, so run this before starting them, as a running
+instance replaces the file with its own index when it stops.`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE:         reindex,
+	}
+
+	cmd.Flags().StringSlice("tenants", []string{entity.DefaultTenant}, "tenants whose users are indexed")
+
+	return &cmd
+}
+
+// searchIndexFile returns the path given by --search-index-file, refusing it
+// when user fields are encrypted in the store as the file would hold them in
+// the clear.
+func searchIndexFile(ccmd *cobra.Command) (string, error) {
+	path, err := ccmd.Flags().GetString("search-index-file")
+	if err != nil || path == "" {
+		return path, err
+	}
+
+	keyFile, err := ccmd.Flags().GetString("encryption-key-file")
+	if err != nil {
+		return "", err
+	}
+
+	if keyFile != "" {
+		return "", errors.New("--search-index-file cannot be used with --encryption-key-file, " +
+			"it would hold the encrypted fields of users in the clear")
+	}
+
+	return path, nil
+}
+
+func reindex(ccmd *cobra.Command, args []string) error {
+	path, err := searchIndexFile(ccmd)
+	if err != nil {
+		return err
+	}
+
+	if path == "" {
+		return errors.New("--search-index-file is required")
+	}
+
+	tenantNames, err := tenants(ccmd)
+	if err != nil {
+		return err
+	}
+
+	userStore, err := newUserStore(ccmd)
+	if err != nil {
+		return err
+	}
+
+	index := search.NewIndex()
+	userService := service.New(userStore, service.WithTenants(tenantNames...), service.WithSearchIndex(index))
+
+	count, err := userService.Reindex(ccmd.Context())
+	if err != nil {
+		return err
+	}
+
+	err = index.SaveFile(path)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(ccmd.OutOrStdout(), "indexed %d users to %s\n", count, path)
+
+	return nil
+}
+
+// loadSearchIndex fills the index from --search-index-file, falling back to
+// rebuilding it from the store when there is no usable file, which is then
+// saved for the next start.
+func loadSearchIndex(ccmd *cobra.Command, svc *service.UserService, index *search.Index) error {
+	path, err := searchIndexFile(ccmd)
+	if err != nil {
+		return err
+	}
+
+	if path != "" {
+		err = index.LoadFile(path)
+		if err == nil {
+			log.Infof("loaded search index from %s", path)
+
+			return nil
+		}
+
+		if !os.IsNotExist(err) {
+			log.Warnf("rebuilding search index, unable to load it: %v", err)
+		}
+	}
+
+	count, err := svc.Reindex(ccmd.Context())
+	if err != nil {
+		return fmt.Errorf("unable to build search index: %w", err)
+	}
+
+	log.Infof("indexed %d users for search", count)
+
+	if path == "" {
+		return nil
+	}
+
+	return index.SaveFile(path)
+}
+
+// saveSearchIndex writes the index to --search-index-file when given, so
+// that the next start does not need to rebuild it.
+func saveSearchIndex(ccmd *cobra.Command, index *search.Index) {
+	path, err := searchIndexFile(ccmd)
+	if err != nil || path == "" {
+		return
+	}
+
+	if err := index.SaveFile(path); err != nil {
+		log.Errorf("failed to save search index to %s: %v", path, err)
+	}
+}
+
+// reindexPeriodically rebuilds the search index from the store at each
+// interval until the context is cancelled, picking up the users written by
+// other instances.
+func reindexPeriodically(ctx context.Context, svc *service.UserService, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			count, err := svc.Reindex(ctx)
+			if err != nil {
+				log.Errorf("rebuild of search index failed, will retry: %v", err)
+
+				continue
+			}
+
+			log.Debugf("rebuilt search index of %d users", count)
+		}
+	}
+}
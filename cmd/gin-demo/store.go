@@ -0,0 +1,136 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/spf13/cobra"
+
+	"github.com/electrofelix/gin-demo/service"
+	"github.com/electrofelix/gin-demo/store"
+)
+
+const (
+	storeDynamoDB = "dynamodb"
+	storeMemory   = "memory"
+	storeSQL      = "sql"
+)
+
+// newUserStore constructs the user store backend selected by the --store
+// flag, initializing any storage it depends on. The options only apply to
+// the DynamoDB store.
+func newUserStore(ccmd *cobra.Command, options ...store.Option) (service.UserStore, error) {
+	backend, err := ccmd.Flags().GetString("store")
+	if err != nil {
+		return nil, err
+	}
+
+	switch backend {
+	case storeDynamoDB:
+		return newMigratedDynamoDBUserStore(ccmd, options...)
+	case storeMemory:
+		return store.NewMemoryUserStore(), nil
+	case storeSQL:
+		return newSQLUserStore(ccmd)
+	default:
+		return nil, fmt.Errorf(
+			"unknown store '%s', must be one of: %s, %s, %s", backend, storeDynamoDB, storeMemory, storeSQL,
+		)
+	}
+}
+
+// requireDynamoDBStore fails commands that only apply to the DynamoDB store.
+func requireDynamoDBStore(ccmd *cobra.Command) error {
+	backend, err := ccmd.Flags().GetString("store")
+	if err != nil {
+		return err
+	}
+
+	if backend != storeDynamoDB {
+		return fmt.Errorf("%s only applies to the %s store", ccmd.Name(), storeDynamoDB)
+	}
+
+	return nil
+}
+
+func newDynamoDBUserStore(ccmd *cobra.Command, options ...store.Option) (*store.UserStore, error) {
+	awsCfg, err := loadAWSConfig(ccmd)
+	if err != nil {
+		return nil, err
+	}
+
+	dbClient := dynamodb.NewFromConfig(awsCfg)
+
+	encryption, err := encryptionOptions(ccmd)
+	if err != nil {
+		return nil, err
+	}
+
+	options = append(encryption, options...)
+
+	// table should be provided via a config option
+	return store.NewUserStore(dbClient, "user-table", options...), nil
+}
+
+// newMigratedDynamoDBUserStore applies any pending migrations to the table
+// before it is used, unless disabled by --migrate-on-start.
+func newMigratedDynamoDBUserStore(ccmd *cobra.Command, options ...store.Option) (*store.UserStore, error) {
+	userStore, err := newDynamoDBUserStore(ccmd, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	migrate, err := ccmd.Flags().GetBool("migrate-on-start")
+	if err != nil {
+		return nil, err
+	}
+
+	if migrate {
+		err = store.NewMigrator(userStore).Up(ccmd.Context())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return userStore, nil
+}
+
+func newSQLUserStore(ccmd *cobra.Command) (*store.SQLUserStore, error) {
+	driver, err := ccmd.Flags().GetString("sql-driver")
+	if err != nil {
+		return nil, err
+	}
+
+	dsn, err := ccmd.Flags().GetString("sql-dsn")
+	if err != nil {
+		return nil, err
+	}
+
+	if dsn == "" {
+		return nil, fmt.Errorf("--sql-dsn is required when using the %s store", storeSQL)
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if driver == store.SQLDriverSQLite {
+		// sqlite only supports a single writer, serialize access rather
+		// than surfacing 'database is locked' errors to clients
+		db.SetMaxOpenConns(1)
+	}
+
+	userStore, err := store.NewSQLUserStore(db, driver)
+	if err != nil {
+		return nil, err
+	}
+
+	err = userStore.InitializeSchema(ccmd.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	return userStore, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/spf13/cobra"
+
+	"github.com/electrofelix/gin-demo/controller"
+	"github.com/electrofelix/gin-demo/entity"
+)
+
+// tenants returns the tenants given by --tenants, checking each is valid.
+func tenants(ccmd *cobra.Command) ([]string, error) {
+	names, err := ccmd.Flags().GetStringSlice("tenants")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		if !entity.ValidTenant(name) {
+			return nil, fmt.Errorf("invalid tenant '%s', must be a lowercase DNS label", name)
+		}
+	}
+
+	return names, nil
+}
+
+// newTenantOptions configures how the controller authenticates and resolves
+// the tenant of each request, from the --tenant-claim of the token when
+// given, then the subdomain of --tenant-domain, and otherwise from the
+// --tenant-header.
+func newTenantOptions(ccmd *cobra.Command) ([]controller.Option, error) {
+	header, err := ccmd.Flags().GetString("tenant-header")
+	if err != nil {
+		return nil, err
+	}
+
+	domain, err := ccmd.Flags().GetString("tenant-domain")
+	if err != nil {
+		return nil, err
+	}
+
+	defaultTenant, err := ccmd.Flags().GetString("default-tenant")
+	if err != nil {
+		return nil, err
+	}
+
+	if defaultTenant != "" && !entity.ValidTenant(defaultTenant) {
+		return nil, fmt.Errorf("invalid default tenant '%s', must be a lowercase DNS label", defaultTenant)
+	}
+
+	claim, err := ccmd.Flags().GetString("tenant-claim")
+	if err != nil {
+		return nil, err
+	}
+
+	verifier, err := newTokenVerifier(ccmd)
+	if err != nil {
+		return nil, err
+	}
+
+	resolver := controller.TenantFromHeader(header)
+
+	switch {
+	case claim != "":
+		if verifier == nil {
+			return nil, errors.New("--tenant-claim requires --token-secret-file")
+		}
+
+		resolver = controller.TenantFromClaim(claim)
+	case domain != "":
+		resolver = controller.TenantFromSubdomain(domain)
+	case header == "":
+		return nil, errors.New("one of --tenant-header, --tenant-domain or --tenant-claim is required")
+	}
+
+	options := []controller.Option{
+		controller.WithTenantResolver(resolver),
+		controller.WithDefaultTenant(defaultTenant),
+	}
+
+	if verifier != nil {
+		options = append(options, controller.WithTokenVerifier(verifier))
+	}
+
+	return options, nil
+}
+
+// newTokenVerifier returns a verifier of tokens signed with the secret held
+// by --token-secret-file and from the --token-issuer for the
+// --token-audience when given, or nil when tokens are not required.
+func newTokenVerifier(ccmd *cobra.Command) (*controller.TokenVerifier, error) {
+	path, err := ccmd.Flags().GetString("token-secret-file")
+	if err != nil {
+		return nil, err
+	}
+
+	issuer, err := ccmd.Flags().GetString("token-issuer")
+	if err != nil {
+		return nil, err
+	}
+
+	audience, err := ccmd.Flags().GetString("token-audience")
+	if err != nil {
+		return nil, err
+	}
+
+	if path == "" {
+		if issuer != "" || audience != "" {
+			return nil, errors.New("--token-issuer and --token-audience require --token-secret-file")
+		}
+
+		return nil, nil
+	}
+
+	secret, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	secret = bytes.TrimSpace(secret)
+	if len(secret) < 32 {
+		return nil, fmt.Errorf("token secret in %s must be at least 32 bytes", path)
+	}
+
+	var options []controller.TokenOption
+
+	if issuer != "" {
+		options = append(options, controller.WithTokenIssuer(issuer))
+	}
+
+	if audience != "" {
+		options = append(options, controller.WithTokenAudience(audience))
+	}
+
+	return controller.NewTokenVerifier(secret, options...), nil
+}
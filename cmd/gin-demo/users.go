@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/electrofelix/gin-demo/entity"
+	"github.com/electrofelix/gin-demo/service"
+)
+
+const (
+	formatCSV   = "csv"
+	formatJSONL = "jsonl"
+)
+
+func newUsersCmd() *cobra.Command {
+	cmd := cobra.Command{
+		Use:   "users",
+		Short: "manage users directly in the user store",
+	}
+
+	importCmd := cobra.Command{
+		Use:   "import FILE",
+		Short: "create the users in a JSONL or CSV file, reading stdin if FILE is -",
+		Long: `Create the users in a JSONL or CSV file, reading stdin if FILE is -.
+
+Each JSONL line is a user object, a CSV file requires a header naming the
+email, name and password columns. The result of each row is written as a JSON
+line to stdout, with the row being the line of the file.`,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE:         importUsers,
+	}
+
+	importCmd.Flags().String("format", "", fmt.Sprintf("format of the file, one of: %s, %s (default from the file extension)", formatJSONL, formatCSV))
+	importCmd.Flags().Int("batch-size", 500, "number of users to create in each batch")
+	importCmd.Flags().Int("workers", 0, "number of passwords to hash in parallel (default the number of CPUs)")
+	importCmd.Flags().String("actor", "import", "actor recorded in the audit trail of the created users")
+	importCmd.Flags().String("tenant", entity.DefaultTenant, "tenant the users are created in")
+
+	cmd.AddCommand(&importCmd)
+
+	return &cmd
+}
+
+// importRow is a single user read from the file, or why it could not be.
+type importRow struct {
+	line int
+	user entity.User
+	err  error
+}
+
+func importUsers(ccmd *cobra.Command, args []string) error {
+	flags := ccmd.Flags()
+
+	format, err := flags.GetString("format")
+	if err != nil {
+		return err
+	}
+
+	batchSize, err := flags.GetInt("batch-size")
+	if err != nil {
+		return err
+	}
+
+	if batchSize < 1 || batchSize > service.MaxBatchSize {
+		return fmt.Errorf("--batch-size must be between 1 and %d", service.MaxBatchSize)
+	}
+
+	workers, err := flags.GetInt("workers")
+	if err != nil {
+		return err
+	}
+
+	actor, err := flags.GetString("actor")
+	if err != nil {
+		return err
+	}
+
+	tenant, err := flags.GetString("tenant")
+	if err != nil {
+		return err
+	}
+
+	if !entity.ValidTenant(tenant) {
+		return fmt.Errorf("invalid tenant '%s', must be a lowercase DNS label", tenant)
+	}
+
+	if format == "" {
+		format = formatJSONL
+		if strings.EqualFold(filepath.Ext(args[0]), ".csv") {
+			format = formatCSV
+		}
+	}
+
+	var read func(io.Reader, func(importRow) error) error
+
+	switch format {
+	case formatJSONL:
+		read = readJSONLUsers
+	case formatCSV:
+		read = readCSVUsers
+	default:
+		return fmt.Errorf("unknown format '%s', must be one of: %s, %s", format, formatJSONL, formatCSV)
+	}
+
+	in := ccmd.InOrStdin()
+	if args[0] != "-" {
+		file, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		in = file
+	}
+
+	userStore, err := newUserStore(ccmd)
+	if err != nil {
+		return err
+	}
+
+	userService := service.New(userStore, service.WithHashWorkers(workers), service.WithTenants(tenant))
+	ctx := service.WithActor(ccmd.Context(), actor)
+
+	encoder := json.NewEncoder(ccmd.OutOrStdout())
+	counts := map[entity.BatchStatus]int{}
+
+	report := func(result entity.BatchResult) error {
+		counts[result.Status]++
+
+		return encoder.Encode(result)
+	}
+
+	var batch []importRow
+
+	// rows that could not be read are reported in order with the results
+	// of the batch they were read with
+	flush := func() error {
+		users := make([]entity.User, 0, len(batch))
+		for _, row := range batch {
+			if row.err == nil {
+				users = append(users, row.user)
+			}
+		}
+
+		var results []entity.BatchResult
+		if len(users) > 0 {
+			results, err = userService.CreateBatch(ctx, tenant, users)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, row := range batch {
+			result := entity.BatchResult{Status: entity.BatchStatusInvalid}
+			if row.err != nil {
+				result.Error = row.err.Error()
+			} else {
+				result, results = results[0], results[1:]
+			}
+
+			result.Row = row.line
+
+			if err := report(result); err != nil {
+				return err
+			}
+		}
+
+		batch = batch[:0]
+
+		return nil
+	}
+
+	err = read(in, func(row importRow) error {
+		batch = append(batch, row)
+
+		if len(batch) < batchSize {
+			return nil
+		}
+
+		return flush()
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(
+		ccmd.ErrOrStderr(), "created: %d duplicate: %d invalid: %d failed: %d\n",
+		counts[entity.BatchStatusCreated], counts[entity.BatchStatusDuplicate],
+		counts[entity.BatchStatusInvalid], counts[entity.BatchStatusFailed],
+	)
+
+	if counts[entity.BatchStatusFailed] > 0 {
+		return fmt.Errorf("%d users failed to be created", counts[entity.BatchStatusFailed])
+	}
+
+	return nil
+}
+
+func readJSONLUsers(in io.Reader, fn func(importRow) error) error {
+	scanner := bufio.NewScanner(in)
+	line := 0
+
+	for scanner.Scan() {
+		line++
+
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		row := importRow{line: line}
+		row.err = json.Unmarshal([]byte(text), &row.user)
+
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+func readCSVUsers(in io.Reader, fn func(importRow) error) error {
+	reader := csv.NewReader(in)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("reading csv header: %w", err)
+	}
+
+	columns := map[string]int{}
+	for idx, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = idx
+	}
+
+	for _, name := range []string{"email", "name", "password"} {
+		if _, ok := columns[name]; !ok {
+			return fmt.Errorf("csv header is missing the '%s' column", name)
+		}
+	}
+
+	field := func(record []string, name string) string {
+		idx := columns[name]
+		if idx >= len(record) {
+			return ""
+		}
+
+		return record[idx]
+	}
+
+	// rows spanning multiple lines are not expected, so the header is line 1
+	line := 1
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+
+		line++
+
+		row := importRow{line: line}
+
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			row.err = parseErr
+		} else if err != nil {
+			return err
+		} else {
+			row.user = entity.User{
+				Email:    field(record, "email"),
+				Name:     field(record, "name"),
+				Password: field(record, "password"),
+			}
+		}
+
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package controller
+
+import (
+	"net"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/electrofelix/gin-demo/entity"
+)
+
+// DefaultTenantHeader is the header the tenant of a request is taken from
+// unless another TenantResolver is given.
+const DefaultTenantHeader = "X-Tenant"
+
+// TenantResolver returns the tenant a request is made for, or an empty string
+// if the request does not name one. A resolver may instead abort a request
+// that must name a tenant but does not.
+type TenantResolver func(ctx *gin.Context) string
+
+// TenantFromHeader resolves the tenant from the value of the header. Any
+// client can set the header, so it does not keep tenants apart from each
+// other, only TenantFromClaim does.
+func TenantFromHeader(name string) TenantResolver {
+	return func(ctx *gin.Context) string {
+		return strings.ToLower(strings.TrimSpace(ctx.GetHeader(name)))
+	}
+}
+
+// TenantFromSubdomain resolves the tenant from the label of the host directly
+// below the domain, such that acme.example.com is the tenant acme of the
+// domain example.com. Requests to any other host do not name a tenant. As
+// with the header, clients choose the host they send.
+func TenantFromSubdomain(domain string) TenantResolver {
+	suffix := "." + strings.ToLower(strings.Trim(domain, "."))
+
+	return func(ctx *gin.Context) string {
+		host := ctx.Request.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		host = strings.ToLower(host)
+		if !strings.HasSuffix(host, suffix) {
+			return ""
+		}
+
+		label := strings.TrimSuffix(host, suffix)
+		if strings.Contains(label, ".") {
+			return ""
+		}
+
+		return label
+	}
+}
+
+// TenantFromClaim resolves the tenant from the claim of the verified bearer
+// token of the request, so requires WithTokenVerifier. Requests whose token
+// has no such claim are forbidden rather than given the default tenant, as
+// the token may have been issued for another purpose.
+func TenantFromClaim(name string) TenantResolver {
+	return func(ctx *gin.Context) string {
+		tenant := strings.ToLower(strings.TrimSpace(requestClaims(ctx).String(name)))
+		if tenant == "" {
+			ctx.AbortWithStatusJSON(403, gin.H{"error": entity.ErrTokenTenant.Error()})
+		}
+
+		return tenant
+	}
+}
+
+// WithTenantResolver sets how the tenant of each request is determined, by
+// default the tenant is taken from the DefaultTenantHeader.
+func WithTenantResolver(resolver TenantResolver) Option {
+	return func(uc *UserController) {
+		uc.resolveTenant = resolver
+	}
+}
+
+// WithDefaultTenant sets the tenant of requests that do not name one, by
+// default entity.DefaultTenant. An empty tenant requires every request to
+// name one.
+func WithDefaultTenant(tenant string) Option {
+	return func(uc *UserController) {
+		uc.defaultTenant = tenant
+	}
+}
+
+// tenant authenticates the request and resolves its tenant, aborting it if
+// its token is rejected, the resolver aborts it, no tenant is given and
+// there is no default, or the tenant is not well formed.
+func (uc *UserController) tenant(ctx *gin.Context) (string, bool) {
+	if !uc.authenticate(ctx) {
+		return "", false
+	}
+
+	tenant := uc.resolveTenant(ctx)
+	if ctx.IsAborted() {
+		return "", false
+	}
+
+	if tenant == "" {
+		tenant = uc.defaultTenant
+	}
+
+	if !entity.ValidTenant(tenant) {
+		ctx.AbortWithStatusJSON(400, gin.H{"error": entity.ErrTenantInvalid.Error()})
+
+		return "", false
+	}
+
+	return tenant, true
+}
@@ -0,0 +1,145 @@
+package controller
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+
+	"github.com/electrofelix/gin-demo/entity"
+)
+
+// claimsKey is where the claims of the verified token of a request are kept
+// in the gin context.
+const claimsKey = "controller.claims"
+
+// tokenLeeway allows for the clocks of the issuer and this service to differ
+// when checking the times of a token.
+const tokenLeeway = time.Minute
+
+// TokenClaims are the claims of a verified bearer token.
+type TokenClaims map[string]interface{}
+
+// String returns the claim if it is a string, or an empty string.
+func (c TokenClaims) String(name string) string {
+	value, _ := c[name].(string)
+
+	return value
+}
+
+// TokenVerifier checks the bearer tokens of requests, which must be JWTs
+// signed with HMAC-SHA256 by an issuer sharing the secret.
+type TokenVerifier struct {
+	secret   []byte
+	issuer   string
+	audience string
+	parser   *jwt.Parser
+	now      func() time.Time
+}
+
+// TokenOption configures a TokenVerifier.
+type TokenOption func(*TokenVerifier)
+
+func NewTokenVerifier(secret []byte, options ...TokenOption) *TokenVerifier {
+	tv := &TokenVerifier{
+		secret: secret,
+		// the time claims are checked by Verify, which allows for leeway
+		parser: jwt.NewParser(jwt.WithValidMethods([]string{"HS256"}), jwt.WithoutClaimsValidation()),
+		now:    time.Now,
+	}
+
+	for _, opt := range options {
+		opt(tv)
+	}
+
+	return tv
+}
+
+// WithTokenIssuer requires the iss claim of tokens to be the issuer.
+func WithTokenIssuer(issuer string) TokenOption {
+	return func(tv *TokenVerifier) {
+		tv.issuer = issuer
+	}
+}
+
+// WithTokenAudience requires the aud claim of tokens to include the audience,
+// so that tokens issued with the same secret for other services are refused.
+func WithTokenAudience(audience string) TokenOption {
+	return func(tv *TokenVerifier) {
+		tv.audience = audience
+	}
+}
+
+// Verify returns the claims of the token once its signature is checked, and
+// that it has an exp claim that has not passed and any nbf or iat claim is
+// not in the future. The iss and aud claims must also match when the
+// verifier has an issuer or audience.
+func (tv *TokenVerifier) Verify(token string) (TokenClaims, error) {
+	claims := jwt.MapClaims{}
+
+	_, err := tv.parser.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+		return tv.secret, nil
+	})
+	if err != nil {
+		return nil, entity.ErrTokenInvalid
+	}
+
+	now := tv.now()
+
+	if !claims.VerifyExpiresAt(now.Add(-tokenLeeway).Unix(), true) ||
+		!claims.VerifyNotBefore(now.Add(tokenLeeway).Unix(), false) ||
+		!claims.VerifyIssuedAt(now.Add(tokenLeeway).Unix(), false) {
+		return nil, entity.ErrTokenInvalid
+	}
+
+	if tv.issuer != "" && !claims.VerifyIssuer(tv.issuer, true) {
+		return nil, entity.ErrTokenInvalid
+	}
+
+	if tv.audience != "" && !claims.VerifyAudience(tv.audience, true) {
+		return nil, entity.ErrTokenInvalid
+	}
+
+	return TokenClaims(claims), nil
+}
+
+// WithTokenVerifier requires every request to carry a bearer token accepted
+// by the verifier, the subject of the token is then recorded as the actor of
+// any changes made.
+func WithTokenVerifier(verifier *TokenVerifier) Option {
+	return func(uc *UserController) {
+		uc.verifier = verifier
+	}
+}
+
+// authenticate verifies the bearer token of the request when tokens are
+// required, aborting it if the token is missing or invalid.
+func (uc *UserController) authenticate(ctx *gin.Context) bool {
+	if uc.verifier == nil {
+		return true
+	}
+
+	token := strings.TrimPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+
+	claims, err := uc.verifier.Verify(token)
+	if err != nil {
+		ctx.Header("WWW-Authenticate", "Bearer")
+		ctx.AbortWithStatusJSON(401, gin.H{"error": err.Error()})
+
+		return false
+	}
+
+	ctx.Set(claimsKey, claims)
+
+	return true
+}
+
+// requestClaims returns the claims of the verified token of the request, or
+// nil when tokens are not required.
+func requestClaims(ctx *gin.Context) TokenClaims {
+	value, _ := ctx.Get(claimsKey)
+	claims, _ := value.(TokenClaims)
+
+	return claims
+}
@@ -0,0 +1,127 @@
+package controller_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/electrofelix/gin-demo/controller"
+	"github.com/electrofelix/gin-demo/entity"
+)
+
+var tokenSecret = []byte("0123456789abcdef0123456789abcdef")
+
+// signToken returns a JWT of the claims signed with the secret using alg, the
+// secret is ignored for the none alg.
+func signToken(t *testing.T, secret []byte, alg string, claims map[string]interface{}) string {
+	t.Helper()
+
+	var key interface{} = secret
+	if alg == "none" {
+		key = jwt.UnsafeAllowNoneSignatureType
+	}
+
+	token, err := jwt.NewWithClaims(jwt.GetSigningMethod(alg), jwt.MapClaims(claims)).SignedString(key)
+	require.NoError(t, err)
+
+	return token
+}
+
+func TestTokenVerifier_Verify(t *testing.T) {
+	now := time.Now()
+
+	t.Run("success", func(t *testing.T) {
+		verifier := controller.NewTokenVerifier(tokenSecret)
+
+		token := signToken(t, tokenSecret, "HS256", map[string]interface{}{
+			"sub": "admin@example.com", "tenant": "acme", "exp": now.Add(time.Hour).Unix(),
+		})
+
+		claims, err := verifier.Verify(token)
+		require.NoError(t, err)
+		assert.Equal(t, "admin@example.com", claims.String("sub"))
+		assert.Equal(t, "acme", claims.String("tenant"))
+	})
+
+	t.Run("leeway", func(t *testing.T) {
+		verifier := controller.NewTokenVerifier(tokenSecret)
+
+		// clocks of the issuer may be a little ahead or behind
+		token := signToken(t, tokenSecret, "HS256", map[string]interface{}{
+			"sub": "admin", "exp": now.Add(-10 * time.Second).Unix(),
+			"nbf": now.Add(10 * time.Second).Unix(), "iat": now.Add(10 * time.Second).Unix(),
+		})
+
+		_, err := verifier.Verify(token)
+		assert.NoError(t, err)
+	})
+
+	t.Run("issuer-and-audience", func(t *testing.T) {
+		verifier := controller.NewTokenVerifier(
+			tokenSecret, controller.WithTokenIssuer("https://auth.example.com"), controller.WithTokenAudience("gin-demo"),
+		)
+
+		for _, audience := range []interface{}{"gin-demo", []string{"other", "gin-demo"}} {
+			token := signToken(t, tokenSecret, "HS256", map[string]interface{}{
+				"sub": "admin", "exp": now.Add(time.Hour).Unix(), "iss": "https://auth.example.com", "aud": audience,
+			})
+
+			_, err := verifier.Verify(token)
+			assert.NoError(t, err)
+		}
+	})
+
+	for name, token := range map[string]string{
+		"other-secret": signToken(t, []byte("another-secret"), "HS256", map[string]interface{}{
+			"sub": "admin", "exp": now.Add(time.Hour).Unix(),
+		}),
+		"other-alg": signToken(t, tokenSecret, "HS384", map[string]interface{}{
+			"sub": "admin", "exp": now.Add(time.Hour).Unix(),
+		}),
+		"none-alg": signToken(t, tokenSecret, "none", map[string]interface{}{
+			"sub": "admin", "exp": now.Add(time.Hour).Unix(),
+		}),
+		"expired": signToken(t, tokenSecret, "HS256", map[string]interface{}{
+			"sub": "admin", "exp": now.Add(-2 * time.Minute).Unix(),
+		}),
+		"expiry-missing": signToken(t, tokenSecret, "HS256", map[string]interface{}{"sub": "admin"}),
+		"not-yet-valid": signToken(t, tokenSecret, "HS256", map[string]interface{}{
+			"sub": "admin", "exp": now.Add(2 * time.Hour).Unix(), "nbf": now.Add(time.Hour).Unix(),
+		}),
+		"issued-in-future": signToken(t, tokenSecret, "HS256", map[string]interface{}{
+			"sub": "admin", "exp": now.Add(2 * time.Hour).Unix(), "iat": now.Add(time.Hour).Unix(),
+		}),
+		"malformed": "not-a-token",
+		"missing":   "",
+	} {
+		token := token
+
+		t.Run(name, func(t *testing.T) {
+			_, err := controller.NewTokenVerifier(tokenSecret).Verify(token)
+			assert.ErrorIs(t, err, entity.ErrTokenInvalid)
+		})
+	}
+
+	verifier := controller.NewTokenVerifier(
+		tokenSecret, controller.WithTokenIssuer("https://auth.example.com"), controller.WithTokenAudience("gin-demo"),
+	)
+
+	for name, claims := range map[string]map[string]interface{}{
+		"other-issuer":     {"iss": "https://evil.example.com", "aud": "gin-demo"},
+		"issuer-missing":   {"aud": "gin-demo"},
+		"other-audience":   {"iss": "https://auth.example.com", "aud": []string{"other"}},
+		"audience-missing": {"iss": "https://auth.example.com"},
+	} {
+		claims["sub"] = "admin"
+		claims["exp"] = now.Add(time.Hour).Unix()
+		token := signToken(t, tokenSecret, "HS256", claims)
+
+		t.Run(name, func(t *testing.T) {
+			_, err := verifier.Verify(token)
+			assert.ErrorIs(t, err, entity.ErrTokenInvalid)
+		})
+	}
+}
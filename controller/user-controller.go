@@ -5,33 +5,57 @@ package controller
 import (
 	"context"
 	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 
 	"github.com/electrofelix/gin-demo/entity"
+	"github.com/electrofelix/gin-demo/service"
 )
 
+// retryAfter is the number of seconds clients are asked to wait before
+// retrying a request that failed because the store was unavailable.
+const retryAfter = "1"
+
+// actorHeader names who claims to be making a request for the audit trail.
+// Any client can set it, so it is always recorded with the client address.
+const actorHeader = "X-Actor"
+
 type UserService interface {
-	Create(ctx context.Context, user entity.User) (entity.User, error)
-	Delete(ctx context.Context, id string) (entity.User, error)
-	Get(ctx context.Context, id string) (entity.User, error)
-	List(ctx context.Context) ([]entity.User, error)
-	Update(ctx context.Context, id string, user entity.User) (entity.User, error)
-	ValidateCredentials(ctx context.Context, credentials entity.UserLogin) error
+	Create(ctx context.Context, tenant string, user entity.User) (entity.User, error)
+	CreateBatch(ctx context.Context, tenant string, users []entity.User) ([]entity.BatchResult, error)
+	Delete(ctx context.Context, tenant, id string) (entity.User, error)
+	Get(ctx context.Context, tenant, id string) (entity.User, error)
+	GetMany(ctx context.Context, tenant string, ids []string) (entity.UserBatch, error)
+	List(ctx context.Context, tenant string, opts entity.ListOptions) (entity.UserPage, error)
+	ListAudit(ctx context.Context, tenant, id string, opts entity.ListOptions) (entity.AuditPage, error)
+	Restore(ctx context.Context, tenant, id string) (entity.User, error)
+	Search(ctx context.Context, tenant, query string, opts entity.ListOptions) (entity.SearchPage, error)
+	Update(ctx context.Context, tenant, id string, user entity.User) (entity.User, error)
+	ValidateCredentials(ctx context.Context, tenant string, credentials entity.UserLogin) error
 }
 
 type UserController struct {
-	service UserService
-	logger  *logrus.Logger
+	service       UserService
+	resolveTenant TenantResolver
+	defaultTenant string
+	verifier      *TokenVerifier
+	logger        *logrus.Logger
 }
 
 type Option func(*UserController)
 
 func New(service UserService, router gin.IRoutes, opts ...Option) *UserController {
 	controller := &UserController{
-		service: service,
-		logger:  logrus.StandardLogger(),
+		service:       service,
+		resolveTenant: TenantFromHeader(DefaultTenantHeader),
+		defaultTenant: entity.DefaultTenant,
+		logger:        logrus.StandardLogger(),
 	}
 
 	for _, opt := range opts {
@@ -41,10 +65,14 @@ func New(service UserService, router gin.IRoutes, opts ...Option) *UserControlle
 	controller.logger.Info("UserController registering routes")
 
 	router.GET("/users", controller.list)
+	router.GET("/users/search", controller.search)
 	router.GET("/users/:id", controller.get)
+	router.GET("/users/:id/audit", controller.audit)
 	router.POST("/users", controller.create)
+	router.POST("/users:action", controller.action)
 	router.DELETE("/users/:id", controller.delete)
 	router.PATCH("/users/:id", controller.update)
+	router.POST("/users/:id/restore", controller.restore)
 	router.POST("/login", controller.login)
 
 	return controller
@@ -56,7 +84,127 @@ func WithLogger(l *logrus.Logger) Option {
 	}
 }
 
+// action dispatches the custom methods of the users collection. gin treats a
+// colon anywhere in a segment as the start of a parameter, and cannot register
+// two of them at the same place, so the methods share the /users:action route
+// and are matched here by the whole of the last segment of the path.
+func (uc *UserController) action(ctx *gin.Context) {
+	switch path.Base(ctx.Request.URL.Path) {
+	case "users:batchCreate":
+		uc.batchCreate(ctx)
+	case "users:batchGet":
+		uc.batchGet(ctx)
+	default:
+		ctx.AbortWithStatusJSON(404, gin.H{"error": "unknown action"})
+	}
+}
+
+func (uc *UserController) audit(ctx *gin.Context) {
+	tenant, ok := uc.tenant(ctx)
+	if !ok {
+		return
+	}
+
+	id := ctx.Param("id")
+
+	opts, ok := listOptions(ctx)
+	if !ok {
+		return
+	}
+
+	page, err := uc.service.ListAudit(ctx, tenant, id, opts)
+	if err != nil {
+		if errors.Is(err, entity.ErrLimitInvalid) || errors.Is(err, entity.ErrCursorInvalid) ||
+			errors.Is(err, entity.ErrIDInvalid) {
+			ctx.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+
+			return
+		}
+
+		abortInternal(ctx, err)
+
+		return
+	}
+
+	ctx.JSON(200, page)
+}
+
+// batchCreateRequest does not validate the individual users, as invalid
+// users are reported in the results rather than failing the whole batch.
+type batchCreateRequest struct {
+	Users []entity.User `json:"users" binding:"required"`
+}
+
+func (uc *UserController) batchCreate(ctx *gin.Context) {
+	tenant, ok := uc.tenant(ctx)
+	if !ok {
+		return
+	}
+
+	var request batchCreateRequest
+	err := ctx.BindJSON(&request)
+	if err != nil {
+		ctx.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+
+		return
+	}
+
+	results, err := uc.service.CreateBatch(requestContext(ctx), tenant, request.Users)
+	if err != nil {
+		if errors.Is(err, entity.ErrBatchTooLarge) {
+			ctx.AbortWithStatusJSON(413, gin.H{"error": err.Error()})
+
+			return
+		}
+
+		abortInternal(ctx, err)
+
+		return
+	}
+
+	ctx.JSON(200, gin.H{"results": results})
+}
+
+type batchGetRequest struct {
+	Ids []string `json:"ids" binding:"required"`
+}
+
+func (uc *UserController) batchGet(ctx *gin.Context) {
+	tenant, ok := uc.tenant(ctx)
+	if !ok {
+		return
+	}
+
+	var request batchGetRequest
+	err := ctx.BindJSON(&request)
+	if err != nil {
+		ctx.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+
+		return
+	}
+
+	batch, err := uc.service.GetMany(requestContext(ctx), tenant, request.Ids)
+	if err != nil {
+		if errors.Is(err, entity.ErrBatchTooLarge) {
+			ctx.AbortWithStatusJSON(413, gin.H{"error": err.Error()})
+
+			return
+		}
+
+		abortInternal(ctx, err)
+
+		return
+	}
+
+	ctx.JSON(200, batch)
+}
+
 func (uc *UserController) create(ctx *gin.Context) {
+	tenant, ok := uc.tenant(ctx)
+	if !ok {
+		return
+	}
+
 	// should consider separate objects for internal vs external representations
 	var user entity.User
 	err := ctx.BindJSON(&user)
@@ -66,7 +214,7 @@ func (uc *UserController) create(ctx *gin.Context) {
 		return
 	}
 
-	userResp, err := uc.service.Create(ctx, user)
+	userResp, err := uc.service.Create(requestContext(ctx), tenant, user)
 	if err != nil {
 		if errors.Is(err, entity.ErrEmailDuplicate) {
 			// could potentially return 201 here as well
@@ -75,18 +223,24 @@ func (uc *UserController) create(ctx *gin.Context) {
 			return
 		}
 
-		ctx.AbortWithStatusJSON(500, gin.H{"error": "Internal Error"})
+		abortInternal(ctx, err)
 
 		return
 	}
 
+	ctx.Header("ETag", etag(userResp))
 	ctx.JSON(201, userResp)
 }
 
 func (uc *UserController) delete(ctx *gin.Context) {
+	tenant, ok := uc.tenant(ctx)
+	if !ok {
+		return
+	}
+
 	id := ctx.Param("id")
 
-	userResp, err := uc.service.Delete(ctx, id)
+	userResp, err := uc.service.Delete(requestContext(ctx), tenant, id)
 	if err != nil {
 		if errors.Is(err, entity.ErrNotFound) {
 			ctx.AbortWithStatusJSON(404, err)
@@ -94,7 +248,14 @@ func (uc *UserController) delete(ctx *gin.Context) {
 			return
 		}
 
-		ctx.AbortWithStatusJSON(500, gin.H{"error": "Internal Error"})
+		// the user was changed concurrently, such as by another delete
+		if errors.Is(err, entity.ErrConflict) {
+			ctx.AbortWithStatusJSON(409, gin.H{"error": err.Error()})
+
+			return
+		}
+
+		abortInternal(ctx, err)
 
 		return
 	}
@@ -103,9 +264,14 @@ func (uc *UserController) delete(ctx *gin.Context) {
 }
 
 func (uc *UserController) get(ctx *gin.Context) {
+	tenant, ok := uc.tenant(ctx)
+	if !ok {
+		return
+	}
+
 	id := ctx.Param("id")
 
-	userResp, err := uc.service.Get(ctx, id)
+	userResp, err := uc.service.Get(ctx, tenant, id)
 	if err != nil {
 		if errors.Is(err, entity.ErrNotFound) {
 			ctx.AbortWithStatusJSON(404, err)
@@ -113,26 +279,90 @@ func (uc *UserController) get(ctx *gin.Context) {
 			return
 		}
 
-		ctx.AbortWithStatusJSON(500, gin.H{"error": "Internal Error"})
+		abortInternal(ctx, err)
 
 		return
 	}
 
+	ctx.Header("ETag", etag(userResp))
 	ctx.JSON(200, userResp)
 }
 
 func (uc *UserController) list(ctx *gin.Context) {
-	usersResp, err := uc.service.List(ctx)
+	tenant, ok := uc.tenant(ctx)
+	if !ok {
+		return
+	}
+
+	opts, ok := listOptions(ctx)
+	if !ok {
+		return
+	}
+
+	opts, ok = listFilters(ctx, opts)
+	if !ok {
+		return
+	}
+
+	page, err := uc.service.List(ctx, tenant, opts)
 	if err != nil {
-		ctx.AbortWithStatusJSON(500, gin.H{"error": "Internal Error"})
+		if errors.Is(err, entity.ErrLimitInvalid) || errors.Is(err, entity.ErrCursorInvalid) ||
+			errors.Is(err, entity.ErrFilterInvalid) || errors.Is(err, entity.ErrFilterUnsupported) {
+			ctx.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+
+			return
+		}
+
+		abortInternal(ctx, err)
 
 		return
 	}
 
-	ctx.JSON(200, usersResp)
+	ctx.JSON(200, page)
+}
+
+// search ranks the users by how closely they match the q parameter, paged
+// the same as list.
+func (uc *UserController) search(ctx *gin.Context) {
+	tenant, ok := uc.tenant(ctx)
+	if !ok {
+		return
+	}
+
+	opts, ok := listOptions(ctx)
+	if !ok {
+		return
+	}
+
+	page, err := uc.service.Search(ctx, tenant, ctx.Query("q"), opts)
+	if err != nil {
+		if errors.Is(err, entity.ErrLimitInvalid) || errors.Is(err, entity.ErrCursorInvalid) ||
+			errors.Is(err, entity.ErrQueryInvalid) {
+			ctx.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+
+			return
+		}
+
+		if errors.Is(err, entity.ErrSearchDisabled) {
+			ctx.AbortWithStatusJSON(501, gin.H{"error": err.Error()})
+
+			return
+		}
+
+		abortInternal(ctx, err)
+
+		return
+	}
+
+	ctx.JSON(200, page)
 }
 
 func (uc *UserController) login(ctx *gin.Context) {
+	tenant, ok := uc.tenant(ctx)
+	if !ok {
+		return
+	}
+
 	var credentials entity.UserLogin
 	err := ctx.BindJSON(&credentials)
 	if err != nil {
@@ -141,7 +371,10 @@ func (uc *UserController) login(ctx *gin.Context) {
 		return
 	}
 
-	err = uc.service.ValidateCredentials(ctx, credentials)
+	// only taken from X-Forwarded-For when sent by a proxy the engine trusts
+	credentials.SourceIp = ctx.ClientIP()
+
+	err = uc.service.ValidateCredentials(ctx, tenant, credentials)
 	if err != nil {
 		if errors.Is(err, entity.ErrNotFound) || errors.Is(err, entity.ErrBadCredentials) {
 			ctx.AbortWithStatusJSON(401, gin.H{"error": "Invalid Email or Password"})
@@ -149,7 +382,7 @@ func (uc *UserController) login(ctx *gin.Context) {
 			return
 		}
 
-		ctx.AbortWithStatusJSON(500, gin.H{"error": "Internal Error"})
+		abortInternal(ctx, err)
 
 		return
 	}
@@ -157,7 +390,43 @@ func (uc *UserController) login(ctx *gin.Context) {
 	ctx.JSON(200, gin.H{"status": "SUCCESS"})
 }
 
+func (uc *UserController) restore(ctx *gin.Context) {
+	tenant, ok := uc.tenant(ctx)
+	if !ok {
+		return
+	}
+
+	id := ctx.Param("id")
+
+	userResp, err := uc.service.Restore(requestContext(ctx), tenant, id)
+	if err != nil {
+		if errors.Is(err, entity.ErrNotFound) {
+			ctx.AbortWithStatusJSON(404, err)
+
+			return
+		}
+
+		if errors.Is(err, entity.ErrConflict) {
+			ctx.AbortWithStatusJSON(409, gin.H{"error": err.Error()})
+
+			return
+		}
+
+		abortInternal(ctx, err)
+
+		return
+	}
+
+	ctx.Header("ETag", etag(userResp))
+	ctx.JSON(200, userResp)
+}
+
 func (uc *UserController) update(ctx *gin.Context) {
+	tenant, ok := uc.tenant(ctx)
+	if !ok {
+		return
+	}
+
 	id := ctx.Param("id")
 
 	var userUpdate entity.User
@@ -168,8 +437,19 @@ func (uc *UserController) update(ctx *gin.Context) {
 		return
 	}
 
+	ifMatch := ctx.GetHeader("If-Match")
+	if ifMatch != "" {
+		version, ok := parseIfMatch(ifMatch)
+		if !ok {
+			ctx.AbortWithStatusJSON(412, gin.H{"error": entity.ErrConflict.Error()})
 
-	user, err := uc.service.Update(ctx, id, userUpdate)
+			return
+		}
+
+		userUpdate.Version = version
+	}
+
+	user, err := uc.service.Update(requestContext(ctx), tenant, id, userUpdate)
 	if err != nil {
 		if errors.Is(err, entity.ErrNotFound) {
 			ctx.AbortWithStatusJSON(404, err)
@@ -177,6 +457,18 @@ func (uc *UserController) update(ctx *gin.Context) {
 			return
 		}
 
+		if errors.Is(err, entity.ErrConflict) {
+			if ifMatch != "" {
+				ctx.AbortWithStatusJSON(412, gin.H{"error": err.Error()})
+
+				return
+			}
+
+			ctx.AbortWithStatusJSON(409, gin.H{"error": err.Error()})
+
+			return
+		}
+
 		if errors.Is(err, entity.ErrEmailDuplicate) {
 			// could potentially return 201 here as well
 			ctx.AbortWithStatusJSON(409, gin.H{"error": err.Error()})
@@ -184,10 +476,140 @@ func (uc *UserController) update(ctx *gin.Context) {
 			return
 		}
 
-		ctx.AbortWithStatusJSON(500, gin.H{"error": "Internal Error"})
+		abortInternal(ctx, err)
 
 		return
 	}
 
+	ctx.Header("ETag", etag(user))
 	ctx.JSON(200, user)
 }
+
+// listOptions parses the paging query parameters, aborting the request if
+// they are invalid.
+func listOptions(ctx *gin.Context) (entity.ListOptions, bool) {
+	opts := entity.ListOptions{
+		Cursor: ctx.Query("cursor"),
+	}
+
+	if limit := ctx.Query("limit"); limit != "" {
+		value, err := strconv.ParseInt(limit, 10, 32)
+		if err != nil {
+			ctx.AbortWithStatusJSON(400, gin.H{"error": entity.ErrLimitInvalid.Error()})
+
+			return entity.ListOptions{}, false
+		}
+
+		opts.Limit = int32(value)
+	}
+
+	return opts, true
+}
+
+// listFilters adds the filters of users given as query parameters, where
+// last login times are RFC 3339.
+func listFilters(ctx *gin.Context, opts entity.ListOptions) (entity.ListOptions, bool) {
+	opts.EmailPrefix = ctx.Query("email_prefix")
+	opts.NamePrefix = ctx.Query("name_prefix")
+
+	var ok bool
+
+	if opts.LastLoginAfter, ok = queryTime(ctx, "last_login_after"); !ok {
+		return entity.ListOptions{}, false
+	}
+
+	if opts.LastLoginBefore, ok = queryTime(ctx, "last_login_before"); !ok {
+		return entity.ListOptions{}, false
+	}
+
+	return opts, true
+}
+
+// queryTime returns the zero time when the parameter is not given.
+func queryTime(ctx *gin.Context, param string) (time.Time, bool) {
+	value := ctx.Query(param)
+	if value == "" {
+		return time.Time{}, true
+	}
+
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		ctx.AbortWithStatusJSON(400, gin.H{"error": fmt.Sprintf("%s: %s must be RFC 3339", entity.ErrFilterInvalid, param)})
+
+		return time.Time{}, false
+	}
+
+	return parsed, true
+}
+
+// abortInternal aborts a request that failed unexpectedly, telling the client
+// to retry later when the failure is only temporary. Requests for a tenant
+// that does not exist are reported as not found, as the service only checks
+// the tenant once it is needed.
+func abortInternal(ctx *gin.Context, err error) {
+	if errors.Is(err, entity.ErrTenantUnknown) {
+		ctx.AbortWithStatusJSON(404, gin.H{"error": err.Error()})
+
+		return
+	}
+
+	if errors.Is(err, entity.ErrTenantInvalid) {
+		ctx.AbortWithStatusJSON(400, gin.H{"error": err.Error()})
+
+		return
+	}
+
+	if errors.Is(err, entity.ErrUnavailable) {
+		ctx.Header("Retry-After", retryAfter)
+		ctx.AbortWithStatusJSON(503, gin.H{"error": entity.ErrUnavailable.Error()})
+
+		return
+	}
+
+	ctx.AbortWithStatusJSON(500, gin.H{"error": "Internal Error"})
+}
+
+// requestContext identifies the actor making the request for any changes
+// recorded in the audit trail, the subject of its token when tokens are
+// required. Otherwise the actor named by the header is unverified, so the
+// client address is recorded with it, as in "admin via 192.0.2.1", which is
+// only taken from X-Forwarded-For when sent by a proxy the engine trusts.
+func requestContext(ctx *gin.Context) context.Context {
+	if subject := requestClaims(ctx).String("sub"); subject != "" {
+		return service.WithActor(ctx, subject)
+	}
+
+	actor := ctx.ClientIP()
+	if claimed := strings.TrimSpace(ctx.GetHeader(actorHeader)); claimed != "" {
+		actor = fmt.Sprintf("%s via %s", claimed, actor)
+	}
+
+	return service.WithActor(ctx, actor)
+}
+
+// etag returns a strong entity tag for the user, derived from the version as
+// it changes on every write.
+func etag(user entity.User) string {
+	return fmt.Sprintf(`"%d"`, user.Version)
+}
+
+// parseIfMatch returns the version required by an If-Match header, where a
+// version of 0 means any current version is acceptable. Weak tags and lists
+// of tags are not supported and will never match.
+func parseIfMatch(header string) (int64, bool) {
+	header = strings.TrimSpace(header)
+	if header == "*" {
+		return 0, true
+	}
+
+	if len(header) < 2 || !strings.HasPrefix(header, `"`) || !strings.HasSuffix(header, `"`) {
+		return 0, false
+	}
+
+	version, err := strconv.ParseInt(header[1:len(header)-1], 10, 64)
+	if err != nil || version <= 0 {
+		return 0, false
+	}
+
+	return version, true
+}
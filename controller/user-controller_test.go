@@ -21,9 +21,14 @@ import (
 	"github.com/electrofelix/gin-demo/controller"
 	"github.com/electrofelix/gin-demo/entity"
 	"github.com/electrofelix/gin-demo/mocks"
+	"github.com/electrofelix/gin-demo/server"
+	"github.com/electrofelix/gin-demo/service"
+	"github.com/electrofelix/gin-demo/store"
 )
 
-func setupMocks(t *testing.T) (*controller.UserController, *gin.Engine, *mocks.MockUserService, *test.Hook) {
+func setupMocks(
+	t *testing.T, opts ...controller.Option,
+) (*controller.UserController, *gin.Engine, *mocks.MockUserService, *test.Hook) {
 	t.Helper()
 	ctrl := gomock.NewController(t)
 
@@ -31,7 +36,7 @@ func setupMocks(t *testing.T) (*controller.UserController, *gin.Engine, *mocks.M
 	logHook := test.NewLocal(testLogger)
 	mockService := mocks.NewMockUserService(ctrl)
 	engine := gin.Default()
-	c := controller.New(mockService, engine, controller.WithLogger(testLogger))
+	c := controller.New(mockService, engine, append([]controller.Option{controller.WithLogger(testLogger)}, opts...)...)
 
 	return c, engine, mockService, logHook
 }
@@ -58,7 +63,7 @@ func TestUserController_list(t *testing.T) {
 		_, engine, mockService, _ := setupMocks(t)
 		recorder := httptest.NewRecorder()
 
-		mockService.EXPECT().List(gomock.Any()).Return([]entity.User{}, nil)
+		mockService.EXPECT().List(gomock.Any(), entity.DefaultTenant, gomock.Any()).Return(entity.UserPage{Users: []entity.User{}}, nil)
 
 		req, err := http.NewRequest("GET", "/users", nil)
 		require.NoError(t, err)
@@ -66,7 +71,7 @@ func TestUserController_list(t *testing.T) {
 		engine.ServeHTTP(recorder, req)
 
 		assert.Equal(t, 200, recorder.Code)
-		assert.Equal(t, "[]", recorder.Body.String())
+		assert.Equal(t, "{\"users\":[]}", recorder.Body.String())
 	})
 
 	t.Run("multiple-users", func(t *testing.T) {
@@ -86,10 +91,12 @@ func TestUserController_list(t *testing.T) {
 			},
 		}
 
-		jsonBody, err := json.Marshal(users)
+		page := entity.UserPage{Users: users, NextCursor: "next-page"}
+
+		jsonBody, err := json.Marshal(page)
 		require.NoError(t, err)
 
-		mockService.EXPECT().List(gomock.Any()).Return(users, nil)
+		mockService.EXPECT().List(gomock.Any(), entity.DefaultTenant, gomock.Any()).Return(page, nil)
 
 		req, err := http.NewRequest("GET", "/users", nil)
 		require.NoError(t, err)
@@ -105,7 +112,7 @@ func TestUserController_list(t *testing.T) {
 		_, engine, mockService, _ := setupMocks(t)
 		recorder := httptest.NewRecorder()
 
-		mockService.EXPECT().List(gomock.Any()).Return([]entity.User{}, errors.New("failed lookup"))
+		mockService.EXPECT().List(gomock.Any(), entity.DefaultTenant, gomock.Any()).Return(entity.UserPage{}, errors.New("failed lookup"))
 
 		req, err := http.NewRequest("GET", "/users", nil)
 		require.NoError(t, err)
@@ -115,6 +122,122 @@ func TestUserController_list(t *testing.T) {
 		assert.Equal(t, 500, recorder.Code)
 		assert.Equal(t, "{\"error\":\"Internal Error\"}", recorder.Body.String())
 	})
+
+	t.Run("unavailable", func(t *testing.T) {
+		_, engine, mockService, _ := setupMocks(t)
+		recorder := httptest.NewRecorder()
+
+		mockService.EXPECT().List(gomock.Any(), entity.DefaultTenant, gomock.Any()).Return(
+			entity.UserPage{}, fmt.Errorf("scan users: %w", entity.ErrUnavailable),
+		)
+
+		req, err := http.NewRequest("GET", "/users", nil)
+		require.NoError(t, err)
+
+		engine.ServeHTTP(recorder, req)
+
+		assert.Equal(t, 503, recorder.Code)
+		assert.Equal(t, "1", recorder.Header().Get("Retry-After"))
+		assert.Equal(t, "{\"error\":\"service temporarily unavailable, retry later\"}", recorder.Body.String())
+	})
+
+	t.Run("pagination", func(t *testing.T) {
+		_, engine, mockService, _ := setupMocks(t)
+		recorder := httptest.NewRecorder()
+
+		mockService.EXPECT().List(gomock.Any(), entity.DefaultTenant, entity.ListOptions{Limit: 10, Cursor: "some-cursor"}).Return(
+			entity.UserPage{Users: []entity.User{}}, nil,
+		)
+
+		req, err := http.NewRequest("GET", "/users?limit=10&cursor=some-cursor", nil)
+		require.NoError(t, err)
+
+		engine.ServeHTTP(recorder, req)
+
+		assert.Equal(t, 200, recorder.Code)
+	})
+
+	t.Run("bad-limit", func(t *testing.T) {
+		_, engine, _, _ := setupMocks(t)
+		recorder := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "/users?limit=lots", nil)
+		require.NoError(t, err)
+
+		engine.ServeHTTP(recorder, req)
+
+		assert.Equal(t, 400, recorder.Code)
+		assert.Equal(t, fmt.Sprintf("{\"error\":\"%s\"}", entity.ErrLimitInvalid.Error()), recorder.Body.String())
+	})
+
+	t.Run("bad-cursor", func(t *testing.T) {
+		_, engine, mockService, _ := setupMocks(t)
+		recorder := httptest.NewRecorder()
+
+		mockService.EXPECT().List(gomock.Any(), entity.DefaultTenant, gomock.Any()).Return(entity.UserPage{}, entity.ErrCursorInvalid)
+
+		req, err := http.NewRequest("GET", "/users?cursor=garbage", nil)
+		require.NoError(t, err)
+
+		engine.ServeHTTP(recorder, req)
+
+		assert.Equal(t, 400, recorder.Code)
+	})
+
+	t.Run("filters", func(t *testing.T) {
+		_, engine, mockService, _ := setupMocks(t)
+		recorder := httptest.NewRecorder()
+
+		mockService.EXPECT().List(gomock.Any(), entity.DefaultTenant, entity.ListOptions{
+			EmailPrefix:     "user",
+			NamePrefix:      "Test",
+			LastLoginAfter:  time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC),
+			LastLoginBefore: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC),
+		}).Return(entity.UserPage{Users: []entity.User{}}, nil)
+
+		req, err := http.NewRequest(
+			"GET",
+			"/users?email_prefix=user&name_prefix=Test&last_login_after=2024-05-01T00:00:00Z&last_login_before=2024-06-01T00:00:00Z",
+			nil,
+		)
+		require.NoError(t, err)
+
+		engine.ServeHTTP(recorder, req)
+
+		assert.Equal(t, 200, recorder.Code)
+	})
+
+	t.Run("bad-last-login", func(t *testing.T) {
+		_, engine, _, _ := setupMocks(t)
+		recorder := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "/users?last_login_after=yesterday", nil)
+		require.NoError(t, err)
+
+		engine.ServeHTTP(recorder, req)
+
+		assert.Equal(t, 400, recorder.Code)
+		assert.Equal(
+			t, "{\"error\":\"list filter is invalid: last_login_after must be RFC 3339\"}", recorder.Body.String(),
+		)
+	})
+
+	t.Run("filter-unsupported", func(t *testing.T) {
+		_, engine, mockService, _ := setupMocks(t)
+		recorder := httptest.NewRecorder()
+
+		mockService.EXPECT().List(gomock.Any(), entity.DefaultTenant, gomock.Any()).Return(
+			entity.UserPage{}, entity.ErrFilterUnsupported,
+		)
+
+		req, err := http.NewRequest("GET", "/users?name_prefix=test", nil)
+		require.NoError(t, err)
+
+		engine.ServeHTTP(recorder, req)
+
+		assert.Equal(t, 400, recorder.Code)
+		assert.Equal(t, fmt.Sprintf("{\"error\":\"%s\"}", entity.ErrFilterUnsupported.Error()), recorder.Body.String())
+	})
 }
 
 // setup a user entity and equvalent json for the request
@@ -140,8 +263,8 @@ func TestUserController_create(t *testing.T) {
 
 		var returnedUser entity.User
 
-		mockService.EXPECT().Create(gomock.Any(), gomock.Any()).DoAndReturn(
-			func(ctx context.Context, user entity.User) (entity.User, error) {
+		mockService.EXPECT().Create(gomock.Any(), entity.DefaultTenant, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, tenant string, user entity.User) (entity.User, error) {
 				returnedUser = newUser
 
 				returnedUser.Password = ""
@@ -166,7 +289,7 @@ func TestUserController_create(t *testing.T) {
 		_, engine, mockService, _ := setupMocks(t)
 		recorder := httptest.NewRecorder()
 
-		mockService.EXPECT().Create(gomock.Any(), gomock.Any()).Return(
+		mockService.EXPECT().Create(gomock.Any(), entity.DefaultTenant, gomock.Any()).Return(
 			entity.User{}, entity.ErrEmailDuplicate,
 		)
 
@@ -180,3 +303,669 @@ func TestUserController_create(t *testing.T) {
 		assert.Equal(t, fmt.Sprintf("{\"error\":\"%s\"}", entity.ErrEmailDuplicate.Error()), recorder.Body.String())
 	})
 }
+
+func TestUserController_batchCreate(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		_, engine, mockService, _ := setupMocks(t)
+		recorder := httptest.NewRecorder()
+
+		results := []entity.BatchResult{
+			{Row: 1, Status: entity.BatchStatusCreated, Id: "c0000000000000000000", Email: "user1@test.com"},
+			{Row: 2, Status: entity.BatchStatusInvalid, Error: entity.ErrUserInvalid.Error()},
+		}
+
+		mockService.EXPECT().CreateBatch(gomock.Any(), entity.DefaultTenant, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, tenant string, users []entity.User) ([]entity.BatchResult, error) {
+				// individual users are validated by the service
+				assert.Len(t, users, 2)
+
+				return results, nil
+			},
+		)
+
+		body := `{"users":[{"email":"user1@test.com","name":"user 1","password":"secret"},{"name":"user 2"}]}`
+		req, err := http.NewRequest("POST", "/users:batchCreate", bytes.NewBufferString(body))
+		require.NoError(t, err)
+
+		engine.ServeHTTP(recorder, req)
+
+		jsonBody, err := json.Marshal(gin.H{"results": results})
+		require.NoError(t, err)
+
+		assert.Equal(t, 200, recorder.Code)
+		assert.Equal(t, string(jsonBody), recorder.Body.String())
+	})
+
+	t.Run("too-large", func(t *testing.T) {
+		_, engine, mockService, _ := setupMocks(t)
+		recorder := httptest.NewRecorder()
+
+		mockService.EXPECT().CreateBatch(gomock.Any(), entity.DefaultTenant, gomock.Any()).Return(nil, entity.ErrBatchTooLarge)
+
+		req, err := http.NewRequest("POST", "/users:batchCreate", bytes.NewBufferString(`{"users":[]}`))
+		require.NoError(t, err)
+
+		engine.ServeHTTP(recorder, req)
+
+		assert.Equal(t, 413, recorder.Code)
+	})
+
+	t.Run("missing-users", func(t *testing.T) {
+		_, engine, _, _ := setupMocks(t)
+		recorder := httptest.NewRecorder()
+
+		req, err := http.NewRequest("POST", "/users:batchCreate", bytes.NewBufferString(`{}`))
+		require.NoError(t, err)
+
+		engine.ServeHTTP(recorder, req)
+
+		assert.Equal(t, 400, recorder.Code)
+	})
+
+	t.Run("unknown-action", func(t *testing.T) {
+		_, engine, _, _ := setupMocks(t)
+		recorder := httptest.NewRecorder()
+
+		req, err := http.NewRequest("POST", "/users:batchDelete", bytes.NewBufferString(`{}`))
+		require.NoError(t, err)
+
+		engine.ServeHTTP(recorder, req)
+
+		assert.Equal(t, 404, recorder.Code)
+	})
+
+	t.Run("missing-colon", func(t *testing.T) {
+		_, engine, _, _ := setupMocks(t)
+		recorder := httptest.NewRecorder()
+
+		req, err := http.NewRequest("POST", "/usersbatchCreate", bytes.NewBufferString(`{"users":[]}`))
+		require.NoError(t, err)
+
+		engine.ServeHTTP(recorder, req)
+
+		assert.Equal(t, 404, recorder.Code)
+	})
+}
+
+func TestUserController_batchGet(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		_, engine, mockService, _ := setupMocks(t)
+		recorder := httptest.NewRecorder()
+
+		batch := entity.UserBatch{
+			Users:   []entity.User{{Id: "c0000000000000000000", Email: "user1@test.com", Name: "user 1"}},
+			Missing: []string{"c0000000000000000001"},
+		}
+
+		mockService.EXPECT().GetMany(
+			gomock.Any(), entity.DefaultTenant, []string{"c0000000000000000000", "c0000000000000000001"},
+		).Return(batch, nil)
+
+		body := `{"ids":["c0000000000000000000","c0000000000000000001"]}`
+		req, err := http.NewRequest("POST", "/users:batchGet", bytes.NewBufferString(body))
+		require.NoError(t, err)
+
+		engine.ServeHTTP(recorder, req)
+
+		jsonBody, err := json.Marshal(batch)
+		require.NoError(t, err)
+
+		assert.Equal(t, 200, recorder.Code)
+		assert.Equal(t, string(jsonBody), recorder.Body.String())
+	})
+
+	t.Run("too-large", func(t *testing.T) {
+		_, engine, mockService, _ := setupMocks(t)
+		recorder := httptest.NewRecorder()
+
+		mockService.EXPECT().GetMany(gomock.Any(), entity.DefaultTenant, gomock.Any()).Return(
+			entity.UserBatch{}, entity.ErrBatchTooLarge,
+		)
+
+		req, err := http.NewRequest("POST", "/users:batchGet", bytes.NewBufferString(`{"ids":[]}`))
+		require.NoError(t, err)
+
+		engine.ServeHTTP(recorder, req)
+
+		assert.Equal(t, 413, recorder.Code)
+	})
+
+	t.Run("missing-ids", func(t *testing.T) {
+		_, engine, _, _ := setupMocks(t)
+		recorder := httptest.NewRecorder()
+
+		req, err := http.NewRequest("POST", "/users:batchGet", bytes.NewBufferString(`{}`))
+		require.NoError(t, err)
+
+		engine.ServeHTTP(recorder, req)
+
+		assert.Equal(t, 400, recorder.Code)
+	})
+}
+
+func TestUserController_get(t *testing.T) {
+	t.Run("etag", func(t *testing.T) {
+		_, engine, mockService, _ := setupMocks(t)
+		recorder := httptest.NewRecorder()
+
+		user, _ := setupTestUser(t)
+		user.Id = "c0ffee"
+		user.Version = 3
+
+		mockService.EXPECT().Get(gomock.Any(), entity.DefaultTenant, user.Id).Return(user, nil)
+
+		req, err := http.NewRequest("GET", "/users/c0ffee", nil)
+		require.NoError(t, err)
+
+		engine.ServeHTTP(recorder, req)
+
+		assert.Equal(t, 200, recorder.Code)
+		assert.Equal(t, `"3"`, recorder.Header().Get("ETag"))
+	})
+}
+
+func TestUserController_search(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		_, engine, mockService, _ := setupMocks(t)
+		recorder := httptest.NewRecorder()
+
+		user, _ := setupTestUser(t)
+		user.Password = ""
+		page := entity.SearchPage{
+			Results:    []entity.SearchResult{{User: user, Score: 1.5}},
+			NextCursor: "next-page",
+		}
+
+		jsonBody, err := json.Marshal(page)
+		require.NoError(t, err)
+
+		mockService.EXPECT().Search(
+			gomock.Any(), entity.DefaultTenant, "jon smth", entity.ListOptions{Limit: 10, Cursor: "some-cursor"},
+		).Return(page, nil)
+
+		req, err := http.NewRequest("GET", "/users/search?q=jon+smth&limit=10&cursor=some-cursor", nil)
+		require.NoError(t, err)
+
+		engine.ServeHTTP(recorder, req)
+
+		assert.Equal(t, 200, recorder.Code)
+		assert.Equal(t, jsonBody, recorder.Body.Bytes())
+	})
+
+	t.Run("bad-query", func(t *testing.T) {
+		_, engine, mockService, _ := setupMocks(t)
+		recorder := httptest.NewRecorder()
+
+		mockService.EXPECT().Search(gomock.Any(), entity.DefaultTenant, "", gomock.Any()).Return(
+			entity.SearchPage{}, entity.ErrQueryInvalid,
+		)
+
+		req, err := http.NewRequest("GET", "/users/search", nil)
+		require.NoError(t, err)
+
+		engine.ServeHTTP(recorder, req)
+
+		assert.Equal(t, 400, recorder.Code)
+		assert.Equal(t, fmt.Sprintf("{\"error\":\"%s\"}", entity.ErrQueryInvalid.Error()), recorder.Body.String())
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		_, engine, mockService, _ := setupMocks(t)
+		recorder := httptest.NewRecorder()
+
+		mockService.EXPECT().Search(gomock.Any(), entity.DefaultTenant, "john", gomock.Any()).Return(
+			entity.SearchPage{}, entity.ErrSearchDisabled,
+		)
+
+		req, err := http.NewRequest("GET", "/users/search?q=john", nil)
+		require.NoError(t, err)
+
+		engine.ServeHTTP(recorder, req)
+
+		assert.Equal(t, 501, recorder.Code)
+	})
+}
+
+func TestUserController_tenant(t *testing.T) {
+	t.Run("header", func(t *testing.T) {
+		_, engine, mockService, _ := setupMocks(t)
+		recorder := httptest.NewRecorder()
+
+		mockService.EXPECT().Get(gomock.Any(), "acme", "c0ffee").Return(entity.User{Id: "c0ffee"}, nil)
+
+		req, err := http.NewRequest("GET", "/users/c0ffee", nil)
+		require.NoError(t, err)
+		req.Header.Set(controller.DefaultTenantHeader, "acme")
+
+		engine.ServeHTTP(recorder, req)
+
+		assert.Equal(t, 200, recorder.Code)
+	})
+
+	t.Run("subdomain", func(t *testing.T) {
+		_, engine, mockService, _ := setupMocks(
+			t, controller.WithTenantResolver(controller.TenantFromSubdomain("example.com")),
+		)
+
+		mockService.EXPECT().List(gomock.Any(), "acme", gomock.Any()).Return(entity.UserPage{}, nil)
+		mockService.EXPECT().List(gomock.Any(), entity.DefaultTenant, gomock.Any()).Return(entity.UserPage{}, nil)
+
+		for _, host := range []string{"acme.example.com:8080", "example.com"} {
+			recorder := httptest.NewRecorder()
+
+			req, err := http.NewRequest("GET", "/users", nil)
+			require.NoError(t, err)
+			req.Host = host
+
+			engine.ServeHTTP(recorder, req)
+
+			assert.Equal(t, 200, recorder.Code, host)
+		}
+	})
+
+	t.Run("claim", func(t *testing.T) {
+		_, engine, mockService, _ := setupMocks(
+			t,
+			controller.WithTokenVerifier(controller.NewTokenVerifier(tokenSecret)),
+			controller.WithTenantResolver(controller.TenantFromClaim("tenant")),
+		)
+		recorder := httptest.NewRecorder()
+
+		// the header cannot select another tenant than that of the token
+		mockService.EXPECT().Get(gomock.Any(), "acme", "c0ffee").Return(entity.User{Id: "c0ffee"}, nil)
+
+		req, err := http.NewRequest("GET", "/users/c0ffee", nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+signToken(t, tokenSecret, "HS256", map[string]interface{}{
+			"sub": "admin@example.com", "tenant": "acme", "exp": time.Now().Add(time.Hour).Unix(),
+		}))
+		req.Header.Set(controller.DefaultTenantHeader, "globex")
+
+		engine.ServeHTTP(recorder, req)
+
+		assert.Equal(t, 200, recorder.Code)
+	})
+
+	t.Run("claim-missing", func(t *testing.T) {
+		_, engine, _, _ := setupMocks(
+			t,
+			controller.WithTokenVerifier(controller.NewTokenVerifier(tokenSecret)),
+			controller.WithTenantResolver(controller.TenantFromClaim("tenant")),
+		)
+		recorder := httptest.NewRecorder()
+
+		// a valid token without the claim is not given the default tenant
+		req, err := http.NewRequest("GET", "/users/c0ffee", nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+signToken(t, tokenSecret, "HS256", map[string]interface{}{
+			"sub": "admin@example.com", "exp": time.Now().Add(time.Hour).Unix(),
+		}))
+
+		engine.ServeHTTP(recorder, req)
+
+		assert.Equal(t, 403, recorder.Code)
+		assert.Equal(t, "{\"error\":\"bearer token does not name a tenant\"}", recorder.Body.String())
+	})
+
+	t.Run("token-invalid", func(t *testing.T) {
+		_, engine, _, _ := setupMocks(
+			t,
+			controller.WithTokenVerifier(controller.NewTokenVerifier(tokenSecret)),
+			controller.WithTenantResolver(controller.TenantFromClaim("tenant")),
+		)
+
+		for _, authorization := range []string{
+			"",
+			"Bearer " + signToken(t, []byte("another-secret"), "HS256", map[string]interface{}{
+				"tenant": "acme", "exp": time.Now().Add(time.Hour).Unix(),
+			}),
+		} {
+			recorder := httptest.NewRecorder()
+
+			req, err := http.NewRequest("GET", "/users", nil)
+			require.NoError(t, err)
+			req.Header.Set("Authorization", authorization)
+
+			engine.ServeHTTP(recorder, req)
+
+			assert.Equal(t, 401, recorder.Code)
+			assert.Equal(t, "Bearer", recorder.Header().Get("WWW-Authenticate"))
+		}
+	})
+
+	t.Run("required", func(t *testing.T) {
+		_, engine, _, _ := setupMocks(t, controller.WithDefaultTenant(""))
+		recorder := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "/users", nil)
+		require.NoError(t, err)
+
+		engine.ServeHTTP(recorder, req)
+
+		assert.Equal(t, 400, recorder.Code)
+		assert.JSONEq(t, fmt.Sprintf(`{"error": %q}`, entity.ErrTenantInvalid), recorder.Body.String())
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, engine, _, _ := setupMocks(t)
+		recorder := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "/users", nil)
+		require.NoError(t, err)
+		req.Header.Set(controller.DefaultTenantHeader, "acme#users")
+
+		engine.ServeHTTP(recorder, req)
+
+		assert.Equal(t, 400, recorder.Code)
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		_, engine, mockService, _ := setupMocks(t)
+		recorder := httptest.NewRecorder()
+
+		mockService.EXPECT().Get(gomock.Any(), "globex", "c0ffee").Return(entity.User{}, entity.ErrTenantUnknown)
+
+		req, err := http.NewRequest("GET", "/users/c0ffee", nil)
+		require.NoError(t, err)
+		req.Header.Set(controller.DefaultTenantHeader, "globex")
+
+		engine.ServeHTTP(recorder, req)
+
+		assert.Equal(t, 404, recorder.Code)
+	})
+}
+
+func TestUserController_update(t *testing.T) {
+	t.Run("if-match", func(t *testing.T) {
+		_, engine, mockService, _ := setupMocks(t)
+		recorder := httptest.NewRecorder()
+
+		user, jsonBody := setupTestUser(t)
+
+		mockService.EXPECT().Update(gomock.Any(), entity.DefaultTenant, "c0ffee", gomock.Any()).DoAndReturn(
+			func(ctx context.Context, tenant, id string, userUpdate entity.User) (entity.User, error) {
+				assert.Equal(t, int64(3), userUpdate.Version)
+
+				user.Version = 4
+
+				return user, nil
+			},
+		)
+
+		req, err := http.NewRequest("PATCH", "/users/c0ffee", jsonBody)
+		require.NoError(t, err)
+		req.Header.Set("If-Match", `"3"`)
+
+		engine.ServeHTTP(recorder, req)
+
+		assert.Equal(t, 200, recorder.Code)
+		assert.Equal(t, `"4"`, recorder.Header().Get("ETag"))
+	})
+
+	t.Run("if-match-any", func(t *testing.T) {
+		_, engine, mockService, _ := setupMocks(t)
+		recorder := httptest.NewRecorder()
+
+		user, jsonBody := setupTestUser(t)
+
+		mockService.EXPECT().Update(gomock.Any(), entity.DefaultTenant, "c0ffee", gomock.Any()).DoAndReturn(
+			func(ctx context.Context, tenant, id string, userUpdate entity.User) (entity.User, error) {
+				assert.Equal(t, int64(0), userUpdate.Version)
+
+				return user, nil
+			},
+		)
+
+		req, err := http.NewRequest("PATCH", "/users/c0ffee", jsonBody)
+		require.NoError(t, err)
+		req.Header.Set("If-Match", "*")
+
+		engine.ServeHTTP(recorder, req)
+
+		assert.Equal(t, 200, recorder.Code)
+	})
+
+	t.Run("if-match-mismatch", func(t *testing.T) {
+		_, engine, mockService, _ := setupMocks(t)
+		recorder := httptest.NewRecorder()
+
+		_, jsonBody := setupTestUser(t)
+
+		mockService.EXPECT().Update(gomock.Any(), entity.DefaultTenant, "c0ffee", gomock.Any()).Return(entity.User{}, entity.ErrConflict)
+
+		req, err := http.NewRequest("PATCH", "/users/c0ffee", jsonBody)
+		require.NoError(t, err)
+		req.Header.Set("If-Match", `"2"`)
+
+		engine.ServeHTTP(recorder, req)
+
+		assert.Equal(t, 412, recorder.Code)
+	})
+
+	t.Run("if-match-weak", func(t *testing.T) {
+		_, engine, _, _ := setupMocks(t)
+		recorder := httptest.NewRecorder()
+
+		_, jsonBody := setupTestUser(t)
+
+		req, err := http.NewRequest("PATCH", "/users/c0ffee", jsonBody)
+		require.NoError(t, err)
+		req.Header.Set("If-Match", `W/"2"`)
+
+		engine.ServeHTTP(recorder, req)
+
+		assert.Equal(t, 412, recorder.Code)
+	})
+
+	t.Run("conflict", func(t *testing.T) {
+		_, engine, mockService, _ := setupMocks(t)
+		recorder := httptest.NewRecorder()
+
+		_, jsonBody := setupTestUser(t)
+
+		mockService.EXPECT().Update(gomock.Any(), entity.DefaultTenant, "c0ffee", gomock.Any()).Return(entity.User{}, entity.ErrConflict)
+
+		req, err := http.NewRequest("PATCH", "/users/c0ffee", jsonBody)
+		require.NoError(t, err)
+
+		engine.ServeHTTP(recorder, req)
+
+		assert.Equal(t, 409, recorder.Code)
+	})
+}
+
+func TestUserController_delete(t *testing.T) {
+	t.Run("not-found", func(t *testing.T) {
+		_, engine, mockService, _ := setupMocks(t)
+		recorder := httptest.NewRecorder()
+
+		mockService.EXPECT().Delete(gomock.Any(), entity.DefaultTenant, "c0ffee").Return(entity.User{}, entity.ErrNotFound)
+
+		req, err := http.NewRequest("DELETE", "/users/c0ffee", nil)
+		require.NoError(t, err)
+
+		engine.ServeHTTP(recorder, req)
+
+		assert.Equal(t, 404, recorder.Code)
+	})
+
+	t.Run("conflict", func(t *testing.T) {
+		_, engine, mockService, _ := setupMocks(t)
+		recorder := httptest.NewRecorder()
+
+		// the user was deleted or updated since the service read it
+		mockService.EXPECT().Delete(gomock.Any(), entity.DefaultTenant, "c0ffee").Return(entity.User{}, entity.ErrConflict)
+
+		req, err := http.NewRequest("DELETE", "/users/c0ffee", nil)
+		require.NoError(t, err)
+
+		engine.ServeHTTP(recorder, req)
+
+		assert.Equal(t, 409, recorder.Code)
+		assert.Equal(t, fmt.Sprintf("{\"error\":\"%s\"}", entity.ErrConflict.Error()), recorder.Body.String())
+	})
+}
+
+func TestUserController_restore(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		_, engine, mockService, _ := setupMocks(t)
+		recorder := httptest.NewRecorder()
+
+		user, _ := setupTestUser(t)
+		user.Id = "c0ffee"
+		user.Password = ""
+		user.Version = 5
+
+		mockService.EXPECT().Restore(gomock.Any(), entity.DefaultTenant, user.Id).Return(user, nil)
+
+		req, err := http.NewRequest("POST", "/users/c0ffee/restore", nil)
+		require.NoError(t, err)
+
+		engine.ServeHTTP(recorder, req)
+
+		jsonUser, err := json.Marshal(user)
+		require.NoError(t, err)
+
+		assert.Equal(t, 200, recorder.Code)
+		assert.Equal(t, string(jsonUser), recorder.Body.String())
+		assert.Equal(t, `"5"`, recorder.Header().Get("ETag"))
+	})
+
+	t.Run("not-found", func(t *testing.T) {
+		_, engine, mockService, _ := setupMocks(t)
+		recorder := httptest.NewRecorder()
+
+		mockService.EXPECT().Restore(gomock.Any(), entity.DefaultTenant, "c0ffee").Return(entity.User{}, entity.ErrNotFound)
+
+		req, err := http.NewRequest("POST", "/users/c0ffee/restore", nil)
+		require.NoError(t, err)
+
+		engine.ServeHTTP(recorder, req)
+
+		assert.Equal(t, 404, recorder.Code)
+	})
+}
+
+func TestUserController_login(t *testing.T) {
+	t.Run("forwarded-for-not-recorded", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		mockService := mocks.NewMockUserService(ctrl)
+
+		// the router of the server only trusts the configured proxies
+		s := server.New()
+		controller.New(mockService, s.GetRouter())
+
+		mockService.EXPECT().ValidateCredentials(gomock.Any(), entity.DefaultTenant, entity.UserLogin{
+			Email: "test@example.com", Password: "simple-password", SourceIp: "192.0.2.1",
+		}).Return(nil)
+
+		req, err := http.NewRequest(
+			"POST", "/login", bytes.NewBufferString(`{"email":"test@example.com","password":"simple-password"}`),
+		)
+		require.NoError(t, err)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("X-Forwarded-For", "198.51.100.7")
+
+		recorder := httptest.NewRecorder()
+		s.GetRouter().(http.Handler).ServeHTTP(recorder, req)
+
+		assert.Equal(t, 200, recorder.Code)
+	})
+}
+
+func TestUserController_audit(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		_, engine, mockService, _ := setupMocks(t)
+		recorder := httptest.NewRecorder()
+
+		page := entity.AuditPage{
+			Entries: []entity.AuditEntry{
+				{
+					UserId:    "c0ffee",
+					Timestamp: time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC),
+					Actor:     "admin@example.com",
+					Action:    entity.AuditActionUpdate,
+					Changes:   map[string]entity.AuditChange{"password": {New: entity.AuditRedacted}},
+				},
+			},
+			NextCursor: "next-page",
+		}
+
+		mockService.EXPECT().ListAudit(
+			gomock.Any(), entity.DefaultTenant, "c0ffee", entity.ListOptions{Limit: 1, Cursor: "this-page"},
+		).Return(page, nil)
+
+		req, err := http.NewRequest("GET", "/users/c0ffee/audit?limit=1&cursor=this-page", nil)
+		require.NoError(t, err)
+
+		engine.ServeHTTP(recorder, req)
+
+		jsonPage, err := json.Marshal(page)
+		require.NoError(t, err)
+
+		assert.Equal(t, 200, recorder.Code)
+		assert.Equal(t, string(jsonPage), recorder.Body.String())
+	})
+
+	t.Run("forwarded-for-not-recorded", func(t *testing.T) {
+		// the router of the server only trusts the configured proxies
+		s := server.New()
+		controller.New(service.New(store.NewMemoryUserStore()), s.GetRouter())
+		engine := s.GetRouter().(http.Handler)
+
+		_, jsonBody := setupTestUser(t)
+
+		req, err := http.NewRequest("POST", "/users", jsonBody)
+		require.NoError(t, err)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("X-Actor", "admin@example.com")
+		req.Header.Set("X-Forwarded-For", "198.51.100.7")
+
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, req)
+		require.Equal(t, 201, recorder.Code)
+
+		var created entity.User
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &created))
+
+		req, err = http.NewRequest("GET", "/users/"+created.Id+"/audit", nil)
+		require.NoError(t, err)
+
+		recorder = httptest.NewRecorder()
+		engine.ServeHTTP(recorder, req)
+		require.Equal(t, 200, recorder.Code)
+
+		var page entity.AuditPage
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &page))
+		require.Len(t, page.Entries, 1)
+		assert.Equal(t, "admin@example.com via 192.0.2.1", page.Entries[0].Actor)
+	})
+
+	t.Run("bad-limit", func(t *testing.T) {
+		_, engine, _, _ := setupMocks(t)
+		recorder := httptest.NewRecorder()
+
+		req, err := http.NewRequest("GET", "/users/c0ffee/audit?limit=many", nil)
+		require.NoError(t, err)
+
+		engine.ServeHTTP(recorder, req)
+
+		assert.Equal(t, 400, recorder.Code)
+	})
+
+	t.Run("bad-cursor", func(t *testing.T) {
+		_, engine, mockService, _ := setupMocks(t)
+		recorder := httptest.NewRecorder()
+
+		mockService.EXPECT().ListAudit(gomock.Any(), entity.DefaultTenant, "c0ffee", gomock.Any()).Return(
+			entity.AuditPage{}, entity.ErrCursorInvalid,
+		)
+
+		req, err := http.NewRequest("GET", "/users/c0ffee/audit?cursor=garbage", nil)
+		require.NoError(t, err)
+
+		engine.ServeHTTP(recorder, req)
+
+		assert.Equal(t, 400, recorder.Code)
+	})
+}
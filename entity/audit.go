@@ -0,0 +1,37 @@
+package entity
+
+import "time"
+
+const (
+	AuditActionCreate  = "create"
+	AuditActionUpdate  = "update"
+	AuditActionDelete  = "delete"
+	AuditActionRestore = "restore"
+	AuditActionLogin   = "login"
+
+	// AuditRedacted replaces the values of sensitive fields such as the
+	// password, recording only that they changed.
+	AuditRedacted = "[redacted]"
+)
+
+// AuditEntry records an action performed on a user and by whom, it is
+// written by the store together with the change to the user.
+type AuditEntry struct {
+	UserId    string                 `json:"user_id"`
+	Timestamp time.Time              `json:"timestamp"`
+	Actor     string                 `json:"actor"`
+	Action    string                 `json:"action"`
+	Changes   map[string]AuditChange `json:"changes,omitempty"`
+}
+
+// AuditChange holds the previous and new value of a single user field.
+type AuditChange struct {
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+}
+
+// AuditPage is a single page of audit entries, newest first.
+type AuditPage struct {
+	Entries    []AuditEntry `json:"entries"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
@@ -0,0 +1,22 @@
+package entity
+
+// BatchStatus is the outcome of creating a single user of a batch.
+type BatchStatus string
+
+const (
+	BatchStatusCreated   BatchStatus = "created"
+	BatchStatusDuplicate BatchStatus = "duplicate"
+	BatchStatusInvalid   BatchStatus = "invalid"
+	// BatchStatusFailed is any other error, the user may be retried.
+	BatchStatusFailed BatchStatus = "failed"
+)
+
+// BatchResult reports the outcome for the user at Row of a batch, counting
+// from 1. Id is only set once the user has been created.
+type BatchResult struct {
+	Row    int         `json:"row"`
+	Status BatchStatus `json:"status"`
+	Id     string      `json:"id,omitempty"`
+	Email  string      `json:"email,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
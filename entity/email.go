@@ -0,0 +1,32 @@
+package entity
+
+import (
+	"strings"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/text/cases"
+)
+
+// CanonicalEmail returns the form of an email used to determine uniqueness
+// and to look up users, while the email as given is kept for display. The
+// whole address is trimmed and case folded, and an internationalised domain
+// is converted to its ASCII form where valid so that either spelling of the
+// domain matches. The canonical form must never change once users have been
+// stored with it, as it is used as the key of their email reservations.
+func CanonicalEmail(email string) string {
+	// a Caser holds state, so one is not shared between requests
+	email = cases.Fold().String(strings.TrimSpace(email))
+
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return email
+	}
+
+	domain, err := idna.Lookup.ToASCII(email[at+1:])
+	if err != nil {
+		// not a valid domain name, fall back to the folded form
+		return email
+	}
+
+	return email[:at+1] + domain
+}
@@ -12,4 +12,22 @@ var (
 	ErrInternalError         = errors.New("internal server error")
 	ErrUpdateFieldNotAllowed = errors.New("requested field update not allowed")
 	ErrBadCredentials        = errors.New("invalid credentials")
+	ErrConflict              = errors.New("user was modified by another request")
+	ErrUserInvalid           = errors.New("user requires an email, name and password")
+	ErrBatchTooLarge         = errors.New("too many users in batch")
+	ErrUnavailable           = errors.New("service temporarily unavailable, retry later")
+
+	ErrTenantInvalid = errors.New("tenant is missing or invalid")
+	ErrTenantUnknown = errors.New("tenant does not exist")
+	ErrTokenInvalid  = errors.New("bearer token is missing or invalid")
+	ErrTokenTenant   = errors.New("bearer token does not name a tenant")
+
+	ErrCursorInvalid = errors.New("pagination cursor is invalid")
+	ErrLimitInvalid  = errors.New("pagination limit is out of range")
+
+	ErrFilterInvalid     = errors.New("list filter is invalid")
+	ErrFilterUnsupported = errors.New("list filter is not supported on encrypted fields")
+
+	ErrQueryInvalid   = errors.New("search query is missing or too long")
+	ErrSearchDisabled = errors.New("search is not enabled")
 )
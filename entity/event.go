@@ -0,0 +1,29 @@
+package entity
+
+import "time"
+
+// UserEventType is the kind of change to a user reported by a UserEvent.
+type UserEventType string
+
+const (
+	UserCreated UserEventType = "UserCreated"
+	UserUpdated UserEventType = "UserUpdated"
+	// UserDeleted is reported when a user is deleted, and again with
+	// Purged set once it is permanently removed.
+	UserDeleted UserEventType = "UserDeleted"
+)
+
+// UserEvent is a change to a user read from the change stream of the store.
+// Events may be delivered more than once, always with the same Id.
+type UserEvent struct {
+	Id       string        `json:"id"`
+	Type     UserEventType `json:"type"`
+	TenantId string        `json:"tenant_id"`
+	UserId   string        `json:"user_id"`
+	Time     time.Time     `json:"time"`
+	// User is the user after the change, nil once purged.
+	User *User `json:"user,omitempty"`
+	// Previous is the user before the change, nil when created.
+	Previous *User `json:"previous,omitempty"`
+	Purged   bool  `json:"purged,omitempty"`
+}
@@ -0,0 +1,21 @@
+package entity
+
+// SearchHit is a user matching a search query, a higher Score is a closer
+// match.
+type SearchHit struct {
+	Id    string
+	Score float64
+}
+
+// SearchResult is a user found by a search along with how closely it matched.
+type SearchResult struct {
+	User  User    `json:"user"`
+	Score float64 `json:"score"`
+}
+
+// SearchPage is a page of search results ordered by descending score, the
+// NextCursor is empty on the last page.
+type SearchPage struct {
+	Results    []SearchResult `json:"results"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
@@ -0,0 +1,26 @@
+package entity
+
+import "regexp"
+
+// DefaultTenant owns the users stored before tenants were introduced, along
+// with any users written without a tenant.
+const DefaultTenant = "default"
+
+// tenantPattern limits tenants to valid DNS labels, so that they can be
+// resolved from a subdomain and never contain the separators of store keys.
+var tenantPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// ValidTenant reports whether the tenant is well formed, it does not check
+// that the tenant exists.
+func ValidTenant(tenant string) bool {
+	return tenantPattern.MatchString(tenant)
+}
+
+// TenantOrDefault returns the tenant, or the DefaultTenant if none is set.
+func TenantOrDefault(tenant string) string {
+	if tenant == "" {
+		return DefaultTenant
+	}
+
+	return tenant
+}
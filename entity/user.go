@@ -1,16 +1,140 @@
 package entity
 
-import "time"
+import (
+	"strings"
+	"time"
+
+	"golang.org/x/text/cases"
+)
 
 type User struct {
-	Id        string    `json:"id"`
-	Email     string    `json:"email" binding:"required"`
-	Name      string    `json:"name" binding:"required"`
-	Password  string    `json:"password,omitempty" binding:"required"`
+	Id string `json:"id"`
+	// TenantId is the organisation the user belongs to, set from the
+	// request rather than the body. Users without one belong to the
+	// DefaultTenant, the DynamoDB store records it in the key of the item.
+	TenantId string `json:"tenant_id" dynamodbav:"-"`
+	Email    string `json:"email" binding:"required"`
+	Name     string `json:"name" binding:"required"`
+	// Password is only set on users being written, stores keep the hash
+	// with the Credentials and never return it with the user.
+	Password  string    `json:"password,omitempty" binding:"required" dynamodbav:"-"`
 	LastLogin time.Time `json:"last_login"`
+	// LoginCount and LastLoginIp are only changed by recording a Login,
+	// which updates them with LastLogin in place without a new Version.
+	LoginCount  int64  `json:"login_count"`
+	LastLoginIp string `json:"last_login_ip,omitempty" dynamodbav:",omitempty"`
+	// Version is incremented by the store on every write, updates are
+	// only applied when it matches the version currently stored.
+	Version int64 `json:"version"`
+	// DeletedAt is set when the user is soft deleted, the user is kept with
+	// its email reserved until purged after a grace period.
+	DeletedAt *time.Time `json:"deleted_at,omitempty" dynamodbav:",omitempty"`
+}
+
+// Credentials are the secrets of a user, stored apart from the User so that
+// reading or listing users never loads them and changing them does not
+// rewrite the user.
+type Credentials struct {
+	// Password is the bcrypt hash of the password of the user.
+	Password string `json:"password"`
+	// FailedLogins counts the failed logins since the last successful one,
+	// a user locked out by them cannot log in again before LockedUntil.
+	FailedLogins int64      `json:"failed_logins"`
+	LockedUntil  *time.Time `json:"locked_until,omitempty" dynamodbav:",omitempty"`
+	// MfaSecret is the TOTP secret of the user, empty unless the user has
+	// enrolled in MFA. It is always encrypted when encryption is enabled.
+	MfaSecret string `json:"mfa_secret,omitempty" dynamodbav:",omitempty"`
+	// Version counts the writes of the credentials, which are only replaced
+	// while still at the version read.
+	Version int64 `json:"version"`
 }
 
 type UserLogin struct {
 	Email    string `json:"email" binding:"required"`
 	Password string `json:"password" binding:"required"`
+	// SourceIp is the address the login was made from, set from the
+	// request rather than the body.
+	SourceIp string `json:"-"`
+}
+
+// Login is a successful login to be recorded against the user.
+type Login struct {
+	Time     time.Time
+	SourceIp string
+}
+
+// ListOptions controls paging through users, where Cursor is the opaque
+// value returned as the NextCursor of a previous page. Stores may return
+// fewer than Limit users even when there are further pages.
+type ListOptions struct {
+	Limit  int32
+	Cursor string
+	// Deleted selects only soft deleted users instead of only active users.
+	Deleted bool
+	// EmailPrefix and NamePrefix select users whose email or name begins
+	// with them, both must be given in their SearchForm. Filtered users may
+	// be returned in order of the field filtered on rather than by Id.
+	EmailPrefix string
+	NamePrefix  string
+	// LastLoginAfter and LastLoginBefore select users whose last login is
+	// strictly within the range, either may be zero to leave it open. Users
+	// that have never logged in are not matched by any range.
+	LastLoginAfter  time.Time
+	LastLoginBefore time.Time
+}
+
+// Filtered reports whether any of the filters beyond Deleted are set.
+func (o ListOptions) Filtered() bool {
+	return o.EmailPrefix != "" || o.NamePrefix != "" || o.LastLoginFiltered()
+}
+
+// LastLoginFiltered reports whether a range of last login is selected.
+func (o ListOptions) LastLoginFiltered() bool {
+	return !o.LastLoginAfter.IsZero() || !o.LastLoginBefore.IsZero()
+}
+
+// Matches reports whether the user satisfies the filters of the options,
+// other than Deleted, for stores that cannot apply them in a query.
+func (o ListOptions) Matches(user *User) bool {
+	if o.EmailPrefix != "" && !strings.HasPrefix(SearchForm(user.Email), o.EmailPrefix) {
+		return false
+	}
+
+	if o.NamePrefix != "" && !strings.HasPrefix(SearchForm(user.Name), o.NamePrefix) {
+		return false
+	}
+
+	if !o.LastLoginFiltered() {
+		return true
+	}
+
+	if user.LastLogin.IsZero() {
+		return false
+	}
+
+	return (o.LastLoginAfter.IsZero() || user.LastLogin.After(o.LastLoginAfter)) &&
+		(o.LastLoginBefore.IsZero() || user.LastLogin.Before(o.LastLoginBefore))
+}
+
+// SearchForm returns the form of an email or name matched by the prefix
+// filters of ListOptions, trimmed and case folded. Unlike CanonicalEmail
+// the domain of an email is left as given, so that any prefix of it
+// matches.
+func SearchForm(value string) string {
+	// a Caser holds state, so one is not shared between requests
+	return cases.Fold().String(strings.TrimSpace(value))
+}
+
+// UserBatch is the result of getting users by ids, Missing holds the ids
+// requested for which there is no user.
+type UserBatch struct {
+	Users   []User   `json:"users"`
+	Missing []string `json:"missing"`
+}
+
+// UserPage is a single page of users, NextCursor is empty once there are
+// no further pages to retrieve.
+type UserPage struct {
+	Users      []User `json:"users"`
+	NextCursor string `json:"next_cursor,omitempty"`
 }
@@ -7,11 +7,19 @@ require (
 	github.com/aws/aws-sdk-go-v2/config v1.1.3
 	github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue v1.0.4
 	github.com/aws/aws-sdk-go-v2/service/dynamodb v1.2.0
-	github.com/gin-gonic/gin v1.6.3
+	github.com/aws/aws-sdk-go-v2/service/dynamodbstreams v1.1.3
+	github.com/aws/smithy-go v1.2.0
+	github.com/gin-gonic/gin v1.7.7
+	github.com/golang-jwt/jwt/v4 v4.5.2
 	github.com/golang/mock v1.5.0
+	github.com/lib/pq v1.10.0
+	github.com/mattn/go-sqlite3 v1.14.6
+	github.com/prometheus/client_golang v1.10.0
 	github.com/rs/xid v1.2.1
 	github.com/sirupsen/logrus v1.8.1
 	github.com/spf13/cobra v1.1.3
 	github.com/stretchr/testify v1.7.0
 	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
+	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110
+	golang.org/x/text v0.3.3
 )
@@ -35,6 +35,26 @@ func (m *MockDynamoDBAPI) EXPECT() *MockDynamoDBAPIMockRecorder {
 	return m.recorder
 }
 
+// BatchGetItem mocks base method.
+func (m *MockDynamoDBAPI) BatchGetItem(arg0 context.Context, arg1 *dynamodb.BatchGetItemInput, arg2 ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{arg0, arg1}
+	for _, a := range arg2 {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "BatchGetItem", varargs...)
+	ret0, _ := ret[0].(*dynamodb.BatchGetItemOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// BatchGetItem indicates an expected call of BatchGetItem.
+func (mr *MockDynamoDBAPIMockRecorder) BatchGetItem(arg0, arg1 interface{}, arg2 ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]interface{}{arg0, arg1}, arg2...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BatchGetItem", reflect.TypeOf((*MockDynamoDBAPI)(nil).BatchGetItem), varargs...)
+}
+
 // CreateTable mocks base method.
 func (m *MockDynamoDBAPI) CreateTable(arg0 context.Context, arg1 *dynamodb.CreateTableInput, arg2 ...func(*dynamodb.Options)) (*dynamodb.CreateTableOutput, error) {
 	m.ctrl.T.Helper()
@@ -75,44 +95,44 @@ func (mr *MockDynamoDBAPIMockRecorder) DeleteItem(arg0, arg1 interface{}, arg2 .
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteItem", reflect.TypeOf((*MockDynamoDBAPI)(nil).DeleteItem), varargs...)
 }
 
-// GetItem mocks base method.
-func (m *MockDynamoDBAPI) GetItem(arg0 context.Context, arg1 *dynamodb.GetItemInput, arg2 ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+// DescribeTable mocks base method.
+func (m *MockDynamoDBAPI) DescribeTable(arg0 context.Context, arg1 *dynamodb.DescribeTableInput, arg2 ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error) {
 	m.ctrl.T.Helper()
 	varargs := []interface{}{arg0, arg1}
 	for _, a := range arg2 {
 		varargs = append(varargs, a)
 	}
-	ret := m.ctrl.Call(m, "GetItem", varargs...)
-	ret0, _ := ret[0].(*dynamodb.GetItemOutput)
+	ret := m.ctrl.Call(m, "DescribeTable", varargs...)
+	ret0, _ := ret[0].(*dynamodb.DescribeTableOutput)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// GetItem indicates an expected call of GetItem.
-func (mr *MockDynamoDBAPIMockRecorder) GetItem(arg0, arg1 interface{}, arg2 ...interface{}) *gomock.Call {
+// DescribeTable indicates an expected call of DescribeTable.
+func (mr *MockDynamoDBAPIMockRecorder) DescribeTable(arg0, arg1 interface{}, arg2 ...interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	varargs := append([]interface{}{arg0, arg1}, arg2...)
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetItem", reflect.TypeOf((*MockDynamoDBAPI)(nil).GetItem), varargs...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DescribeTable", reflect.TypeOf((*MockDynamoDBAPI)(nil).DescribeTable), varargs...)
 }
 
-// ListTables mocks base method.
-func (m *MockDynamoDBAPI) ListTables(arg0 context.Context, arg1 *dynamodb.ListTablesInput, arg2 ...func(*dynamodb.Options)) (*dynamodb.ListTablesOutput, error) {
+// GetItem mocks base method.
+func (m *MockDynamoDBAPI) GetItem(arg0 context.Context, arg1 *dynamodb.GetItemInput, arg2 ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
 	m.ctrl.T.Helper()
 	varargs := []interface{}{arg0, arg1}
 	for _, a := range arg2 {
 		varargs = append(varargs, a)
 	}
-	ret := m.ctrl.Call(m, "ListTables", varargs...)
-	ret0, _ := ret[0].(*dynamodb.ListTablesOutput)
+	ret := m.ctrl.Call(m, "GetItem", varargs...)
+	ret0, _ := ret[0].(*dynamodb.GetItemOutput)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// ListTables indicates an expected call of ListTables.
-func (mr *MockDynamoDBAPIMockRecorder) ListTables(arg0, arg1 interface{}, arg2 ...interface{}) *gomock.Call {
+// GetItem indicates an expected call of GetItem.
+func (mr *MockDynamoDBAPIMockRecorder) GetItem(arg0, arg1 interface{}, arg2 ...interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	varargs := append([]interface{}{arg0, arg1}, arg2...)
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListTables", reflect.TypeOf((*MockDynamoDBAPI)(nil).ListTables), varargs...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetItem", reflect.TypeOf((*MockDynamoDBAPI)(nil).GetItem), varargs...)
 }
 
 // PutItem mocks base method.
@@ -135,6 +155,26 @@ func (mr *MockDynamoDBAPIMockRecorder) PutItem(arg0, arg1 interface{}, arg2 ...i
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PutItem", reflect.TypeOf((*MockDynamoDBAPI)(nil).PutItem), varargs...)
 }
 
+// Query mocks base method.
+func (m *MockDynamoDBAPI) Query(arg0 context.Context, arg1 *dynamodb.QueryInput, arg2 ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{arg0, arg1}
+	for _, a := range arg2 {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "Query", varargs...)
+	ret0, _ := ret[0].(*dynamodb.QueryOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Query indicates an expected call of Query.
+func (mr *MockDynamoDBAPIMockRecorder) Query(arg0, arg1 interface{}, arg2 ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]interface{}{arg0, arg1}, arg2...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Query", reflect.TypeOf((*MockDynamoDBAPI)(nil).Query), varargs...)
+}
+
 // Scan mocks base method.
 func (m *MockDynamoDBAPI) Scan(arg0 context.Context, arg1 *dynamodb.ScanInput, arg2 ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
 	m.ctrl.T.Helper()
@@ -174,3 +214,43 @@ func (mr *MockDynamoDBAPIMockRecorder) TransactWriteItems(arg0, arg1 interface{}
 	varargs := append([]interface{}{arg0, arg1}, arg2...)
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TransactWriteItems", reflect.TypeOf((*MockDynamoDBAPI)(nil).TransactWriteItems), varargs...)
 }
+
+// UpdateItem mocks base method.
+func (m *MockDynamoDBAPI) UpdateItem(arg0 context.Context, arg1 *dynamodb.UpdateItemInput, arg2 ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{arg0, arg1}
+	for _, a := range arg2 {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "UpdateItem", varargs...)
+	ret0, _ := ret[0].(*dynamodb.UpdateItemOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UpdateItem indicates an expected call of UpdateItem.
+func (mr *MockDynamoDBAPIMockRecorder) UpdateItem(arg0, arg1 interface{}, arg2 ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]interface{}{arg0, arg1}, arg2...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateItem", reflect.TypeOf((*MockDynamoDBAPI)(nil).UpdateItem), varargs...)
+}
+
+// UpdateTable mocks base method.
+func (m *MockDynamoDBAPI) UpdateTable(arg0 context.Context, arg1 *dynamodb.UpdateTableInput, arg2 ...func(*dynamodb.Options)) (*dynamodb.UpdateTableOutput, error) {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{arg0, arg1}
+	for _, a := range arg2 {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "UpdateTable", varargs...)
+	ret0, _ := ret[0].(*dynamodb.UpdateTableOutput)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UpdateTable indicates an expected call of UpdateTable.
+func (mr *MockDynamoDBAPIMockRecorder) UpdateTable(arg0, arg1 interface{}, arg2 ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]interface{}{arg0, arg1}, arg2...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateTable", reflect.TypeOf((*MockDynamoDBAPI)(nil).UpdateTable), varargs...)
+}
@@ -36,90 +36,165 @@ func (m *MockUserService) EXPECT() *MockUserServiceMockRecorder {
 }
 
 // Create mocks base method.
-func (m *MockUserService) Create(arg0 context.Context, arg1 entity.User) (entity.User, error) {
+func (m *MockUserService) Create(arg0 context.Context, arg1 string, arg2 entity.User) (entity.User, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Create", arg0, arg1)
+	ret := m.ctrl.Call(m, "Create", arg0, arg1, arg2)
 	ret0, _ := ret[0].(entity.User)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // Create indicates an expected call of Create.
-func (mr *MockUserServiceMockRecorder) Create(arg0, arg1 interface{}) *gomock.Call {
+func (mr *MockUserServiceMockRecorder) Create(arg0, arg1, arg2 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Create", reflect.TypeOf((*MockUserService)(nil).Create), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Create", reflect.TypeOf((*MockUserService)(nil).Create), arg0, arg1, arg2)
+}
+
+// CreateBatch mocks base method.
+func (m *MockUserService) CreateBatch(arg0 context.Context, arg1 string, arg2 []entity.User) ([]entity.BatchResult, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateBatch", arg0, arg1, arg2)
+	ret0, _ := ret[0].([]entity.BatchResult)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CreateBatch indicates an expected call of CreateBatch.
+func (mr *MockUserServiceMockRecorder) CreateBatch(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateBatch", reflect.TypeOf((*MockUserService)(nil).CreateBatch), arg0, arg1, arg2)
 }
 
 // Delete mocks base method.
-func (m *MockUserService) Delete(arg0 context.Context, arg1 string) (entity.User, error) {
+func (m *MockUserService) Delete(arg0 context.Context, arg1, arg2 string) (entity.User, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Delete", arg0, arg1)
+	ret := m.ctrl.Call(m, "Delete", arg0, arg1, arg2)
 	ret0, _ := ret[0].(entity.User)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // Delete indicates an expected call of Delete.
-func (mr *MockUserServiceMockRecorder) Delete(arg0, arg1 interface{}) *gomock.Call {
+func (mr *MockUserServiceMockRecorder) Delete(arg0, arg1, arg2 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockUserService)(nil).Delete), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockUserService)(nil).Delete), arg0, arg1, arg2)
 }
 
 // Get mocks base method.
-func (m *MockUserService) Get(arg0 context.Context, arg1 string) (entity.User, error) {
+func (m *MockUserService) Get(arg0 context.Context, arg1, arg2 string) (entity.User, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Get", arg0, arg1)
+	ret := m.ctrl.Call(m, "Get", arg0, arg1, arg2)
 	ret0, _ := ret[0].(entity.User)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // Get indicates an expected call of Get.
-func (mr *MockUserServiceMockRecorder) Get(arg0, arg1 interface{}) *gomock.Call {
+func (mr *MockUserServiceMockRecorder) Get(arg0, arg1, arg2 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockUserService)(nil).Get), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockUserService)(nil).Get), arg0, arg1, arg2)
+}
+
+// GetMany mocks base method.
+func (m *MockUserService) GetMany(arg0 context.Context, arg1 string, arg2 []string) (entity.UserBatch, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetMany", arg0, arg1, arg2)
+	ret0, _ := ret[0].(entity.UserBatch)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetMany indicates an expected call of GetMany.
+func (mr *MockUserServiceMockRecorder) GetMany(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetMany", reflect.TypeOf((*MockUserService)(nil).GetMany), arg0, arg1, arg2)
 }
 
 // List mocks base method.
-func (m *MockUserService) List(arg0 context.Context) ([]entity.User, error) {
+func (m *MockUserService) List(arg0 context.Context, arg1 string, arg2 entity.ListOptions) (entity.UserPage, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "List", arg0)
-	ret0, _ := ret[0].([]entity.User)
+	ret := m.ctrl.Call(m, "List", arg0, arg1, arg2)
+	ret0, _ := ret[0].(entity.UserPage)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // List indicates an expected call of List.
-func (mr *MockUserServiceMockRecorder) List(arg0 interface{}) *gomock.Call {
+func (mr *MockUserServiceMockRecorder) List(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "List", reflect.TypeOf((*MockUserService)(nil).List), arg0, arg1, arg2)
+}
+
+// ListAudit mocks base method.
+func (m *MockUserService) ListAudit(arg0 context.Context, arg1, arg2 string, arg3 entity.ListOptions) (entity.AuditPage, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListAudit", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(entity.AuditPage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListAudit indicates an expected call of ListAudit.
+func (mr *MockUserServiceMockRecorder) ListAudit(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListAudit", reflect.TypeOf((*MockUserService)(nil).ListAudit), arg0, arg1, arg2, arg3)
+}
+
+// Restore mocks base method.
+func (m *MockUserService) Restore(arg0 context.Context, arg1, arg2 string) (entity.User, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Restore", arg0, arg1, arg2)
+	ret0, _ := ret[0].(entity.User)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Restore indicates an expected call of Restore.
+func (mr *MockUserServiceMockRecorder) Restore(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Restore", reflect.TypeOf((*MockUserService)(nil).Restore), arg0, arg1, arg2)
+}
+
+// Search mocks base method.
+func (m *MockUserService) Search(arg0 context.Context, arg1, arg2 string, arg3 entity.ListOptions) (entity.SearchPage, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Search", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(entity.SearchPage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Search indicates an expected call of Search.
+func (mr *MockUserServiceMockRecorder) Search(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "List", reflect.TypeOf((*MockUserService)(nil).List), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Search", reflect.TypeOf((*MockUserService)(nil).Search), arg0, arg1, arg2, arg3)
 }
 
 // Update mocks base method.
-func (m *MockUserService) Update(arg0 context.Context, arg1 string, arg2 entity.User) (entity.User, error) {
+func (m *MockUserService) Update(arg0 context.Context, arg1, arg2 string, arg3 entity.User) (entity.User, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Update", arg0, arg1, arg2)
+	ret := m.ctrl.Call(m, "Update", arg0, arg1, arg2, arg3)
 	ret0, _ := ret[0].(entity.User)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // Update indicates an expected call of Update.
-func (mr *MockUserServiceMockRecorder) Update(arg0, arg1, arg2 interface{}) *gomock.Call {
+func (mr *MockUserServiceMockRecorder) Update(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Update", reflect.TypeOf((*MockUserService)(nil).Update), arg0, arg1, arg2)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Update", reflect.TypeOf((*MockUserService)(nil).Update), arg0, arg1, arg2, arg3)
 }
 
 // ValidateCredentials mocks base method.
-func (m *MockUserService) ValidateCredentials(arg0 context.Context, arg1 entity.UserLogin) error {
+func (m *MockUserService) ValidateCredentials(arg0 context.Context, arg1 string, arg2 entity.UserLogin) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "ValidateCredentials", arg0, arg1)
+	ret := m.ctrl.Call(m, "ValidateCredentials", arg0, arg1, arg2)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // ValidateCredentials indicates an expected call of ValidateCredentials.
-func (mr *MockUserServiceMockRecorder) ValidateCredentials(arg0, arg1 interface{}) *gomock.Call {
+func (mr *MockUserServiceMockRecorder) ValidateCredentials(arg0, arg1, arg2 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ValidateCredentials", reflect.TypeOf((*MockUserService)(nil).ValidateCredentials), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ValidateCredentials", reflect.TypeOf((*MockUserService)(nil).ValidateCredentials), arg0, arg1, arg2)
 }
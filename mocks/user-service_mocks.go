@@ -36,88 +36,195 @@ func (m *MockUserStore) EXPECT() *MockUserStoreMockRecorder {
 }
 
 // Create mocks base method.
-func (m *MockUserStore) Create(arg0 context.Context, arg1 *entity.User) error {
+func (m *MockUserStore) Create(arg0 context.Context, arg1 *entity.User, arg2 ...entity.AuditEntry) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Create", arg0, arg1)
+	varargs := []interface{}{arg0, arg1}
+	for _, a := range arg2 {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "Create", varargs...)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // Create indicates an expected call of Create.
-func (mr *MockUserStoreMockRecorder) Create(arg0, arg1 interface{}) *gomock.Call {
+func (mr *MockUserStoreMockRecorder) Create(arg0, arg1 interface{}, arg2 ...interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Create", reflect.TypeOf((*MockUserStore)(nil).Create), arg0, arg1)
+	varargs := append([]interface{}{arg0, arg1}, arg2...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Create", reflect.TypeOf((*MockUserStore)(nil).Create), varargs...)
 }
 
-// Delete mocks base method.
-func (m *MockUserStore) Delete(arg0 context.Context, arg1 string) error {
+// CreateBatch mocks base method.
+func (m *MockUserStore) CreateBatch(arg0 context.Context, arg1 []*entity.User, arg2 []entity.AuditEntry) []error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Delete", arg0, arg1)
-	ret0, _ := ret[0].(error)
+	ret := m.ctrl.Call(m, "CreateBatch", arg0, arg1, arg2)
+	ret0, _ := ret[0].([]error)
 	return ret0
 }
 
-// Delete indicates an expected call of Delete.
-func (mr *MockUserStoreMockRecorder) Delete(arg0, arg1 interface{}) *gomock.Call {
+// CreateBatch indicates an expected call of CreateBatch.
+func (mr *MockUserStoreMockRecorder) CreateBatch(arg0, arg1, arg2 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockUserStore)(nil).Delete), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateBatch", reflect.TypeOf((*MockUserStore)(nil).CreateBatch), arg0, arg1, arg2)
 }
 
 // GetByEmail mocks base method.
-func (m *MockUserStore) GetByEmail(arg0 context.Context, arg1 string) (*entity.User, error) {
+func (m *MockUserStore) GetByEmail(arg0 context.Context, arg1, arg2 string) (*entity.User, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetByEmail", arg0, arg1)
+	ret := m.ctrl.Call(m, "GetByEmail", arg0, arg1, arg2)
 	ret0, _ := ret[0].(*entity.User)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetByEmail indicates an expected call of GetByEmail.
-func (mr *MockUserStoreMockRecorder) GetByEmail(arg0, arg1 interface{}) *gomock.Call {
+func (mr *MockUserStoreMockRecorder) GetByEmail(arg0, arg1, arg2 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetByEmail", reflect.TypeOf((*MockUserStore)(nil).GetByEmail), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetByEmail", reflect.TypeOf((*MockUserStore)(nil).GetByEmail), arg0, arg1, arg2)
 }
 
 // GetById mocks base method.
-func (m *MockUserStore) GetById(arg0 context.Context, arg1 string) (*entity.User, error) {
+func (m *MockUserStore) GetById(arg0 context.Context, arg1, arg2 string) (*entity.User, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetById", arg0, arg1)
+	ret := m.ctrl.Call(m, "GetById", arg0, arg1, arg2)
 	ret0, _ := ret[0].(*entity.User)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetById indicates an expected call of GetById.
-func (mr *MockUserStoreMockRecorder) GetById(arg0, arg1 interface{}) *gomock.Call {
+func (mr *MockUserStoreMockRecorder) GetById(arg0, arg1, arg2 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetById", reflect.TypeOf((*MockUserStore)(nil).GetById), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetById", reflect.TypeOf((*MockUserStore)(nil).GetById), arg0, arg1, arg2)
 }
 
-// List mocks base method.
-func (m *MockUserStore) List(arg0 context.Context) ([]entity.User, error) {
+// GetCredentials mocks base method.
+func (m *MockUserStore) GetCredentials(arg0 context.Context, arg1, arg2 string) (*entity.Credentials, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "List", arg0)
+	ret := m.ctrl.Call(m, "GetCredentials", arg0, arg1, arg2)
+	ret0, _ := ret[0].(*entity.Credentials)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetCredentials indicates an expected call of GetCredentials.
+func (mr *MockUserStoreMockRecorder) GetCredentials(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetCredentials", reflect.TypeOf((*MockUserStore)(nil).GetCredentials), arg0, arg1, arg2)
+}
+
+// GetMany mocks base method.
+func (m *MockUserStore) GetMany(arg0 context.Context, arg1 string, arg2 []string) ([]entity.User, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetMany", arg0, arg1, arg2)
 	ret0, _ := ret[0].([]entity.User)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
+// GetMany indicates an expected call of GetMany.
+func (mr *MockUserStoreMockRecorder) GetMany(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetMany", reflect.TypeOf((*MockUserStore)(nil).GetMany), arg0, arg1, arg2)
+}
+
+// List mocks base method.
+func (m *MockUserStore) List(arg0 context.Context, arg1 string, arg2 entity.ListOptions) (entity.UserPage, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "List", arg0, arg1, arg2)
+	ret0, _ := ret[0].(entity.UserPage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
 // List indicates an expected call of List.
-func (mr *MockUserStoreMockRecorder) List(arg0 interface{}) *gomock.Call {
+func (mr *MockUserStoreMockRecorder) List(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "List", reflect.TypeOf((*MockUserStore)(nil).List), arg0, arg1, arg2)
+}
+
+// ListAudit mocks base method.
+func (m *MockUserStore) ListAudit(arg0 context.Context, arg1, arg2 string, arg3 entity.ListOptions) (entity.AuditPage, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListAudit", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(entity.AuditPage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListAudit indicates an expected call of ListAudit.
+func (mr *MockUserStoreMockRecorder) ListAudit(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListAudit", reflect.TypeOf((*MockUserStore)(nil).ListAudit), arg0, arg1, arg2, arg3)
+}
+
+// Purge mocks base method.
+func (m *MockUserStore) Purge(arg0 context.Context, arg1 *entity.User) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Purge", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Purge indicates an expected call of Purge.
+func (mr *MockUserStoreMockRecorder) Purge(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Purge", reflect.TypeOf((*MockUserStore)(nil).Purge), arg0, arg1)
+}
+
+// PutCredentials mocks base method.
+func (m *MockUserStore) PutCredentials(arg0 context.Context, arg1, arg2 string, arg3 int64, arg4 *entity.Credentials, arg5 ...entity.AuditEntry) error {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{arg0, arg1, arg2, arg3, arg4}
+	for _, a := range arg5 {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "PutCredentials", varargs...)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// PutCredentials indicates an expected call of PutCredentials.
+func (mr *MockUserStoreMockRecorder) PutCredentials(arg0, arg1, arg2, arg3, arg4 interface{}, arg5 ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]interface{}{arg0, arg1, arg2, arg3, arg4}, arg5...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PutCredentials", reflect.TypeOf((*MockUserStore)(nil).PutCredentials), varargs...)
+}
+
+// RecordLogin mocks base method.
+func (m *MockUserStore) RecordLogin(arg0 context.Context, arg1, arg2 string, arg3 entity.Login, arg4 ...entity.AuditEntry) error {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{arg0, arg1, arg2, arg3}
+	for _, a := range arg4 {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "RecordLogin", varargs...)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RecordLogin indicates an expected call of RecordLogin.
+func (mr *MockUserStoreMockRecorder) RecordLogin(arg0, arg1, arg2, arg3 interface{}, arg4 ...interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "List", reflect.TypeOf((*MockUserStore)(nil).List), arg0)
+	varargs := append([]interface{}{arg0, arg1, arg2, arg3}, arg4...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RecordLogin", reflect.TypeOf((*MockUserStore)(nil).RecordLogin), varargs...)
 }
 
-// Put mocks base method.
-func (m *MockUserStore) Put(arg0 context.Context, arg1 *entity.User) error {
+// Update mocks base method.
+func (m *MockUserStore) Update(arg0 context.Context, arg1 *entity.User, arg2 ...entity.AuditEntry) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Put", arg0, arg1)
+	varargs := []interface{}{arg0, arg1}
+	for _, a := range arg2 {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "Update", varargs...)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-// Put indicates an expected call of Put.
-func (mr *MockUserStoreMockRecorder) Put(arg0, arg1 interface{}) *gomock.Call {
+// Update indicates an expected call of Update.
+func (mr *MockUserStoreMockRecorder) Update(arg0, arg1 interface{}, arg2 ...interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Put", reflect.TypeOf((*MockUserStore)(nil).Put), arg0, arg1)
+	varargs := append([]interface{}{arg0, arg1}, arg2...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Update", reflect.TypeOf((*MockUserStore)(nil).Update), varargs...)
 }
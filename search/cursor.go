@@ -0,0 +1,48 @@
+package search
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+
+	"github.com/electrofelix/gin-demo/entity"
+)
+
+// cursor is the position in the ranking of the query that the next page
+// starts from, the query terms are kept so that the cursor is not used to
+// page through the results of another query.
+type cursor struct {
+	Query  string `json:"q"`
+	Offset int    `json:"o"`
+}
+
+func encodeCursor(offset int, terms []string) (string, error) {
+	data, err := json.Marshal(cursor{Query: strings.Join(terms, " "), Offset: offset})
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodeCursor returns the offset of the cursor, which is 0 when there is no
+// cursor, and entity.ErrCursorInvalid if it was not returned for the terms.
+func decodeCursor(encoded string, terms []string) (int, error) {
+	if encoded == "" {
+		return 0, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return 0, entity.ErrCursorInvalid
+	}
+
+	var c cursor
+
+	err = json.Unmarshal(data, &c)
+	if err != nil || c.Offset <= 0 || c.Query != strings.Join(terms, " ") {
+		return 0, entity.ErrCursorInvalid
+	}
+
+	return c.Offset, nil
+}
@@ -0,0 +1,398 @@
+package search
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/electrofelix/gin-demo/entity"
+)
+
+// Index is an in-process inverted index of the names and emails of users,
+// partitioned by tenant. Each term of a query matches the terms of a user
+// exactly, as a prefix, or within a few edits so that misspelt queries still
+// find the user, and users must match every term of the query. Deleted users
+// are never indexed.
+type Index struct {
+	mu      sync.RWMutex
+	tenants map[string]*tenantIndex
+}
+
+// document holds the fields of a user that were indexed, in their
+// entity.SearchForm.
+type document struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+type tenantIndex struct {
+	docs map[string]document
+	// postings maps each term to the ids of the users having it
+	postings map[string]map[string]bool
+	// grams maps each trigram to the terms containing it, finding the
+	// terms close enough to a query term to be compared with it
+	grams map[string]map[string]bool
+}
+
+func NewIndex() *Index {
+	return &Index{tenants: map[string]*tenantIndex{}}
+}
+
+func newTenantIndex() *tenantIndex {
+	return &tenantIndex{
+		docs:     map[string]document{},
+		postings: map[string]map[string]bool{},
+		grams:    map[string]map[string]bool{},
+	}
+}
+
+// Put indexes the user in its tenant, replacing any previous version of the
+// user, or removes it when the user is deleted.
+func (idx *Index) Put(user entity.User) {
+	if user.DeletedAt != nil {
+		idx.Remove(user.TenantId, user.Id)
+
+		return
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	ti, ok := idx.tenants[user.TenantId]
+	if !ok {
+		ti = newTenantIndex()
+		idx.tenants[user.TenantId] = ti
+	}
+
+	ti.put(user.Id, document{Name: entity.SearchForm(user.Name), Email: entity.SearchForm(user.Email)})
+}
+
+// Remove drops the user from the index, removing a user that is not indexed
+// has no effect.
+func (idx *Index) Remove(tenant, id string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if ti, ok := idx.tenants[tenant]; ok {
+		ti.remove(id)
+	}
+}
+
+// Replace swaps the users indexed for the tenant with the given users in one
+// step, so that searches never see a partially rebuilt tenant.
+func (idx *Index) Replace(tenant string, users []entity.User) {
+	ti := newTenantIndex()
+
+	for _, user := range users {
+		if user.DeletedAt == nil {
+			ti.put(user.Id, document{Name: entity.SearchForm(user.Name), Email: entity.SearchForm(user.Email)})
+		}
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.tenants[tenant] = ti
+}
+
+// Len returns the number of users indexed for the tenant.
+func (idx *Index) Len(tenant string) int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	if ti, ok := idx.tenants[tenant]; ok {
+		return len(ti.docs)
+	}
+
+	return 0
+}
+
+// Search returns a page of the users of the tenant matching the query,
+// closest matches first. Pages are taken from the ranking at the time of each
+// request, so users written between pages may be skipped or repeated. A
+// cursor is only valid for the query that returned it.
+func (idx *Index) Search(tenant, query string, opts entity.ListOptions) ([]entity.SearchHit, string, error) {
+	terms := Terms(query)
+	if len(terms) == 0 {
+		return nil, "", entity.ErrQueryInvalid
+	}
+
+	offset, err := decodeCursor(opts.Cursor, terms)
+	if err != nil {
+		return nil, "", err
+	}
+
+	idx.mu.RLock()
+	var hits []entity.SearchHit
+	if ti, ok := idx.tenants[tenant]; ok {
+		hits = ti.search(terms)
+	}
+	idx.mu.RUnlock()
+
+	if offset >= len(hits) {
+		return []entity.SearchHit{}, "", nil
+	}
+
+	hits = hits[offset:]
+	if opts.Limit <= 0 || int(opts.Limit) >= len(hits) {
+		return hits, "", nil
+	}
+
+	cursor, err := encodeCursor(offset+int(opts.Limit), terms)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return hits[:opts.Limit], cursor, nil
+}
+
+// Terms splits a name, email or query into the terms that are indexed and
+// matched, the runs of letters and digits of its entity.SearchForm.
+func Terms(value string) []string {
+	fields := strings.FieldsFunc(entity.SearchForm(value), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	seen := make(map[string]bool, len(fields))
+	terms := fields[:0]
+
+	for _, field := range fields {
+		if !seen[field] {
+			seen[field] = true
+			terms = append(terms, field)
+		}
+	}
+
+	return terms
+}
+
+func (doc document) terms() []string {
+	return Terms(doc.Name + " " + doc.Email)
+}
+
+func (ti *tenantIndex) put(id string, doc document) {
+	ti.remove(id)
+	ti.docs[id] = doc
+
+	for _, term := range doc.terms() {
+		ids, ok := ti.postings[term]
+		if !ok {
+			ids = map[string]bool{}
+			ti.postings[term] = ids
+
+			for _, gram := range trigrams(term) {
+				if ti.grams[gram] == nil {
+					ti.grams[gram] = map[string]bool{}
+				}
+
+				ti.grams[gram][term] = true
+			}
+		}
+
+		ids[id] = true
+	}
+}
+
+func (ti *tenantIndex) remove(id string) {
+	doc, ok := ti.docs[id]
+	if !ok {
+		return
+	}
+
+	delete(ti.docs, id)
+
+	for _, term := range doc.terms() {
+		ids := ti.postings[term]
+		delete(ids, id)
+
+		if len(ids) > 0 {
+			continue
+		}
+
+		delete(ti.postings, term)
+
+		for _, gram := range trigrams(term) {
+			delete(ti.grams[gram], term)
+
+			if len(ti.grams[gram]) == 0 {
+				delete(ti.grams, gram)
+			}
+		}
+	}
+}
+
+// search scores each user as the sum of how closely each of the query terms
+// matched its closest term, dropping users not matching every query term.
+func (ti *tenantIndex) search(terms []string) []entity.SearchHit {
+	var scores map[string]float64
+
+	for _, queryTerm := range terms {
+		matched := map[string]float64{}
+
+		for term := range ti.candidates(queryTerm) {
+			score := matchScore(queryTerm, term)
+			if score == 0 {
+				continue
+			}
+
+			for id := range ti.postings[term] {
+				if score > matched[id] {
+					matched[id] = score
+				}
+			}
+		}
+
+		if scores == nil {
+			scores = matched
+
+			continue
+		}
+
+		for id, score := range scores {
+			if best, ok := matched[id]; ok {
+				scores[id] = score + best
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+
+	hits := make([]entity.SearchHit, 0, len(scores))
+	for id, score := range scores {
+		hits = append(hits, entity.SearchHit{Id: id, Score: score})
+	}
+
+	// ties are broken by id, so that paging through equal scores is stable
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+
+		return hits[i].Id < hits[j].Id
+	})
+
+	return hits
+}
+
+// candidates returns the indexed terms sharing a trigram with the query
+// term, any term within the allowed edits or having it as a prefix shares
+// at least one.
+func (ti *tenantIndex) candidates(queryTerm string) map[string]bool {
+	terms := map[string]bool{}
+
+	for _, gram := range trigrams(queryTerm) {
+		for term := range ti.grams[gram] {
+			terms[term] = true
+		}
+	}
+
+	return terms
+}
+
+// matchScore rates how closely the indexed term matches the query term, 1
+// for the same term, above 0.5 for a term starting with it and up to 0.5
+// for a term within the allowed edits of it. It is 0 for any other term.
+func matchScore(queryTerm, term string) float64 {
+	if queryTerm == term {
+		return 1
+	}
+
+	query, indexed := []rune(queryTerm), []rune(term)
+
+	if strings.HasPrefix(term, queryTerm) {
+		return 0.5 + 0.4*float64(len(query))/float64(len(indexed))
+	}
+
+	edits := maxEdits(len(query))
+	if edits == 0 {
+		return 0
+	}
+
+	distance := editDistance(query, indexed, edits)
+	if distance > edits {
+		return 0
+	}
+
+	return 0.5 * (1 - float64(distance)/float64(len(query)+1))
+}
+
+// maxEdits allows more edits in longer terms, short terms would otherwise
+// match almost anything.
+func maxEdits(length int) int {
+	switch {
+	case length <= 2:
+		return 0
+	case length <= 5:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// editDistance returns the Levenshtein distance between the terms, or any
+// value above limit once it is certain to exceed it.
+func editDistance(a, b []rune, limit int) int {
+	if diff := len(a) - len(b); diff > limit || -diff > limit {
+		return limit + 1
+	}
+
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		rowMin := current[0]
+
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+
+			if current[j] < rowMin {
+				rowMin = current[j]
+			}
+		}
+
+		if rowMin > limit {
+			return limit + 1
+		}
+
+		previous, current = current, previous
+	}
+
+	return previous[len(b)]
+}
+
+func min(values ...int) int {
+	lowest := values[0]
+
+	for _, value := range values[1:] {
+		if value < lowest {
+			lowest = value
+		}
+	}
+
+	return lowest
+}
+
+// trigrams returns the trigrams of the term padded as by pg_trgm, with two
+// spaces before and one after so that the start of the term carries the
+// most weight.
+func trigrams(term string) []string {
+	padded := []rune("  " + term + " ")
+	grams := make([]string, 0, len(padded)-2)
+
+	for i := 0; i+3 <= len(padded); i++ {
+		grams = append(grams, string(padded[i:i+3]))
+	}
+
+	return grams
+}
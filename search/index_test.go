@@ -0,0 +1,192 @@
+package search_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/electrofelix/gin-demo/entity"
+	"github.com/electrofelix/gin-demo/search"
+)
+
+func setupIndex(t *testing.T) *search.Index {
+	index := search.NewIndex()
+
+	for _, user := range []entity.User{
+		{Id: "1", TenantId: entity.DefaultTenant, Name: "John Smith", Email: "john.smith@example.com"},
+		{Id: "2", TenantId: entity.DefaultTenant, Name: "Jon Smyth", Email: "jsmyth@example.com"},
+		{Id: "3", TenantId: entity.DefaultTenant, Name: "Jane Doe", Email: "jane@example.org"},
+		{Id: "4", TenantId: "acme", Name: "John Smith", Email: "john@acme.example.com"},
+	} {
+		index.Put(user)
+	}
+
+	return index
+}
+
+func hitIds(hits []entity.SearchHit) []string {
+	ids := make([]string, len(hits))
+	for idx, hit := range hits {
+		ids[idx] = hit.Id
+	}
+
+	return ids
+}
+
+func TestIndex_Search(t *testing.T) {
+	t.Run("fuzzy", func(t *testing.T) {
+		index := setupIndex(t)
+
+		hits, cursor, err := index.Search(entity.DefaultTenant, "jon smth", entity.ListOptions{})
+		require.NoError(t, err)
+
+		assert.ElementsMatch(t, []string{"1", "2"}, hitIds(hits))
+		assert.Empty(t, cursor)
+	})
+
+	t.Run("exact-ranked-first", func(t *testing.T) {
+		index := setupIndex(t)
+
+		hits, _, err := index.Search(entity.DefaultTenant, "John Smith", entity.ListOptions{})
+		require.NoError(t, err)
+
+		require.Equal(t, []string{"1", "2"}, hitIds(hits))
+		assert.Greater(t, hits[0].Score, hits[1].Score)
+	})
+
+	t.Run("prefix", func(t *testing.T) {
+		index := setupIndex(t)
+
+		hits, _, err := index.Search(entity.DefaultTenant, "ja", entity.ListOptions{})
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{"3"}, hitIds(hits))
+	})
+
+	t.Run("all-terms-required", func(t *testing.T) {
+		index := setupIndex(t)
+
+		hits, _, err := index.Search(entity.DefaultTenant, "jane smith", entity.ListOptions{})
+		require.NoError(t, err)
+
+		assert.Empty(t, hits)
+	})
+
+	t.Run("tenant", func(t *testing.T) {
+		index := setupIndex(t)
+
+		hits, _, err := index.Search("acme", "john", entity.ListOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"4"}, hitIds(hits))
+
+		hits, _, err = index.Search("other", "john", entity.ListOptions{})
+		require.NoError(t, err)
+		assert.Empty(t, hits)
+	})
+
+	t.Run("empty-query", func(t *testing.T) {
+		index := setupIndex(t)
+
+		_, _, err := index.Search(entity.DefaultTenant, " @. ", entity.ListOptions{})
+		assert.ErrorIs(t, err, entity.ErrQueryInvalid)
+	})
+
+	t.Run("pagination", func(t *testing.T) {
+		index := setupIndex(t)
+
+		first, cursor, err := index.Search(entity.DefaultTenant, "example", entity.ListOptions{Limit: 2})
+		require.NoError(t, err)
+		require.Len(t, first, 2)
+		require.NotEmpty(t, cursor)
+
+		second, next, err := index.Search(entity.DefaultTenant, "example", entity.ListOptions{Limit: 2, Cursor: cursor})
+		require.NoError(t, err)
+		assert.Empty(t, next)
+
+		assert.ElementsMatch(t, []string{"1", "2", "3"}, append(hitIds(first), hitIds(second)...))
+	})
+
+	t.Run("cursor-of-other-query", func(t *testing.T) {
+		index := setupIndex(t)
+
+		_, cursor, err := index.Search(entity.DefaultTenant, "example", entity.ListOptions{Limit: 1})
+		require.NoError(t, err)
+		require.NotEmpty(t, cursor)
+
+		_, _, err = index.Search(entity.DefaultTenant, "john", entity.ListOptions{Limit: 1, Cursor: cursor})
+		assert.ErrorIs(t, err, entity.ErrCursorInvalid)
+	})
+
+	t.Run("bad-cursor", func(t *testing.T) {
+		index := setupIndex(t)
+
+		_, _, err := index.Search(entity.DefaultTenant, "john", entity.ListOptions{Cursor: "not-a-cursor"})
+		assert.ErrorIs(t, err, entity.ErrCursorInvalid)
+	})
+}
+
+func TestIndex_Put(t *testing.T) {
+	t.Run("replaces", func(t *testing.T) {
+		index := setupIndex(t)
+
+		index.Put(entity.User{Id: "3", TenantId: entity.DefaultTenant, Name: "Jane Brown", Email: "jane@example.org"})
+
+		hits, _, err := index.Search(entity.DefaultTenant, "doe", entity.ListOptions{})
+		require.NoError(t, err)
+		assert.Empty(t, hits)
+
+		hits, _, err = index.Search(entity.DefaultTenant, "brown", entity.ListOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"3"}, hitIds(hits))
+	})
+
+	t.Run("deleted", func(t *testing.T) {
+		index := setupIndex(t)
+
+		now := time.Now()
+		index.Put(entity.User{Id: "3", TenantId: entity.DefaultTenant, Name: "Jane Doe", DeletedAt: &now})
+
+		hits, _, err := index.Search(entity.DefaultTenant, "jane", entity.ListOptions{})
+		require.NoError(t, err)
+		assert.Empty(t, hits)
+		assert.Equal(t, 2, index.Len(entity.DefaultTenant))
+	})
+}
+
+func TestIndex_Replace(t *testing.T) {
+	index := setupIndex(t)
+
+	index.Replace(entity.DefaultTenant, []entity.User{
+		{Id: "5", TenantId: entity.DefaultTenant, Name: "Ann Other", Email: "ann@example.com"},
+	})
+
+	hits, _, err := index.Search(entity.DefaultTenant, "example", entity.ListOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"5"}, hitIds(hits))
+
+	// other tenants are left as they were
+	assert.Equal(t, 1, index.Len("acme"))
+}
+
+func TestIndex_SaveFile(t *testing.T) {
+	index := setupIndex(t)
+	path := filepath.Join(t.TempDir(), "search.json")
+
+	require.NoError(t, index.SaveFile(path))
+
+	loaded := search.NewIndex()
+	require.NoError(t, loaded.LoadFile(path))
+
+	for _, tenant := range []string{entity.DefaultTenant, "acme"} {
+		want, _, err := index.Search(tenant, "jon smth", entity.ListOptions{})
+		require.NoError(t, err)
+
+		got, _, err := loaded.Search(tenant, "jon smth", entity.ListOptions{})
+		require.NoError(t, err)
+
+		assert.Equal(t, want, got)
+	}
+}
@@ -0,0 +1,89 @@
+package search
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// snapshotVersion is bumped whenever the snapshot format changes, snapshots
+// of any other version are rejected so that they are rebuilt.
+const snapshotVersion = 1
+
+// snapshot holds the fields of the users indexed by tenant and id, the
+// postings are rebuilt from them on load rather than stored.
+type snapshot struct {
+	Version int                            `json:"version"`
+	Tenants map[string]map[string]document `json:"tenants"`
+}
+
+// SaveFile writes the users indexed to the file, replacing it in one step
+// so that it is never seen half written. The file holds the names and
+// emails of the users in the clear.
+func (idx *Index) SaveFile(path string) error {
+	idx.mu.RLock()
+	snap := snapshot{Version: snapshotVersion, Tenants: make(map[string]map[string]document, len(idx.tenants))}
+
+	for tenant, ti := range idx.tenants {
+		docs := make(map[string]document, len(ti.docs))
+		for id, doc := range ti.docs {
+			docs[id] = doc
+		}
+
+		snap.Tenants[tenant] = docs
+	}
+	idx.mu.RUnlock()
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// LoadFile replaces the users indexed with those saved to the file by
+// SaveFile.
+func (idx *Index) LoadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var snap snapshot
+
+	err = json.Unmarshal(data, &snap)
+	if err != nil {
+		return fmt.Errorf("invalid search index file %s: %w", path, err)
+	}
+
+	if snap.Version != snapshotVersion {
+		return fmt.Errorf("search index file %s has version %d, expected %d", path, snap.Version, snapshotVersion)
+	}
+
+	tenants := make(map[string]*tenantIndex, len(snap.Tenants))
+
+	for tenant, docs := range snap.Tenants {
+		ti := newTenantIndex()
+		for id, doc := range docs {
+			ti.put(id, doc)
+		}
+
+		tenants[tenant] = ti
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.tenants = tenants
+
+	return nil
+}
@@ -9,6 +9,8 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 )
 
@@ -17,17 +19,20 @@ type Controller interface {
 }
 
 type Server struct {
-	address string
-	logger  *logrus.Logger
-	router  *gin.Engine
+	address        string
+	gatherer       prometheus.Gatherer
+	logger         *logrus.Logger
+	router         *gin.Engine
+	trustedProxies []string
 }
 
 type Option func(*Server)
 
 func New(options ...Option) *Server {
 	s := Server{
-		address: ":8080",
-		logger:  logrus.StandardLogger(),
+		address:  ":8080",
+		gatherer: prometheus.DefaultGatherer,
+		logger:   logrus.StandardLogger(),
 	}
 
 	for _, opt := range options {
@@ -39,6 +44,16 @@ func New(options ...Option) *Server {
 	// provided at this point.
 	s.router = gin.Default()
 
+	// gin trusts the X-Forwarded-For of any client unless told otherwise,
+	// which would let clients choose the address recorded for them
+	if err := s.router.SetTrustedProxies(s.trustedProxies); err != nil {
+		s.logger.Errorf("ignoring invalid trusted proxies, trusting none: %v", err)
+
+		_ = s.router.SetTrustedProxies(nil)
+	}
+
+	s.router.GET("/metrics", gin.WrapH(promhttp.HandlerFor(s.gatherer, promhttp.HandlerOpts{})))
+
 	return &s
 }
 
@@ -54,6 +69,23 @@ func WithAddress(addr string) Option {
 	}
 }
 
+// WithTrustedProxies sets the addresses or CIDRs of the proxies whose
+// X-Forwarded-For and X-Real-IP headers are trusted for the client address,
+// by default none are and the address of the connection is used.
+func WithTrustedProxies(proxies ...string) Option {
+	return func(s *Server) {
+		s.trustedProxies = proxies
+	}
+}
+
+// WithMetricsGatherer sets where the metrics served at /metrics are gathered
+// from, by default the global Prometheus registry.
+func WithMetricsGatherer(g prometheus.Gatherer) Option {
+	return func(s *Server) {
+		s.gatherer = g
+	}
+}
+
 func (s *Server) GetRouter() gin.IRouter {
 	return s.router
 }
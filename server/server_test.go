@@ -2,9 +2,13 @@ package server_test
 
 import (
 	"context"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
@@ -30,3 +34,67 @@ func TestServer_Start(t *testing.T) {
 		assert.Equal(t, "Shutdown complete", hook.LastEntry().Message)
 	})
 }
+
+func TestServer_Metrics(t *testing.T) {
+	t.Run("serves-gathered", func(t *testing.T) {
+		registry := prometheus.NewRegistry()
+		counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_requests_total", Help: "test counter"})
+		registry.MustRegister(counter)
+		counter.Inc()
+
+		s := server.New(server.WithMetricsGatherer(registry))
+
+		req, err := http.NewRequest("GET", "/metrics", nil)
+		require.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		s.GetRouter().(http.Handler).ServeHTTP(recorder, req)
+
+		assert.Equal(t, 200, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "test_requests_total 1")
+	})
+}
+
+func TestServer_ClientIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []server.Option
+		want    string
+	}{
+		{
+			name: "forwarded-for-ignored",
+			want: "192.0.2.1",
+		},
+		{
+			name:    "trusted-proxy",
+			options: []server.Option{server.WithTrustedProxies("192.0.2.0/24")},
+			want:    "198.51.100.7",
+		},
+		{
+			name:    "untrusted-proxy",
+			options: []server.Option{server.WithTrustedProxies("10.0.0.0/8")},
+			want:    "192.0.2.1",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			s := server.New(tt.options...)
+			s.GetRouter().GET("/ip", func(ctx *gin.Context) {
+				ctx.String(200, ctx.ClientIP())
+			})
+
+			req, err := http.NewRequest("GET", "/ip", nil)
+			require.NoError(t, err)
+			req.RemoteAddr = "192.0.2.1:1234"
+			req.Header.Set("X-Forwarded-For", "198.51.100.7")
+
+			recorder := httptest.NewRecorder()
+			s.GetRouter().(http.Handler).ServeHTTP(recorder, req)
+
+			assert.Equal(t, tt.want, recorder.Body.String())
+		})
+	}
+}
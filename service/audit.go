@@ -0,0 +1,86 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/electrofelix/gin-demo/entity"
+)
+
+// unknownActor is recorded when changes are made without an actor having
+// been associated with the context.
+const unknownActor = "unknown"
+
+type actorKey struct{}
+
+// WithActor returns a context identifying who is performing the request, to
+// be recorded in the audit trail of any users changed.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+func actorFromContext(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok && actor != "" {
+		return actor
+	}
+
+	return unknownActor
+}
+
+func newAuditEntry(ctx context.Context, action string, before, after *entity.User) entity.AuditEntry {
+	return entity.AuditEntry{
+		UserId:    after.Id,
+		Timestamp: time.Now().UTC(),
+		Actor:     actorFromContext(ctx),
+		Action:    action,
+		Changes:   userChanges(before, after),
+	}
+}
+
+// userChanges compares the fields that can be modified through the API, the
+// password is only ever recorded as having changed.
+func userChanges(before, after *entity.User) map[string]entity.AuditChange {
+	if before == nil {
+		before = &entity.User{}
+	}
+
+	changes := map[string]entity.AuditChange{}
+
+	if before.Email != after.Email {
+		changes["email"] = entity.AuditChange{Old: before.Email, New: after.Email}
+	}
+
+	if before.Name != after.Name {
+		changes["name"] = entity.AuditChange{Old: before.Name, New: after.Name}
+	}
+
+	if before.Password != after.Password {
+		changes["password"] = entity.AuditChange{Old: redact(before.Password), New: redact(after.Password)}
+	}
+
+	if (before.DeletedAt == nil) != (after.DeletedAt == nil) {
+		changes["deleted_at"] = entity.AuditChange{Old: formatTime(before.DeletedAt), New: formatTime(after.DeletedAt)}
+	}
+
+	if len(changes) == 0 {
+		return nil
+	}
+
+	return changes
+}
+
+func redact(value string) string {
+	if value == "" {
+		return ""
+	}
+
+	return entity.AuditRedacted
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+
+	return t.UTC().Format(time.RFC3339Nano)
+}
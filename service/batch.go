@@ -0,0 +1,208 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/rs/xid"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/electrofelix/gin-demo/entity"
+)
+
+const (
+	// MaxBatchSize is the most users that may be created in a single batch.
+	MaxBatchSize = 1000
+	// MaxBatchGetSize is the most ids that may be requested in a single
+	// batch get.
+	MaxBatchGetSize = 100
+)
+
+// CreateBatch creates the users, returning a result for every user in the
+// same order. Users that are invalid or share an email, ignoring case, with
+// an earlier user of the batch are not written, passwords of the remainder
+// are hashed in parallel before they are stored.
+func (us *UserService) CreateBatch(ctx context.Context, tenant string, users []entity.User) ([]entity.BatchResult, error) {
+	if err := us.validateTenant(tenant); err != nil {
+		return nil, err
+	}
+
+	if len(users) > MaxBatchSize {
+		return nil, entity.ErrBatchTooLarge
+	}
+
+	results := make([]entity.BatchResult, len(users))
+	seen := map[string]bool{}
+	pending := make([]int, 0, len(users))
+
+	for idx := range users {
+		user := &users[idx]
+		user.Email = strings.TrimSpace(user.Email)
+		results[idx] = entity.BatchResult{Row: idx + 1, Email: user.Email}
+
+		email := entity.CanonicalEmail(user.Email)
+
+		switch {
+		case user.Email == "" || user.Name == "" || user.Password == "":
+			results[idx].Status = entity.BatchStatusInvalid
+			results[idx].Error = entity.ErrUserInvalid.Error()
+		case seen[email]:
+			results[idx].Status = entity.BatchStatusDuplicate
+			results[idx].Error = entity.ErrEmailDuplicate.Error()
+		default:
+			seen[email] = true
+			pending = append(pending, idx)
+		}
+	}
+
+	hashErrs := us.hashPasswords(users, pending)
+
+	created := make([]*entity.User, 0, len(pending))
+	audit := make([]entity.AuditEntry, 0, len(pending))
+	createdIdx := make([]int, 0, len(pending))
+
+	for _, idx := range pending {
+		if hashErrs[idx] != nil {
+			us.logger.Errorf("failed to encrypted password text for new user: %s\n", users[idx].Email)
+
+			results[idx].Status = entity.BatchStatusFailed
+			results[idx].Error = entity.ErrInternalError.Error()
+
+			continue
+		}
+
+		user := &users[idx]
+		user.Id = xid.New().String()
+		user.TenantId = tenant
+		user.DeletedAt = nil
+
+		created = append(created, user)
+		audit = append(audit, newAuditEntry(ctx, entity.AuditActionCreate, nil, user))
+		createdIdx = append(createdIdx, idx)
+	}
+
+	if len(created) == 0 {
+		return results, nil
+	}
+
+	for pos, err := range us.store.CreateBatch(ctx, created, audit) {
+		result := &results[createdIdx[pos]]
+
+		switch {
+		case err == nil:
+			result.Status = entity.BatchStatusCreated
+			result.Id = created[pos].Id
+
+			us.indexUser(tenant, created[pos])
+		case errors.Is(err, entity.ErrEmailDuplicate):
+			result.Status = entity.BatchStatusDuplicate
+			result.Error = err.Error()
+		default:
+			us.logger.Errorf("failed to create user '%s' in batch: %v", created[pos].Email, err)
+
+			result.Status = entity.BatchStatusFailed
+			result.Error = internalError(err).Error()
+		}
+	}
+
+	return results, nil
+}
+
+// GetMany returns the users with the given ids in the order requested, along
+// with the ids that are invalid or have no user. Repeated ids are returned
+// once.
+func (us *UserService) GetMany(ctx context.Context, tenant string, ids []string) (entity.UserBatch, error) {
+	if err := us.validateTenant(tenant); err != nil {
+		return entity.UserBatch{}, err
+	}
+
+	if len(ids) > MaxBatchGetSize {
+		return entity.UserBatch{}, entity.ErrBatchTooLarge
+	}
+
+	seen := make(map[string]bool, len(ids))
+	unique := make([]string, 0, len(ids))
+	valid := make([]string, 0, len(ids))
+
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+
+		seen[id] = true
+		unique = append(unique, id)
+
+		if validateId(id) == nil {
+			valid = append(valid, id)
+		}
+	}
+
+	found := map[string]entity.User{}
+
+	if len(valid) > 0 {
+		users, err := us.store.GetMany(ctx, tenant, valid)
+		if err != nil {
+			us.logger.Errorf("failed to get batch of %d users: %v", len(valid), err)
+
+			return entity.UserBatch{}, internalError(err)
+		}
+
+		for _, user := range users {
+			if user.DeletedAt == nil {
+				user.Password = ""
+				found[user.Id] = user
+			}
+		}
+	}
+
+	batch := entity.UserBatch{Users: []entity.User{}, Missing: []string{}}
+
+	for _, id := range unique {
+		if user, ok := found[id]; ok {
+			batch.Users = append(batch.Users, user)
+		} else {
+			batch.Missing = append(batch.Missing, id)
+		}
+	}
+
+	return batch, nil
+}
+
+// hashPasswords replaces the password of each of the indexed users with its
+// hash using a pool of workers, returning any errors by index of user.
+func (us *UserService) hashPasswords(users []entity.User, indexes []int) []error {
+	errs := make([]error, len(users))
+	work := make(chan int)
+
+	var wg sync.WaitGroup
+
+	for worker := 0; worker < us.hashWorkers; worker++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for idx := range work {
+				password, err := bcrypt.GenerateFromPassword([]byte(users[idx].Password), bcrypt.MinCost)
+				if err != nil {
+					errs[idx] = err
+
+					continue
+				}
+
+				users[idx].Password = string(password)
+			}
+		}()
+	}
+
+	for _, idx := range indexes {
+		work <- idx
+	}
+
+	close(work)
+	wg.Wait()
+
+	return errs
+}
@@ -0,0 +1,166 @@
+package service
+
+import (
+	"context"
+	"sort"
+
+	"github.com/electrofelix/gin-demo/entity"
+)
+
+// maxQueryLength bounds the length of search queries, matching the longest
+// prefix accepted by List.
+const maxQueryLength = maxPrefixLength
+
+// SearchIndex ranks the users of a tenant by how closely they match a query.
+// The index only sees writes made through the service, so is rebuilt from
+// the store by Reindex to pick up users written by other processes.
+type SearchIndex interface {
+	Put(user entity.User)
+	Remove(tenant, id string)
+	Replace(tenant string, users []entity.User)
+	Search(tenant, query string, opts entity.ListOptions) ([]entity.SearchHit, string, error)
+}
+
+// WithSearchIndex enables Search, keeping the index updated with every user
+// written by the service.
+func WithSearchIndex(index SearchIndex) Option {
+	return func(us *UserService) {
+		us.search = index
+	}
+}
+
+// Search returns a page of the users matching the query, closest matches
+// first. Users written since they were indexed are returned as stored, and
+// any removed since are left out, so pages may be shorter than the limit.
+func (us *UserService) Search(ctx context.Context, tenant, query string, opts entity.ListOptions) (entity.SearchPage, error) {
+	if err := us.validateTenant(tenant); err != nil {
+		return entity.SearchPage{}, err
+	}
+
+	if us.search == nil {
+		return entity.SearchPage{}, entity.ErrSearchDisabled
+	}
+
+	if len(query) > maxQueryLength {
+		return entity.SearchPage{}, entity.ErrQueryInvalid
+	}
+
+	if opts.Limit == 0 {
+		opts.Limit = defaultPageLimit
+	}
+
+	// results are read with GetMany, which is limited to smaller batches
+	// than a page of List
+	if opts.Limit < 0 || opts.Limit > MaxBatchGetSize {
+		return entity.SearchPage{}, entity.ErrLimitInvalid
+	}
+
+	hits, cursor, err := us.search.Search(tenant, query, opts)
+	if err != nil {
+		return entity.SearchPage{}, err
+	}
+
+	page := entity.SearchPage{Results: []entity.SearchResult{}, NextCursor: cursor}
+
+	if len(hits) == 0 {
+		return page, nil
+	}
+
+	ids := make([]string, len(hits))
+	for idx, hit := range hits {
+		ids[idx] = hit.Id
+	}
+
+	users, err := us.store.GetMany(ctx, tenant, ids)
+	if err != nil {
+		us.logger.Errorf("failed to get %d users found by search: %v", len(ids), err)
+
+		return entity.SearchPage{}, internalError(err)
+	}
+
+	found := make(map[string]entity.User, len(users))
+	for _, user := range users {
+		if user.DeletedAt == nil {
+			user.Password = ""
+			found[user.Id] = user
+		}
+	}
+
+	for _, hit := range hits {
+		if user, ok := found[hit.Id]; ok {
+			page.Results = append(page.Results, entity.SearchResult{User: user, Score: hit.Score})
+		}
+	}
+
+	return page, nil
+}
+
+// Reindex rebuilds the search index from the users of every tenant in the
+// store, returning the number of users indexed. Each tenant is swapped in
+// once read, writes made by the service while it is read may be missed
+// until the next rebuild.
+func (us *UserService) Reindex(ctx context.Context) (int, error) {
+	if us.search == nil {
+		return 0, entity.ErrSearchDisabled
+	}
+
+	tenants := make([]string, 0, len(us.tenants))
+	for tenant := range us.tenants {
+		tenants = append(tenants, tenant)
+	}
+
+	sort.Strings(tenants)
+
+	indexed := 0
+
+	for _, tenant := range tenants {
+		opts := entity.ListOptions{Limit: maxPageLimit}
+		users := []entity.User{}
+
+		for {
+			page, err := us.store.List(ctx, tenant, opts)
+			if err != nil {
+				us.logger.Errorf("failed to list users of tenant %s to index: %v", tenant, err)
+
+				return indexed, err
+			}
+
+			for idx := range page.Users {
+				page.Users[idx].TenantId = tenant
+			}
+
+			users = append(users, page.Users...)
+
+			if page.NextCursor == "" {
+				break
+			}
+
+			opts.Cursor = page.NextCursor
+		}
+
+		us.search.Replace(tenant, users)
+		indexed += len(users)
+	}
+
+	return indexed, nil
+}
+
+// indexUser updates the search index with a user of the tenant written to
+// the store.
+func (us *UserService) indexUser(tenant string, user *entity.User) {
+	if us.search == nil {
+		return
+	}
+
+	if user.DeletedAt != nil {
+		us.search.Remove(tenant, user.Id)
+
+		return
+	}
+
+	indexed := *user
+	indexed.TenantId = tenant
+	indexed.Password = ""
+
+	us.search.Put(indexed)
+}
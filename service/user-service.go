@@ -5,6 +5,9 @@ package service
 import (
 	"context"
 	"errors"
+	"runtime"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/rs/xid"
@@ -14,27 +17,70 @@ import (
 	"github.com/electrofelix/gin-demo/entity"
 )
 
+// UserStore persists users, any audit entries passed to a write are recorded
+// atomically with the change to the user. Users are partitioned by tenant,
+// taken from the TenantId of users written and given before the Id or email
+// of those read, so that no user is visible to any other tenant. The password
+// of a user written is kept as its Credentials, which are never returned
+// with the user and are only replaced when the user has a password.
 type UserStore interface {
-	Create(context.Context, *entity.User) error
-	Delete(context.Context, string) error
-	GetByEmail(context.Context, string) (*entity.User, error)
-	GetById(context.Context, string) (*entity.User, error)
-	List(context.Context) ([]entity.User, error)
-	Put(context.Context, *entity.User) error
-	Update(context.Context, *entity.User) error
+	Create(context.Context, *entity.User, ...entity.AuditEntry) error
+	CreateBatch(context.Context, []*entity.User, []entity.AuditEntry) []error
+	GetByEmail(context.Context, string, string) (*entity.User, error)
+	GetById(context.Context, string, string) (*entity.User, error)
+	GetCredentials(context.Context, string, string) (*entity.Credentials, error)
+	GetMany(context.Context, string, []string) ([]entity.User, error)
+	List(context.Context, string, entity.ListOptions) (entity.UserPage, error)
+	ListAudit(context.Context, string, string, entity.ListOptions) (entity.AuditPage, error)
+	Purge(context.Context, *entity.User) error
+	PutCredentials(context.Context, string, string, int64, *entity.Credentials, ...entity.AuditEntry) error
+	RecordLogin(context.Context, string, string, entity.Login, ...entity.AuditEntry) error
+	Update(context.Context, *entity.User, ...entity.AuditEntry) error
 }
 
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+	// maxPrefixLength bounds the prefix filters of List, no longer value
+	// can match a stored email or name.
+	maxPrefixLength = 256
+
+	// DefaultDeleteGracePeriod is how long a deleted user may be restored
+	// and keeps its email reserved before being purged.
+	DefaultDeleteGracePeriod = 30 * 24 * time.Hour
+
+	// DefaultMaxFailedLogins is how many failed logins in a row lock a user
+	// out for the DefaultLockoutPeriod.
+	DefaultMaxFailedLogins = 5
+	DefaultLockoutPeriod   = 15 * time.Minute
+
+	// failedLoginAttempts bounds the retries of counting a failed login
+	// against concurrent changes of the credentials.
+	failedLoginAttempts = 3
+)
+
 type UserService struct {
-	store  UserStore
-	logger *logrus.Logger
+	store           UserStore
+	search          SearchIndex
+	tenants         map[string]bool
+	gracePeriod     time.Duration
+	maxFailedLogins int64
+	lockoutPeriod   time.Duration
+	hashWorkers     int
+	logger          *logrus.Logger
 }
 
 type Option func(*UserService)
 
 func New(store UserStore, options ...Option) *UserService {
 	us := &UserService{
-		store:  store,
-		logger: logrus.StandardLogger(),
+		store:           store,
+		tenants:         map[string]bool{entity.DefaultTenant: true},
+		gracePeriod:     DefaultDeleteGracePeriod,
+		maxFailedLogins: DefaultMaxFailedLogins,
+		lockoutPeriod:   DefaultLockoutPeriod,
+		hashWorkers:     runtime.NumCPU(),
+		logger:          logrus.StandardLogger(),
 	}
 
 	for _, opt := range options {
@@ -44,9 +90,54 @@ func New(store UserStore, options ...Option) *UserService {
 	return us
 }
 
-func (us *UserService) Create(ctx context.Context, user entity.User) (entity.User, error) {
+func WithDeleteGracePeriod(d time.Duration) Option {
+	return func(us *UserService) {
+		us.gracePeriod = d
+	}
+}
+
+// WithLockout sets how many failed logins in a row lock a user out, and for
+// how long each failed login after that keeps them locked out.
+func WithLockout(maxFailedLogins int64, period time.Duration) Option {
+	return func(us *UserService) {
+		us.maxFailedLogins = maxFailedLogins
+		us.lockoutPeriod = period
+	}
+}
+
+// WithTenants sets the tenants requests may be made for, replacing the
+// entity.DefaultTenant which is otherwise the only tenant.
+func WithTenants(tenants ...string) Option {
+	return func(us *UserService) {
+		us.tenants = make(map[string]bool, len(tenants))
+		for _, tenant := range tenants {
+			us.tenants[tenant] = true
+		}
+	}
+}
+
+// WithHashWorkers sets how many passwords are hashed in parallel when
+// creating a batch of users, defaults to the number of CPUs.
+func WithHashWorkers(n int) Option {
+	return func(us *UserService) {
+		if n > 0 {
+			us.hashWorkers = n
+		}
+	}
+}
+
+func (us *UserService) Create(ctx context.Context, tenant string, user entity.User) (entity.User, error) {
+	if err := us.validateTenant(tenant); err != nil {
+		return entity.User{}, err
+	}
+
 	// create the new user id
 	user.Id = xid.New().String()
+	user.TenantId = tenant
+	user.DeletedAt = nil
+	// the email is kept as given for display, stores determine uniqueness
+	// from entity.CanonicalEmail
+	user.Email = strings.TrimSpace(user.Email)
 
 	password, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.MinCost)
 	if err != nil {
@@ -57,46 +148,64 @@ func (us *UserService) Create(ctx context.Context, user entity.User) (entity.Use
 
 	user.Password = string(password)
 
-	err = us.store.Create(ctx, &user)
+	err = us.store.Create(ctx, &user, newAuditEntry(ctx, entity.AuditActionCreate, nil, &user))
 	if err != nil {
 		return entity.User{}, err
 	}
 
+	us.indexUser(tenant, &user)
 	user.Password = ""
 
 	return user, nil
 }
 
-func (us *UserService) Delete(ctx context.Context, id string) (entity.User, error) {
-	user, err := us.Get(ctx, id)
+// Delete marks the user as deleted, hiding it from Get and List while
+// keeping the email reserved so that it can be restored until purged.
+func (us *UserService) Delete(ctx context.Context, tenant, id string) (entity.User, error) {
+	if err := us.validate(tenant, id); err != nil {
+		return entity.User{}, err
+	}
+
+	user, err := us.store.GetById(ctx, tenant, id)
 	if err != nil {
 		us.logger.Errorf("error retrieving item before delete: %v", err)
 
 		return entity.User{}, err
 	}
 
-	// Should exist at this point, thought something else may have deleted
-	// it. For audit purposes would be better to mark deleted initially before
-	// removal, or scrub the password in case it's still referenced by something
-	// else
-	err = us.store.Delete(ctx, id)
+	if user.DeletedAt != nil {
+		return entity.User{}, entity.ErrNotFound
+	}
+
+	before := *user
+	now := time.Now().UTC()
+	user.DeletedAt = &now
+
+	err = us.store.Update(ctx, user, newAuditEntry(ctx, entity.AuditActionDelete, &before, user))
 	if err != nil {
 		return entity.User{}, err
 	}
 
-	return user, nil
+	us.indexUser(tenant, user)
+	user.Password = ""
+
+	return *user, nil
 }
 
-func (us *UserService) Get(ctx context.Context, id string) (entity.User, error) {
-	if err := validateId(id); err != nil {
+func (us *UserService) Get(ctx context.Context, tenant, id string) (entity.User, error) {
+	if err := us.validate(tenant, id); err != nil {
 		return entity.User{}, err
 	}
 
-	user, err := us.store.GetById(ctx, id)
+	user, err := us.store.GetById(ctx, tenant, id)
 	if err != nil {
 		return entity.User{}, err
 	}
 
+	if user.DeletedAt != nil {
+		return entity.User{}, entity.ErrNotFound
+	}
+
 	respUser := *user
 	// technically the task didn't specify whether Password needs to be
 	// protected, just assuming that it's probably a good idea
@@ -108,44 +217,192 @@ func (us *UserService) Get(ctx context.Context, id string) (entity.User, error)
 	return respUser, nil
 }
 
-func (us *UserService) List(ctx context.Context) ([]entity.User, error) {
-	users, err := us.store.List(ctx)
+func (us *UserService) List(ctx context.Context, tenant string, opts entity.ListOptions) (entity.UserPage, error) {
+	if err := us.validateTenant(tenant); err != nil {
+		return entity.UserPage{}, err
+	}
+
+	if opts.Limit == 0 {
+		opts.Limit = defaultPageLimit
+	}
+
+	if opts.Limit < 0 || opts.Limit > maxPageLimit {
+		return entity.UserPage{}, entity.ErrLimitInvalid
+	}
+
+	opts, err := normalizeFilters(opts)
 	if err != nil {
-		return nil, err
+		return entity.UserPage{}, err
+	}
+
+	page, err := us.store.List(ctx, tenant, opts)
+	if err != nil {
+		return entity.UserPage{}, err
 	}
 
 	// ideally return different structures or implement the dynamodb marshal/unmarshal
 	// interface and make password private so that it's not returned by default
-	for idx := 0; idx < len(users); idx++ {
-		users[idx].Password = ""
+	for idx := 0; idx < len(page.Users); idx++ {
+		page.Users[idx].Password = ""
 	}
 
-	return users, nil
+	return page, nil
+}
+
+// normalizeFilters converts the prefixes to the SearchForm the stores match
+// on and rejects filters that could never match.
+func normalizeFilters(opts entity.ListOptions) (entity.ListOptions, error) {
+	opts.EmailPrefix = entity.SearchForm(opts.EmailPrefix)
+	opts.NamePrefix = entity.SearchForm(opts.NamePrefix)
+
+	if len(opts.EmailPrefix) > maxPrefixLength || len(opts.NamePrefix) > maxPrefixLength {
+		return entity.ListOptions{}, entity.ErrFilterInvalid
+	}
+
+	if !opts.LastLoginAfter.IsZero() && !opts.LastLoginBefore.IsZero() &&
+		!opts.LastLoginAfter.Before(opts.LastLoginBefore) {
+		return entity.ListOptions{}, entity.ErrFilterInvalid
+	}
+
+	return opts, nil
+}
+
+// ListAudit returns the audit trail of the user newest first, this remains
+// available after the user has been deleted.
+func (us *UserService) ListAudit(ctx context.Context, tenant, id string, opts entity.ListOptions) (entity.AuditPage, error) {
+	if err := us.validate(tenant, id); err != nil {
+		return entity.AuditPage{}, err
+	}
+
+	if opts.Limit == 0 {
+		opts.Limit = defaultPageLimit
+	}
+
+	if opts.Limit < 0 || opts.Limit > maxPageLimit {
+		return entity.AuditPage{}, entity.ErrLimitInvalid
+	}
+
+	return us.store.ListAudit(ctx, tenant, id, opts)
+}
+
+// Purge permanently removes users of every tenant deleted for longer than the
+// grace period, returning the number of users removed. Users restored or
+// purged by another process while running are skipped.
+func (us *UserService) Purge(ctx context.Context) (int, error) {
+	tenants := make([]string, 0, len(us.tenants))
+	for tenant := range us.tenants {
+		tenants = append(tenants, tenant)
+	}
+
+	sort.Strings(tenants)
+
+	purged := 0
+
+	for _, tenant := range tenants {
+		count, err := us.purgeTenant(ctx, tenant)
+		purged += count
+
+		if err != nil {
+			return purged, err
+		}
+	}
+
+	return purged, nil
+}
+
+func (us *UserService) purgeTenant(ctx context.Context, tenant string) (int, error) {
+	cutoff := time.Now().Add(-us.gracePeriod)
+	opts := entity.ListOptions{Limit: defaultPageLimit, Deleted: true}
+	purged := 0
+
+	for {
+		page, err := us.store.List(ctx, tenant, opts)
+		if err != nil {
+			return purged, err
+		}
+
+		for idx := range page.Users {
+			user := page.Users[idx]
+			user.TenantId = tenant
+
+			if user.DeletedAt == nil || user.DeletedAt.After(cutoff) {
+				continue
+			}
+
+			err := us.store.Purge(ctx, &user)
+			if errors.Is(err, entity.ErrConflict) || errors.Is(err, entity.ErrNotFound) {
+				continue
+			}
+
+			if err != nil {
+				us.logger.Errorf("failed to purge deleted user %s: %v", user.Id, err)
+
+				return purged, err
+			}
+
+			us.indexUser(tenant, &user)
+			purged++
+		}
+
+		if page.NextCursor == "" {
+			return purged, nil
+		}
+
+		opts.Cursor = page.NextCursor
+	}
 }
 
-func (us *UserService) Put(ctx context.Context, user entity.User) (entity.User, error) {
-	if err := validateId(user.Id); err != nil {
+// Restore reverses the deletion of a user that has not yet been purged,
+// restoring a user that is not deleted has no effect.
+func (us *UserService) Restore(ctx context.Context, tenant, id string) (entity.User, error) {
+	if err := us.validate(tenant, id); err != nil {
 		return entity.User{}, err
 	}
 
-	err := us.store.Put(ctx, &user)
+	user, err := us.store.GetById(ctx, tenant, id)
 	if err != nil {
 		return entity.User{}, err
 	}
 
-	return user, nil
+	if user.DeletedAt != nil {
+		before := *user
+		user.DeletedAt = nil
+
+		err = us.store.Update(ctx, user, newAuditEntry(ctx, entity.AuditActionRestore, &before, user))
+		if err != nil {
+			us.logger.Errorf("failed to restore user: %s\n", id)
+
+			return entity.User{}, err
+		}
+
+		us.indexUser(tenant, user)
+	}
+
+	user.Password = ""
+
+	return *user, nil
 }
 
-func (us *UserService) Update(ctx context.Context, id string, user entity.User) (entity.User, error) {
-	if err := validateId(id); err != nil {
+// Update applies the non-empty fields of user to the stored user. A non-zero
+// user.Version must match the stored version, allowing callers to ensure they
+// are modifying the user as they last saw it.
+func (us *UserService) Update(ctx context.Context, tenant, id string, user entity.User) (entity.User, error) {
+	if err := us.validate(tenant, id); err != nil {
 		return entity.User{}, err
 	}
 
-	currentUser, err := us.Get(ctx, id)
+	currentUser, err := us.Get(ctx, tenant, id)
 	if err != nil {
 		return entity.User{}, err
 	}
 
+	if user.Version != 0 && user.Version != currentUser.Version {
+		return entity.User{}, entity.ErrConflict
+	}
+
+	before := currentUser
+	profileChanged := false
+
 	if user.Password != "" {
 		password, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.MinCost)
 		if err != nil {
@@ -158,7 +415,8 @@ func (us *UserService) Update(ctx context.Context, id string, user entity.User)
 	}
 
 	if user.Email != "" {
-		currentUser.Email = user.Email
+		currentUser.Email = strings.TrimSpace(user.Email)
+		profileChanged = profileChanged || currentUser.Email != before.Email
 	}
 
 	// should really have separate structs for requests with pointers for field values to ensure
@@ -166,21 +424,58 @@ func (us *UserService) Update(ctx context.Context, id string, user entity.User)
 	// to unset
 	if user.Name != "" {
 		currentUser.Name = user.Name
+		profileChanged = profileChanged || currentUser.Name != before.Name
+	}
+
+	audit := newAuditEntry(ctx, entity.AuditActionUpdate, &before, &currentUser)
+
+	if !profileChanged && currentUser.Password != "" {
+		// only the password changed, leave the user and its version as is
+		// while still requiring the version read to be current
+		err = us.changePassword(ctx, tenant, currentUser.Id, currentUser.Version, currentUser.Password, audit)
+	} else {
+		err = us.store.Update(ctx, &currentUser, audit)
 	}
 
-	err = us.store.Update(ctx, &currentUser)
 	if err != nil {
 		us.logger.Errorf("failed to store updated user information: %s\n", currentUser.Id)
 		return entity.User{}, err
 	}
 
+	if profileChanged {
+		us.indexUser(tenant, &currentUser)
+	}
+
 	currentUser.Password = ""
 
 	return currentUser, nil
 }
 
-func (us *UserService) ValidateCredentials(ctx context.Context, credentials entity.UserLogin) error {
-	user, err := us.store.GetByEmail(ctx, credentials.Email)
+// changePassword replaces the password hash in the stored credentials of
+// the user, keeping the rest of them, provided neither the user nor its
+// credentials have changed since read, entity.ErrConflict is returned
+// otherwise.
+func (us *UserService) changePassword(
+	ctx context.Context, tenant, id string, version int64, password string, audit entity.AuditEntry,
+) error {
+	credentials, err := us.store.GetCredentials(ctx, tenant, id)
+	if errors.Is(err, entity.ErrNotFound) {
+		credentials = &entity.Credentials{}
+	} else if err != nil {
+		return err
+	}
+
+	credentials.Password = password
+
+	return us.store.PutCredentials(ctx, tenant, id, version, credentials, audit)
+}
+
+func (us *UserService) ValidateCredentials(ctx context.Context, tenant string, credentials entity.UserLogin) error {
+	if err := us.validateTenant(tenant); err != nil {
+		return err
+	}
+
+	user, err := us.store.GetByEmail(ctx, tenant, entity.CanonicalEmail(credentials.Email))
 	if err != nil {
 		if errors.Is(err, entity.ErrNotFound) {
 			return entity.ErrBadCredentials
@@ -188,27 +483,148 @@ func (us *UserService) ValidateCredentials(ctx context.Context, credentials enti
 
 		us.logger.Errorf("failed to retrieve user '%s', unexpected error: %v", credentials.Email, err)
 
-		return entity.ErrInternalError
+		return internalError(err)
+	}
+
+	if user.DeletedAt != nil {
+		return entity.ErrBadCredentials
+	}
+
+	stored, err := us.store.GetCredentials(ctx, tenant, user.Id)
+	if err != nil {
+		if errors.Is(err, entity.ErrNotFound) {
+			return entity.ErrBadCredentials
+		}
+
+		us.logger.Errorf("failed to retrieve credentials of '%s', unexpected error: %v", credentials.Email, err)
+
+		return internalError(err)
+	}
+
+	now := time.Now()
+
+	// a locked out user is refused the same as a wrong password, without
+	// checking the password or counting another failure
+	if stored.LockedUntil != nil && now.Before(*stored.LockedUntil) {
+		return entity.ErrBadCredentials
 	}
 
-	// should move this to a receiver function on the User struct?
-	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(credentials.Password))
+	// should move this to a receiver function on the Credentials struct?
+	err = bcrypt.CompareHashAndPassword([]byte(stored.Password), []byte(credentials.Password))
 	if err != nil {
+		us.recordFailedLogin(ctx, tenant, user.Id, stored, now)
+
 		return entity.ErrBadCredentials
 	}
 
-	user.LastLogin = time.Now()
+	if stored.FailedLogins != 0 || stored.LockedUntil != nil {
+		us.resetFailedLogins(ctx, tenant, user.Id, stored)
+	}
+
+	audit := newAuditEntry(ctx, entity.AuditActionLogin, user, user)
+	// having proven their credentials the user is the actor
+	audit.Actor = user.Email
+
+	login := entity.Login{Time: now, SourceIp: credentials.SourceIp}
+
+	err = us.store.RecordLogin(ctx, tenant, user.Id, login, audit)
+	if errors.Is(err, entity.ErrNotFound) {
+		// the user was purged between reading and recording the login,
+		// not worth failing a valid login over
+		us.logger.Warnf("skipped recording last login for '%s', user removed concurrently", credentials.Email)
+
+		return nil
+	}
 
-	err = us.store.Put(ctx, user)
 	if err != nil {
 		us.logger.Errorf("failed to update user '%s', last login time unexpected error: %v", credentials.Email, err)
 
-		return entity.ErrInternalError
+		return internalError(err)
+	}
+
+	return nil
+}
+
+// recordFailedLogin counts a failed login against the credentials, locking
+// the user out once there have been too many in a row. The credentials are
+// read again should they change concurrently, such as by another failed
+// login, so that no failure goes uncounted.
+func (us *UserService) recordFailedLogin(
+	ctx context.Context, tenant, id string, credentials *entity.Credentials, now time.Time,
+) {
+	for attempt := 1; ; attempt++ {
+		credentials.FailedLogins++
+
+		if credentials.FailedLogins >= us.maxFailedLogins {
+			lockedUntil := now.Add(us.lockoutPeriod)
+			credentials.LockedUntil = &lockedUntil
+		}
+
+		err := us.store.PutCredentials(ctx, tenant, id, 0, credentials)
+		if err == nil {
+			return
+		}
+
+		if !errors.Is(err, entity.ErrConflict) || attempt == failedLoginAttempts {
+			us.logger.Errorf("failed to record failed login of user %s: %v", id, err)
+
+			return
+		}
+
+		credentials, err = us.store.GetCredentials(ctx, tenant, id)
+		if err != nil {
+			us.logger.Errorf("failed to retrieve credentials of user %s: %v", id, err)
+
+			return
+		}
+	}
+}
+
+// resetFailedLogins clears the failed logins of the user after a successful
+// one. A conflict means the credentials were changed concurrently and is
+// not worth failing a valid login over.
+func (us *UserService) resetFailedLogins(ctx context.Context, tenant, id string, credentials *entity.Credentials) {
+	credentials.FailedLogins = 0
+	credentials.LockedUntil = nil
+
+	err := us.store.PutCredentials(ctx, tenant, id, 0, credentials)
+	if err != nil {
+		us.logger.Warnf("failed to reset failed logins of user %s: %v", id, err)
+	}
+}
+
+// internalError hides the details of an unexpected store error from callers,
+// except for entity.ErrUnavailable which tells them to retry later.
+func internalError(err error) error {
+	if errors.Is(err, entity.ErrUnavailable) {
+		return entity.ErrUnavailable
+	}
+
+	return entity.ErrInternalError
+}
+
+// validateTenant rejects requests for tenants that are malformed or not one
+// of those configured.
+func (us *UserService) validateTenant(tenant string) error {
+	if !entity.ValidTenant(tenant) {
+		return entity.ErrTenantInvalid
+	}
+
+	if !us.tenants[tenant] {
+		return entity.ErrTenantUnknown
 	}
 
 	return nil
 }
 
+func (us *UserService) validate(tenant, id string) error {
+	if err := us.validateTenant(tenant); err != nil {
+		return err
+	}
+
+	return validateId(id)
+}
+
 func validateId(id string) error {
 	if id == "" {
 		return entity.ErrIDMissing
@@ -2,7 +2,10 @@ package service_test
 
 import (
 	"context"
+	"errors"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/rs/xid"
@@ -12,6 +15,7 @@ import (
 
 	"github.com/electrofelix/gin-demo/entity"
 	"github.com/electrofelix/gin-demo/mocks"
+	"github.com/electrofelix/gin-demo/search"
 	"github.com/electrofelix/gin-demo/service"
 )
 
@@ -28,15 +32,116 @@ func TestUserService_Create(t *testing.T) {
 			Name:  "test-user",
 		}
 
-		mockStore.EXPECT().Create(gomock.Any(), gomock.Any()).Do(
-			func(ctx context.Context, newUser *entity.User) {
+		mockStore.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any()).Do(
+			func(ctx context.Context, newUser *entity.User, audit ...entity.AuditEntry) {
 				assert.NotEqual(t, user.Password, newUser.Password)
 			},
 		).Return(nil)
 
-		_, err := svc.Create(context.Background(), user)
+		_, err := svc.Create(context.Background(), entity.DefaultTenant, user)
 		assert.NoError(t, err)
 	})
+
+	t.Run("tenant", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		svc := service.New(mockStore, service.WithTenants("acme", "globex"))
+
+		user := entity.User{
+			Email:    "user1@test.com",
+			Name:     "test-user",
+			TenantId: "globex",
+		}
+
+		mockStore.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any()).Do(
+			func(ctx context.Context, newUser *entity.User, audit ...entity.AuditEntry) {
+				assert.Equal(t, "acme", newUser.TenantId, "the tenant of the request should be used")
+			},
+		).Return(nil)
+
+		got, err := svc.Create(context.Background(), "acme", user)
+		require.NoError(t, err)
+
+		assert.Equal(t, "acme", got.TenantId)
+	})
+
+	t.Run("tenant-invalid", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		svc := service.New(mockStore)
+
+		_, err := svc.Create(context.Background(), "Not_A_Tenant", entity.User{Email: "user1@test.com"})
+		assert.ErrorIs(t, err, entity.ErrTenantInvalid)
+
+		_, err = svc.Create(context.Background(), "", entity.User{Email: "user1@test.com"})
+		assert.ErrorIs(t, err, entity.ErrTenantInvalid)
+	})
+
+	t.Run("tenant-unknown", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		svc := service.New(mockStore, service.WithTenants("acme"))
+
+		_, err := svc.Create(context.Background(), entity.DefaultTenant, entity.User{Email: "user1@test.com"})
+		assert.ErrorIs(t, err, entity.ErrTenantUnknown)
+	})
+}
+
+func TestUserService_CreateBatch(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	t.Run("results", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		svc := service.New(mockStore, service.WithHashWorkers(2))
+
+		users := []entity.User{
+			{Email: "user1@test.com", Name: "user 1", Password: "secret"},
+			{Email: "user2@test.com", Name: "user 2"},
+			{Email: " USER1@Test.com", Name: "user 1 again", Password: "secret"},
+			{Email: "user3@test.com", Name: "user 3", Password: "secret"},
+			{Email: "user4@test.com", Name: "user 4", Password: "secret"},
+		}
+
+		mockStore.EXPECT().CreateBatch(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+			func(ctx context.Context, created []*entity.User, audit []entity.AuditEntry) []error {
+				require.Len(t, created, 3, "invalid and repeated users should not be stored")
+				require.Len(t, audit, 3)
+
+				for idx, user := range created {
+					assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(user.Password), []byte("secret")))
+					assert.Equal(t, user.Id, audit[idx].UserId)
+					assert.Equal(t, entity.AuditActionCreate, audit[idx].Action)
+				}
+
+				return []error{nil, entity.ErrEmailDuplicate, errors.New("unavailable")}
+			},
+		)
+
+		results, err := svc.CreateBatch(context.Background(), entity.DefaultTenant, users)
+		require.NoError(t, err)
+		require.Len(t, results, len(users))
+
+		statuses := make([]entity.BatchStatus, len(results))
+		for idx, result := range results {
+			assert.Equal(t, idx+1, result.Row)
+			statuses[idx] = result.Status
+		}
+
+		assert.Equal(t, []entity.BatchStatus{
+			entity.BatchStatusCreated,
+			entity.BatchStatusInvalid,
+			entity.BatchStatusDuplicate,
+			entity.BatchStatusDuplicate,
+			entity.BatchStatusFailed,
+		}, statuses)
+		assert.NotEmpty(t, results[0].Id)
+		assert.Empty(t, results[3].Id)
+	})
+
+	t.Run("too-large", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		svc := service.New(mockStore)
+
+		_, err := svc.CreateBatch(context.Background(), entity.DefaultTenant, make([]entity.User, service.MaxBatchSize+1))
+		assert.ErrorIs(t, err, entity.ErrBatchTooLarge)
+	})
 }
 
 func TestUserService_Delete(t *testing.T) {
@@ -52,22 +157,53 @@ func TestUserService_Delete(t *testing.T) {
 			Name:  "test-user",
 		}
 
-		mockStore.EXPECT().GetById(gomock.Any(), gomock.Any()).Return(&user, nil)
-		mockStore.EXPECT().Delete(gomock.Any(), gomock.Any()).Return(nil)
+		mockStore.EXPECT().GetById(gomock.Any(), entity.DefaultTenant, gomock.Any()).Return(&user, nil)
+		mockStore.EXPECT().Update(gomock.Any(), gomock.Any(), gomock.Any()).Do(
+			func(ctx context.Context, deleted *entity.User, audit ...entity.AuditEntry) {
+				assert.NotNil(t, deleted.DeletedAt, "should only mark the user as deleted")
+
+				if assert.Len(t, audit, 1) {
+					assert.Equal(t, entity.AuditActionDelete, audit[0].Action)
+					assert.Equal(t, "admin@example.com", audit[0].Actor)
+					assert.Contains(t, audit[0].Changes, "deleted_at")
+				}
+			},
+		).Return(nil)
 
-		got, err := svc.Delete(context.Background(), user.Id)
+		ctx := service.WithActor(context.Background(), "admin@example.com")
+
+		got, err := svc.Delete(ctx, entity.DefaultTenant, user.Id)
 		require.NoError(t, err)
 
-		assert.Equal(t, user, got)
+		assert.Equal(t, user.Id, got.Id)
+		assert.NotNil(t, got.DeletedAt)
+	})
+
+	t.Run("already-deleted", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		svc := service.New(mockStore)
+
+		deletedAt := time.Now()
+		user := entity.User{
+			Id:        xid.New().String(),
+			Email:     "user1@test.com",
+			Name:      "test-user",
+			DeletedAt: &deletedAt,
+		}
+
+		mockStore.EXPECT().GetById(gomock.Any(), entity.DefaultTenant, gomock.Any()).Return(&user, nil)
+
+		_, err := svc.Delete(context.Background(), entity.DefaultTenant, user.Id)
+		assert.ErrorIs(t, err, entity.ErrNotFound)
 	})
 
 	t.Run("not-found", func(t *testing.T) {
 		mockStore := mocks.NewMockUserStore(ctrl)
 		svc := service.New(mockStore)
 
-		mockStore.EXPECT().GetById(gomock.Any(), gomock.Any()).Return(nil, entity.ErrNotFound)
+		mockStore.EXPECT().GetById(gomock.Any(), entity.DefaultTenant, gomock.Any()).Return(nil, entity.ErrNotFound)
 
-		got, err := svc.Delete(context.Background(), xid.New().String())
+		got, err := svc.Delete(context.Background(), entity.DefaultTenant, xid.New().String())
 		if assert.ErrorIs(t, err, entity.ErrNotFound) {
 			assert.Equal(t, entity.User{}, got)
 		}
@@ -87,9 +223,9 @@ func TestUserService_Get(t *testing.T) {
 			Name:  "test-user",
 		}
 
-		mockStore.EXPECT().GetById(gomock.Any(), gomock.Any()).Return(&user, nil)
+		mockStore.EXPECT().GetById(gomock.Any(), entity.DefaultTenant, gomock.Any()).Return(&user, nil)
 
-		got, err := svc.Get(context.Background(), user.Id)
+		got, err := svc.Get(context.Background(), entity.DefaultTenant, user.Id)
 		require.NoError(t, err)
 
 		assert.Equal(t, user, got)
@@ -99,7 +235,7 @@ func TestUserService_Get(t *testing.T) {
 		mockStore := mocks.NewMockUserStore(ctrl)
 		svc := service.New(mockStore)
 
-		_, err := svc.Get(context.Background(), "")
+		_, err := svc.Get(context.Background(), entity.DefaultTenant, "")
 		assert.ErrorIs(t, err, entity.ErrIDMissing)
 	})
 
@@ -107,14 +243,395 @@ func TestUserService_Get(t *testing.T) {
 		mockStore := mocks.NewMockUserStore(ctrl)
 		svc := service.New(mockStore)
 
-		mockStore.EXPECT().GetById(gomock.Any(), gomock.Any()).Return(nil, entity.ErrNotFound)
+		mockStore.EXPECT().GetById(gomock.Any(), entity.DefaultTenant, gomock.Any()).Return(nil, entity.ErrNotFound)
 
-		user, err := svc.Get(context.Background(), xid.New().String())
+		user, err := svc.Get(context.Background(), entity.DefaultTenant, xid.New().String())
 		require.Error(t, err)
 
 		assert.ErrorIs(t, err, entity.ErrNotFound)
 		assert.Equal(t, entity.User{}, user)
 	})
+
+	t.Run("deleted", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		svc := service.New(mockStore)
+
+		deletedAt := time.Now()
+		user := entity.User{
+			Id:        xid.New().String(),
+			Email:     "user1@example.com",
+			Name:      "test-user",
+			DeletedAt: &deletedAt,
+		}
+
+		mockStore.EXPECT().GetById(gomock.Any(), entity.DefaultTenant, gomock.Any()).Return(&user, nil)
+
+		_, err := svc.Get(context.Background(), entity.DefaultTenant, user.Id)
+		assert.ErrorIs(t, err, entity.ErrNotFound)
+	})
+}
+
+func TestUserService_GetMany(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	t.Run("found-and-missing", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		svc := service.New(mockStore)
+
+		user := entity.User{Id: xid.New().String(), Email: "user1@test.com", Password: "hashed"}
+		deletedAt := time.Now()
+		deleted := entity.User{Id: xid.New().String(), Email: "user2@test.com", DeletedAt: &deletedAt}
+		unknown := xid.New().String()
+
+		// invalid and repeated ids are not requested from the store
+		mockStore.EXPECT().GetMany(
+			gomock.Any(), entity.DefaultTenant, []string{unknown, user.Id, deleted.Id},
+		).Return([]entity.User{user, deleted}, nil)
+
+		got, err := svc.GetMany(
+			context.Background(), entity.DefaultTenant,
+			[]string{unknown, user.Id, "bad-id", deleted.Id, user.Id, ""},
+		)
+		require.NoError(t, err)
+
+		user.Password = ""
+		assert.Equal(t, entity.UserBatch{
+			Users:   []entity.User{user},
+			Missing: []string{unknown, "bad-id", deleted.Id, ""},
+		}, got)
+	})
+
+	t.Run("all-invalid", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		svc := service.New(mockStore)
+
+		got, err := svc.GetMany(context.Background(), entity.DefaultTenant, []string{"bad-id"})
+		require.NoError(t, err)
+		assert.Equal(t, entity.UserBatch{Users: []entity.User{}, Missing: []string{"bad-id"}}, got)
+	})
+
+	t.Run("too-large", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		svc := service.New(mockStore)
+
+		_, err := svc.GetMany(context.Background(), entity.DefaultTenant, make([]string, service.MaxBatchGetSize+1))
+		assert.ErrorIs(t, err, entity.ErrBatchTooLarge)
+	})
+
+	t.Run("unavailable", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		svc := service.New(mockStore)
+
+		mockStore.EXPECT().GetMany(gomock.Any(), entity.DefaultTenant, gomock.Any()).Return(nil, entity.ErrUnavailable)
+
+		_, err := svc.GetMany(context.Background(), entity.DefaultTenant, []string{xid.New().String()})
+		assert.ErrorIs(t, err, entity.ErrUnavailable)
+	})
+}
+
+func TestUserService_Search(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	t.Run("indexed-writes", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		svc := service.New(mockStore, service.WithSearchIndex(search.NewIndex()))
+
+		mockStore.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil)
+
+		created, err := svc.Create(context.Background(), entity.DefaultTenant, entity.User{
+			Email: "john.smith@test.com", Name: "John Smith", Password: "password",
+		})
+		require.NoError(t, err)
+
+		mockStore.EXPECT().GetMany(gomock.Any(), entity.DefaultTenant, []string{created.Id}).Return(
+			[]entity.User{created}, nil,
+		)
+
+		page, err := svc.Search(context.Background(), entity.DefaultTenant, "jon smth", entity.ListOptions{})
+		require.NoError(t, err)
+		require.Len(t, page.Results, 1)
+		assert.Equal(t, created, page.Results[0].User)
+		assert.Empty(t, page.NextCursor)
+
+		stored := created
+		mockStore.EXPECT().GetById(gomock.Any(), entity.DefaultTenant, created.Id).Return(&stored, nil)
+		mockStore.EXPECT().Update(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil)
+
+		_, err = svc.Delete(context.Background(), entity.DefaultTenant, created.Id)
+		require.NoError(t, err)
+
+		// deleted users are dropped from the index without reading the store
+		page, err = svc.Search(context.Background(), entity.DefaultTenant, "jon smth", entity.ListOptions{})
+		require.NoError(t, err)
+		assert.Empty(t, page.Results)
+	})
+
+	t.Run("stale-index", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		index := search.NewIndex()
+		svc := service.New(mockStore, service.WithSearchIndex(index))
+
+		id := xid.New().String()
+		index.Put(entity.User{Id: id, TenantId: entity.DefaultTenant, Name: "John Smith"})
+
+		mockStore.EXPECT().GetMany(gomock.Any(), entity.DefaultTenant, []string{id}).Return([]entity.User{}, nil)
+
+		page, err := svc.Search(context.Background(), entity.DefaultTenant, "john", entity.ListOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, entity.SearchPage{Results: []entity.SearchResult{}}, page)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		svc := service.New(mockStore)
+
+		_, err := svc.Search(context.Background(), entity.DefaultTenant, "john", entity.ListOptions{})
+		assert.ErrorIs(t, err, entity.ErrSearchDisabled)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		svc := service.New(mockStore, service.WithSearchIndex(search.NewIndex()))
+
+		_, err := svc.Search(context.Background(), entity.DefaultTenant, "", entity.ListOptions{})
+		assert.ErrorIs(t, err, entity.ErrQueryInvalid)
+
+		_, err = svc.Search(context.Background(), entity.DefaultTenant, strings.Repeat("a", 1000), entity.ListOptions{})
+		assert.ErrorIs(t, err, entity.ErrQueryInvalid)
+
+		_, err = svc.Search(
+			context.Background(), entity.DefaultTenant, "john", entity.ListOptions{Limit: service.MaxBatchGetSize + 1},
+		)
+		assert.ErrorIs(t, err, entity.ErrLimitInvalid)
+	})
+}
+
+func TestUserService_Reindex(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	mockStore := mocks.NewMockUserStore(ctrl)
+	index := search.NewIndex()
+	svc := service.New(mockStore, service.WithTenants(entity.DefaultTenant, "acme"), service.WithSearchIndex(index))
+
+	// a user written before the rebuild that is no longer stored
+	index.Put(entity.User{Id: xid.New().String(), TenantId: entity.DefaultTenant, Name: "Removed User"})
+
+	first := entity.User{Id: xid.New().String(), Name: "John Smith"}
+	second := entity.User{Id: xid.New().String(), Name: "Jane Doe"}
+
+	gomock.InOrder(
+		mockStore.EXPECT().List(gomock.Any(), "acme", gomock.Any()).Return(entity.UserPage{Users: []entity.User{}}, nil),
+		mockStore.EXPECT().List(gomock.Any(), entity.DefaultTenant, gomock.Any()).Return(
+			entity.UserPage{Users: []entity.User{first}, NextCursor: "next-page"}, nil,
+		),
+		mockStore.EXPECT().List(gomock.Any(), entity.DefaultTenant, gomock.Any()).Do(
+			func(ctx context.Context, tenant string, opts entity.ListOptions) {
+				assert.Equal(t, "next-page", opts.Cursor)
+			},
+		).Return(entity.UserPage{Users: []entity.User{second}}, nil),
+	)
+
+	indexed, err := svc.Reindex(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, indexed)
+
+	hits, _, err := index.Search(entity.DefaultTenant, "removed", entity.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, hits)
+
+	hits, _, err = index.Search(entity.DefaultTenant, "jane", entity.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, hits, 1)
+	assert.Equal(t, second.Id, hits[0].Id)
+
+	assert.Equal(t, 2, index.Len(entity.DefaultTenant))
+}
+
+func TestUserService_ListAudit(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	t.Run("default-limit", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		svc := service.New(mockStore)
+
+		id := xid.New().String()
+		page := entity.AuditPage{Entries: []entity.AuditEntry{{UserId: id, Action: entity.AuditActionCreate}}}
+
+		mockStore.EXPECT().ListAudit(gomock.Any(), entity.DefaultTenant, id, entity.ListOptions{Limit: 100}).Return(page, nil)
+
+		got, err := svc.ListAudit(context.Background(), entity.DefaultTenant, id, entity.ListOptions{})
+		require.NoError(t, err)
+
+		assert.Equal(t, page, got)
+	})
+
+	t.Run("limit-out-of-range", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		svc := service.New(mockStore)
+
+		_, err := svc.ListAudit(context.Background(), entity.DefaultTenant, xid.New().String(), entity.ListOptions{Limit: 1001})
+		assert.ErrorIs(t, err, entity.ErrLimitInvalid)
+	})
+
+	t.Run("bad-id", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		svc := service.New(mockStore)
+
+		_, err := svc.ListAudit(context.Background(), entity.DefaultTenant, "a-bad-id", entity.ListOptions{})
+		assert.ErrorIs(t, err, entity.ErrIDInvalid)
+	})
+}
+
+func TestUserService_Purge(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	t.Run("grace-period", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		svc := service.New(mockStore, service.WithDeleteGracePeriod(time.Hour))
+
+		expired := time.Now().Add(-2 * time.Hour)
+		recent := time.Now().Add(-time.Minute)
+
+		page1 := entity.UserPage{
+			Users: []entity.User{
+				{Id: xid.New().String(), Email: "user1@example.com", DeletedAt: &expired},
+				{Id: xid.New().String(), Email: "user2@example.com", DeletedAt: &recent},
+			},
+			NextCursor: "next",
+		}
+		page2 := entity.UserPage{
+			Users: []entity.User{
+				{Id: xid.New().String(), Email: "user3@example.com", DeletedAt: &expired},
+				{Id: xid.New().String(), Email: "user4@example.com", DeletedAt: &expired},
+			},
+		}
+
+		gomock.InOrder(
+			mockStore.EXPECT().List(gomock.Any(), entity.DefaultTenant, entity.ListOptions{Limit: 100, Deleted: true}).Return(page1, nil),
+			mockStore.EXPECT().List(
+				gomock.Any(), entity.DefaultTenant, entity.ListOptions{Limit: 100, Cursor: "next", Deleted: true},
+			).Return(page2, nil),
+		)
+
+		var purged []string
+
+		mockStore.EXPECT().Purge(gomock.Any(), gomock.Any()).DoAndReturn(
+			func(ctx context.Context, user *entity.User) error {
+				purged = append(purged, user.Email)
+
+				if user.Email == "user4@example.com" {
+					// restored since listed
+					return entity.ErrConflict
+				}
+
+				return nil
+			},
+		).Times(3)
+
+		count, err := svc.Purge(context.Background())
+		require.NoError(t, err)
+
+		assert.Equal(t, 2, count)
+		assert.Equal(t, []string{"user1@example.com", "user3@example.com", "user4@example.com"}, purged)
+	})
+
+	t.Run("tenants", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		svc := service.New(
+			mockStore, service.WithTenants("globex", "acme"), service.WithDeleteGracePeriod(time.Hour),
+		)
+
+		expired := time.Now().Add(-2 * time.Hour)
+
+		gomock.InOrder(
+			mockStore.EXPECT().List(gomock.Any(), "acme", entity.ListOptions{Limit: 100, Deleted: true}).Return(
+				entity.UserPage{
+					Users: []entity.User{{Id: xid.New().String(), Email: "user1@example.com", DeletedAt: &expired}},
+				}, nil,
+			),
+			mockStore.EXPECT().List(gomock.Any(), "globex", entity.ListOptions{Limit: 100, Deleted: true}).Return(
+				entity.UserPage{
+					Users: []entity.User{{Id: xid.New().String(), Email: "user1@example.com", DeletedAt: &expired}},
+				}, nil,
+			),
+		)
+
+		var purged []string
+
+		mockStore.EXPECT().Purge(gomock.Any(), gomock.Any()).DoAndReturn(
+			func(ctx context.Context, user *entity.User) error {
+				purged = append(purged, user.TenantId)
+
+				return nil
+			},
+		).Times(2)
+
+		count, err := svc.Purge(context.Background())
+		require.NoError(t, err)
+
+		assert.Equal(t, 2, count)
+		assert.Equal(t, []string{"acme", "globex"}, purged)
+	})
+}
+
+func TestUserService_Restore(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	t.Run("success", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		svc := service.New(mockStore)
+
+		deletedAt := time.Now()
+		user := entity.User{
+			Id:        xid.New().String(),
+			Email:     "user1@example.com",
+			Name:      "test-user",
+			Password:  "some-password",
+			DeletedAt: &deletedAt,
+		}
+
+		mockStore.EXPECT().GetById(gomock.Any(), entity.DefaultTenant, gomock.Any()).Return(&user, nil)
+		mockStore.EXPECT().Update(gomock.Any(), gomock.Any(), gomock.Any()).Do(
+			func(ctx context.Context, restored *entity.User, audit ...entity.AuditEntry) {
+				assert.Nil(t, restored.DeletedAt)
+				assert.Equal(t, "some-password", restored.Password)
+			},
+		).Return(nil)
+
+		got, err := svc.Restore(context.Background(), entity.DefaultTenant, user.Id)
+		require.NoError(t, err)
+
+		assert.Nil(t, got.DeletedAt)
+		assert.Equal(t, "", got.Password)
+	})
+
+	t.Run("not-deleted", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		svc := service.New(mockStore)
+
+		user := entity.User{
+			Id:    xid.New().String(),
+			Email: "user1@example.com",
+			Name:  "test-user",
+		}
+
+		mockStore.EXPECT().GetById(gomock.Any(), entity.DefaultTenant, gomock.Any()).Return(&user, nil)
+
+		got, err := svc.Restore(context.Background(), entity.DefaultTenant, user.Id)
+		require.NoError(t, err)
+
+		assert.Equal(t, user.Id, got.Id)
+	})
+
+	t.Run("not-found", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		svc := service.New(mockStore)
+
+		mockStore.EXPECT().GetById(gomock.Any(), entity.DefaultTenant, gomock.Any()).Return(nil, entity.ErrNotFound)
+
+		_, err := svc.Restore(context.Background(), entity.DefaultTenant, xid.New().String())
+		assert.ErrorIs(t, err, entity.ErrNotFound)
+	})
 }
 
 func TestUserService_List(t *testing.T) {
@@ -137,43 +654,57 @@ func TestUserService_List(t *testing.T) {
 			},
 		}
 
-		mockStore.EXPECT().List(gomock.Any()).Return(users, nil)
+		mockStore.EXPECT().List(gomock.Any(), entity.DefaultTenant, entity.ListOptions{Limit: 100}).Return(
+			entity.UserPage{Users: users, NextCursor: "next-page"}, nil,
+		)
 
-		got, err := svc.List(context.Background())
+		got, err := svc.List(context.Background(), entity.DefaultTenant, entity.ListOptions{})
 		require.NoError(t, err)
 
-		assert.ElementsMatch(t, users, got)
+		assert.ElementsMatch(t, users, got.Users)
+		assert.Equal(t, "next-page", got.NextCursor)
 	})
-}
 
-func TestUserService_Put(t *testing.T) {
-	ctrl := gomock.NewController(t)
-
-	t.Run("success", func(t *testing.T) {
+	t.Run("limit-out-of-range", func(t *testing.T) {
 		mockStore := mocks.NewMockUserStore(ctrl)
 		svc := service.New(mockStore)
 
-		user := entity.User{
-			Id:    xid.New().String(),
-			Email: "user1@test.com",
-			Name:  "test-user1",
-		}
+		_, err := svc.List(context.Background(), entity.DefaultTenant, entity.ListOptions{Limit: 5000})
+		assert.ErrorIs(t, err, entity.ErrLimitInvalid)
 
-		mockStore.EXPECT().Put(gomock.Any(), gomock.Any()).Return(nil)
+		_, err = svc.List(context.Background(), entity.DefaultTenant, entity.ListOptions{Limit: -1})
+		assert.ErrorIs(t, err, entity.ErrLimitInvalid)
+	})
 
-		got, err := svc.Put(context.Background(), user)
-		require.NoError(t, err)
+	t.Run("filters-normalized", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		svc := service.New(mockStore)
 
-		assert.Equal(t, user, got)
+		mockStore.EXPECT().List(gomock.Any(), entity.DefaultTenant, entity.ListOptions{
+			Limit: 100, EmailPrefix: "user@", NamePrefix: "strasse",
+		}).Return(entity.UserPage{}, nil)
+
+		_, err := svc.List(context.Background(), entity.DefaultTenant, entity.ListOptions{
+			EmailPrefix: " User@", NamePrefix: "STRASSE ",
+		})
+		require.NoError(t, err)
 	})
 
-	t.Run("bad-id", func(t *testing.T) {
+	t.Run("filters-invalid", func(t *testing.T) {
 		mockStore := mocks.NewMockUserStore(ctrl)
 		svc := service.New(mockStore)
 
-		_, err := svc.Put(context.Background(), entity.User{})
+		now := time.Now()
 
-		assert.ErrorIs(t, err, entity.ErrIDMissing)
+		_, err := svc.List(context.Background(), entity.DefaultTenant, entity.ListOptions{
+			LastLoginAfter: now, LastLoginBefore: now.Add(-time.Hour),
+		})
+		assert.ErrorIs(t, err, entity.ErrFilterInvalid)
+
+		_, err = svc.List(context.Background(), entity.DefaultTenant, entity.ListOptions{
+			NamePrefix: strings.Repeat("a", 1000),
+		})
+		assert.ErrorIs(t, err, entity.ErrFilterInvalid)
 	})
 }
 
@@ -195,10 +726,10 @@ func TestUserService_Update(t *testing.T) {
 			Id: xid.New().String(),
 		}
 
-		mockStore.EXPECT().GetById(gomock.Any(), gomock.Any()).Return(&user, nil)
-		mockStore.EXPECT().Put(gomock.Any(), gomock.Any()).Return(nil)
+		mockStore.EXPECT().GetById(gomock.Any(), entity.DefaultTenant, gomock.Any()).Return(&user, nil)
+		mockStore.EXPECT().Update(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil)
 
-		got, err := svc.Update(context.Background(), user.Id, userUpdate)
+		got, err := svc.Update(context.Background(), entity.DefaultTenant, user.Id, userUpdate)
 		require.NoError(t, err)
 
 		assert.Equal(t, user.Email, got.Email)
@@ -222,10 +753,10 @@ func TestUserService_Update(t *testing.T) {
 			Name:  "test-user2",
 		}
 
-		mockStore.EXPECT().GetById(gomock.Any(), gomock.Any()).Return(&user, nil)
-		mockStore.EXPECT().Put(gomock.Any(), gomock.Any()).Return(nil)
+		mockStore.EXPECT().GetById(gomock.Any(), entity.DefaultTenant, gomock.Any()).Return(&user, nil)
+		mockStore.EXPECT().Update(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil)
 
-		got, err := svc.Update(context.Background(), user.Id, userUpdate)
+		got, err := svc.Update(context.Background(), entity.DefaultTenant, user.Id, userUpdate)
 		require.NoError(t, err)
 
 		assert.Equal(t, user.Email, got.Email)
@@ -248,17 +779,38 @@ func TestUserService_Update(t *testing.T) {
 			Password: "some-password",
 		}
 
-		mockStore.EXPECT().GetById(gomock.Any(), gomock.Any()).Return(&user, nil)
-		mockStore.EXPECT().Put(gomock.Any(), gomock.Any()).Do(
-			func(ctx context.Context, user *entity.User) {
-				assert.NotEqual(t, "some-password", user.Password)
-
-				err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte("some-password"))
+		// only the credentials are written when the password alone changes
+		mockStore.EXPECT().GetById(gomock.Any(), entity.DefaultTenant, gomock.Any()).Return(&user, nil)
+		mockStore.EXPECT().GetCredentials(gomock.Any(), entity.DefaultTenant, user.Id).Return(
+			&entity.Credentials{Password: "old-hash", FailedLogins: 2, MfaSecret: "mfa-secret"}, nil,
+		)
+		mockStore.EXPECT().PutCredentials(
+			gomock.Any(), entity.DefaultTenant, user.Id, user.Version, gomock.Any(), gomock.Any(),
+		).Do(
+			func(ctx context.Context, tenant, id string, version int64, credentials *entity.Credentials, audit ...entity.AuditEntry) {
+				assert.NotEqual(t, "some-password", credentials.Password)
+
+				// the rest of the credentials are kept
+				assert.Equal(t, int64(2), credentials.FailedLogins)
+				assert.Equal(t, "mfa-secret", credentials.MfaSecret)
+
+				err := bcrypt.CompareHashAndPassword([]byte(credentials.Password), []byte("some-password"))
 				assert.NoError(t, err)
+
+				if assert.Len(t, audit, 1) {
+					assert.Equal(t, entity.AuditActionUpdate, audit[0].Action)
+					assert.Equal(t, "unknown", audit[0].Actor)
+					assert.Equal(
+						t,
+						map[string]entity.AuditChange{"password": {New: entity.AuditRedacted}},
+						audit[0].Changes,
+						"password hashes must not be recorded",
+					)
+				}
 			},
 		).Return(nil)
 
-		got, err := svc.Update(context.Background(), user.Id, userUpdate)
+		got, err := svc.Update(context.Background(), entity.DefaultTenant, user.Id, userUpdate)
 		require.NoError(t, err)
 
 		assert.Equal(t, user.Email, got.Email)
@@ -269,7 +821,7 @@ func TestUserService_Update(t *testing.T) {
 		mockStore := mocks.NewMockUserStore(ctrl)
 		svc := service.New(mockStore)
 
-		_, err := svc.Update(context.Background(), "", entity.User{})
+		_, err := svc.Update(context.Background(), entity.DefaultTenant, "", entity.User{})
 
 		assert.ErrorIs(t, err, entity.ErrIDMissing)
 	})
@@ -282,10 +834,33 @@ func TestUserService_Update(t *testing.T) {
 			Email: "user2@test.com",
 		}
 
-		_, err := svc.Update(context.Background(), "a-bad-id", userUpdate)
+		_, err := svc.Update(context.Background(), entity.DefaultTenant, "a-bad-id", userUpdate)
 
 		assert.ErrorIs(t, err, entity.ErrIDInvalid)
 	})
+
+	t.Run("version-mismatch", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		svc := service.New(mockStore)
+
+		user := entity.User{
+			Id:      xid.New().String(),
+			Email:   "user1@test.com",
+			Name:    "test-user1",
+			Version: 2,
+		}
+
+		userUpdate := entity.User{
+			Name:    "test-user2",
+			Version: 1,
+		}
+
+		mockStore.EXPECT().GetById(gomock.Any(), entity.DefaultTenant, gomock.Any()).Return(&user, nil)
+
+		_, err := svc.Update(context.Background(), entity.DefaultTenant, user.Id, userUpdate)
+
+		assert.ErrorIs(t, err, entity.ErrConflict)
+	})
 }
 
 func setupUserLoginResponses(
@@ -305,13 +880,13 @@ func setupUserLoginResponses(
 	}
 
 	// capture the encrypted password using create to help
-	mock.EXPECT().Create(gomock.Any(), gomock.Any()).Do(
-		func(ctx context.Context, newUser *entity.User) {
+	mock.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any()).Do(
+		func(ctx context.Context, newUser *entity.User, audit ...entity.AuditEntry) {
 			user.Password = newUser.Password
 		},
 	).Return(nil)
 
-	_, err := svc.Create(context.Background(), user)
+	_, err := svc.Create(context.Background(), entity.DefaultTenant, user)
 	require.NoError(t, err)
 
 	return user, userLogin
@@ -325,10 +900,59 @@ func TestUserService_ValidateCredentials(t *testing.T) {
 		svc := service.New(mockStore)
 		user, userLogin := setupUserLoginResponses(t, mockStore, svc)
 
-		mockStore.EXPECT().GetByEmail(gomock.Any(), gomock.Any()).Return(&user, nil)
-		mockStore.EXPECT().Put(gomock.Any(), gomock.Any()).Return(nil)
+		mockStore.EXPECT().GetByEmail(gomock.Any(), entity.DefaultTenant, gomock.Any()).Return(&user, nil)
+		mockStore.EXPECT().GetCredentials(gomock.Any(), entity.DefaultTenant, user.Id).Return(
+			&entity.Credentials{Password: user.Password}, nil,
+		)
+		mockStore.EXPECT().RecordLogin(gomock.Any(), entity.DefaultTenant, user.Id, gomock.Any(), gomock.Any()).Do(
+			func(ctx context.Context, tenant, id string, login entity.Login, audit ...entity.AuditEntry) {
+				assert.Equal(t, "192.0.2.1", login.SourceIp)
+				assert.WithinDuration(t, time.Now(), login.Time, time.Minute)
+
+				if assert.Len(t, audit, 1) {
+					assert.Equal(t, entity.AuditActionLogin, audit[0].Action)
+					assert.Equal(t, user.Email, audit[0].Actor)
+				}
+			},
+		).Return(nil)
 
-		err := svc.ValidateCredentials(context.Background(), userLogin)
+		userLogin.SourceIp = "192.0.2.1"
+
+		err := svc.ValidateCredentials(context.Background(), entity.DefaultTenant, userLogin)
+		assert.NoError(t, err)
+	})
+
+	t.Run("email-case", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		svc := service.New(mockStore)
+		user, userLogin := setupUserLoginResponses(t, mockStore, svc)
+
+		mockStore.EXPECT().GetByEmail(gomock.Any(), entity.DefaultTenant, "user1@test.com").Return(&user, nil)
+		mockStore.EXPECT().GetCredentials(gomock.Any(), entity.DefaultTenant, user.Id).Return(
+			&entity.Credentials{Password: user.Password}, nil,
+		)
+		mockStore.EXPECT().RecordLogin(gomock.Any(), entity.DefaultTenant, user.Id, gomock.Any(), gomock.Any()).Return(nil)
+
+		userLogin.Email = " User1@Test.COM"
+
+		err := svc.ValidateCredentials(context.Background(), entity.DefaultTenant, userLogin)
+		assert.NoError(t, err)
+	})
+
+	t.Run("concurrent-purge", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		svc := service.New(mockStore)
+		user, userLogin := setupUserLoginResponses(t, mockStore, svc)
+
+		mockStore.EXPECT().GetByEmail(gomock.Any(), entity.DefaultTenant, gomock.Any()).Return(&user, nil)
+		mockStore.EXPECT().GetCredentials(gomock.Any(), entity.DefaultTenant, user.Id).Return(
+			&entity.Credentials{Password: user.Password}, nil,
+		)
+		mockStore.EXPECT().RecordLogin(gomock.Any(), entity.DefaultTenant, user.Id, gomock.Any(), gomock.Any()).Return(
+			entity.ErrNotFound,
+		)
+
+		err := svc.ValidateCredentials(context.Background(), entity.DefaultTenant, userLogin)
 		assert.NoError(t, err)
 	})
 
@@ -337,11 +961,110 @@ func TestUserService_ValidateCredentials(t *testing.T) {
 		svc := service.New(mockStore)
 		user, userLogin := setupUserLoginResponses(t, mockStore, svc)
 
-		mockStore.EXPECT().GetByEmail(gomock.Any(), gomock.Any()).Return(&user, nil)
+		mockStore.EXPECT().GetByEmail(gomock.Any(), entity.DefaultTenant, gomock.Any()).Return(&user, nil)
+		mockStore.EXPECT().GetCredentials(gomock.Any(), entity.DefaultTenant, user.Id).Return(
+			&entity.Credentials{Password: user.Password}, nil,
+		)
+
+		mockStore.EXPECT().PutCredentials(gomock.Any(), entity.DefaultTenant, user.Id, int64(0), gomock.Any()).Do(
+			func(ctx context.Context, tenant, id string, version int64, credentials *entity.Credentials, audit ...entity.AuditEntry) {
+				// the failure is counted without locking the user out yet
+				assert.Equal(t, int64(1), credentials.FailedLogins)
+				assert.Nil(t, credentials.LockedUntil)
+				assert.Equal(t, user.Password, credentials.Password)
+			},
+		).Return(nil)
 
 		userLogin.Password = "the-wrong-password"
 
-		err := svc.ValidateCredentials(context.Background(), userLogin)
+		err := svc.ValidateCredentials(context.Background(), entity.DefaultTenant, userLogin)
+		assert.ErrorIs(t, err, entity.ErrBadCredentials)
+	})
+
+	t.Run("password-mismatch-locks-out", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		svc := service.New(mockStore, service.WithLockout(3, time.Hour))
+		user, userLogin := setupUserLoginResponses(t, mockStore, svc)
+
+		mockStore.EXPECT().GetByEmail(gomock.Any(), entity.DefaultTenant, gomock.Any()).Return(&user, nil)
+		mockStore.EXPECT().GetCredentials(gomock.Any(), entity.DefaultTenant, user.Id).Return(
+			&entity.Credentials{Password: user.Password, FailedLogins: 1, Version: 4}, nil,
+		)
+
+		// a concurrent failed login is counted as well as this one
+		mockStore.EXPECT().PutCredentials(gomock.Any(), entity.DefaultTenant, user.Id, int64(0), gomock.Any()).Return(
+			entity.ErrConflict,
+		)
+		mockStore.EXPECT().GetCredentials(gomock.Any(), entity.DefaultTenant, user.Id).Return(
+			&entity.Credentials{Password: user.Password, FailedLogins: 2, Version: 5}, nil,
+		)
+		mockStore.EXPECT().PutCredentials(gomock.Any(), entity.DefaultTenant, user.Id, int64(0), gomock.Any()).Do(
+			func(ctx context.Context, tenant, id string, version int64, credentials *entity.Credentials, audit ...entity.AuditEntry) {
+				assert.Equal(t, int64(3), credentials.FailedLogins)
+				assert.Equal(t, int64(5), credentials.Version)
+
+				if assert.NotNil(t, credentials.LockedUntil) {
+					assert.WithinDuration(t, time.Now().Add(time.Hour), *credentials.LockedUntil, time.Minute)
+				}
+			},
+		).Return(nil)
+
+		userLogin.Password = "the-wrong-password"
+
+		err := svc.ValidateCredentials(context.Background(), entity.DefaultTenant, userLogin)
+		assert.ErrorIs(t, err, entity.ErrBadCredentials)
+	})
+
+	t.Run("locked-out", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		svc := service.New(mockStore)
+		user, userLogin := setupUserLoginResponses(t, mockStore, svc)
+
+		lockedUntil := time.Now().Add(time.Minute)
+
+		// refused even with the right password, and without counting it
+		mockStore.EXPECT().GetByEmail(gomock.Any(), entity.DefaultTenant, gomock.Any()).Return(&user, nil)
+		mockStore.EXPECT().GetCredentials(gomock.Any(), entity.DefaultTenant, user.Id).Return(
+			&entity.Credentials{Password: user.Password, FailedLogins: 5, LockedUntil: &lockedUntil}, nil,
+		)
+
+		err := svc.ValidateCredentials(context.Background(), entity.DefaultTenant, userLogin)
+		assert.ErrorIs(t, err, entity.ErrBadCredentials)
+	})
+
+	t.Run("lockout-expired-resets", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		svc := service.New(mockStore)
+		user, userLogin := setupUserLoginResponses(t, mockStore, svc)
+
+		lockedUntil := time.Now().Add(-time.Minute)
+
+		mockStore.EXPECT().GetByEmail(gomock.Any(), entity.DefaultTenant, gomock.Any()).Return(&user, nil)
+		mockStore.EXPECT().GetCredentials(gomock.Any(), entity.DefaultTenant, user.Id).Return(
+			&entity.Credentials{Password: user.Password, FailedLogins: 5, LockedUntil: &lockedUntil, MfaSecret: "mfa"}, nil,
+		)
+		mockStore.EXPECT().PutCredentials(gomock.Any(), entity.DefaultTenant, user.Id, int64(0), gomock.Any()).Do(
+			func(ctx context.Context, tenant, id string, version int64, credentials *entity.Credentials, audit ...entity.AuditEntry) {
+				assert.Zero(t, credentials.FailedLogins)
+				assert.Nil(t, credentials.LockedUntil)
+				assert.Equal(t, "mfa", credentials.MfaSecret)
+			},
+		).Return(nil)
+		mockStore.EXPECT().RecordLogin(gomock.Any(), entity.DefaultTenant, user.Id, gomock.Any(), gomock.Any()).Return(nil)
+
+		err := svc.ValidateCredentials(context.Background(), entity.DefaultTenant, userLogin)
+		assert.NoError(t, err)
+	})
+
+	t.Run("credentials-not-found", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		svc := service.New(mockStore)
+		user, userLogin := setupUserLoginResponses(t, mockStore, svc)
+
+		mockStore.EXPECT().GetByEmail(gomock.Any(), entity.DefaultTenant, gomock.Any()).Return(&user, nil)
+		mockStore.EXPECT().GetCredentials(gomock.Any(), entity.DefaultTenant, user.Id).Return(nil, entity.ErrNotFound)
+
+		err := svc.ValidateCredentials(context.Background(), entity.DefaultTenant, userLogin)
 		assert.ErrorIs(t, err, entity.ErrBadCredentials)
 	})
 
@@ -350,9 +1073,9 @@ func TestUserService_ValidateCredentials(t *testing.T) {
 		svc := service.New(mockStore)
 		_, userLogin := setupUserLoginResponses(t, mockStore, svc)
 
-		mockStore.EXPECT().GetByEmail(gomock.Any(), gomock.Any()).Return(nil, entity.ErrNotFound)
+		mockStore.EXPECT().GetByEmail(gomock.Any(), entity.DefaultTenant, gomock.Any()).Return(nil, entity.ErrNotFound)
 
-		err := svc.ValidateCredentials(context.Background(), userLogin)
+		err := svc.ValidateCredentials(context.Background(), entity.DefaultTenant, userLogin)
 		assert.ErrorIs(t, err, entity.ErrBadCredentials)
 	})
 
@@ -361,9 +1084,20 @@ func TestUserService_ValidateCredentials(t *testing.T) {
 		svc := service.New(mockStore)
 		_, userLogin := setupUserLoginResponses(t, mockStore, svc)
 
-		mockStore.EXPECT().GetByEmail(gomock.Any(), gomock.Any()).Return(nil, entity.ErrIDMissing)
+		mockStore.EXPECT().GetByEmail(gomock.Any(), entity.DefaultTenant, gomock.Any()).Return(nil, entity.ErrIDMissing)
 
-		err := svc.ValidateCredentials(context.Background(), userLogin)
+		err := svc.ValidateCredentials(context.Background(), entity.DefaultTenant, userLogin)
 		assert.ErrorIs(t, err, entity.ErrInternalError)
 	})
+
+	t.Run("unavailable", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		svc := service.New(mockStore)
+		_, userLogin := setupUserLoginResponses(t, mockStore, svc)
+
+		mockStore.EXPECT().GetByEmail(gomock.Any(), entity.DefaultTenant, gomock.Any()).Return(nil, entity.ErrUnavailable)
+
+		err := svc.ValidateCredentials(context.Background(), entity.DefaultTenant, userLogin)
+		assert.ErrorIs(t, err, entity.ErrUnavailable)
+	})
 }
@@ -0,0 +1,225 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"github.com/electrofelix/gin-demo/entity"
+)
+
+// audit entries share the partition of the user they are about, with the
+// tenant and timestamp in the sort key to keep them in chronological order
+// within the tenant of the user.
+const (
+	// auditTimestampFormat is fixed width so that sort keys compare in the
+	// same order as the timestamps they contain
+	auditTimestampFormat = "2006-01-02T15:04:05.000000000Z"
+)
+
+func auditKey(tenant string, timestamp time.Time) string {
+	return auditPrefix(tenant) + timestamp.UTC().Format(auditTimestampFormat)
+}
+
+// decodeAuditCursor returns the timestamp of the last entry returned for the
+// user, cursors for any other user or tenant are rejected.
+func decodeAuditCursor(cursor, tenant, id string) (time.Time, error) {
+	lastKey, err := decodeCursor(cursor)
+	if err != nil || lastKey == nil {
+		return time.Time{}, err
+	}
+
+	sortKey, prefix := lastKey["objectType"], auditPrefix(tenant)
+	if lastKey["Id"] != id || !strings.HasPrefix(sortKey, prefix) {
+		return time.Time{}, entity.ErrCursorInvalid
+	}
+
+	timestamp, err := time.Parse(auditTimestampFormat, strings.TrimPrefix(sortKey, prefix))
+	if err != nil {
+		return time.Time{}, entity.ErrCursorInvalid
+	}
+
+	return timestamp, nil
+}
+
+func encodeAuditCursor(tenant string, entry entity.AuditEntry) (string, error) {
+	return encodeCursor(map[string]string{"Id": entry.UserId, "objectType": auditKey(tenant, entry.Timestamp)})
+}
+
+// auditPuts returns the transaction items recording the audit entries of a
+// user of the tenant, to be written along with the change to the user. An
+// entry is never written over another of the same user and timestamp, the
+// transaction is cancelled instead, see isAuditConflict.
+func (us *UserStore) auditPuts(
+	ctx context.Context, tenant string, entries []entity.AuditEntry,
+) ([]types.TransactWriteItem, error) {
+	puts := make([]types.TransactWriteItem, 0, len(entries))
+
+	for _, entry := range entries {
+		item, err := us.marshalAuditEntry(ctx, tenant, entry)
+		if err != nil {
+			return nil, err
+		}
+
+		puts = append(puts, types.TransactWriteItem{
+			Put: &types.Put{
+				Item:                item,
+				TableName:           aws.String(us.tableName),
+				ConditionExpression: aws.String("attribute_not_exists(Id)"),
+			},
+		})
+	}
+
+	return puts, nil
+}
+
+// isAuditConflict reports whether a transaction was cancelled by an audit
+// entry of the same user and timestamp having been recorded by a concurrent
+// write, where the items before first are the only others with conditions.
+func isAuditConflict(err error, first int) bool {
+	var errTransaction *types.TransactionCanceledException
+	if !errors.As(err, &errTransaction) {
+		return false
+	}
+
+	for idx, reason := range errTransaction.CancellationReasons {
+		if idx >= first && aws.ToString(reason.Code) == "ConditionalCheckFailed" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// marshalAuditEntry returns the item storing the entry, which is encrypted
+// whenever encryption is enabled.
+func (us *UserStore) marshalAuditEntry(
+	ctx context.Context, tenant string, entry entity.AuditEntry,
+) (map[string]types.AttributeValue, error) {
+	item, err := attributevalue.MarshalMap(entry)
+	if err != nil {
+		us.logger.Errorf("Marshal failed for audit entry of user (%s): %v", entry.UserId, err)
+
+		return nil, err
+	}
+
+	item["Id"] = &types.AttributeValueMemberS{Value: entry.UserId}
+	item["objectType"] = &types.AttributeValueMemberS{Value: auditKey(tenant, entry.Timestamp)}
+
+	if us.encryption == nil {
+		return item, nil
+	}
+
+	// the changes may include any of the user fields, so are encrypted as
+	// a whole
+	changes, err := json.Marshal(entry.Changes)
+	if err != nil {
+		return nil, err
+	}
+
+	item["Changes"] = &types.AttributeValueMemberS{Value: string(changes)}
+
+	err = us.encryptItem(ctx, item, auditEncryptedFields)
+	if err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
+
+// ListAudit returns the audit entries recorded for the user, newest first.
+func (us *UserStore) ListAudit(ctx context.Context, tenant, id string, opts entity.ListOptions) (entity.AuditPage, error) {
+	if id == "" {
+		return entity.AuditPage{}, entity.ErrIDMissing
+	}
+
+	if _, err := decodeAuditCursor(opts.Cursor, tenant, id); err != nil {
+		return entity.AuditPage{}, err
+	}
+
+	startKey, err := decodeDynamoDBCursor(opts.Cursor)
+	if err != nil {
+		return entity.AuditPage{}, err
+	}
+
+	queryInput := dynamodb.QueryInput{
+		TableName:              aws.String(us.tableName),
+		KeyConditionExpression: aws.String("Id = :id AND begins_with(objectType, :prefix)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":id":     &types.AttributeValueMemberS{Value: id},
+			":prefix": &types.AttributeValueMemberS{Value: auditPrefix(tenant)},
+		},
+		ExclusiveStartKey: startKey,
+		ScanIndexForward:  aws.Bool(false),
+	}
+
+	if opts.Limit > 0 {
+		queryInput.Limit = aws.Int32(opts.Limit)
+	}
+
+	result, err := us.dbClient.Query(ctx, &queryInput)
+	if err != nil {
+		us.logger.Errorf("error during audit query for %s: %v", id, err)
+
+		return entity.AuditPage{}, err
+	}
+
+	entries := make([]entity.AuditEntry, 0, len(result.Items))
+
+	for _, item := range result.Items {
+		entry, err := us.unmarshalAuditEntry(ctx, item)
+		if err != nil {
+			us.logger.Errorf("error unmarshaling audit entries for %s: %v", id, err)
+
+			return entity.AuditPage{}, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	nextCursor, err := encodeDynamoDBCursor(result.LastEvaluatedKey)
+	if err != nil {
+		us.logger.Errorf("error encoding audit cursor for %s: %v", id, err)
+
+		return entity.AuditPage{}, err
+	}
+
+	return entity.AuditPage{Entries: entries, NextCursor: nextCursor}, nil
+}
+
+// unmarshalAuditEntry decrypts the entry if needed, where the changes were
+// encrypted as JSON.
+func (us *UserStore) unmarshalAuditEntry(ctx context.Context, item map[string]types.AttributeValue) (entity.AuditEntry, error) {
+	var entry entity.AuditEntry
+
+	encrypted := isEncrypted(item)
+
+	err := us.decryptItem(ctx, item)
+	if err != nil {
+		return entry, err
+	}
+
+	var changes *types.AttributeValueMemberS
+	if encrypted {
+		changes, _ = item["Changes"].(*types.AttributeValueMemberS)
+		delete(item, "Changes")
+	}
+
+	err = attributevalue.UnmarshalMap(item, &entry)
+	if err != nil {
+		return entry, err
+	}
+
+	if changes != nil {
+		err = json.Unmarshal([]byte(changes.Value), &entry.Changes)
+	}
+
+	return entry, err
+}
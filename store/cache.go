@@ -0,0 +1,392 @@
+package store
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/electrofelix/gin-demo/entity"
+	"github.com/electrofelix/gin-demo/service"
+)
+
+const (
+	defaultCacheSize        = 1000
+	defaultCacheTTL         = 30 * time.Second
+	defaultCacheNegativeTTL = 5 * time.Second
+)
+
+// CacheStats are running totals of the use of a CachingUserStore.
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Size      int    `json:"size"`
+}
+
+// cacheEntry is a single user, or the absence of one, reachable by each of
+// its keys so that all are dropped together.
+type cacheEntry struct {
+	keys    []string
+	user    *entity.User
+	expires time.Time
+}
+
+// CachingUserStore decorates another service.UserStore, caching the users
+// returned by GetById and GetByEmail in a bounded LRU. Users are dropped from
+// the cache by any write through it, writes by other processes are only seen
+// once the TTL expires so it bounds how stale reads may be.
+type CachingUserStore struct {
+	next        service.UserStore
+	size        int
+	ttl         time.Duration
+	negativeTTL time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	// generation is incremented by every invalidation, so that a read that
+	// started before a write does not cache the user as it was
+	generation uint64
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+type CacheOption func(*CachingUserStore)
+
+func NewCachingUserStore(next service.UserStore, options ...CacheOption) *CachingUserStore {
+	cs := &CachingUserStore{
+		next:        next,
+		size:        defaultCacheSize,
+		ttl:         defaultCacheTTL,
+		negativeTTL: defaultCacheNegativeTTL,
+		entries:     map[string]*list.Element{},
+		lru:         list.New(),
+	}
+
+	for _, opt := range options {
+		opt(cs)
+	}
+
+	return cs
+}
+
+// WithCacheSize sets the most users to hold, including those not found.
+func WithCacheSize(size int) CacheOption {
+	return func(cs *CachingUserStore) {
+		cs.size = size
+	}
+}
+
+// WithCacheTTL sets how long users that were found are cached.
+func WithCacheTTL(d time.Duration) CacheOption {
+	return func(cs *CachingUserStore) {
+		cs.ttl = d
+	}
+}
+
+// WithCacheNegativeTTL sets how long users that were not found are cached,
+// 0 disables caching them.
+func WithCacheNegativeTTL(d time.Duration) CacheOption {
+	return func(cs *CachingUserStore) {
+		cs.negativeTTL = d
+	}
+}
+
+// Stats returns the totals since the cache was created.
+func (cs *CachingUserStore) Stats() CacheStats {
+	cs.mu.Lock()
+	size := cs.lru.Len()
+	cs.mu.Unlock()
+
+	return CacheStats{
+		Hits:      atomic.LoadUint64(&cs.hits),
+		Misses:    atomic.LoadUint64(&cs.misses),
+		Evictions: atomic.LoadUint64(&cs.evictions),
+		Size:      size,
+	}
+}
+
+func (cs *CachingUserStore) Create(ctx context.Context, user *entity.User, audit ...entity.AuditEntry) error {
+	// drops any cached absence of the user
+	defer cs.invalidate(user)
+
+	return cs.next.Create(ctx, user, audit...)
+}
+
+func (cs *CachingUserStore) CreateBatch(ctx context.Context, users []*entity.User, audit []entity.AuditEntry) []error {
+	defer cs.invalidate(users...)
+
+	return cs.next.CreateBatch(ctx, users, audit)
+}
+
+func (cs *CachingUserStore) GetByEmail(ctx context.Context, tenant, email string) (*entity.User, error) {
+	return cs.get(emailCacheKey(tenant, email), func() (*entity.User, error) {
+		return cs.next.GetByEmail(ctx, tenant, email)
+	})
+}
+
+func (cs *CachingUserStore) GetById(ctx context.Context, tenant, id string) (*entity.User, error) {
+	return cs.get(idCacheKey(tenant, id), func() (*entity.User, error) {
+		return cs.next.GetById(ctx, tenant, id)
+	})
+}
+
+// GetMany serves the users it can from the cache, reading the rest with a
+// single GetMany of the next store and caching them along with the absence
+// of any not found.
+func (cs *CachingUserStore) GetMany(ctx context.Context, tenant string, ids []string) ([]entity.User, error) {
+	found := make(map[string]*entity.User, len(ids))
+	load := make([]string, 0, len(ids))
+
+	cs.mu.Lock()
+
+	for _, id := range ids {
+		if entry, ok := cs.lookup(idCacheKey(tenant, id)); ok {
+			found[id] = entry.user
+
+			continue
+		}
+
+		load = append(load, id)
+	}
+
+	generation := cs.generation
+	cs.mu.Unlock()
+
+	atomic.AddUint64(&cs.hits, uint64(len(ids)-len(load)))
+	atomic.AddUint64(&cs.misses, uint64(len(load)))
+
+	if len(load) > 0 {
+		loaded, err := cs.next.GetMany(ctx, tenant, load)
+		if err != nil {
+			return nil, err
+		}
+
+		for idx := range loaded {
+			user := &loaded[idx]
+			found[user.Id] = user
+
+			cs.add(generation, &cacheEntry{
+				keys: []string{idCacheKey(user.TenantId, user.Id), emailCacheKey(user.TenantId, user.Email)},
+				user: copyUser(user),
+			})
+		}
+
+		for _, id := range load {
+			if _, ok := found[id]; !ok {
+				cs.add(generation, &cacheEntry{keys: []string{idCacheKey(tenant, id)}})
+			}
+		}
+	}
+
+	users := make([]entity.User, 0, len(found))
+
+	for _, id := range ids {
+		if user := found[id]; user != nil {
+			users = append(users, *copyUser(user))
+		}
+
+		// only the first of any repeated id is returned
+		delete(found, id)
+	}
+
+	return users, nil
+}
+
+// GetCredentials is never cached, so that a changed password takes effect
+// immediately on every instance.
+func (cs *CachingUserStore) GetCredentials(ctx context.Context, tenant, id string) (*entity.Credentials, error) {
+	return cs.next.GetCredentials(ctx, tenant, id)
+}
+
+func (cs *CachingUserStore) List(ctx context.Context, tenant string, opts entity.ListOptions) (entity.UserPage, error) {
+	return cs.next.List(ctx, tenant, opts)
+}
+
+func (cs *CachingUserStore) ListAudit(
+	ctx context.Context, tenant, id string, opts entity.ListOptions,
+) (entity.AuditPage, error) {
+	return cs.next.ListAudit(ctx, tenant, id, opts)
+}
+
+func (cs *CachingUserStore) Purge(ctx context.Context, user *entity.User) error {
+	defer cs.invalidate(user)
+
+	return cs.next.Purge(ctx, user)
+}
+
+// PutCredentials leaves the cache alone, as the cached users do not hold
+// their credentials.
+func (cs *CachingUserStore) PutCredentials(
+	ctx context.Context, tenant, id string, version int64, credentials *entity.Credentials,
+	audit ...entity.AuditEntry,
+) error {
+	return cs.next.PutCredentials(ctx, tenant, id, version, credentials, audit...)
+}
+
+func (cs *CachingUserStore) RecordLogin(
+	ctx context.Context, tenant, id string, login entity.Login, audit ...entity.AuditEntry,
+) error {
+	defer cs.invalidateKeys(idCacheKey(tenant, id))
+
+	return cs.next.RecordLogin(ctx, tenant, id, login, audit...)
+}
+
+func (cs *CachingUserStore) Update(ctx context.Context, user *entity.User, audit ...entity.AuditEntry) error {
+	defer cs.invalidate(user)
+
+	return cs.next.Update(ctx, user, audit...)
+}
+
+func (cs *CachingUserStore) get(key string, load func() (*entity.User, error)) (*entity.User, error) {
+	cs.mu.Lock()
+	entry, ok := cs.lookup(key)
+	generation := cs.generation
+	cs.mu.Unlock()
+
+	if ok {
+		atomic.AddUint64(&cs.hits, 1)
+
+		if entry.user == nil {
+			return nil, entity.ErrNotFound
+		}
+
+		return copyUser(entry.user), nil
+	}
+
+	atomic.AddUint64(&cs.misses, 1)
+
+	user, err := load()
+
+	switch {
+	case err == nil:
+		cs.add(generation, &cacheEntry{
+			keys: []string{idCacheKey(user.TenantId, user.Id), emailCacheKey(user.TenantId, user.Email)},
+			user: copyUser(user),
+		})
+	case errors.Is(err, entity.ErrNotFound):
+		cs.add(generation, &cacheEntry{keys: []string{key}})
+	}
+
+	return user, err
+}
+
+// lookup returns the entry for the key unless it has expired, it must be
+// called with the lock held.
+func (cs *CachingUserStore) lookup(key string) (*cacheEntry, bool) {
+	elem, ok := cs.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := elem.Value.(*cacheEntry)
+
+	if !time.Now().Before(entry.expires) {
+		cs.remove(elem)
+
+		return nil, false
+	}
+
+	cs.lru.MoveToFront(elem)
+
+	return entry, true
+}
+
+func (cs *CachingUserStore) add(generation uint64, entry *cacheEntry) {
+	ttl := cs.ttl
+	if entry.user == nil {
+		ttl = cs.negativeTTL
+	}
+
+	if cs.size <= 0 || ttl <= 0 {
+		return
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if generation != cs.generation {
+		// written since it was read, the value may already be stale
+		return
+	}
+
+	for _, key := range entry.keys {
+		if elem, ok := cs.entries[key]; ok {
+			cs.remove(elem)
+		}
+	}
+
+	entry.expires = time.Now().Add(ttl)
+
+	elem := cs.lru.PushFront(entry)
+	for _, key := range entry.keys {
+		cs.entries[key] = elem
+	}
+
+	for cs.lru.Len() > cs.size {
+		cs.remove(cs.lru.Back())
+		atomic.AddUint64(&cs.evictions, 1)
+	}
+}
+
+// invalidate drops the users by both Id and email, along with any email
+// they were cached with before being written.
+func (cs *CachingUserStore) invalidate(users ...*entity.User) {
+	keys := make([]string, 0, 2*len(users))
+	for _, user := range users {
+		keys = append(keys, idCacheKey(user.TenantId, user.Id), emailCacheKey(user.TenantId, user.Email))
+	}
+
+	cs.invalidateKeys(keys...)
+}
+
+func (cs *CachingUserStore) invalidateKeys(keys ...string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.generation++
+
+	for _, key := range keys {
+		if elem, ok := cs.entries[key]; ok {
+			cs.remove(elem)
+		}
+	}
+}
+
+// remove must be called with the lock held.
+func (cs *CachingUserStore) remove(elem *list.Element) {
+	entry := cs.lru.Remove(elem).(*cacheEntry)
+
+	for _, key := range entry.keys {
+		if cs.entries[key] == elem {
+			delete(cs.entries, key)
+		}
+	}
+}
+
+// cache keys include the tenant, as the same Id or email may be used by
+// users of different tenants
+func idCacheKey(tenant, id string) string {
+	return "id:" + entity.TenantOrDefault(tenant) + ":" + id
+}
+
+func emailCacheKey(tenant, email string) string {
+	return "email:" + entity.TenantOrDefault(tenant) + ":" + entity.CanonicalEmail(email)
+}
+
+// copyUser prevents callers modifying the cached user.
+func copyUser(user *entity.User) *entity.User {
+	cp := *user
+
+	if user.DeletedAt != nil {
+		deletedAt := *user.DeletedAt
+		cp.DeletedAt = &deletedAt
+	}
+
+	return &cp
+}
@@ -0,0 +1,214 @@
+package store_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/electrofelix/gin-demo/entity"
+	"github.com/electrofelix/gin-demo/mocks"
+	"github.com/electrofelix/gin-demo/service"
+	"github.com/electrofelix/gin-demo/store"
+	"github.com/electrofelix/gin-demo/store/storetest"
+)
+
+func TestCachingUserStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) service.UserStore {
+		return store.NewCachingUserStore(store.NewMemoryUserStore())
+	})
+}
+
+func TestCachingUserStore_GetById(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	t.Run("hit", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		cache := store.NewCachingUserStore(mockStore)
+
+		user := entity.User{Id: xid.New().String(), Email: "User1@Example.com"}
+		stored := user
+
+		mockStore.EXPECT().GetById(gomock.Any(), entity.DefaultTenant, user.Id).Return(&stored, nil).Times(1)
+
+		for i := 0; i < 3; i++ {
+			got, err := cache.GetById(context.Background(), entity.DefaultTenant, user.Id)
+			require.NoError(t, err)
+			assert.Equal(t, user, *got)
+
+			// callers must not be able to modify the cached user
+			got.Name = "modified"
+		}
+
+		// cached under the email as well
+		got, err := cache.GetByEmail(context.Background(), entity.DefaultTenant, "user1@example.com")
+		require.NoError(t, err)
+		assert.Equal(t, user, *got)
+
+		assert.Equal(t, store.CacheStats{Hits: 3, Misses: 1, Size: 1}, cache.Stats())
+	})
+
+	t.Run("not-found", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		cache := store.NewCachingUserStore(mockStore, store.WithCacheNegativeTTL(50*time.Millisecond))
+
+		id := xid.New().String()
+
+		mockStore.EXPECT().GetById(gomock.Any(), entity.DefaultTenant, id).Return(nil, entity.ErrNotFound).Times(2)
+
+		for i := 0; i < 2; i++ {
+			_, err := cache.GetById(context.Background(), entity.DefaultTenant, id)
+			assert.ErrorIs(t, err, entity.ErrNotFound)
+		}
+
+		time.Sleep(60 * time.Millisecond)
+
+		_, err := cache.GetById(context.Background(), entity.DefaultTenant, id)
+		assert.ErrorIs(t, err, entity.ErrNotFound)
+	})
+
+	t.Run("errors-not-cached", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		cache := store.NewCachingUserStore(mockStore)
+
+		id := xid.New().String()
+
+		mockStore.EXPECT().GetById(gomock.Any(), entity.DefaultTenant, id).Return(nil, fmt.Errorf("unavailable")).Times(2)
+
+		for i := 0; i < 2; i++ {
+			_, err := cache.GetById(context.Background(), entity.DefaultTenant, id)
+			assert.Error(t, err)
+		}
+	})
+
+	t.Run("expires", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		cache := store.NewCachingUserStore(mockStore, store.WithCacheTTL(50*time.Millisecond))
+
+		user := entity.User{Id: xid.New().String(), Email: "user1@example.com"}
+
+		mockStore.EXPECT().GetById(gomock.Any(), entity.DefaultTenant, user.Id).Return(&user, nil).Times(2)
+
+		_, err := cache.GetById(context.Background(), entity.DefaultTenant, user.Id)
+		require.NoError(t, err)
+
+		time.Sleep(60 * time.Millisecond)
+
+		_, err = cache.GetById(context.Background(), entity.DefaultTenant, user.Id)
+		require.NoError(t, err)
+	})
+
+	t.Run("evicts-least-recently-used", func(t *testing.T) {
+		memory := store.NewMemoryUserStore()
+		cache := store.NewCachingUserStore(memory, store.WithCacheSize(2))
+
+		users := make([]entity.User, 3)
+		for idx := range users {
+			users[idx] = entity.User{Id: xid.New().String(), Email: fmt.Sprintf("user%d@example.com", idx)}
+			require.NoError(t, memory.Create(context.Background(), &users[idx]))
+		}
+
+		for _, idx := range []int{0, 1, 0, 2} {
+			_, err := cache.GetById(context.Background(), entity.DefaultTenant, users[idx].Id)
+			require.NoError(t, err)
+		}
+
+		assert.Equal(t, store.CacheStats{Hits: 1, Misses: 3, Evictions: 1, Size: 2}, cache.Stats())
+
+		// user 1 was evicted, user 0 is still cached
+		_, err := cache.GetById(context.Background(), entity.DefaultTenant, users[0].Id)
+		require.NoError(t, err)
+		_, err = cache.GetById(context.Background(), entity.DefaultTenant, users[1].Id)
+		require.NoError(t, err)
+
+		stats := cache.Stats()
+		assert.Equal(t, uint64(2), stats.Hits)
+		assert.Equal(t, uint64(4), stats.Misses)
+	})
+}
+
+func TestCachingUserStore_GetMany(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	t.Run("partial-hit", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		cache := store.NewCachingUserStore(mockStore)
+
+		cached := entity.User{Id: xid.New().String(), Email: "user1@example.com"}
+		loaded := entity.User{Id: xid.New().String(), Email: "user2@example.com"}
+		missing := xid.New().String()
+
+		stored := cached
+		mockStore.EXPECT().GetById(gomock.Any(), entity.DefaultTenant, cached.Id).Return(&stored, nil).Times(1)
+
+		_, err := cache.GetById(context.Background(), entity.DefaultTenant, cached.Id)
+		require.NoError(t, err)
+
+		// only the users not already cached are read
+		mockStore.EXPECT().GetMany(gomock.Any(), entity.DefaultTenant, []string{loaded.Id, missing}).Return(
+			[]entity.User{loaded}, nil,
+		).Times(1)
+
+		for i := 0; i < 2; i++ {
+			got, err := cache.GetMany(
+				context.Background(), entity.DefaultTenant, []string{loaded.Id, missing, cached.Id},
+			)
+			require.NoError(t, err)
+			assert.Equal(t, []entity.User{loaded, cached}, got)
+		}
+
+		assert.Equal(t, store.CacheStats{Hits: 4, Misses: 3, Size: 3}, cache.Stats())
+	})
+
+	t.Run("errors-not-cached", func(t *testing.T) {
+		mockStore := mocks.NewMockUserStore(ctrl)
+		cache := store.NewCachingUserStore(mockStore)
+
+		id := xid.New().String()
+
+		mockStore.EXPECT().GetMany(gomock.Any(), entity.DefaultTenant, []string{id}).Return(
+			nil, fmt.Errorf("unavailable"),
+		).Times(2)
+
+		for i := 0; i < 2; i++ {
+			_, err := cache.GetMany(context.Background(), entity.DefaultTenant, []string{id})
+			assert.Error(t, err)
+		}
+	})
+}
+
+func TestCachingUserStore_Update(t *testing.T) {
+	t.Run("invalidates", func(t *testing.T) {
+		cache := store.NewCachingUserStore(store.NewMemoryUserStore())
+
+		user := entity.User{Id: xid.New().String(), Email: "user1@example.com", Name: "before"}
+		require.NoError(t, cache.Create(context.Background(), &user))
+
+		_, err := cache.GetByEmail(context.Background(), entity.DefaultTenant, user.Email)
+		require.NoError(t, err)
+
+		// cache the absence of the new email
+		_, err = cache.GetByEmail(context.Background(), entity.DefaultTenant, "user2@example.com")
+		assert.ErrorIs(t, err, entity.ErrNotFound)
+
+		user.Email = "user2@example.com"
+		user.Name = "after"
+		require.NoError(t, cache.Update(context.Background(), &user))
+
+		_, err = cache.GetByEmail(context.Background(), entity.DefaultTenant, "user1@example.com")
+		assert.ErrorIs(t, err, entity.ErrNotFound, "the old email must not find the user")
+
+		got, err := cache.GetByEmail(context.Background(), entity.DefaultTenant, "user2@example.com")
+		require.NoError(t, err)
+		assert.Equal(t, "after", got.Name)
+
+		got, err = cache.GetById(context.Background(), entity.DefaultTenant, user.Id)
+		require.NoError(t, err)
+		assert.Equal(t, "after", got.Name)
+	})
+}
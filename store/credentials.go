@@ -0,0 +1,272 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"github.com/electrofelix/gin-demo/entity"
+)
+
+// the credentials of a user are kept in an item of their own alongside the
+// user item, sharing its Id, so that the password hash, lockout counters and
+// MFA secret are only ever read when checking a login. The item is written
+// in the same transaction as the user whenever the user is written with a
+// password.
+
+// GetCredentials returns the credentials of the user, entity.ErrNotFound is
+// returned when the user does not exist.
+func (us *UserStore) GetCredentials(ctx context.Context, tenant, id string) (*entity.Credentials, error) {
+	if id == "" {
+		return nil, entity.ErrIDMissing
+	}
+
+	result, err := us.dbClient.GetItem(ctx, &dynamodb.GetItemInput{
+		Key:       credentialsKey(tenant, id),
+		TableName: aws.String(us.tableName),
+	})
+	if err != nil {
+		us.logger.Errorf("error during get of credentials: %v", err)
+
+		return nil, err
+	}
+
+	if len(result.Item) == 0 {
+		return nil, entity.ErrNotFound
+	}
+
+	err = us.decryptItem(ctx, result.Item)
+	if err != nil {
+		us.logger.Errorf("error decrypting credentials of %s: %v", id, err)
+
+		return nil, err
+	}
+
+	var credentials entity.Credentials
+
+	err = attributevalue.UnmarshalMap(result.Item, &credentials)
+	if err != nil {
+		us.logger.Errorf("error unmarshaling credentials of %s: %v", id, err)
+
+		return nil, err
+	}
+
+	return &credentials, nil
+}
+
+// PutCredentials replaces the credentials of an existing user without
+// writing the user item, so its Version is unchanged. A non-zero version
+// must match that of the user and the stored credentials must still be at
+// credentials.Version, otherwise entity.ErrConflict is returned. On success
+// credentials.Version is that of the credentials written.
+func (us *UserStore) PutCredentials(
+	ctx context.Context, tenant, id string, version int64, credentials *entity.Credentials,
+	audit ...entity.AuditEntry,
+) error {
+	if id == "" {
+		return entity.ErrIDMissing
+	}
+
+	updated := *credentials
+	updated.Version++
+
+	item, err := us.marshalCredentials(ctx, tenant, id, &updated)
+	if err != nil {
+		return err
+	}
+
+	credentialsCondition, credentialsValues := credentialsVersionCondition(credentials.Version)
+
+	auditPuts, err := us.auditPuts(ctx, tenant, audit)
+	if err != nil {
+		return err
+	}
+
+	condition := "attribute_exists(Id)"
+
+	var values map[string]types.AttributeValue
+	if version != 0 {
+		condition, values = versionCondition(version)
+	}
+
+	transaction := dynamodb.TransactWriteItemsInput{
+		TransactItems: append(
+			[]types.TransactWriteItem{
+				{
+					// credentials are never written for a user that has
+					// been removed, or changed since the version given
+					ConditionCheck: &types.ConditionCheck{
+						Key:                       userKey(tenant, id),
+						TableName:                 aws.String(us.tableName),
+						ConditionExpression:       aws.String(condition),
+						ExpressionAttributeValues: values,
+					},
+				},
+				{
+					// never written over credentials changed since read
+					Put: &types.Put{
+						Item:                      item,
+						TableName:                 aws.String(us.tableName),
+						ConditionExpression:       aws.String(credentialsCondition),
+						ExpressionAttributeValues: credentialsValues,
+					},
+				},
+			},
+			auditPuts...,
+		),
+	}
+
+	_, err = us.dbClient.TransactWriteItems(ctx, &transaction)
+	if err != nil {
+		var errTransaction *types.TransactionCanceledException
+		if errors.As(err, &errTransaction) {
+			failedReasons := errTransaction.CancellationReasons
+
+			if len(failedReasons) >= 1 && aws.ToString(failedReasons[0].Code) == "ConditionalCheckFailed" {
+				if version == 0 {
+					return entity.ErrNotFound
+				}
+
+				// distinguish between the user missing and a version
+				// mismatch
+				if _, err := us.GetById(ctx, tenant, id); err != nil {
+					return err
+				}
+
+				return entity.ErrConflict
+			}
+		}
+
+		if isAuditConflict(err, 1) {
+			return entity.ErrConflict
+		}
+
+		us.logger.Errorf("error putting credentials of %s: %v", id, err)
+
+		return err
+	}
+
+	credentials.Version = updated.Version
+
+	return nil
+}
+
+// passwordCredentials returns the credentials of a new user written with a
+// password, or nil when the user is written without one.
+func passwordCredentials(user *entity.User) *entity.Credentials {
+	if user.Password == "" {
+		return nil
+	}
+
+	return &entity.Credentials{Password: user.Password, Version: 1}
+}
+
+// credentialsVersionCondition returns a condition expression that only
+// matches when the stored credentials are still at the given version. Version
+// 0 matches both credentials that were never written and those written before
+// they were versioned.
+func credentialsVersionCondition(version int64) (string, map[string]types.AttributeValue) {
+	if version == 0 {
+		return "attribute_not_exists(Version)", nil
+	}
+
+	return "Version = :credentialsVersion", map[string]types.AttributeValue{
+		":credentialsVersion": &types.AttributeValueMemberN{Value: strconv.FormatInt(version, 10)},
+	}
+}
+
+// credentialsPuts returns the transaction item writing the credentials of
+// a new user, or none when the credentials are nil.
+func (us *UserStore) credentialsPuts(
+	ctx context.Context, tenant, id string, credentials *entity.Credentials,
+) ([]types.TransactWriteItem, error) {
+	if credentials == nil {
+		return nil, nil
+	}
+
+	item, err := us.marshalCredentials(ctx, tenant, id, credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	return []types.TransactWriteItem{
+		{
+			Put: &types.Put{
+				Item:      item,
+				TableName: aws.String(us.tableName),
+			},
+		},
+	}, nil
+}
+
+// passwordPuts returns the transaction item writing the password of the user
+// over its stored credentials, keeping the rest of them, or none when the
+// user is written without a password. The item is conditioned on the
+// credentials being unchanged since read, so the transaction is cancelled
+// rather than reverting a concurrent PutCredentials.
+func (us *UserStore) passwordPuts(ctx context.Context, user *entity.User) ([]types.TransactWriteItem, error) {
+	if user.Password == "" {
+		return nil, nil
+	}
+
+	credentials, err := us.GetCredentials(ctx, user.TenantId, user.Id)
+	if errors.Is(err, entity.ErrNotFound) {
+		credentials = &entity.Credentials{}
+	} else if err != nil {
+		return nil, err
+	}
+
+	condition, values := credentialsVersionCondition(credentials.Version)
+
+	credentials.Password = user.Password
+	credentials.Version++
+
+	item, err := us.marshalCredentials(ctx, user.TenantId, user.Id, credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	return []types.TransactWriteItem{
+		{
+			Put: &types.Put{
+				Item:                      item,
+				TableName:                 aws.String(us.tableName),
+				ConditionExpression:       aws.String(condition),
+				ExpressionAttributeValues: values,
+			},
+		},
+	}, nil
+}
+
+// marshalCredentials returns the item storing the credentials, with any of
+// the configured fields encrypted.
+func (us *UserStore) marshalCredentials(
+	ctx context.Context, tenant, id string, credentials *entity.Credentials,
+) (map[string]types.AttributeValue, error) {
+	item, err := attributevalue.MarshalMap(credentials)
+	if err != nil {
+		us.logger.Errorf("Marshal failed for credentials (%s): %v", id, err)
+
+		return nil, err
+	}
+
+	for name, value := range credentialsKey(tenant, id) {
+		item[name] = value
+	}
+
+	if us.encryption == nil {
+		return item, nil
+	}
+
+	err = us.encryptItem(ctx, item, us.encryption.credentialsFields())
+	if err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
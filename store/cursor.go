@@ -0,0 +1,77 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"github.com/electrofelix/gin-demo/entity"
+)
+
+// encodeCursor converts the key attributes of the last item returned into
+// an opaque string that can be handed to clients to request the next page.
+func encodeCursor(lastKey map[string]string) (string, error) {
+	if len(lastKey) == 0 {
+		return "", nil
+	}
+
+	data, err := json.Marshal(lastKey)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodeCursor reverses encodeCursor, any cursor that cannot be decoded is
+// reported as entity.ErrCursorInvalid as it can only come from a client.
+func decodeCursor(cursor string) (map[string]string, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, entity.ErrCursorInvalid
+	}
+
+	lastKey := map[string]string{}
+
+	err = json.Unmarshal(data, &lastKey)
+	if err != nil || lastKey["Id"] == "" {
+		return nil, entity.ErrCursorInvalid
+	}
+
+	return lastKey, nil
+}
+
+func encodeDynamoDBCursor(lastKey map[string]types.AttributeValue) (string, error) {
+	if len(lastKey) == 0 {
+		return "", nil
+	}
+
+	keyValues := map[string]string{}
+
+	err := attributevalue.UnmarshalMap(lastKey, &keyValues)
+	if err != nil {
+		return "", err
+	}
+
+	return encodeCursor(keyValues)
+}
+
+func decodeDynamoDBCursor(cursor string) (map[string]types.AttributeValue, error) {
+	keyValues, err := decodeCursor(cursor)
+	if err != nil || keyValues == nil {
+		return nil, err
+	}
+
+	startKey, err := attributevalue.MarshalMap(keyValues)
+	if err != nil {
+		return nil, entity.ErrCursorInvalid
+	}
+
+	return startKey, nil
+}
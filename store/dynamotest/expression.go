@@ -0,0 +1,897 @@
+package dynamotest
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+type item = map[string]types.AttributeValue
+
+// reservedWords is a subset of the DynamoDB reserved words which cannot be
+// used directly as attribute names in expressions, covering those most
+// likely to be used as attributes of the stored objects.
+var reservedWords = map[string]bool{
+	"ACTION": true, "COUNT": true, "DATA": true, "DATE": true, "INDEX": true,
+	"KEY": true, "NAME": true, "STATUS": true, "TABLE": true, "TIME": true,
+	"TIMESTAMP": true, "USER": true, "USERS": true, "VALUE": true,
+}
+
+// condition is a parsed condition, filter or key condition expression.
+type condition interface {
+	eval(it item) (bool, error)
+}
+
+// operand is anything that can be compared within a condition, either an
+// attribute of the item, a placeholder value or the size of an attribute.
+type operand interface {
+	resolve(it item) (types.AttributeValue, bool)
+}
+
+type pathOperand struct {
+	name string
+}
+
+func (p pathOperand) resolve(it item) (types.AttributeValue, bool) {
+	value, ok := it[p.name]
+
+	return value, ok
+}
+
+type valueOperand struct {
+	value types.AttributeValue
+}
+
+func (v valueOperand) resolve(it item) (types.AttributeValue, bool) {
+	return v.value, true
+}
+
+type sizeOperand struct {
+	path pathOperand
+}
+
+func (s sizeOperand) resolve(it item) (types.AttributeValue, bool) {
+	value, ok := s.path.resolve(it)
+	if !ok {
+		return nil, false
+	}
+
+	var size int
+
+	switch v := value.(type) {
+	case *types.AttributeValueMemberS:
+		size = len(v.Value)
+	case *types.AttributeValueMemberB:
+		size = len(v.Value)
+	case *types.AttributeValueMemberSS:
+		size = len(v.Value)
+	case *types.AttributeValueMemberNS:
+		size = len(v.Value)
+	case *types.AttributeValueMemberBS:
+		size = len(v.Value)
+	case *types.AttributeValueMemberL:
+		size = len(v.Value)
+	case *types.AttributeValueMemberM:
+		size = len(v.Value)
+	default:
+		return nil, false
+	}
+
+	return &types.AttributeValueMemberN{Value: strconv.Itoa(size)}, true
+}
+
+type andCondition struct{ left, right condition }
+
+func (c andCondition) eval(it item) (bool, error) {
+	left, err := c.left.eval(it)
+	if err != nil || !left {
+		return false, err
+	}
+
+	return c.right.eval(it)
+}
+
+type orCondition struct{ left, right condition }
+
+func (c orCondition) eval(it item) (bool, error) {
+	left, err := c.left.eval(it)
+	if err != nil || left {
+		return left, err
+	}
+
+	return c.right.eval(it)
+}
+
+type notCondition struct{ inner condition }
+
+func (c notCondition) eval(it item) (bool, error) {
+	result, err := c.inner.eval(it)
+
+	return !result, err
+}
+
+type comparison struct {
+	comparator  string
+	left, right operand
+}
+
+func (c comparison) eval(it item) (bool, error) {
+	left, leftOk := c.left.resolve(it)
+	right, rightOk := c.right.resolve(it)
+
+	if !leftOk || !rightOk {
+		// comparisons against missing attributes are always false, with
+		// the exception of inequality
+		return c.comparator == "<>", nil
+	}
+
+	if c.comparator == "=" {
+		return equal(left, right), nil
+	}
+
+	if c.comparator == "<>" {
+		return !equal(left, right), nil
+	}
+
+	order, ok := compare(left, right)
+	if !ok {
+		return false, nil
+	}
+
+	switch c.comparator {
+	case "<":
+		return order < 0, nil
+	case "<=":
+		return order <= 0, nil
+	case ">":
+		return order > 0, nil
+	case ">=":
+		return order >= 0, nil
+	}
+
+	return false, fmt.Errorf("unsupported comparator %s", c.comparator)
+}
+
+type betweenCondition struct {
+	value, lower, upper operand
+}
+
+func (c betweenCondition) eval(it item) (bool, error) {
+	lower, err := comparison{comparator: ">=", left: c.value, right: c.lower}.eval(it)
+	if err != nil || !lower {
+		return false, err
+	}
+
+	return comparison{comparator: "<=", left: c.value, right: c.upper}.eval(it)
+}
+
+type inCondition struct {
+	value   operand
+	options []operand
+}
+
+func (c inCondition) eval(it item) (bool, error) {
+	for _, option := range c.options {
+		if match, _ := (comparison{comparator: "=", left: c.value, right: option}).eval(it); match {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+type functionCondition struct {
+	name string
+	args []operand
+}
+
+func (c functionCondition) eval(it item) (bool, error) {
+	switch c.name {
+	case "attribute_exists", "attribute_not_exists":
+		_, exists := c.args[0].resolve(it)
+
+		return exists == (c.name == "attribute_exists"), nil
+	case "attribute_type":
+		value, ok := c.args[0].resolve(it)
+		expected, _ := c.args[1].resolve(it)
+
+		if !ok {
+			return false, nil
+		}
+
+		expectedType, isString := expected.(*types.AttributeValueMemberS)
+		if !isString {
+			return false, fmt.Errorf("attribute_type requires a string type")
+		}
+
+		return attributeType(value) == expectedType.Value, nil
+	case "begins_with":
+		value, ok := c.args[0].resolve(it)
+		prefix, prefixOk := c.args[1].resolve(it)
+
+		if !ok || !prefixOk {
+			return false, nil
+		}
+
+		s, isString := value.(*types.AttributeValueMemberS)
+		p, prefixString := prefix.(*types.AttributeValueMemberS)
+
+		return isString && prefixString && strings.HasPrefix(s.Value, p.Value), nil
+	case "contains":
+		value, ok := c.args[0].resolve(it)
+		needle, needleOk := c.args[1].resolve(it)
+
+		if !ok || !needleOk {
+			return false, nil
+		}
+
+		return contains(value, needle), nil
+	}
+
+	return false, fmt.Errorf("unsupported function %s", c.name)
+}
+
+func attributeType(value types.AttributeValue) string {
+	switch value.(type) {
+	case *types.AttributeValueMemberS:
+		return "S"
+	case *types.AttributeValueMemberN:
+		return "N"
+	case *types.AttributeValueMemberB:
+		return "B"
+	case *types.AttributeValueMemberBOOL:
+		return "BOOL"
+	case *types.AttributeValueMemberNULL:
+		return "NULL"
+	case *types.AttributeValueMemberSS:
+		return "SS"
+	case *types.AttributeValueMemberNS:
+		return "NS"
+	case *types.AttributeValueMemberBS:
+		return "BS"
+	case *types.AttributeValueMemberL:
+		return "L"
+	case *types.AttributeValueMemberM:
+		return "M"
+	}
+
+	return ""
+}
+
+func contains(value, needle types.AttributeValue) bool {
+	switch v := value.(type) {
+	case *types.AttributeValueMemberS:
+		n, ok := needle.(*types.AttributeValueMemberS)
+
+		return ok && strings.Contains(v.Value, n.Value)
+	case *types.AttributeValueMemberSS:
+		n, ok := needle.(*types.AttributeValueMemberS)
+		if !ok {
+			return false
+		}
+
+		for _, s := range v.Value {
+			if s == n.Value {
+				return true
+			}
+		}
+	case *types.AttributeValueMemberL:
+		for _, element := range v.Value {
+			if equal(element, needle) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func equal(left, right types.AttributeValue) bool {
+	if order, ok := compare(left, right); ok {
+		return order == 0
+	}
+
+	return reflect.DeepEqual(left, right)
+}
+
+// compare orders two scalar values of the same type, ok is false where the
+// types differ or cannot be ordered.
+func compare(left, right types.AttributeValue) (int, bool) {
+	switch l := left.(type) {
+	case *types.AttributeValueMemberS:
+		r, ok := right.(*types.AttributeValueMemberS)
+		if !ok {
+			return 0, false
+		}
+
+		return strings.Compare(l.Value, r.Value), true
+	case *types.AttributeValueMemberN:
+		r, ok := right.(*types.AttributeValueMemberN)
+		if !ok {
+			return 0, false
+		}
+
+		lNum, lOk := new(big.Float).SetString(l.Value)
+		rNum, rOk := new(big.Float).SetString(r.Value)
+
+		if !lOk || !rOk {
+			return 0, false
+		}
+
+		return lNum.Cmp(rNum), true
+	case *types.AttributeValueMemberB:
+		r, ok := right.(*types.AttributeValueMemberB)
+		if !ok {
+			return 0, false
+		}
+
+		return bytes.Compare(l.Value, r.Value), true
+	}
+
+	return 0, false
+}
+
+// expressionParser is a small recursive descent parser covering the subset
+// of the DynamoDB expression grammar needed by the store.
+type expressionParser struct {
+	tokens []string
+	pos    int
+	names  map[string]string
+	values map[string]types.AttributeValue
+}
+
+func parseCondition(
+	expression string, names map[string]string, values map[string]types.AttributeValue,
+) (condition, error) {
+	tokens, err := tokenize(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &expressionParser{tokens: tokens, names: names, values: values}
+
+	cond, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.done() {
+		return nil, fmt.Errorf("unexpected token '%s' in expression '%s'", p.peek(), expression)
+	}
+
+	return cond, nil
+}
+
+func tokenize(expression string) ([]string, error) {
+	var tokens []string
+
+	runes := []rune(expression)
+
+	for idx := 0; idx < len(runes); {
+		r := runes[idx]
+
+		switch {
+		case unicode.IsSpace(r):
+			idx++
+		case strings.ContainsRune("(),+-", r):
+			tokens = append(tokens, string(r))
+			idx++
+		case r == '=':
+			tokens = append(tokens, "=")
+			idx++
+		case r == '<' || r == '>':
+			if idx+1 < len(runes) && (runes[idx+1] == '=' || (r == '<' && runes[idx+1] == '>')) {
+				tokens = append(tokens, string(runes[idx:idx+2]))
+				idx += 2
+			} else {
+				tokens = append(tokens, string(r))
+				idx++
+			}
+		case r == '#' || r == ':' || r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r):
+			start := idx
+
+			idx++
+
+			for idx < len(runes) && (runes[idx] == '_' || runes[idx] == '.' ||
+				unicode.IsLetter(runes[idx]) || unicode.IsDigit(runes[idx])) {
+				idx++
+			}
+
+			tokens = append(tokens, string(runes[start:idx]))
+		default:
+			return nil, fmt.Errorf("unexpected character '%c' in expression '%s'", r, expression)
+		}
+	}
+
+	return tokens, nil
+}
+
+func (p *expressionParser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *expressionParser) peek() string {
+	if p.done() {
+		return ""
+	}
+
+	return p.tokens[p.pos]
+}
+
+func (p *expressionParser) next() string {
+	token := p.peek()
+	p.pos++
+
+	return token
+}
+
+func (p *expressionParser) isKeyword(keyword string) bool {
+	return strings.EqualFold(p.peek(), keyword)
+}
+
+func (p *expressionParser) expect(token string) error {
+	if got := p.next(); !strings.EqualFold(got, token) {
+		return fmt.Errorf("expected '%s' but found '%s'", token, got)
+	}
+
+	return nil
+}
+
+func (p *expressionParser) parseOr() (condition, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isKeyword("OR") {
+		p.next()
+
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		left = orCondition{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *expressionParser) parseAnd() (condition, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isKeyword("AND") {
+		p.next()
+
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+
+		left = andCondition{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *expressionParser) parseNot() (condition, error) {
+	if p.isKeyword("NOT") {
+		p.next()
+
+		inner, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+
+		return notCondition{inner: inner}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *expressionParser) parsePrimary() (condition, error) {
+	if p.peek() == "(" {
+		p.next()
+
+		cond, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		return cond, p.expect(")")
+	}
+
+	if name := strings.ToLower(p.peek()); p.pos+1 < len(p.tokens) && p.tokens[p.pos+1] == "(" && name != "size" {
+		return p.parseFunction()
+	}
+
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case p.isKeyword("BETWEEN"):
+		p.next()
+
+		lower, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := p.expect("AND"); err != nil {
+			return nil, err
+		}
+
+		upper, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+
+		return betweenCondition{value: left, lower: lower, upper: upper}, nil
+	case p.isKeyword("IN"):
+		p.next()
+
+		options, err := p.parseArguments()
+		if err != nil {
+			return nil, err
+		}
+
+		return inCondition{value: left, options: options}, nil
+	}
+
+	comparator := p.next()
+
+	switch comparator {
+	case "=", "<>", "<", "<=", ">", ">=":
+	default:
+		return nil, fmt.Errorf("expected comparator but found '%s'", comparator)
+	}
+
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	return comparison{comparator: comparator, left: left, right: right}, nil
+}
+
+func (p *expressionParser) parseFunction() (condition, error) {
+	name := strings.ToLower(p.next())
+
+	args, err := p.parseArguments()
+	if err != nil {
+		return nil, err
+	}
+
+	expected := map[string]int{
+		"attribute_exists":     1,
+		"attribute_not_exists": 1,
+		"attribute_type":       2,
+		"begins_with":          2,
+		"contains":             2,
+	}
+
+	count, ok := expected[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported function '%s'", name)
+	}
+
+	if len(args) != count {
+		return nil, fmt.Errorf("function '%s' expects %d arguments, got %d", name, count, len(args))
+	}
+
+	return functionCondition{name: name, args: args}, nil
+}
+
+func (p *expressionParser) parseArguments() ([]operand, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	var args []operand
+
+	for {
+		arg, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+
+		args = append(args, arg)
+
+		if p.peek() != "," {
+			break
+		}
+
+		p.next()
+	}
+
+	return args, p.expect(")")
+}
+
+func (p *expressionParser) parseOperand() (operand, error) {
+	token := p.next()
+
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case strings.EqualFold(token, "size") && p.peek() == "(":
+		p.next()
+
+		path, err := p.parsePath(p.next())
+		if err != nil {
+			return nil, err
+		}
+
+		return sizeOperand{path: path}, p.expect(")")
+	case strings.HasPrefix(token, ":"):
+		value, ok := p.values[token]
+		if !ok {
+			return nil, fmt.Errorf("expression attribute value '%s' not defined", token)
+		}
+
+		return valueOperand{value: value}, nil
+	}
+
+	return p.parsePath(token)
+}
+
+func (p *expressionParser) parsePath(token string) (pathOperand, error) {
+	if strings.HasPrefix(token, "#") {
+		name, ok := p.names[token]
+		if !ok {
+			return pathOperand{}, fmt.Errorf("expression attribute name '%s' not defined", token)
+		}
+
+		return pathOperand{name: name}, nil
+	}
+
+	if token == "" || strings.ContainsAny(token, "().,") {
+		return pathOperand{}, fmt.Errorf("invalid attribute name '%s'", token)
+	}
+
+	if reservedWords[strings.ToUpper(token)] {
+		return pathOperand{}, fmt.Errorf(
+			"attribute name is a reserved keyword; reserved keyword: %s", token,
+		)
+	}
+
+	return pathOperand{name: token}, nil
+}
+
+// ifNotExistsOperand is the if_not_exists function of a SET action, taking
+// the value of the attribute when present and the fallback otherwise.
+type ifNotExistsOperand struct {
+	path     pathOperand
+	fallback operand
+}
+
+func (o ifNotExistsOperand) resolve(it item) (types.AttributeValue, bool) {
+	if value, ok := o.path.resolve(it); ok {
+		return value, true
+	}
+
+	return o.fallback.resolve(it)
+}
+
+// arithmeticOperand adds or subtracts two numbers within a SET action.
+type arithmeticOperand struct {
+	subtract    bool
+	left, right operand
+}
+
+func (o arithmeticOperand) resolve(it item) (types.AttributeValue, bool) {
+	left, ok := o.left.resolve(it)
+	if !ok {
+		return nil, false
+	}
+
+	right, ok := o.right.resolve(it)
+	if !ok {
+		return nil, false
+	}
+
+	return addNumbers(left, right, o.subtract)
+}
+
+func addNumbers(left, right types.AttributeValue, subtract bool) (types.AttributeValue, bool) {
+	l, lOk := left.(*types.AttributeValueMemberN)
+	r, rOk := right.(*types.AttributeValueMemberN)
+
+	if !lOk || !rOk {
+		return nil, false
+	}
+
+	lNum, lOk := new(big.Float).SetString(l.Value)
+	rNum, rOk := new(big.Float).SetString(r.Value)
+
+	if !lOk || !rOk {
+		return nil, false
+	}
+
+	if subtract {
+		rNum.Neg(rNum)
+	}
+
+	return &types.AttributeValueMemberN{Value: new(big.Float).Add(lNum, rNum).Text('f', -1)}, true
+}
+
+// updateAction is a single action of an update expression, modifying the
+// item in place.
+type updateAction func(it item) error
+
+// parseUpdate parses the SET, ADD and REMOVE clauses of an update expression,
+// DELETE of set members is not supported.
+func parseUpdate(
+	expression string, names map[string]string, values map[string]types.AttributeValue,
+) ([]updateAction, error) {
+	tokens, err := tokenize(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &expressionParser{tokens: tokens, names: names, values: values}
+
+	var actions []updateAction
+
+	for !p.done() {
+		clause := strings.ToUpper(p.next())
+
+		for {
+			var action updateAction
+
+			switch clause {
+			case "SET":
+				action, err = p.parseSetAction()
+			case "ADD":
+				action, err = p.parseAddAction()
+			case "REMOVE":
+				action, err = p.parseRemoveAction()
+			default:
+				return nil, fmt.Errorf("unsupported clause '%s' in expression '%s'", clause, expression)
+			}
+
+			if err != nil {
+				return nil, err
+			}
+
+			actions = append(actions, action)
+
+			if p.peek() != "," {
+				break
+			}
+
+			p.next()
+		}
+	}
+
+	if len(actions) == 0 {
+		return nil, fmt.Errorf("empty update expression")
+	}
+
+	return actions, nil
+}
+
+func (p *expressionParser) parseSetAction() (updateAction, error) {
+	path, err := p.parsePath(p.next())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.expect("="); err != nil {
+		return nil, err
+	}
+
+	value, err := p.parseSetOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.peek() == "+" || p.peek() == "-" {
+		subtract := p.next() == "-"
+
+		right, err := p.parseSetOperand()
+		if err != nil {
+			return nil, err
+		}
+
+		value = arithmeticOperand{subtract: subtract, left: value, right: right}
+	}
+
+	return func(it item) error {
+		resolved, ok := value.resolve(it)
+		if !ok {
+			return fmt.Errorf("the value of %s refers to a missing attribute or is not a number", path.name)
+		}
+
+		it[path.name] = resolved
+
+		return nil
+	}, nil
+}
+
+func (p *expressionParser) parseSetOperand() (operand, error) {
+	if !strings.EqualFold(p.peek(), "if_not_exists") {
+		return p.parseOperand()
+	}
+
+	p.next()
+
+	args, err := p.parseArguments()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(args) != 2 {
+		return nil, fmt.Errorf("function 'if_not_exists' expects 2 arguments, got %d", len(args))
+	}
+
+	path, ok := args[0].(pathOperand)
+	if !ok {
+		return nil, fmt.Errorf("first argument of 'if_not_exists' must be an attribute")
+	}
+
+	return ifNotExistsOperand{path: path, fallback: args[1]}, nil
+}
+
+func (p *expressionParser) parseAddAction() (updateAction, error) {
+	path, err := p.parsePath(p.next())
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := value.(valueOperand); !ok {
+		return nil, fmt.Errorf("ADD of %s requires a value", path.name)
+	}
+
+	return func(it item) error {
+		added, _ := value.resolve(it)
+
+		current, ok := path.resolve(it)
+		if !ok {
+			if _, ok := added.(*types.AttributeValueMemberN); !ok {
+				return fmt.Errorf("ADD of %s only supports numbers", path.name)
+			}
+
+			it[path.name] = added
+
+			return nil
+		}
+
+		sum, ok := addNumbers(current, added, false)
+		if !ok {
+			return fmt.Errorf("ADD of %s only supports numbers", path.name)
+		}
+
+		it[path.name] = sum
+
+		return nil
+	}, nil
+}
+
+func (p *expressionParser) parseRemoveAction() (updateAction, error) {
+	path, err := p.parsePath(p.next())
+	if err != nil {
+		return nil, err
+	}
+
+	return func(it item) error {
+		delete(it, path.name)
+
+		return nil
+	}, nil
+}
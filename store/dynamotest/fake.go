@@ -0,0 +1,1017 @@
+// Package dynamotest provides an in-process fake of the DynamoDB API used by
+// the store, so that tests can exercise the real store code paths without
+// needing dynamodb-local running in docker.
+//
+// Unlike the generated mocks the fake keeps items in memory, evaluates the
+// condition, key condition and filter expressions sent to it and returns the
+// same error types as DynamoDB, such as TransactionCanceledException with
+// cancellation reasons for each item in the transaction. Tables with a
+// stream enabled record every write, which are read back through the
+// DynamoDB Streams API also implemented by the fake.
+package dynamotest
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+)
+
+// maxTransactItems is the limit of items DynamoDB accepts in a single
+// TransactWriteItems call.
+const maxTransactItems = 25
+
+// maxBatchGetKeys is the limit of keys DynamoDB accepts in a single
+// BatchGetItem call.
+const maxBatchGetKeys = 100
+
+type keySchema struct {
+	hashKey  string
+	rangeKey string
+}
+
+type table struct {
+	description types.TableDescription
+	keys        keySchema
+	indexes     map[string]keySchema
+	items       map[string]item
+	// stream records the changes to the items while enabled
+	stream *stream
+}
+
+// FakeDynamoDB implements the store.DynamoDBAPI interface in memory. All
+// operations are serialized so transactions are trivially atomic.
+type FakeDynamoDB struct {
+	mu     sync.Mutex
+	tables map[string]*table
+}
+
+func New() *FakeDynamoDB {
+	return &FakeDynamoDB{
+		tables: map[string]*table{},
+	}
+}
+
+func validationError(format string, args ...interface{}) error {
+	return &smithy.GenericAPIError{
+		Code:    "ValidationException",
+		Message: fmt.Sprintf(format, args...),
+		Fault:   smithy.FaultClient,
+	}
+}
+
+func keySchemaFrom(elements []types.KeySchemaElement) keySchema {
+	var keys keySchema
+
+	for _, element := range elements {
+		if element.KeyType == types.KeyTypeHash {
+			keys.hashKey = aws.ToString(element.AttributeName)
+		} else {
+			keys.rangeKey = aws.ToString(element.AttributeName)
+		}
+	}
+
+	return keys
+}
+
+func copyItem(it item) item {
+	if it == nil {
+		return nil
+	}
+
+	copied := make(item, len(it))
+	for name, value := range it {
+		copied[name] = value
+	}
+
+	return copied
+}
+
+func (f *FakeDynamoDB) table(name *string) (*table, error) {
+	t, ok := f.tables[aws.ToString(name)]
+	if !ok {
+		return nil, &types.ResourceNotFoundException{
+			Message: aws.String(fmt.Sprintf("Requested resource not found: Table: %s not found", aws.ToString(name))),
+		}
+	}
+
+	return t, nil
+}
+
+// keyString returns the value of a key attribute, which the store always
+// defines as a string.
+func keyString(it item, name string) (string, bool) {
+	value, ok := it[name].(*types.AttributeValueMemberS)
+	if !ok {
+		return "", false
+	}
+
+	return value.Value, true
+}
+
+// primaryKey validates the key attributes of the item and returns a string
+// identifying it uniquely within the table.
+func (t *table) primaryKey(it item) (string, error) {
+	hash, ok := keyString(it, t.keys.hashKey)
+	if !ok || hash == "" {
+		return "", validationError("One or more parameter values were invalid: Missing the key %s in the item", t.keys.hashKey)
+	}
+
+	if t.keys.rangeKey == "" {
+		return hash, nil
+	}
+
+	rangeValue, ok := keyString(it, t.keys.rangeKey)
+	if !ok || rangeValue == "" {
+		return "", validationError("One or more parameter values were invalid: Missing the key %s in the item", t.keys.rangeKey)
+	}
+
+	return hash + "\x00" + rangeValue, nil
+}
+
+// keyOf extracts only the table key attributes from an item.
+func (t *table) keyOf(it item) item {
+	key := item{t.keys.hashKey: it[t.keys.hashKey]}
+
+	if t.keys.rangeKey != "" {
+		key[t.keys.rangeKey] = it[t.keys.rangeKey]
+	}
+
+	return key
+}
+
+func (t *table) validateIndexKeys(it item) error {
+	for name, index := range t.indexes {
+		for _, attr := range []string{index.hashKey, index.rangeKey} {
+			if attr == "" {
+				continue
+			}
+
+			if value, ok := keyString(it, attr); ok && value == "" {
+				return validationError(
+					"One or more parameter values are not valid. A value specified for a secondary index key "+
+						"is not supported. The AttributeValue for a key attribute cannot contain an empty string "+
+						"value. IndexName: %s, IndexKey: %s", name, attr,
+				)
+			}
+		}
+	}
+
+	return nil
+}
+
+func checkCondition(
+	expression *string, names map[string]string, values map[string]types.AttributeValue, current item,
+) (bool, error) {
+	if expression == nil {
+		return true, nil
+	}
+
+	cond, err := parseCondition(*expression, names, values)
+	if err != nil {
+		return false, validationError("Invalid ConditionExpression: %v", err)
+	}
+
+	if current == nil {
+		current = item{}
+	}
+
+	return cond.eval(current)
+}
+
+func (f *FakeDynamoDB) CreateTable(
+	ctx context.Context, input *dynamodb.CreateTableInput, opts ...func(*dynamodb.Options),
+) (*dynamodb.CreateTableOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name := aws.ToString(input.TableName)
+	if _, ok := f.tables[name]; ok {
+		return nil, &types.ResourceInUseException{
+			Message: aws.String(fmt.Sprintf("Cannot create preexisting table: %s", name)),
+		}
+	}
+
+	t := &table{
+		keys:    keySchemaFrom(input.KeySchema),
+		indexes: map[string]keySchema{},
+		items:   map[string]item{},
+		description: types.TableDescription{
+			TableName:            aws.String(name),
+			TableStatus:          types.TableStatusActive,
+			KeySchema:            input.KeySchema,
+			AttributeDefinitions: input.AttributeDefinitions,
+		},
+	}
+
+	for _, gsi := range input.GlobalSecondaryIndexes {
+		t.indexes[aws.ToString(gsi.IndexName)] = keySchemaFrom(gsi.KeySchema)
+		t.description.GlobalSecondaryIndexes = append(
+			t.description.GlobalSecondaryIndexes,
+			types.GlobalSecondaryIndexDescription{
+				IndexName:   gsi.IndexName,
+				IndexStatus: types.IndexStatusActive,
+				KeySchema:   gsi.KeySchema,
+				Projection:  gsi.Projection,
+			},
+		)
+	}
+
+	if input.StreamSpecification != nil && aws.ToBool(input.StreamSpecification.StreamEnabled) {
+		if err := t.updateStream(input.StreamSpecification); err != nil {
+			return nil, err
+		}
+	}
+
+	f.tables[name] = t
+
+	return &dynamodb.CreateTableOutput{TableDescription: &t.description}, nil
+}
+
+func (f *FakeDynamoDB) DescribeTable(
+	ctx context.Context, input *dynamodb.DescribeTableInput, opts ...func(*dynamodb.Options),
+) (*dynamodb.DescribeTableOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	t, err := f.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	description := t.description
+	description.ItemCount = int64(len(t.items))
+	description.GlobalSecondaryIndexes = append(
+		[]types.GlobalSecondaryIndexDescription(nil), t.description.GlobalSecondaryIndexes...,
+	)
+
+	return &dynamodb.DescribeTableOutput{Table: &description}, nil
+}
+
+// UpdateTable supports creating and deleting global secondary indexes, and
+// enabling or disabling the stream. New indexes are immediately active as
+// the items are already in memory.
+func (f *FakeDynamoDB) UpdateTable(
+	ctx context.Context, input *dynamodb.UpdateTableInput, opts ...func(*dynamodb.Options),
+) (*dynamodb.UpdateTableOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	t, err := f.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(input.GlobalSecondaryIndexUpdates) > 1 {
+		return nil, validationError("Only 1 online index can be created or deleted simultaneously per table")
+	}
+
+	for _, update := range input.GlobalSecondaryIndexUpdates {
+		switch {
+		case update.Create != nil:
+			name := aws.ToString(update.Create.IndexName)
+			if _, ok := t.indexes[name]; ok {
+				return nil, validationError("Attempting to create an index which already exists")
+			}
+
+			t.indexes[name] = keySchemaFrom(update.Create.KeySchema)
+			t.description.GlobalSecondaryIndexes = append(
+				t.description.GlobalSecondaryIndexes,
+				types.GlobalSecondaryIndexDescription{
+					IndexName:   update.Create.IndexName,
+					IndexStatus: types.IndexStatusActive,
+					KeySchema:   update.Create.KeySchema,
+					Projection:  update.Create.Projection,
+				},
+			)
+		case update.Delete != nil:
+			name := aws.ToString(update.Delete.IndexName)
+			if _, ok := t.indexes[name]; !ok {
+				return nil, &types.ResourceNotFoundException{
+					Message: aws.String(fmt.Sprintf("Requested resource not found: Index: %s not found", name)),
+				}
+			}
+
+			delete(t.indexes, name)
+
+			remaining := t.description.GlobalSecondaryIndexes[:0]
+			for _, gsi := range t.description.GlobalSecondaryIndexes {
+				if aws.ToString(gsi.IndexName) != name {
+					remaining = append(remaining, gsi)
+				}
+			}
+
+			t.description.GlobalSecondaryIndexes = remaining
+		default:
+			return nil, validationError("Only Create and Delete index updates are supported")
+		}
+	}
+
+	if input.StreamSpecification != nil {
+		if err := t.updateStream(input.StreamSpecification); err != nil {
+			return nil, err
+		}
+	}
+
+	t.description.AttributeDefinitions = mergeAttributeDefinitions(
+		t.description.AttributeDefinitions, input.AttributeDefinitions,
+	)
+
+	description := t.description
+
+	return &dynamodb.UpdateTableOutput{TableDescription: &description}, nil
+}
+
+func mergeAttributeDefinitions(current, added []types.AttributeDefinition) []types.AttributeDefinition {
+	merged := append([]types.AttributeDefinition(nil), current...)
+
+	for _, definition := range added {
+		found := false
+
+		for _, existing := range merged {
+			if aws.ToString(existing.AttributeName) == aws.ToString(definition.AttributeName) {
+				found = true
+
+				break
+			}
+		}
+
+		if !found {
+			merged = append(merged, definition)
+		}
+	}
+
+	return merged
+}
+
+func (f *FakeDynamoDB) ListTables(
+	ctx context.Context, input *dynamodb.ListTablesInput, opts ...func(*dynamodb.Options),
+) (*dynamodb.ListTablesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	names := make([]string, 0, len(f.tables))
+	for name := range f.tables {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return &dynamodb.ListTablesOutput{TableNames: names}, nil
+}
+
+func (f *FakeDynamoDB) GetItem(
+	ctx context.Context, input *dynamodb.GetItemInput, opts ...func(*dynamodb.Options),
+) (*dynamodb.GetItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	t, err := f.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := t.primaryKey(input.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dynamodb.GetItemOutput{Item: copyItem(t.items[key])}, nil
+}
+
+// BatchGetItem returns every existing item requested, the fake is never
+// throttled so there are no UnprocessedKeys.
+func (f *FakeDynamoDB) BatchGetItem(
+	ctx context.Context, input *dynamodb.BatchGetItemInput, opts ...func(*dynamodb.Options),
+) (*dynamodb.BatchGetItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	output := &dynamodb.BatchGetItemOutput{Responses: map[string][]map[string]types.AttributeValue{}}
+	count := 0
+
+	for name, request := range input.RequestItems {
+		t, err := f.table(aws.String(name))
+		if err != nil {
+			return nil, err
+		}
+
+		seen := map[string]bool{}
+
+		for _, keyItem := range request.Keys {
+			key, err := t.primaryKey(keyItem)
+			if err != nil {
+				return nil, err
+			}
+
+			if seen[key] {
+				return nil, validationError("Provided list of item keys contains duplicates")
+			}
+
+			seen[key] = true
+
+			if it, ok := t.items[key]; ok {
+				output.Responses[name] = append(output.Responses[name], copyItem(it))
+			}
+		}
+
+		count += len(request.Keys)
+	}
+
+	if count == 0 || count > maxBatchGetKeys {
+		return nil, validationError(
+			"Member must have length less than or equal to %d and greater than or equal to 1", maxBatchGetKeys,
+		)
+	}
+
+	return output, nil
+}
+
+func (f *FakeDynamoDB) PutItem(
+	ctx context.Context, input *dynamodb.PutItemInput, opts ...func(*dynamodb.Options),
+) (*dynamodb.PutItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	t, err := f.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := t.primaryKey(input.Item)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.validateIndexKeys(input.Item); err != nil {
+		return nil, err
+	}
+
+	ok, err := checkCondition(
+		input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues, t.items[key],
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, &types.ConditionalCheckFailedException{Message: aws.String("The conditional request failed")}
+	}
+
+	t.write(key, copyItem(input.Item))
+
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *FakeDynamoDB) UpdateItem(
+	ctx context.Context, input *dynamodb.UpdateItemInput, opts ...func(*dynamodb.Options),
+) (*dynamodb.UpdateItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	t, err := f.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := t.primaryKey(input.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	current := t.items[key]
+
+	ok, err := checkCondition(
+		input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues, current,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, &types.ConditionalCheckFailedException{Message: aws.String("The conditional request failed")}
+	}
+
+	updated, err := t.updatedItem(
+		key, input.Key, current, input.UpdateExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	t.write(key, updated)
+
+	output := &dynamodb.UpdateItemOutput{}
+
+	switch input.ReturnValues {
+	case types.ReturnValueAllNew:
+		output.Attributes = copyItem(updated)
+	case types.ReturnValueAllOld:
+		output.Attributes = copyItem(current)
+	}
+
+	return output, nil
+}
+
+// updatedItem applies the update expression to a copy of the current item,
+// which is created from the key when it does not exist as DynamoDB does.
+func (t *table) updatedItem(
+	key string, keyItem, current item, expression *string, names map[string]string, values map[string]types.AttributeValue,
+) (item, error) {
+	if expression == nil {
+		return nil, validationError("UpdateExpression is required")
+	}
+
+	actions, err := parseUpdate(*expression, names, values)
+	if err != nil {
+		return nil, validationError("Invalid UpdateExpression: %v", err)
+	}
+
+	updated := copyItem(current)
+	if updated == nil {
+		updated = t.keyOf(keyItem)
+	}
+
+	for _, action := range actions {
+		if err := action(updated); err != nil {
+			return nil, validationError("Invalid UpdateExpression: %v", err)
+		}
+	}
+
+	if updatedKey, err := t.primaryKey(updated); err != nil || updatedKey != key {
+		return nil, validationError("One or more parameter values were invalid: Cannot update attribute of the key")
+	}
+
+	if err := t.validateIndexKeys(updated); err != nil {
+		return nil, err
+	}
+
+	return updated, nil
+}
+
+func (f *FakeDynamoDB) DeleteItem(
+	ctx context.Context, input *dynamodb.DeleteItemInput, opts ...func(*dynamodb.Options),
+) (*dynamodb.DeleteItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	t, err := f.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := t.primaryKey(input.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := checkCondition(
+		input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues, t.items[key],
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, &types.ConditionalCheckFailedException{Message: aws.String("The conditional request failed")}
+	}
+
+	output := &dynamodb.DeleteItemOutput{}
+	if input.ReturnValues == types.ReturnValueAllOld {
+		output.Attributes = copyItem(t.items[key])
+	}
+
+	t.remove(key)
+
+	return output, nil
+}
+
+// sortedItems returns the items visible through the index, or the table if
+// no index is named, in the order DynamoDB would return them.
+func (t *table) sortedItems(indexName *string) ([]item, keySchema, error) {
+	keys := t.keys
+
+	if indexName != nil {
+		index, ok := t.indexes[*indexName]
+		if !ok {
+			return nil, keySchema{}, validationError(
+				"The table does not have the specified index: %s", *indexName,
+			)
+		}
+
+		keys = index
+	}
+
+	var items []item
+
+	for _, it := range t.items {
+		// secondary indexes are sparse, only containing items that have
+		// the index key attributes
+		if _, ok := keyString(it, keys.hashKey); !ok {
+			continue
+		}
+
+		if keys.rangeKey != "" {
+			if _, ok := keyString(it, keys.rangeKey); !ok {
+				continue
+			}
+		}
+
+		items = append(items, it)
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return t.compareItems(items[i], items[j], keys) < 0
+	})
+
+	return items, keys, nil
+}
+
+// compareItems orders items by the index keys followed by the table keys,
+// giving a stable order even where index keys are not unique.
+func (t *table) compareItems(left, right item, indexKeys keySchema) int {
+	for _, name := range []string{indexKeys.hashKey, indexKeys.rangeKey, t.keys.hashKey, t.keys.rangeKey} {
+		if name == "" {
+			continue
+		}
+
+		leftValue, _ := keyString(left, name)
+		rightValue, _ := keyString(right, name)
+
+		if order := strings.Compare(leftValue, rightValue); order != 0 {
+			return order
+		}
+	}
+
+	return 0
+}
+
+// page applies the exclusive start key, limit and filter to the candidate
+// items, following DynamoDB in applying the limit before the filter.
+func (t *table) page(
+	candidates []item, indexKeys keySchema, startKey item, limit *int32,
+	forward bool, filter condition,
+) (items []item, scanned int32, lastKey item, err error) {
+	start := 0
+
+	if len(startKey) > 0 {
+		if _, err := t.primaryKey(startKey); err != nil {
+			return nil, 0, nil, validationError("The provided starting key is invalid: %v", err)
+		}
+
+		// resume after the position of the start key, which need not
+		// still exist
+		start = sort.Search(len(candidates), func(idx int) bool {
+			order := t.compareItems(candidates[idx], startKey, indexKeys)
+			if forward {
+				return order > 0
+			}
+
+			return order < 0
+		})
+	}
+
+	for idx := start; idx < len(candidates); idx++ {
+		if limit != nil && scanned >= *limit {
+			break
+		}
+
+		it := candidates[idx]
+		scanned++
+
+		lastKey = t.keyOf(it)
+		for _, attr := range []string{indexKeys.hashKey, indexKeys.rangeKey} {
+			if attr != "" {
+				lastKey[attr] = it[attr]
+			}
+		}
+
+		if filter != nil {
+			match, err := filter.eval(it)
+			if err != nil {
+				return nil, 0, nil, err
+			}
+
+			if !match {
+				continue
+			}
+		}
+
+		items = append(items, copyItem(it))
+	}
+
+	// only hand back a key to continue from if the limit stopped the read
+	if limit == nil || scanned < *limit {
+		lastKey = nil
+	}
+
+	return items, scanned, lastKey, nil
+}
+
+func (f *FakeDynamoDB) Query(
+	ctx context.Context, input *dynamodb.QueryInput, opts ...func(*dynamodb.Options),
+) (*dynamodb.QueryOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	t, err := f.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	if input.KeyConditionExpression == nil {
+		return nil, validationError("Either the KeyConditions or KeyConditionExpression parameter must be specified")
+	}
+
+	keyCondition, err := parseCondition(
+		*input.KeyConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues,
+	)
+	if err != nil {
+		return nil, validationError("Invalid KeyConditionExpression: %v", err)
+	}
+
+	var filter condition
+	if input.FilterExpression != nil {
+		filter, err = parseCondition(*input.FilterExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+		if err != nil {
+			return nil, validationError("Invalid FilterExpression: %v", err)
+		}
+	}
+
+	all, keys, err := t.sortedItems(input.IndexName)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []item
+
+	for _, it := range all {
+		match, err := keyCondition.eval(it)
+		if err != nil {
+			return nil, err
+		}
+
+		if match {
+			candidates = append(candidates, it)
+		}
+	}
+
+	forward := input.ScanIndexForward == nil || *input.ScanIndexForward
+	if !forward {
+		for i, j := 0, len(candidates)-1; i < j; i, j = i+1, j-1 {
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+		}
+	}
+
+	items, scanned, lastKey, err := t.page(candidates, keys, input.ExclusiveStartKey, input.Limit, forward, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dynamodb.QueryOutput{
+		Items:            items,
+		Count:            int32(len(items)),
+		ScannedCount:     scanned,
+		LastEvaluatedKey: lastKey,
+	}, nil
+}
+
+func (f *FakeDynamoDB) Scan(
+	ctx context.Context, input *dynamodb.ScanInput, opts ...func(*dynamodb.Options),
+) (*dynamodb.ScanOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	t, err := f.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	var filter condition
+	if input.FilterExpression != nil {
+		filter, err = parseCondition(*input.FilterExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+		if err != nil {
+			return nil, validationError("Invalid FilterExpression: %v", err)
+		}
+	}
+
+	all, keys, err := t.sortedItems(input.IndexName)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := all
+
+	if input.TotalSegments != nil {
+		segment := aws.ToInt32(input.Segment)
+		if segment < 0 || segment >= *input.TotalSegments {
+			return nil, validationError("Segment must be less than TotalSegments")
+		}
+
+		candidates = nil
+
+		for _, it := range all {
+			hash, _ := keyString(it, t.keys.hashKey)
+			if segmentOf(hash, *input.TotalSegments) == segment {
+				candidates = append(candidates, it)
+			}
+		}
+	}
+
+	items, scanned, lastKey, err := t.page(candidates, keys, input.ExclusiveStartKey, input.Limit, true, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dynamodb.ScanOutput{
+		Items:            items,
+		Count:            int32(len(items)),
+		ScannedCount:     scanned,
+		LastEvaluatedKey: lastKey,
+	}, nil
+}
+
+// segmentOf assigns items to parallel scan segments by their partition key.
+func segmentOf(hash string, total int32) int32 {
+	var sum uint32
+
+	for _, b := range []byte(hash) {
+		sum = sum*31 + uint32(b)
+	}
+
+	return int32(sum % uint32(total))
+}
+
+// transactOperation is the common view of a single TransactWriteItem used
+// to check conditions before any changes are applied.
+type transactOperation struct {
+	table     *table
+	key       string
+	condition *string
+	names     map[string]string
+	values    map[string]types.AttributeValue
+	apply     func()
+}
+
+func (f *FakeDynamoDB) transactOperation(twi types.TransactWriteItem) (transactOperation, error) {
+	switch {
+	case twi.Put != nil:
+		t, err := f.table(twi.Put.TableName)
+		if err != nil {
+			return transactOperation{}, err
+		}
+
+		key, err := t.primaryKey(twi.Put.Item)
+		if err != nil {
+			return transactOperation{}, err
+		}
+
+		if err := t.validateIndexKeys(twi.Put.Item); err != nil {
+			return transactOperation{}, err
+		}
+
+		newItem := copyItem(twi.Put.Item)
+
+		return transactOperation{
+			table: t, key: key, condition: twi.Put.ConditionExpression,
+			names: twi.Put.ExpressionAttributeNames, values: twi.Put.ExpressionAttributeValues,
+			apply: func() { t.write(key, newItem) },
+		}, nil
+	case twi.Update != nil:
+		t, err := f.table(twi.Update.TableName)
+		if err != nil {
+			return transactOperation{}, err
+		}
+
+		key, err := t.primaryKey(twi.Update.Key)
+		if err != nil {
+			return transactOperation{}, err
+		}
+
+		// no other operation of the transaction may touch the item, so the
+		// update can be computed before the conditions are checked
+		updated, err := t.updatedItem(
+			key, twi.Update.Key, t.items[key], twi.Update.UpdateExpression,
+			twi.Update.ExpressionAttributeNames, twi.Update.ExpressionAttributeValues,
+		)
+		if err != nil {
+			return transactOperation{}, err
+		}
+
+		return transactOperation{
+			table: t, key: key, condition: twi.Update.ConditionExpression,
+			names: twi.Update.ExpressionAttributeNames, values: twi.Update.ExpressionAttributeValues,
+			apply: func() { t.write(key, updated) },
+		}, nil
+	case twi.Delete != nil:
+		t, err := f.table(twi.Delete.TableName)
+		if err != nil {
+			return transactOperation{}, err
+		}
+
+		key, err := t.primaryKey(twi.Delete.Key)
+		if err != nil {
+			return transactOperation{}, err
+		}
+
+		return transactOperation{
+			table: t, key: key, condition: twi.Delete.ConditionExpression,
+			names: twi.Delete.ExpressionAttributeNames, values: twi.Delete.ExpressionAttributeValues,
+			apply: func() { t.remove(key) },
+		}, nil
+	case twi.ConditionCheck != nil:
+		t, err := f.table(twi.ConditionCheck.TableName)
+		if err != nil {
+			return transactOperation{}, err
+		}
+
+		key, err := t.primaryKey(twi.ConditionCheck.Key)
+		if err != nil {
+			return transactOperation{}, err
+		}
+
+		return transactOperation{
+			table: t, key: key, condition: twi.ConditionCheck.ConditionExpression,
+			names: twi.ConditionCheck.ExpressionAttributeNames, values: twi.ConditionCheck.ExpressionAttributeValues,
+			apply: func() {},
+		}, nil
+	}
+
+	return transactOperation{}, validationError("TransactWriteItem must contain one of Put, Update, Delete or ConditionCheck")
+}
+
+func (f *FakeDynamoDB) TransactWriteItems(
+	ctx context.Context, input *dynamodb.TransactWriteItemsInput, opts ...func(*dynamodb.Options),
+) (*dynamodb.TransactWriteItemsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(input.TransactItems) == 0 || len(input.TransactItems) > maxTransactItems {
+		return nil, validationError(
+			"Member must have length less than or equal to %d and greater than or equal to 1", maxTransactItems,
+		)
+	}
+
+	operations := make([]transactOperation, 0, len(input.TransactItems))
+	seen := map[string]bool{}
+
+	for _, twi := range input.TransactItems {
+		op, err := f.transactOperation(twi)
+		if err != nil {
+			return nil, err
+		}
+
+		itemKey := aws.ToString(op.table.description.TableName) + "\x00" + op.key
+		if seen[itemKey] {
+			return nil, validationError(
+				"Transaction request cannot include multiple operations on one item",
+			)
+		}
+
+		seen[itemKey] = true
+		operations = append(operations, op)
+	}
+
+	reasons := make([]types.CancellationReason, len(operations))
+	codes := make([]string, len(operations))
+	failed := false
+
+	for idx, op := range operations {
+		ok, err := checkCondition(op.condition, op.names, op.values, op.table.items[op.key])
+		if err != nil {
+			return nil, err
+		}
+
+		codes[idx] = "None"
+
+		if !ok {
+			failed = true
+			codes[idx] = "ConditionalCheckFailed"
+			reasons[idx].Message = aws.String("The conditional request failed")
+		}
+
+		reasons[idx].Code = aws.String(codes[idx])
+	}
+
+	if failed {
+		return nil, &types.TransactionCanceledException{
+			Message: aws.String(fmt.Sprintf(
+				"Transaction cancelled, please refer cancellation reasons for specific reasons [%s]",
+				strings.Join(codes, ", "),
+			)),
+			CancellationReasons: reasons,
+		}
+	}
+
+	for _, op := range operations {
+		op.apply()
+	}
+
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
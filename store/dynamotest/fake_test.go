@@ -0,0 +1,540 @@
+package dynamotest_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/electrofelix/gin-demo/store"
+	"github.com/electrofelix/gin-demo/store/dynamotest"
+)
+
+const tableName = "test-table"
+
+var _ store.DynamoDBAPI = (*dynamotest.FakeDynamoDB)(nil)
+
+func setupTable(t *testing.T) *dynamotest.FakeDynamoDB {
+	t.Helper()
+
+	fake := dynamotest.New()
+
+	_, err := fake.CreateTable(context.Background(), &dynamodb.CreateTableInput{
+		TableName: aws.String(tableName),
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("Id"), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String("objectType"), KeyType: types.KeyTypeRange},
+		},
+		GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String("objectType-index"),
+				KeySchema: []types.KeySchemaElement{
+					{AttributeName: aws.String("objectType"), KeyType: types.KeyTypeHash},
+					{AttributeName: aws.String("Id"), KeyType: types.KeyTypeRange},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	return fake
+}
+
+func newItem(id, objectType string, attrs ...string) map[string]types.AttributeValue {
+	it := map[string]types.AttributeValue{
+		"Id":         &types.AttributeValueMemberS{Value: id},
+		"objectType": &types.AttributeValueMemberS{Value: objectType},
+	}
+
+	for idx := 0; idx+1 < len(attrs); idx += 2 {
+		it[attrs[idx]] = &types.AttributeValueMemberS{Value: attrs[idx+1]}
+	}
+
+	return it
+}
+
+func putItem(t *testing.T, fake *dynamotest.FakeDynamoDB, it map[string]types.AttributeValue) {
+	t.Helper()
+
+	_, err := fake.PutItem(context.Background(), &dynamodb.PutItemInput{TableName: aws.String(tableName), Item: it})
+	require.NoError(t, err)
+}
+
+func TestFakeDynamoDB_CreateTable(t *testing.T) {
+	fake := setupTable(t)
+
+	_, err := fake.CreateTable(context.Background(), &dynamodb.CreateTableInput{TableName: aws.String(tableName)})
+
+	var inUse *types.ResourceInUseException
+	assert.True(t, errors.As(err, &inUse))
+
+	tables, err := fake.ListTables(context.Background(), &dynamodb.ListTablesInput{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{tableName}, tables.TableNames)
+}
+
+func TestFakeDynamoDB_UpdateTable(t *testing.T) {
+	fake := setupTable(t)
+	putItem(t, fake, newItem("user1", "UserInfo", "Email", "user1@example.com"))
+
+	_, err := fake.UpdateTable(context.Background(), &dynamodb.UpdateTableInput{
+		TableName: aws.String(tableName),
+		GlobalSecondaryIndexUpdates: []types.GlobalSecondaryIndexUpdate{
+			{
+				Create: &types.CreateGlobalSecondaryIndexAction{
+					IndexName: aws.String("email-index"),
+					KeySchema: []types.KeySchemaElement{
+						{AttributeName: aws.String("Email"), KeyType: types.KeyTypeHash},
+					},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	table, err := fake.DescribeTable(context.Background(), &dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+	require.NoError(t, err)
+	require.Len(t, table.Table.GlobalSecondaryIndexes, 2)
+	assert.Equal(t, types.IndexStatusActive, table.Table.GlobalSecondaryIndexes[1].IndexStatus)
+
+	// existing items are immediately visible through the new index
+	result, err := fake.Query(context.Background(), &dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		IndexName:              aws.String("email-index"),
+		KeyConditionExpression: aws.String("Email = :email"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":email": &types.AttributeValueMemberS{Value: "user1@example.com"},
+		},
+	})
+	require.NoError(t, err)
+	assert.Len(t, result.Items, 1)
+
+	_, err = fake.UpdateTable(context.Background(), &dynamodb.UpdateTableInput{
+		TableName: aws.String(tableName),
+		GlobalSecondaryIndexUpdates: []types.GlobalSecondaryIndexUpdate{
+			{Delete: &types.DeleteGlobalSecondaryIndexAction{IndexName: aws.String("email-index")}},
+		},
+	})
+	require.NoError(t, err)
+
+	table, err = fake.DescribeTable(context.Background(), &dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+	require.NoError(t, err)
+	assert.Len(t, table.Table.GlobalSecondaryIndexes, 1)
+}
+
+func TestFakeDynamoDB_PutItem(t *testing.T) {
+	tests := []struct {
+		name      string
+		condition string
+		values    map[string]types.AttributeValue
+		names     map[string]string
+		expected  bool
+	}{
+		{
+			name:      "not-exists",
+			condition: "attribute_not_exists(Id)",
+			expected:  false,
+		},
+		{
+			name:      "equal",
+			condition: "Email = :email",
+			values:    map[string]types.AttributeValue{":email": &types.AttributeValueMemberS{Value: "a@example.com"}},
+			expected:  true,
+		},
+		{
+			name:      "not-equal",
+			condition: "Email <> :email",
+			values:    map[string]types.AttributeValue{":email": &types.AttributeValueMemberS{Value: "a@example.com"}},
+			expected:  false,
+		},
+		{
+			name:      "missing-attribute",
+			condition: "Missing = :email",
+			values:    map[string]types.AttributeValue{":email": &types.AttributeValueMemberS{Value: "a@example.com"}},
+			expected:  false,
+		},
+		{
+			name:      "attribute-names",
+			condition: "#name = :name AND begins_with(Email, :prefix)",
+			names:     map[string]string{"#name": "Name"},
+			values: map[string]types.AttributeValue{
+				":name":   &types.AttributeValueMemberS{Value: "user"},
+				":prefix": &types.AttributeValueMemberS{Value: "a@"},
+			},
+			expected: true,
+		},
+		{
+			name:      "not-between",
+			condition: "NOT (attribute_not_exists(Id)) AND (#version BETWEEN :low AND :high OR Missing = :low)",
+			names:     map[string]string{"#version": "Version"},
+			values: map[string]types.AttributeValue{
+				":low":  &types.AttributeValueMemberN{Value: "1"},
+				":high": &types.AttributeValueMemberN{Value: "10"},
+			},
+			expected: true,
+		},
+		{
+			name:      "numeric-comparison",
+			condition: "Version < :version",
+			values:    map[string]types.AttributeValue{":version": &types.AttributeValueMemberN{Value: "10"}},
+			expected:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			fake := setupTable(t)
+
+			existing := newItem("id1", "UserInfo", "Email", "a@example.com", "Name", "user")
+			existing["Version"] = &types.AttributeValueMemberN{Value: "9"}
+			putItem(t, fake, existing)
+
+			_, err := fake.PutItem(context.Background(), &dynamodb.PutItemInput{
+				TableName:                 aws.String(tableName),
+				Item:                      newItem("id1", "UserInfo", "Email", "b@example.com"),
+				ConditionExpression:       aws.String(tt.condition),
+				ExpressionAttributeNames:  tt.names,
+				ExpressionAttributeValues: tt.values,
+			})
+			if tt.expected {
+				assert.NoError(t, err)
+
+				return
+			}
+
+			assert.Error(t, err)
+		})
+	}
+
+	t.Run("conditional-check-failed", func(t *testing.T) {
+		fake := setupTable(t)
+
+		putItem(t, fake, newItem("id1", "UserInfo"))
+
+		_, err := fake.PutItem(context.Background(), &dynamodb.PutItemInput{
+			TableName:           aws.String(tableName),
+			Item:                newItem("id1", "UserInfo"),
+			ConditionExpression: aws.String("attribute_not_exists(Id)"),
+		})
+
+		var ccfe *types.ConditionalCheckFailedException
+		assert.True(t, errors.As(err, &ccfe))
+	})
+
+	t.Run("reserved-word", func(t *testing.T) {
+		fake := setupTable(t)
+
+		_, err := fake.PutItem(context.Background(), &dynamodb.PutItemInput{
+			TableName:                 aws.String(tableName),
+			Item:                      newItem("id1", "UserInfo"),
+			ConditionExpression:       aws.String("Name = :name"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{":name": &types.AttributeValueMemberS{Value: "x"}},
+		})
+
+		var apiErr smithy.APIError
+		require.True(t, errors.As(err, &apiErr))
+		assert.Equal(t, "ValidationException", apiErr.ErrorCode())
+	})
+
+	t.Run("missing-key", func(t *testing.T) {
+		fake := setupTable(t)
+
+		_, err := fake.PutItem(context.Background(), &dynamodb.PutItemInput{
+			TableName: aws.String(tableName),
+			Item:      newItem("", "UserInfo"),
+		})
+		assert.Error(t, err)
+	})
+
+	t.Run("unknown-table", func(t *testing.T) {
+		fake := dynamotest.New()
+
+		_, err := fake.PutItem(context.Background(), &dynamodb.PutItemInput{
+			TableName: aws.String(tableName),
+			Item:      newItem("id1", "UserInfo"),
+		})
+
+		var notFound *types.ResourceNotFoundException
+		assert.True(t, errors.As(err, &notFound))
+	})
+}
+
+func TestFakeDynamoDB_BatchGetItem(t *testing.T) {
+	batchGet := func(fake *dynamotest.FakeDynamoDB, keys ...map[string]types.AttributeValue) (
+		*dynamodb.BatchGetItemOutput, error,
+	) {
+		return fake.BatchGetItem(context.Background(), &dynamodb.BatchGetItemInput{
+			RequestItems: map[string]types.KeysAndAttributes{tableName: {Keys: keys}},
+		})
+	}
+
+	t.Run("found-and-missing", func(t *testing.T) {
+		fake := setupTable(t)
+
+		putItem(t, fake, newItem("id1", "UserInfo", "Email", "a@example.com"))
+
+		output, err := batchGet(fake, newItem("id1", "UserInfo"), newItem("id2", "UserInfo"))
+		require.NoError(t, err)
+
+		assert.Equal(t, []map[string]types.AttributeValue{
+			newItem("id1", "UserInfo", "Email", "a@example.com"),
+		}, output.Responses[tableName])
+		assert.Empty(t, output.UnprocessedKeys)
+	})
+
+	t.Run("duplicate-keys", func(t *testing.T) {
+		fake := setupTable(t)
+
+		_, err := batchGet(fake, newItem("id1", "UserInfo"), newItem("id1", "UserInfo"))
+
+		var apiErr smithy.APIError
+		require.True(t, errors.As(err, &apiErr))
+		assert.Equal(t, "ValidationException", apiErr.ErrorCode())
+	})
+
+	t.Run("too-many-keys", func(t *testing.T) {
+		fake := setupTable(t)
+
+		keys := make([]map[string]types.AttributeValue, 0, 101)
+		for idx := 0; idx < 101; idx++ {
+			keys = append(keys, newItem(fmt.Sprintf("id%d", idx), "UserInfo"))
+		}
+
+		_, err := batchGet(fake, keys...)
+
+		var apiErr smithy.APIError
+		require.True(t, errors.As(err, &apiErr))
+		assert.Equal(t, "ValidationException", apiErr.ErrorCode())
+	})
+}
+
+func TestFakeDynamoDB_UpdateItem(t *testing.T) {
+	update := func(fake *dynamotest.FakeDynamoDB, expression string, values map[string]types.AttributeValue) (
+		*dynamodb.UpdateItemOutput, error,
+	) {
+		return fake.UpdateItem(context.Background(), &dynamodb.UpdateItemInput{
+			TableName:                 aws.String(tableName),
+			Key:                       newItem("id1", "UserInfo"),
+			UpdateExpression:          aws.String(expression),
+			ConditionExpression:       aws.String("attribute_exists(Id)"),
+			ExpressionAttributeValues: values,
+			ReturnValues:              types.ReturnValueAllNew,
+		})
+	}
+
+	t.Run("set-add-remove", func(t *testing.T) {
+		fake := setupTable(t)
+
+		putItem(t, fake, newItem("id1", "UserInfo", "Email", "a@example.com", "Alias", "user"))
+
+		values := map[string]types.AttributeValue{
+			":email": &types.AttributeValueMemberS{Value: "b@example.com"},
+			":one":   &types.AttributeValueMemberN{Value: "1"},
+			":zero":  &types.AttributeValueMemberN{Value: "0"},
+		}
+
+		for idx := 0; idx < 2; idx++ {
+			_, err := update(
+				fake, "SET Email = :email, Total = if_not_exists(Total, :zero) + :one REMOVE Alias ADD LoginCount :one",
+				values,
+			)
+			require.NoError(t, err)
+		}
+
+		output, err := update(fake, "ADD LoginCount :one", values)
+		require.NoError(t, err)
+
+		assert.Equal(t, &types.AttributeValueMemberS{Value: "b@example.com"}, output.Attributes["Email"])
+		assert.Equal(t, &types.AttributeValueMemberN{Value: "2"}, output.Attributes["Total"])
+		assert.Equal(t, &types.AttributeValueMemberN{Value: "3"}, output.Attributes["LoginCount"])
+		assert.NotContains(t, output.Attributes, "Alias")
+	})
+
+	t.Run("condition-failed", func(t *testing.T) {
+		fake := setupTable(t)
+
+		_, err := update(fake, "ADD LoginCount :one", map[string]types.AttributeValue{
+			":one": &types.AttributeValueMemberN{Value: "1"},
+		})
+
+		var ccfe *types.ConditionalCheckFailedException
+		assert.True(t, errors.As(err, &ccfe))
+	})
+
+	t.Run("key-attribute", func(t *testing.T) {
+		fake := setupTable(t)
+
+		putItem(t, fake, newItem("id1", "UserInfo"))
+
+		_, err := update(fake, "SET objectType = :type", map[string]types.AttributeValue{
+			":type": &types.AttributeValueMemberS{Value: "UserInfo#email"},
+		})
+
+		var apiErr smithy.APIError
+		require.True(t, errors.As(err, &apiErr))
+		assert.Equal(t, "ValidationException", apiErr.ErrorCode())
+	})
+
+	t.Run("add-string", func(t *testing.T) {
+		fake := setupTable(t)
+
+		putItem(t, fake, newItem("id1", "UserInfo", "Email", "a@example.com"))
+
+		_, err := update(fake, "ADD Email :email", map[string]types.AttributeValue{
+			":email": &types.AttributeValueMemberS{Value: "b@example.com"},
+		})
+
+		var apiErr smithy.APIError
+		require.True(t, errors.As(err, &apiErr))
+		assert.Equal(t, "ValidationException", apiErr.ErrorCode())
+	})
+}
+
+func TestFakeDynamoDB_Query(t *testing.T) {
+	fake := setupTable(t)
+
+	for idx := 0; idx < 5; idx++ {
+		putItem(t, fake, newItem(fmt.Sprintf("id%d", idx), "UserInfo", "Email", fmt.Sprintf("user%d@example.com", idx)))
+		putItem(t, fake, newItem(fmt.Sprintf("user%d@example.com", idx), "UserInfo#email"))
+	}
+
+	query := func(startKey map[string]types.AttributeValue) *dynamodb.QueryOutput {
+		output, err := fake.Query(context.Background(), &dynamodb.QueryInput{
+			TableName:              aws.String(tableName),
+			IndexName:              aws.String("objectType-index"),
+			KeyConditionExpression: aws.String("objectType = :type"),
+			FilterExpression:       aws.String("Email <> :email"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":type":  &types.AttributeValueMemberS{Value: "UserInfo"},
+				":email": &types.AttributeValueMemberS{Value: "user1@example.com"},
+			},
+			ExclusiveStartKey: startKey,
+			Limit:             aws.Int32(2),
+		})
+		require.NoError(t, err)
+
+		return output
+	}
+
+	// limit is applied before the filter so the first page only has one match
+	first := query(nil)
+	assert.Equal(t, int32(1), first.Count)
+	assert.Equal(t, int32(2), first.ScannedCount)
+	require.NotNil(t, first.LastEvaluatedKey)
+
+	second := query(first.LastEvaluatedKey)
+	assert.Equal(t, int32(2), second.Count)
+	require.NotNil(t, second.LastEvaluatedKey)
+
+	third := query(second.LastEvaluatedKey)
+	assert.Equal(t, int32(1), third.Count)
+	assert.Nil(t, third.LastEvaluatedKey)
+
+	t.Run("reverse", func(t *testing.T) {
+		output, err := fake.Query(context.Background(), &dynamodb.QueryInput{
+			TableName:              aws.String(tableName),
+			KeyConditionExpression: aws.String("Id = :id AND begins_with(objectType, :type)"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":id":   &types.AttributeValueMemberS{Value: "id3"},
+				":type": &types.AttributeValueMemberS{Value: "User"},
+			},
+			ScanIndexForward: aws.Bool(false),
+		})
+		require.NoError(t, err)
+
+		assert.Len(t, output.Items, 1)
+	})
+}
+
+func TestFakeDynamoDB_Scan(t *testing.T) {
+	fake := setupTable(t)
+
+	for idx := 0; idx < 20; idx++ {
+		putItem(t, fake, newItem(fmt.Sprintf("id%d", idx), "UserInfo"))
+	}
+
+	seen := map[string]bool{}
+
+	for segment := int32(0); segment < 3; segment++ {
+		output, err := fake.Scan(context.Background(), &dynamodb.ScanInput{
+			TableName:     aws.String(tableName),
+			Segment:       aws.Int32(segment),
+			TotalSegments: aws.Int32(3),
+		})
+		require.NoError(t, err)
+
+		for _, it := range output.Items {
+			id := it["Id"].(*types.AttributeValueMemberS).Value
+
+			assert.False(t, seen[id], "item %s returned by multiple segments", id)
+			seen[id] = true
+		}
+	}
+
+	assert.Len(t, seen, 20)
+}
+
+func TestFakeDynamoDB_TransactWriteItems(t *testing.T) {
+	t.Run("cancelled", func(t *testing.T) {
+		fake := setupTable(t)
+
+		putItem(t, fake, newItem("user1@example.com", "UserInfo#email"))
+
+		_, err := fake.TransactWriteItems(context.Background(), &dynamodb.TransactWriteItemsInput{
+			TransactItems: []types.TransactWriteItem{
+				{
+					Put: &types.Put{
+						TableName:           aws.String(tableName),
+						Item:                newItem("id1", "UserInfo"),
+						ConditionExpression: aws.String("attribute_not_exists(Id)"),
+					},
+				},
+				{
+					Put: &types.Put{
+						TableName:           aws.String(tableName),
+						Item:                newItem("user1@example.com", "UserInfo#email"),
+						ConditionExpression: aws.String("attribute_not_exists(Id)"),
+					},
+				},
+			},
+		})
+
+		var cancelled *types.TransactionCanceledException
+		require.True(t, errors.As(err, &cancelled))
+		require.Len(t, cancelled.CancellationReasons, 2)
+		assert.Equal(t, "None", *cancelled.CancellationReasons[0].Code)
+		assert.Equal(t, "ConditionalCheckFailed", *cancelled.CancellationReasons[1].Code)
+
+		// nothing from the transaction should have been applied
+		output, err := fake.GetItem(context.Background(), &dynamodb.GetItemInput{
+			TableName: aws.String(tableName),
+			Key:       newItem("id1", "UserInfo"),
+		})
+		require.NoError(t, err)
+		assert.Nil(t, output.Item)
+	})
+
+	t.Run("same-item-twice", func(t *testing.T) {
+		fake := setupTable(t)
+
+		_, err := fake.TransactWriteItems(context.Background(), &dynamodb.TransactWriteItemsInput{
+			TransactItems: []types.TransactWriteItem{
+				{Put: &types.Put{TableName: aws.String(tableName), Item: newItem("id1", "UserInfo")}},
+				{Delete: &types.Delete{TableName: aws.String(tableName), Key: newItem("id1", "UserInfo")}},
+			},
+		})
+
+		var apiErr smithy.APIError
+		require.True(t, errors.As(err, &apiErr))
+		assert.Equal(t, "ValidationException", apiErr.ErrorCode())
+	})
+}
@@ -0,0 +1,416 @@
+package dynamotest
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodbstreams"
+	streamtypes "github.com/aws/aws-sdk-go-v2/service/dynamodbstreams/types"
+)
+
+// stream holds the changes to the items of a table. Records are kept
+// forever, so are never trimmed, and new shards are only started by
+// SplitShard.
+type stream struct {
+	arn      string
+	label    string
+	table    string
+	viewType types.StreamViewType
+	keys     []types.KeySchemaElement
+	shards   []*shard
+	sequence int
+	enabled  bool
+}
+
+type shard struct {
+	id      string
+	parent  string
+	records []streamtypes.Record
+	closed  bool
+}
+
+// current is the open shard new records are added to.
+func (s *stream) current() *shard {
+	return s.shards[len(s.shards)-1]
+}
+
+func (s *stream) addShard() {
+	sh := &shard{id: fmt.Sprintf("shardId-%08d", len(s.shards)+1)}
+	if len(s.shards) > 0 {
+		sh.parent = s.current().id
+	}
+
+	s.shards = append(s.shards, sh)
+}
+
+func (s *stream) shard(id string) (*shard, bool) {
+	for _, sh := range s.shards {
+		if sh.id == id {
+			return sh, true
+		}
+	}
+
+	return nil, false
+}
+
+// updateStream enables or disables the stream of the table, a new stream is
+// started each time it is enabled as DynamoDB does.
+func (t *table) updateStream(spec *types.StreamSpecification) error {
+	enabled := aws.ToBool(spec.StreamEnabled)
+
+	switch {
+	case enabled && t.stream != nil && t.stream.enabled:
+		return validationError("Table already has an enabled stream: %s", t.stream.arn)
+	case !enabled && (t.stream == nil || !t.stream.enabled):
+		return validationError("Table already has no enabled stream")
+	case !enabled:
+		t.stream.enabled = false
+		t.stream.current().closed = true
+		t.description.StreamSpecification = &types.StreamSpecification{StreamEnabled: aws.Bool(false)}
+
+		return nil
+	}
+
+	if spec.StreamViewType == "" {
+		return validationError("StreamViewType is required when enabling a stream")
+	}
+
+	name := aws.ToString(t.description.TableName)
+	label := time.Now().UTC().Format("2006-01-02T15:04:05.000000000")
+
+	t.stream = &stream{
+		arn:      fmt.Sprintf("arn:aws:dynamodb:fake:000000000000:table/%s/stream/%s", name, label),
+		label:    label,
+		table:    name,
+		viewType: spec.StreamViewType,
+		keys:     t.description.KeySchema,
+		enabled:  true,
+	}
+	t.stream.addShard()
+
+	t.description.StreamSpecification = &types.StreamSpecification{
+		StreamEnabled: aws.Bool(true), StreamViewType: spec.StreamViewType,
+	}
+	t.description.LatestStreamArn = aws.String(t.stream.arn)
+	t.description.LatestStreamLabel = aws.String(label)
+
+	return nil
+}
+
+// write stores the item, recording the change when the stream is enabled.
+func (t *table) write(key string, newItem item) {
+	oldItem, existed := t.items[key]
+	t.items[key] = newItem
+
+	eventName := streamtypes.OperationTypeInsert
+	if existed {
+		eventName = streamtypes.OperationTypeModify
+	}
+
+	t.record(eventName, oldItem, newItem)
+}
+
+func (t *table) remove(key string) {
+	oldItem, existed := t.items[key]
+	if !existed {
+		return
+	}
+
+	delete(t.items, key)
+
+	t.record(streamtypes.OperationTypeRemove, oldItem, nil)
+}
+
+func (t *table) record(eventName streamtypes.OperationType, oldItem, newItem item) {
+	if t.stream == nil || !t.stream.enabled {
+		return
+	}
+
+	keyItem := newItem
+	if keyItem == nil {
+		keyItem = oldItem
+	}
+
+	t.stream.sequence++
+	sequence := fmt.Sprintf("%021d", t.stream.sequence)
+
+	record := streamtypes.StreamRecord{
+		ApproximateCreationDateTime: aws.Time(time.Now().UTC().Truncate(time.Second)),
+		Keys:                        toStreamItem(t.keyOf(keyItem)),
+		SequenceNumber:              aws.String(sequence),
+		StreamViewType:              streamtypes.StreamViewType(t.stream.viewType),
+	}
+
+	switch t.stream.viewType {
+	case types.StreamViewTypeNewImage:
+		record.NewImage = toStreamItem(newItem)
+	case types.StreamViewTypeOldImage:
+		record.OldImage = toStreamItem(oldItem)
+	case types.StreamViewTypeNewAndOldImages:
+		record.NewImage = toStreamItem(newItem)
+		record.OldImage = toStreamItem(oldItem)
+	}
+
+	sh := t.stream.current()
+	sh.records = append(sh.records, streamtypes.Record{
+		AwsRegion:    aws.String("fake"),
+		Dynamodb:     &record,
+		EventID:      aws.String(fmt.Sprintf("%s-%s", t.stream.label, sequence)),
+		EventName:    eventName,
+		EventSource:  aws.String("aws:dynamodb"),
+		EventVersion: aws.String("1.1"),
+	})
+}
+
+// SplitShard closes the open shard of the stream of the table and starts a
+// child of it, as DynamoDB does periodically and when partitions split.
+func (f *FakeDynamoDB) SplitShard(tableName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	t, err := f.table(aws.String(tableName))
+	if err != nil {
+		return err
+	}
+
+	if t.stream == nil || !t.stream.enabled {
+		return validationError("Table %s has no enabled stream", tableName)
+	}
+
+	t.stream.current().closed = true
+	t.stream.addShard()
+
+	return nil
+}
+
+func (f *FakeDynamoDB) stream(arn *string) (*stream, error) {
+	for _, t := range f.tables {
+		if t.stream != nil && t.stream.arn == aws.ToString(arn) {
+			return t.stream, nil
+		}
+	}
+
+	return nil, &streamtypes.ResourceNotFoundException{
+		Message: aws.String(fmt.Sprintf("Requested resource not found: Stream: %s not found", aws.ToString(arn))),
+	}
+}
+
+// DescribeStream returns the shards of the stream, paged by Limit.
+func (f *FakeDynamoDB) DescribeStream(
+	ctx context.Context, input *dynamodbstreams.DescribeStreamInput, opts ...func(*dynamodbstreams.Options),
+) (*dynamodbstreams.DescribeStreamOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, err := f.stream(input.StreamArn)
+	if err != nil {
+		return nil, err
+	}
+
+	status := streamtypes.StreamStatusEnabled
+	if !s.enabled {
+		status = streamtypes.StreamStatusDisabled
+	}
+
+	description := streamtypes.StreamDescription{
+		StreamArn:      aws.String(s.arn),
+		StreamLabel:    aws.String(s.label),
+		StreamStatus:   status,
+		StreamViewType: streamtypes.StreamViewType(s.viewType),
+		TableName:      aws.String(s.table),
+	}
+
+	for _, element := range s.keys {
+		description.KeySchema = append(description.KeySchema, streamtypes.KeySchemaElement{
+			AttributeName: element.AttributeName,
+			KeyType:       streamtypes.KeyType(element.KeyType),
+		})
+	}
+
+	started := input.ExclusiveStartShardId == nil
+
+	for _, sh := range s.shards {
+		if !started {
+			started = sh.id == aws.ToString(input.ExclusiveStartShardId)
+
+			continue
+		}
+
+		if input.Limit != nil && len(description.Shards) == int(*input.Limit) {
+			description.LastEvaluatedShardId = description.Shards[len(description.Shards)-1].ShardId
+
+			break
+		}
+
+		description.Shards = append(description.Shards, sh.description())
+	}
+
+	return &dynamodbstreams.DescribeStreamOutput{StreamDescription: &description}, nil
+}
+
+func (sh *shard) description() streamtypes.Shard {
+	description := streamtypes.Shard{
+		ShardId:             aws.String(sh.id),
+		SequenceNumberRange: &streamtypes.SequenceNumberRange{},
+	}
+
+	if sh.parent != "" {
+		description.ParentShardId = aws.String(sh.parent)
+	}
+
+	if len(sh.records) > 0 {
+		description.SequenceNumberRange.StartingSequenceNumber = sh.records[0].Dynamodb.SequenceNumber
+
+		if sh.closed {
+			description.SequenceNumberRange.EndingSequenceNumber = sh.records[len(sh.records)-1].Dynamodb.SequenceNumber
+		}
+	}
+
+	return description
+}
+
+// shard iterators are the stream, shard and position of the next record to
+// return, separated by |.
+func shardIterator(s *stream, sh *shard, position int) *string {
+	return aws.String(strings.Join([]string{s.arn, sh.id, strconv.Itoa(position)}, "|"))
+}
+
+func (f *FakeDynamoDB) GetShardIterator(
+	ctx context.Context, input *dynamodbstreams.GetShardIteratorInput, opts ...func(*dynamodbstreams.Options),
+) (*dynamodbstreams.GetShardIteratorOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, err := f.stream(input.StreamArn)
+	if err != nil {
+		return nil, err
+	}
+
+	sh, ok := s.shard(aws.ToString(input.ShardId))
+	if !ok {
+		return nil, &streamtypes.ResourceNotFoundException{
+			Message: aws.String(fmt.Sprintf("Requested resource not found: Shard: %s not found", aws.ToString(input.ShardId))),
+		}
+	}
+
+	position := 0
+
+	switch input.ShardIteratorType {
+	case streamtypes.ShardIteratorTypeTrimHorizon:
+	case streamtypes.ShardIteratorTypeLatest:
+		position = len(sh.records)
+	case streamtypes.ShardIteratorTypeAtSequenceNumber, streamtypes.ShardIteratorTypeAfterSequenceNumber:
+		sequence := aws.ToString(input.SequenceNumber)
+		position = len(sh.records)
+
+		for idx, record := range sh.records {
+			current := aws.ToString(record.Dynamodb.SequenceNumber)
+			if current > sequence ||
+				(current == sequence && input.ShardIteratorType == streamtypes.ShardIteratorTypeAtSequenceNumber) {
+				position = idx
+
+				break
+			}
+		}
+	default:
+		return nil, validationError("Invalid ShardIteratorType: %s", input.ShardIteratorType)
+	}
+
+	return &dynamodbstreams.GetShardIteratorOutput{ShardIterator: shardIterator(s, sh, position)}, nil
+}
+
+// GetRecords returns the records from the iterator, the next iterator is nil
+// once the end of a closed shard has been read.
+func (f *FakeDynamoDB) GetRecords(
+	ctx context.Context, input *dynamodbstreams.GetRecordsInput, opts ...func(*dynamodbstreams.Options),
+) (*dynamodbstreams.GetRecordsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	parts := strings.Split(aws.ToString(input.ShardIterator), "|")
+	if len(parts) != 3 {
+		return nil, validationError("Invalid ShardIterator")
+	}
+
+	s, err := f.stream(aws.String(parts[0]))
+	if err != nil {
+		return nil, err
+	}
+
+	sh, ok := s.shard(parts[1])
+	position, err := strconv.Atoi(parts[2])
+
+	if !ok || err != nil || position < 0 || position > len(sh.records) {
+		return nil, validationError("Invalid ShardIterator")
+	}
+
+	limit := 1000
+	if input.Limit != nil {
+		limit = int(*input.Limit)
+	}
+
+	end := position + limit
+	if end > len(sh.records) {
+		end = len(sh.records)
+	}
+
+	output := &dynamodbstreams.GetRecordsOutput{
+		Records: append([]streamtypes.Record(nil), sh.records[position:end]...),
+	}
+
+	if !sh.closed || end < len(sh.records) {
+		output.NextShardIterator = shardIterator(s, sh, end)
+	}
+
+	return output, nil
+}
+
+func toStreamItem(it item) map[string]streamtypes.AttributeValue {
+	if it == nil {
+		return nil
+	}
+
+	converted := make(map[string]streamtypes.AttributeValue, len(it))
+	for name, value := range it {
+		converted[name] = toStreamValue(value)
+	}
+
+	return converted
+}
+
+func toStreamValue(value types.AttributeValue) streamtypes.AttributeValue {
+	switch v := value.(type) {
+	case *types.AttributeValueMemberS:
+		return &streamtypes.AttributeValueMemberS{Value: v.Value}
+	case *types.AttributeValueMemberN:
+		return &streamtypes.AttributeValueMemberN{Value: v.Value}
+	case *types.AttributeValueMemberB:
+		return &streamtypes.AttributeValueMemberB{Value: v.Value}
+	case *types.AttributeValueMemberSS:
+		return &streamtypes.AttributeValueMemberSS{Value: v.Value}
+	case *types.AttributeValueMemberNS:
+		return &streamtypes.AttributeValueMemberNS{Value: v.Value}
+	case *types.AttributeValueMemberBS:
+		return &streamtypes.AttributeValueMemberBS{Value: v.Value}
+	case *types.AttributeValueMemberBOOL:
+		return &streamtypes.AttributeValueMemberBOOL{Value: v.Value}
+	case *types.AttributeValueMemberNULL:
+		return &streamtypes.AttributeValueMemberNULL{Value: v.Value}
+	case *types.AttributeValueMemberM:
+		return &streamtypes.AttributeValueMemberM{Value: toStreamItem(v.Value)}
+	case *types.AttributeValueMemberL:
+		list := make([]streamtypes.AttributeValue, len(v.Value))
+		for idx, element := range v.Value {
+			list[idx] = toStreamValue(element)
+		}
+
+		return &streamtypes.AttributeValueMemberL{Value: list}
+	}
+
+	return nil
+}
@@ -0,0 +1,135 @@
+package dynamotest_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodbstreams"
+	streamtypes "github.com/aws/aws-sdk-go-v2/service/dynamodbstreams/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/electrofelix/gin-demo/store"
+	"github.com/electrofelix/gin-demo/store/dynamotest"
+)
+
+var _ store.DynamoDBStreamsAPI = (*dynamotest.FakeDynamoDB)(nil)
+
+func setupStream(t *testing.T) (*dynamotest.FakeDynamoDB, string) {
+	t.Helper()
+
+	fake := setupTable(t)
+
+	output, err := fake.UpdateTable(context.Background(), &dynamodb.UpdateTableInput{
+		TableName: aws.String(tableName),
+		StreamSpecification: &types.StreamSpecification{
+			StreamEnabled:  aws.Bool(true),
+			StreamViewType: types.StreamViewTypeNewAndOldImages,
+		},
+	})
+	require.NoError(t, err)
+	require.NotNil(t, output.TableDescription.LatestStreamArn)
+
+	return fake, *output.TableDescription.LatestStreamArn
+}
+
+func readShard(t *testing.T, fake *dynamotest.FakeDynamoDB, arn string, shard streamtypes.Shard) ([]streamtypes.Record, *string) {
+	t.Helper()
+
+	iterator, err := fake.GetShardIterator(context.Background(), &dynamodbstreams.GetShardIteratorInput{
+		StreamArn:         aws.String(arn),
+		ShardId:           shard.ShardId,
+		ShardIteratorType: streamtypes.ShardIteratorTypeTrimHorizon,
+	})
+	require.NoError(t, err)
+
+	output, err := fake.GetRecords(context.Background(), &dynamodbstreams.GetRecordsInput{
+		ShardIterator: iterator.ShardIterator,
+	})
+	require.NoError(t, err)
+
+	return output.Records, output.NextShardIterator
+}
+
+func TestFakeDynamoDB_GetRecords(t *testing.T) {
+	t.Run("changes", func(t *testing.T) {
+		fake, arn := setupStream(t)
+		ctx := context.Background()
+
+		_, err := fake.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(tableName), Item: newItem("id1", "UserInfo", "Name", "first"),
+		})
+		require.NoError(t, err)
+
+		_, err = fake.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(tableName), Item: newItem("id1", "UserInfo", "Name", "second"),
+		})
+		require.NoError(t, err)
+
+		_, err = fake.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(tableName), Key: newItem("id1", "UserInfo"),
+		})
+		require.NoError(t, err)
+
+		described, err := fake.DescribeStream(ctx, &dynamodbstreams.DescribeStreamInput{StreamArn: aws.String(arn)})
+		require.NoError(t, err)
+		require.Len(t, described.StreamDescription.Shards, 1)
+
+		records, next := readShard(t, fake, arn, described.StreamDescription.Shards[0])
+		require.Len(t, records, 3)
+		assert.NotNil(t, next, "open shards always have a next iterator")
+
+		assert.Equal(t, streamtypes.OperationTypeInsert, records[0].EventName)
+		assert.Nil(t, records[0].Dynamodb.OldImage)
+		assert.Equal(t, streamtypes.OperationTypeModify, records[1].EventName)
+		assert.Equal(t, &streamtypes.AttributeValueMemberS{Value: "first"}, records[1].Dynamodb.OldImage["Name"])
+		assert.Equal(t, &streamtypes.AttributeValueMemberS{Value: "second"}, records[1].Dynamodb.NewImage["Name"])
+		assert.Equal(t, streamtypes.OperationTypeRemove, records[2].EventName)
+		assert.Nil(t, records[2].Dynamodb.NewImage)
+
+		assert.Less(t, *records[0].Dynamodb.SequenceNumber, *records[1].Dynamodb.SequenceNumber)
+	})
+
+	t.Run("split-shard", func(t *testing.T) {
+		fake, arn := setupStream(t)
+		ctx := context.Background()
+
+		_, err := fake.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(tableName), Item: newItem("id1", "UserInfo")})
+		require.NoError(t, err)
+		require.NoError(t, fake.SplitShard(tableName))
+
+		_, err = fake.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(tableName), Item: newItem("id2", "UserInfo")})
+		require.NoError(t, err)
+
+		described, err := fake.DescribeStream(ctx, &dynamodbstreams.DescribeStreamInput{StreamArn: aws.String(arn)})
+		require.NoError(t, err)
+
+		shards := described.StreamDescription.Shards
+		require.Len(t, shards, 2)
+		assert.Equal(t, shards[0].ShardId, shards[1].ParentShardId)
+
+		records, next := readShard(t, fake, arn, shards[0])
+		assert.Len(t, records, 1)
+		assert.Nil(t, next, "closed shards end once read")
+
+		records, _ = readShard(t, fake, arn, shards[1])
+		require.Len(t, records, 1)
+		assert.Equal(t, &streamtypes.AttributeValueMemberS{Value: "id2"}, records[0].Dynamodb.Keys["Id"])
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		fake := setupTable(t)
+
+		_, err := fake.PutItem(context.Background(), &dynamodb.PutItemInput{
+			TableName: aws.String(tableName), Item: newItem("id1", "UserInfo"),
+		})
+		require.NoError(t, err)
+
+		output, err := fake.DescribeTable(context.Background(), &dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+		require.NoError(t, err)
+		assert.Nil(t, output.Table.LatestStreamArn)
+	})
+}
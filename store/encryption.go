@@ -0,0 +1,300 @@
+package store
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"github.com/electrofelix/gin-demo/entity"
+)
+
+const (
+	// attributes added to items with encrypted fields, recording how to
+	// decrypt them
+	dataKeyAttribute         = "DataKey"
+	keyIdAttribute           = "KeyId"
+	encryptedFieldsAttribute = "EncryptedFields"
+
+	// emailIndexAttribute holds the blind index of the email on user items
+	// when the email is encrypted, allowing conditions on it.
+	emailIndexAttribute = "EmailIndex"
+
+	dataKeySize = 32
+)
+
+// DefaultEncryptedFields are the user attributes encrypted when none are
+// given to WithEncryption.
+var DefaultEncryptedFields = []string{"Email", "Name"}
+
+// auditEncryptedFields are the attributes of audit entries encrypted
+// whenever encryption is enabled, as they may hold any of the user fields.
+var auditEncryptedFields = []string{"Actor", "Changes"}
+
+// credentialsEncryptedFields are the attributes of credentials items
+// encrypted whenever encryption is enabled, along with the configured fields.
+var credentialsEncryptedFields = []string{"MfaSecret"}
+
+// KeyProvider holds the master keys that wrap the data keys used to encrypt
+// user fields, such as a local key file or a KMS.
+type KeyProvider interface {
+	// WrapKey encrypts the data key with the current master key, returning
+	// the id of the master key used.
+	WrapKey(ctx context.Context, dataKey []byte) ([]byte, string, error)
+	// CurrentKeyId returns the id of the master key used to wrap new data
+	// keys.
+	CurrentKeyId() string
+	// UnwrapKey decrypts a data key wrapped by the master key with the id.
+	UnwrapKey(ctx context.Context, wrapped []byte, keyId string) ([]byte, error)
+	// IndexKey returns the key of the blind index used to look up users by
+	// email, it cannot change while any emails are reserved with it.
+	IndexKey() []byte
+}
+
+// WithEncryption encrypts the given user attributes, by default
+// DefaultEncryptedFields, with a new AES-GCM data key for each write wrapped
+// by the provider. When the email is encrypted its reservation is keyed by
+// an HMAC of it instead, so that GetByEmail still works. Only string
+// attributes other than Id can be encrypted.
+func WithEncryption(provider KeyProvider, fields ...string) Option {
+	return func(us *UserStore) {
+		if len(fields) == 0 {
+			fields = DefaultEncryptedFields
+		}
+
+		us.encryption = &fieldEncryption{provider: provider, fields: fields}
+	}
+}
+
+type fieldEncryption struct {
+	provider KeyProvider
+	fields   []string
+}
+
+func (fe *fieldEncryption) encrypts(field string) bool {
+	for _, f := range fe.fields {
+		if f == field {
+			return true
+		}
+	}
+
+	return false
+}
+
+// credentialsFields returns the attributes encrypted on credentials items.
+func (fe *fieldEncryption) credentialsFields() []string {
+	fields := make([]string, 0, len(fe.fields)+len(credentialsEncryptedFields))
+
+	return append(append(fields, fe.fields...), credentialsEncryptedFields...)
+}
+
+// encryptsEmail reports whether emails are only stored as a blind index.
+func (us *UserStore) encryptsEmail() bool {
+	return us.encryption != nil && us.encryption.encrypts("Email")
+}
+
+// emailId returns the Id of the item reserving the email, either its
+// canonical form or, when emails are encrypted, the blind index of it.
+func (us *UserStore) emailId(email string) string {
+	canonical := entity.CanonicalEmail(email)
+	if !us.encryptsEmail() {
+		return canonical
+	}
+
+	mac := hmac.New(sha256.New, us.encryption.provider.IndexKey())
+	mac.Write([]byte(canonical))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// emailCondition returns a condition that the user item still has the
+// email, matching either an email stored in the clear or its blind index.
+func (us *UserStore) emailCondition(email string) (string, map[string]types.AttributeValue) {
+	values := map[string]types.AttributeValue{
+		":email": &types.AttributeValueMemberS{Value: email},
+	}
+
+	if !us.encryptsEmail() {
+		return "Email = :email", values
+	}
+
+	values[":emailIndex"] = &types.AttributeValueMemberS{Value: us.emailId(email)}
+
+	return fmt.Sprintf("(Email = :email OR %s = :emailIndex)", emailIndexAttribute), values
+}
+
+// encryptUserItem encrypts the configured fields of a marshaled user,
+// recording the blind index of the email if it is one of them.
+func (us *UserStore) encryptUserItem(ctx context.Context, item map[string]types.AttributeValue, email string) error {
+	if us.encryption == nil {
+		return nil
+	}
+
+	if us.encryptsEmail() {
+		item[emailIndexAttribute] = &types.AttributeValueMemberS{Value: us.emailId(email)}
+	}
+
+	return us.encryptItem(ctx, item, us.encryption.fields)
+}
+
+// encryptItem replaces the string attributes named by fields with their
+// ciphertext under a new data key, stored wrapped in the item. Each is
+// bound to the key of the item and the attribute, so that it cannot be
+// moved elsewhere and still decrypt.
+func (us *UserStore) encryptItem(ctx context.Context, item map[string]types.AttributeValue, fields []string) error {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return err
+	}
+
+	wrapped, keyId, err := us.encryption.provider.WrapKey(ctx, dataKey)
+	if err != nil {
+		us.logger.Errorf("failed to wrap data key: %v", err)
+
+		return err
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return err
+	}
+
+	encrypted := make([]string, 0, len(fields))
+
+	for _, field := range fields {
+		value, ok := item[field]
+		if !ok {
+			continue
+		}
+
+		plaintext, ok := value.(*types.AttributeValueMemberS)
+		if !ok || field == "Id" {
+			return fmt.Errorf("unable to encrypt %s, only string attributes other than Id are supported", field)
+		}
+
+		ciphertext, err := seal(aead, []byte(plaintext.Value), fieldAAD(item, field))
+		if err != nil {
+			return err
+		}
+
+		item[field] = &types.AttributeValueMemberB{Value: ciphertext}
+		encrypted = append(encrypted, field)
+	}
+
+	if len(encrypted) == 0 {
+		return nil
+	}
+
+	item[dataKeyAttribute] = &types.AttributeValueMemberB{Value: wrapped}
+	item[keyIdAttribute] = &types.AttributeValueMemberS{Value: keyId}
+	item[encryptedFieldsAttribute] = &types.AttributeValueMemberSS{Value: encrypted}
+
+	return nil
+}
+
+// decryptItem replaces any encrypted attributes of the item with their
+// plaintext, items written without encryption are left unchanged.
+func (us *UserStore) decryptItem(ctx context.Context, item map[string]types.AttributeValue) error {
+	wrapped, ok := item[dataKeyAttribute].(*types.AttributeValueMemberB)
+	if !ok {
+		return nil
+	}
+
+	if us.encryption == nil {
+		return errors.New("item is encrypted, but no encryption keys are configured")
+	}
+
+	keyId, _ := item[keyIdAttribute].(*types.AttributeValueMemberS)
+	fields, _ := item[encryptedFieldsAttribute].(*types.AttributeValueMemberSS)
+
+	if keyId == nil || fields == nil {
+		return errors.New("item is missing the attributes needed to decrypt it")
+	}
+
+	dataKey, err := us.encryption.provider.UnwrapKey(ctx, wrapped.Value, keyId.Value)
+	if err != nil {
+		us.logger.Errorf("failed to unwrap data key with key '%s': %v", keyId.Value, err)
+
+		return err
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return err
+	}
+
+	for _, field := range fields.Value {
+		ciphertext, ok := item[field].(*types.AttributeValueMemberB)
+		if !ok {
+			return fmt.Errorf("encrypted attribute %s is missing", field)
+		}
+
+		plaintext, err := open(aead, ciphertext.Value, fieldAAD(item, field))
+		if err != nil {
+			return fmt.Errorf("failed to decrypt %s: %w", field, err)
+		}
+
+		item[field] = &types.AttributeValueMemberS{Value: string(plaintext)}
+	}
+
+	return nil
+}
+
+func isEncrypted(item map[string]types.AttributeValue) bool {
+	_, ok := item[dataKeyAttribute]
+
+	return ok
+}
+
+// fieldAAD identifies the attribute of the item that a ciphertext belongs to.
+func fieldAAD(item map[string]types.AttributeValue, field string) []byte {
+	var id, objectType string
+
+	if value, ok := item["Id"].(*types.AttributeValueMemberS); ok {
+		id = value.Value
+	}
+
+	if value, ok := item["objectType"].(*types.AttributeValueMemberS); ok {
+		objectType = value.Value
+	}
+
+	return []byte(id + "\x00" + objectType + "\x00" + field)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts the plaintext with a random nonce, returned prefixed to the
+// ciphertext.
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(aead cipher.AEAD, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+
+	return aead.Open(nil, nonce, sealed, additionalData)
+}
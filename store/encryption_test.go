@@ -0,0 +1,241 @@
+package store_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/electrofelix/gin-demo/entity"
+	"github.com/electrofelix/gin-demo/service"
+	"github.com/electrofelix/gin-demo/store"
+	"github.com/electrofelix/gin-demo/store/dynamotest"
+	"github.com/electrofelix/gin-demo/store/storetest"
+)
+
+func newKey(t *testing.T) string {
+	t.Helper()
+
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// writeKeyFile writes a key file with a new key for each id, the last being
+// the current key.
+func writeKeyFile(t *testing.T, indexKey string, ids ...string) string {
+	t.Helper()
+
+	keys := map[string]string{}
+	for _, id := range ids {
+		keys[id] = newKey(t)
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"current":   ids[len(ids)-1],
+		"keys":      keys,
+		"index_key": indexKey,
+	})
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "keys.json")
+	require.NoError(t, ioutil.WriteFile(path, data, 0600))
+
+	return path
+}
+
+func setupKeyProvider(t *testing.T) *store.KeyFileProvider {
+	t.Helper()
+
+	provider, err := store.NewKeyFileProvider(writeKeyFile(t, newKey(t), "1"))
+	require.NoError(t, err)
+
+	return provider
+}
+
+func TestEncryptedUserStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) service.UserStore {
+		_, dataStore := setupFakeUserStore(t, store.WithEncryption(setupKeyProvider(t), "Email", "Name", "Password"))
+
+		return dataStore
+	})
+}
+
+func TestUserStore_Encryption(t *testing.T) {
+	scanItems := func(t *testing.T, dbClient *dynamotest.FakeDynamoDB) []map[string]types.AttributeValue {
+		t.Helper()
+
+		result, err := dbClient.Scan(context.Background(), &dynamodb.ScanInput{TableName: aws.String(tableName)})
+		require.NoError(t, err)
+
+		return result.Items
+	}
+
+	t.Run("at-rest", func(t *testing.T) {
+		dbClient, dataStore := setupFakeUserStore(t, store.WithEncryption(setupKeyProvider(t)))
+
+		user := entity.User{Id: "user1", Email: "Secret.User@example.com", Name: "Secret Name", Password: "hash"}
+		audit := entity.AuditEntry{
+			UserId:    user.Id,
+			Timestamp: time.Now().UTC(),
+			Actor:     "Secret.User@example.com",
+			Action:    entity.AuditActionCreate,
+			Changes: map[string]entity.AuditChange{
+				"email": {New: user.Email},
+				"name":  {New: user.Name},
+			},
+		}
+
+		require.NoError(t, dataStore.Create(context.Background(), &user, audit))
+
+		for _, item := range scanItems(t, dbClient) {
+			for name, value := range item {
+				var raw []byte
+
+				switch v := value.(type) {
+				case *types.AttributeValueMemberS:
+					raw = []byte(v.Value)
+				case *types.AttributeValueMemberB:
+					raw = v.Value
+				}
+
+				for _, secret := range []string{"secret", "Secret"} {
+					assert.False(t, bytes.Contains(raw, []byte(secret)), "attribute %s holds plaintext", name)
+				}
+			}
+		}
+
+		credentials, err := dataStore.GetCredentials(context.Background(), entity.DefaultTenant, user.Id)
+		require.NoError(t, err)
+		assert.Equal(t, "hash", credentials.Password)
+
+		// the password is only returned with the credentials
+		user.Password = ""
+
+		got, err := dataStore.GetByEmail(context.Background(), entity.DefaultTenant, "secret.user@EXAMPLE.com")
+		require.NoError(t, err)
+		assert.Equal(t, user, *got)
+
+		page, err := dataStore.List(context.Background(), entity.DefaultTenant, entity.ListOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, []entity.User{user}, page.Users)
+
+		auditPage, err := dataStore.ListAudit(context.Background(), entity.DefaultTenant, user.Id, entity.ListOptions{})
+		require.NoError(t, err)
+		require.Len(t, auditPage.Entries, 1)
+		assert.True(t, audit.Timestamp.Equal(auditPage.Entries[0].Timestamp))
+		auditPage.Entries[0].Timestamp = audit.Timestamp
+		assert.Equal(t, audit, auditPage.Entries[0])
+	})
+
+	t.Run("wrong-key", func(t *testing.T) {
+		dbClient, dataStore := setupFakeUserStore(t, store.WithEncryption(setupKeyProvider(t)))
+
+		user := entity.User{Id: "user1", Email: "user1@example.com", Name: "test-user"}
+		require.NoError(t, dataStore.Create(context.Background(), &user))
+
+		other := store.NewUserStore(dbClient, tableName, store.WithEncryption(setupKeyProvider(t)))
+		_, err := other.GetById(context.Background(), entity.DefaultTenant, user.Id)
+		assert.Error(t, err)
+
+		unencrypted := store.NewUserStore(dbClient, tableName)
+		_, err = unencrypted.GetById(context.Background(), entity.DefaultTenant, user.Id)
+		assert.Error(t, err)
+	})
+
+	t.Run("enable-on-existing", func(t *testing.T) {
+		dbClient, plainStore := setupFakeUserStore(t)
+
+		user := entity.User{Id: "user1", Email: "user1@example.com", Name: "test-user"}
+		require.NoError(t, plainStore.Create(context.Background(), &user))
+
+		dataStore := store.NewUserStore(dbClient, tableName, store.WithEncryption(setupKeyProvider(t)))
+
+		// users written in the clear are still found by email
+		got, err := dataStore.GetByEmail(context.Background(), entity.DefaultTenant, user.Email)
+		require.NoError(t, err)
+		assert.Equal(t, user, *got)
+
+		// until fsck moves the reservation to the blind index
+		report, err := dataStore.Fsck(context.Background(), true)
+		require.NoError(t, err)
+		assert.Equal(t, 0, report.Unrepaired())
+		require.Len(t, report.Problems, 2)
+		assert.Equal(t, store.ProblemMismatchedEmail, report.Problems[0].Kind)
+		assert.Equal(t, store.ProblemMissingEmail, report.Problems[1].Kind)
+
+		for _, item := range scanItems(t, dbClient) {
+			if id, ok := item["Id"].(*types.AttributeValueMemberS); ok {
+				assert.NotEqual(t, user.Email, id.Value)
+			}
+		}
+
+		got.Name = "updated-user"
+		require.NoError(t, dataStore.Update(context.Background(), got))
+
+		got, err = dataStore.GetByEmail(context.Background(), entity.DefaultTenant, user.Email)
+		require.NoError(t, err)
+		assert.Equal(t, "updated-user", got.Name)
+
+		report, err = dataStore.Fsck(context.Background(), false)
+		require.NoError(t, err)
+		assert.Empty(t, report.Problems)
+	})
+}
+
+func TestNewKeyFileProvider(t *testing.T) {
+	t.Run("wrap-and-unwrap", func(t *testing.T) {
+		provider, err := store.NewKeyFileProvider(writeKeyFile(t, newKey(t), "1", "2"))
+		require.NoError(t, err)
+
+		dataKey := []byte("0123456789abcdef0123456789abcdef")
+
+		wrapped, keyId, err := provider.WrapKey(context.Background(), dataKey)
+		require.NoError(t, err)
+		assert.Equal(t, "2", keyId)
+
+		unwrapped, err := provider.UnwrapKey(context.Background(), wrapped, keyId)
+		require.NoError(t, err)
+		assert.Equal(t, dataKey, unwrapped)
+
+		// bound to the key id
+		_, err = provider.UnwrapKey(context.Background(), wrapped, "1")
+		assert.Error(t, err)
+
+		_, err = provider.UnwrapKey(context.Background(), wrapped, "3")
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		dir := t.TempDir()
+
+		for name, content := range map[string]string{
+			"not-json":        "keys",
+			"missing-current": `{"current": "2", "keys": {"1": "` + newKey(t) + `"}, "index_key": "` + newKey(t) + `"}`,
+			"short-key":       `{"current": "1", "keys": {"1": "c2hvcnQ="}, "index_key": "` + newKey(t) + `"}`,
+			"no-index-key":    `{"current": "1", "keys": {"1": "` + newKey(t) + `"}}`,
+		} {
+			path := filepath.Join(dir, name+".json")
+			require.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+
+			_, err := store.NewKeyFileProvider(path)
+			assert.Error(t, err, name)
+		}
+
+		_, err := store.NewKeyFileProvider(filepath.Join(dir, "missing.json"))
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,218 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"github.com/electrofelix/gin-demo/entity"
+)
+
+// ExportedUser is a user as exported, along with all of its credentials,
+// which are nil for a user that has none.
+type ExportedUser struct {
+	entity.User
+	Credentials *entity.Credentials `json:"credentials,omitempty"`
+}
+
+// Export scans all users of every tenant, including deleted users, in
+// parallel across the number of segments and calls fn with each user and its
+// credentials. Users are returned in no particular order, fn is never called
+// concurrently and any error returned by it stops the export.
+func (us *UserStore) Export(ctx context.Context, segments int, fn func(ExportedUser) error) error {
+	if segments < 1 {
+		return fmt.Errorf("segments must be at least 1, got %d", segments)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	users := make(chan ExportedUser)
+	errs := make(chan error, segments)
+
+	var wg sync.WaitGroup
+
+	for segment := 0; segment < segments; segment++ {
+		wg.Add(1)
+
+		go func(segment int) {
+			defer wg.Done()
+
+			if err := us.scanSegment(ctx, int32(segment), int32(segments), users); err != nil {
+				errs <- err
+
+				cancel()
+			}
+		}(segment)
+	}
+
+	go func() {
+		wg.Wait()
+		close(users)
+	}()
+
+	var fnErr error
+
+	for user := range users {
+		if fnErr != nil {
+			// drain so that the scanning goroutines can exit
+			continue
+		}
+
+		if fnErr = fn(user); fnErr != nil {
+			cancel()
+		}
+	}
+
+	if fnErr != nil {
+		return fnErr
+	}
+
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+func (us *UserStore) scanSegment(ctx context.Context, segment, total int32, users chan<- ExportedUser) error {
+	scanInput := dynamodb.ScanInput{
+		TableName:        aws.String(us.tableName),
+		FilterExpression: aws.String("begins_with(objectType, :prefix)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":prefix": &types.AttributeValueMemberS{Value: key},
+		},
+		Segment:       aws.Int32(segment),
+		TotalSegments: aws.Int32(total),
+	}
+
+	for {
+		result, err := us.dbClient.Scan(ctx, &scanInput)
+		if err != nil {
+			if ctx.Err() == nil {
+				us.logger.Errorf("error scanning segment %d of %d: %v", segment, total, err)
+			}
+
+			return err
+		}
+
+		page := make([]ExportedUser, 0, len(result.Items))
+
+		for _, item := range result.Items {
+			tenant, kind, ok := itemTenant(item)
+			if !ok || kind != kindUser {
+				continue
+			}
+
+			err = us.decryptItem(ctx, item)
+			if err != nil {
+				us.logger.Errorf("error decrypting %s: %v", key, err)
+
+				return err
+			}
+
+			user := entity.User{TenantId: tenant}
+
+			err = attributevalue.UnmarshalMap(item, &user)
+			if err != nil {
+				us.logger.Errorf("error unmarshaling %s: %v", key, err)
+
+				return err
+			}
+
+			page = append(page, ExportedUser{User: user})
+		}
+
+		// the credentials are read for each user, as they may be in any
+		// segment of the scan
+		for idx := range page {
+			credentials, err := us.GetCredentials(ctx, page[idx].TenantId, page[idx].Id)
+			if errors.Is(err, entity.ErrNotFound) {
+				continue
+			}
+
+			if err != nil {
+				return err
+			}
+
+			page[idx].Credentials = credentials
+		}
+
+		for _, user := range page {
+			select {
+			case users <- user:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		if len(result.LastEvaluatedKey) == 0 {
+			return nil
+		}
+
+		scanInput.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+// Load writes previously exported users as they are, preserving their Id,
+// tenant, credentials and version, along with the items reserving their
+// emails and holding their credentials. Users exported with only a password
+// hash, before the rest of their credentials were exported, are written with
+// the credentials of that hash.
+// It returns the error for each user in the same order, an existing user or
+// email is never overwritten.
+func (us *UserStore) Load(ctx context.Context, users []*ExportedUser) []error {
+	batch := make([]*entity.User, len(users))
+	credentials := make([]*entity.Credentials, len(users))
+
+	for idx, user := range users {
+		batch[idx] = &user.User
+		credentials[idx] = user.Credentials
+
+		if credentials[idx] == nil {
+			credentials[idx] = passwordCredentials(&user.User)
+		}
+	}
+
+	return us.writeBatch(ctx, batch, credentials, nil)
+}
+
+// Empty reports whether the table holds no users or email reservations of
+// any tenant. As the tenants are not known it scans until one is found.
+func (us *UserStore) Empty(ctx context.Context) (bool, error) {
+	scanInput := dynamodb.ScanInput{
+		TableName:        aws.String(us.tableName),
+		FilterExpression: aws.String("begins_with(objectType, :prefix)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":prefix": &types.AttributeValueMemberS{Value: key},
+		},
+	}
+
+	for {
+		result, err := us.dbClient.Scan(ctx, &scanInput)
+		if err != nil {
+			us.logger.Errorf("error during scan: %v", err)
+
+			return false, err
+		}
+
+		for _, item := range result.Items {
+			if _, kind, ok := itemTenant(item); ok && kind != kindAudit {
+				return false, nil
+			}
+		}
+
+		if len(result.LastEvaluatedKey) == 0 {
+			return true, nil
+		}
+
+		scanInput.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
@@ -0,0 +1,146 @@
+package store_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/electrofelix/gin-demo/entity"
+	"github.com/electrofelix/gin-demo/store"
+)
+
+func TestUserStore_Export(t *testing.T) {
+	t.Run("export-and-load", func(t *testing.T) {
+		_, source := setupFakeUserStore(t)
+
+		deletedAt := time.Now().UTC().Truncate(time.Second)
+		expected := map[string]entity.User{}
+
+		for idx := 0; idx < 20; idx++ {
+			user := entity.User{
+				Id:       xid.New().String(),
+				Email:    fmt.Sprintf("user%02d@example.com", idx),
+				Name:     fmt.Sprintf("user %d", idx),
+				Password: "hash",
+			}
+
+			require.NoError(t, source.Create(context.Background(), &user))
+
+			if idx%5 == 0 {
+				user.DeletedAt = &deletedAt
+				require.NoError(t, source.Update(context.Background(), &user))
+			}
+
+			expected[user.Id] = user
+		}
+
+		// a user enrolled in MFA and locked out by failed logins
+		enrolled := entity.User{Id: xid.New().String(), Email: "mfa@example.com", Name: "mfa", Password: "hash"}
+		require.NoError(t, source.Create(context.Background(), &enrolled))
+
+		lockedUntil := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+		enrolledCredentials := entity.Credentials{
+			Password:     "hash",
+			FailedLogins: 5,
+			LockedUntil:  &lockedUntil,
+			MfaSecret:    "JBSWY3DPEHPK3PXP",
+			Version:      1,
+		}
+		require.NoError(t, source.PutCredentials(context.Background(), entity.DefaultTenant, enrolled.Id, 0, &enrolledCredentials))
+
+		expected[enrolled.Id] = enrolled
+
+		var exported []store.ExportedUser
+
+		err := source.Export(context.Background(), 3, func(user store.ExportedUser) error {
+			exported = append(exported, user)
+
+			return nil
+		})
+		require.NoError(t, err)
+		assert.Len(t, exported, len(expected), "deleted users should also be exported")
+
+		_, target := setupFakeUserStore(t)
+
+		empty, err := target.Empty(context.Background())
+		require.NoError(t, err)
+		assert.True(t, empty)
+
+		// restored from the JSONL written by the export command
+		users := make([]*store.ExportedUser, len(exported))
+		for idx := range exported {
+			line, err := json.Marshal(exported[idx])
+			require.NoError(t, err)
+
+			users[idx] = &store.ExportedUser{}
+			require.NoError(t, json.Unmarshal(line, users[idx]))
+		}
+
+		for _, err := range target.Load(context.Background(), users) {
+			require.NoError(t, err)
+		}
+
+		empty, err = target.Empty(context.Background())
+		require.NoError(t, err)
+		assert.False(t, empty)
+
+		for _, want := range expected {
+			got, err := target.GetByEmail(context.Background(), entity.DefaultTenant, want.Email)
+			require.NoError(t, err)
+
+			assert.Equal(t, want.Id, got.Id)
+			assert.Equal(t, want.Version, got.Version)
+			assert.Equal(t, want.DeletedAt, got.DeletedAt)
+
+			credentials, err := target.GetCredentials(context.Background(), entity.DefaultTenant, want.Id)
+			require.NoError(t, err)
+			assert.Equal(t, want.Password, credentials.Password, "password hashes should be preserved")
+		}
+
+		credentials, err := target.GetCredentials(context.Background(), entity.DefaultTenant, enrolled.Id)
+		require.NoError(t, err)
+		assert.Equal(t, &enrolledCredentials, credentials, "lockout and MFA enrolment should be preserved")
+
+		// loading again must not overwrite any users
+		sort.Slice(users, func(i, j int) bool { return users[i].Id < users[j].Id })
+
+		for _, err := range target.Load(context.Background(), users[:3]) {
+			assert.Error(t, err)
+		}
+	})
+
+	t.Run("callback-error", func(t *testing.T) {
+		_, dataStore := setupFakeUserStore(t)
+
+		for idx := 0; idx < 5; idx++ {
+			user := entity.User{Id: xid.New().String(), Email: fmt.Sprintf("user%d@example.com", idx)}
+			require.NoError(t, dataStore.Create(context.Background(), &user))
+		}
+
+		errStop := errors.New("stop")
+		calls := 0
+
+		err := dataStore.Export(context.Background(), 2, func(user store.ExportedUser) error {
+			calls++
+
+			return errStop
+		})
+		assert.ErrorIs(t, err, errStop)
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("bad-segments", func(t *testing.T) {
+		_, dataStore := setupFakeUserStore(t)
+
+		err := dataStore.Export(context.Background(), 0, func(store.ExportedUser) error { return nil })
+		assert.Error(t, err)
+	})
+}
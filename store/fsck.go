@@ -0,0 +1,371 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// ProblemKind identifies an inconsistency between the UserInfo items and the
+// UserInfo#email items reserving their email addresses.
+type ProblemKind string
+
+const (
+	// ProblemMissingEmail is a user without an item reserving its email.
+	ProblemMissingEmail ProblemKind = "missing-email"
+	// ProblemOrphanedEmail is an email reserved for a user that does not exist.
+	ProblemOrphanedEmail ProblemKind = "orphaned-email"
+	// ProblemMismatchedEmail is an email reserved for a user that now has a
+	// different email.
+	ProblemMismatchedEmail ProblemKind = "mismatched-email"
+	// ProblemDuplicateEmail is an email used by more than one user, this
+	// cannot be repaired automatically as all but one user must be changed.
+	ProblemDuplicateEmail ProblemKind = "duplicate-email"
+)
+
+type Problem struct {
+	Kind   ProblemKind
+	Tenant string
+	// Email is the Id of the reservation, the canonical email or its blind
+	// index when emails are encrypted
+	Email    string
+	UserIds  []string
+	Repaired bool
+	// Err holds why a repair was not possible
+	Err error
+}
+
+func (p Problem) String() string {
+	status := "unrepaired"
+	if p.Repaired {
+		status = "repaired"
+	} else if p.Err != nil {
+		status = fmt.Sprintf("repair failed: %v", p.Err)
+	}
+
+	return fmt.Sprintf("%s: tenant '%s' email '%s' users %v (%s)", p.Kind, p.Tenant, p.Email, p.UserIds, status)
+}
+
+// FsckReport summarises a consistency check of the table.
+type FsckReport struct {
+	Users    int
+	Emails   int
+	Problems []Problem
+}
+
+// Unrepaired returns the number of problems remaining after the check.
+func (r FsckReport) Unrepaired() int {
+	count := 0
+
+	for _, problem := range r.Problems {
+		if !problem.Repaired {
+			count++
+		}
+	}
+
+	return count
+}
+
+// userSummary holds only the attributes of a user item needed to check or
+// move the reservation of its email.
+type userSummary struct {
+	Id    string
+	Email string
+}
+
+type fsckEmail struct {
+	Id     string
+	UserId string
+}
+
+// fsckTenant holds the users and email reservations of a single tenant, as
+// emails are only unique within a tenant.
+type fsckTenant struct {
+	users  map[string]userSummary
+	emails map[string]fsckEmail
+}
+
+// Fsck scans the table for users and email reservations that are out of sync
+// and, if repair is set, corrects them. Each repair is a transaction that
+// checks the state found by the scan still holds, so it is safe to run
+// against a table in use.
+func (us *UserStore) Fsck(ctx context.Context, repair bool) (FsckReport, error) {
+	tenants, err := us.scanForFsck(ctx)
+	if err != nil {
+		return FsckReport{}, err
+	}
+
+	var report FsckReport
+
+	names := make([]string, 0, len(tenants))
+	for name := range tenants {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		tenant := tenants[name]
+
+		report.Users += len(tenant.users)
+		report.Emails += len(tenant.emails)
+
+		problems := us.checkTenant(name, tenant)
+
+		if repair {
+			us.repair(ctx, name, tenant.users, problems)
+		}
+
+		report.Problems = append(report.Problems, problems...)
+	}
+
+	return report, nil
+}
+
+// checkTenant returns the problems found with the users and emails of the
+// tenant.
+func (us *UserStore) checkTenant(name string, tenant *fsckTenant) []Problem {
+	users, emails := tenant.users, tenant.emails
+
+	var problems []Problem
+
+	usersByEmail := map[string][]string{}
+	for _, user := range users {
+		email := us.emailId(user.Email)
+		usersByEmail[email] = append(usersByEmail[email], user.Id)
+	}
+
+	// stale reservations are released first, so that their email can be
+	// reserved for any user missing one
+	stale := map[string]bool{}
+
+	for _, email := range sortedEmails(emails) {
+		reservation := emails[email]
+
+		user, ok := users[reservation.UserId]
+
+		switch {
+		case !ok:
+			stale[email] = true
+			problems = append(problems, Problem{
+				Tenant: name, Kind: ProblemOrphanedEmail, Email: email, UserIds: []string{reservation.UserId},
+			})
+		case us.emailId(user.Email) != email:
+			stale[email] = true
+			problems = append(problems, Problem{
+				Tenant: name, Kind: ProblemMismatchedEmail, Email: email, UserIds: []string{reservation.UserId},
+			})
+		}
+	}
+
+	for _, email := range sortedKeys(usersByEmail) {
+		ids := usersByEmail[email]
+
+		if len(ids) > 1 {
+			sort.Strings(ids)
+			problems = append(problems, Problem{
+				Tenant: name, Kind: ProblemDuplicateEmail, Email: email, UserIds: ids,
+			})
+
+			continue
+		}
+
+		// a user whose email is held by a stale reservation is missing one
+		// too, as the reservation is released
+		if reservation, ok := emails[email]; !ok || (stale[email] && reservation.UserId != ids[0]) {
+			problems = append(problems, Problem{
+				Tenant: name, Kind: ProblemMissingEmail, Email: email, UserIds: ids,
+			})
+		}
+	}
+
+	return problems
+}
+
+// repair attempts to correct each of the problems of the tenant, recording
+// the outcome in the problem.
+func (us *UserStore) repair(ctx context.Context, tenant string, users map[string]userSummary, problems []Problem) {
+	for idx := range problems {
+		problem := &problems[idx]
+
+		switch problem.Kind {
+		case ProblemOrphanedEmail:
+			problem.Err = us.releaseEmail(ctx, tenant, problem.Email, problem.UserIds[0], "attribute_not_exists(Id)", nil)
+		case ProblemMismatchedEmail:
+			condition, values := us.emailCondition(users[problem.UserIds[0]].Email)
+			problem.Err = us.releaseEmail(ctx, tenant, problem.Email, problem.UserIds[0], condition, values)
+		case ProblemMissingEmail:
+			problem.Err = us.reserveEmail(ctx, tenant, problem.Email, problem.UserIds[0], users[problem.UserIds[0]].Email)
+		case ProblemDuplicateEmail:
+			problem.Err = errors.New("users must be changed to have unique emails")
+		}
+
+		problem.Repaired = problem.Err == nil
+
+		if problem.Err != nil {
+			us.logger.Warnf("unable to repair %s", problem)
+		}
+	}
+}
+
+// scanForFsck returns the users and email reservations of each tenant.
+func (us *UserStore) scanForFsck(ctx context.Context) (map[string]*fsckTenant, error) {
+	tenants := map[string]*fsckTenant{}
+
+	scanInput := dynamodb.ScanInput{
+		TableName:        aws.String(us.tableName),
+		FilterExpression: aws.String("begins_with(objectType, :prefix)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":prefix": &types.AttributeValueMemberS{Value: key},
+		},
+		ConsistentRead: aws.Bool(true),
+	}
+
+	for {
+		result, err := us.dbClient.Scan(ctx, &scanInput)
+		if err != nil {
+			us.logger.Errorf("error during scan: %v", err)
+
+			return nil, err
+		}
+
+		for _, item := range result.Items {
+			name, kind, ok := itemTenant(item)
+			if !ok || (kind != kindUser && kind != kindEmail) {
+				continue
+			}
+
+			tenant, ok := tenants[name]
+			if !ok {
+				tenant = &fsckTenant{users: map[string]userSummary{}, emails: map[string]fsckEmail{}}
+				tenants[name] = tenant
+			}
+
+			if kind == kindUser {
+				if err := us.decryptItem(ctx, item); err != nil {
+					return nil, err
+				}
+
+				var user userSummary
+				if err := attributevalue.UnmarshalMap(item, &user); err != nil {
+					return nil, err
+				}
+
+				tenant.users[user.Id] = user
+			} else {
+				var email fsckEmail
+				if err := attributevalue.UnmarshalMap(item, &email); err != nil {
+					return nil, err
+				}
+
+				tenant.emails[email.Id] = email
+			}
+		}
+
+		if len(result.LastEvaluatedKey) == 0 {
+			return tenants, nil
+		}
+
+		scanInput.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+// releaseEmail deletes the reservation of the email for the user, provided
+// the user item still matches the condition that made it stale.
+func (us *UserStore) releaseEmail(
+	ctx context.Context, tenant, email, userId, userCondition string, values map[string]types.AttributeValue,
+) error {
+	_, err := us.dbClient.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{
+				ConditionCheck: &types.ConditionCheck{
+					Key:                       userKey(tenant, userId),
+					TableName:                 aws.String(us.tableName),
+					ConditionExpression:       aws.String(userCondition),
+					ExpressionAttributeValues: values,
+				},
+			},
+			{
+				Delete: &types.Delete{
+					Key:                 emailKey(tenant, email),
+					TableName:           aws.String(us.tableName),
+					ConditionExpression: aws.String("UserId = :id"),
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":id": &types.AttributeValueMemberS{Value: userId},
+					},
+				},
+			},
+		},
+	})
+
+	return fsckRepairError(err)
+}
+
+// reserveEmail creates the missing reservation of the email,
+// provided the user still has the email seen and it has not been reserved
+// since.
+func (us *UserStore) reserveEmail(ctx context.Context, tenant, email, userId, userEmail string) error {
+	item := emailKey(tenant, email)
+	item["UserId"] = &types.AttributeValueMemberS{Value: userId}
+
+	condition, values := us.emailCondition(userEmail)
+
+	_, err := us.dbClient.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{
+				ConditionCheck: &types.ConditionCheck{
+					Key:                       userKey(tenant, userId),
+					TableName:                 aws.String(us.tableName),
+					ConditionExpression:       aws.String(condition),
+					ExpressionAttributeValues: values,
+				},
+			},
+			{
+				Put: &types.Put{
+					Item:                item,
+					TableName:           aws.String(us.tableName),
+					ConditionExpression: aws.String("attribute_not_exists(Id)"),
+				},
+			},
+		},
+	})
+
+	return fsckRepairError(err)
+}
+
+func fsckRepairError(err error) error {
+	var errTransaction *types.TransactionCanceledException
+	if errors.As(err, &errTransaction) {
+		return errors.New("items changed since the scan, run again to recheck")
+	}
+
+	return err
+}
+
+func sortedEmails(emails map[string]fsckEmail) []string {
+	keys := make([]string, 0, len(emails))
+	for email := range emails {
+		keys = append(keys, email)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
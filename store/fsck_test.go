@@ -0,0 +1,149 @@
+package store_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/electrofelix/gin-demo/entity"
+	"github.com/electrofelix/gin-demo/store"
+	"github.com/electrofelix/gin-demo/store/dynamotest"
+)
+
+func TestUserStore_Fsck(t *testing.T) {
+	putItem := func(t *testing.T, dbClient *dynamotest.FakeDynamoDB, item map[string]types.AttributeValue) {
+		t.Helper()
+
+		_, err := dbClient.PutItem(context.Background(), &dynamodb.PutItemInput{
+			TableName: aws.String(tableName),
+			Item:      item,
+		})
+		require.NoError(t, err)
+	}
+
+	// one of each kind of problem alongside a consistent user
+	populate := func(t *testing.T, dbClient *dynamotest.FakeDynamoDB, dataStore *store.UserStore) {
+		t.Helper()
+
+		require.NoError(t, dataStore.Create(context.Background(), &entity.User{Id: "ok", Email: "ok@example.com"}))
+
+		missing := entity.User{Id: "missing", Email: "missing@example.com"}
+		putItem(t, dbClient, userToUserAttributeValue(missing))
+
+		orphaned := entity.User{Id: "gone", Email: "orphaned@example.com"}
+		putItem(t, dbClient, userToEmailAttributeValue(orphaned))
+
+		changed := entity.User{Id: "changed", Email: "new@example.com"}
+		putItem(t, dbClient, userToUserAttributeValue(changed))
+		putItem(t, dbClient, userToEmailAttributeValue(changed))
+		changed.Email = "old@example.com"
+		putItem(t, dbClient, userToEmailAttributeValue(changed))
+
+		duplicate := entity.User{Id: "dup1", Email: "dup@example.com"}
+		putItem(t, dbClient, userToUserAttributeValue(duplicate))
+		putItem(t, dbClient, userToEmailAttributeValue(duplicate))
+		duplicate.Id = "dup2"
+		putItem(t, dbClient, userToUserAttributeValue(duplicate))
+	}
+
+	kinds := func(report store.FsckReport) map[store.ProblemKind]bool {
+		found := map[store.ProblemKind]bool{}
+		for _, problem := range report.Problems {
+			found[problem.Kind] = problem.Repaired
+		}
+
+		return found
+	}
+
+	t.Run("consistent", func(t *testing.T) {
+		_, dataStore := setupFakeUserStore(t)
+
+		require.NoError(t, dataStore.Create(context.Background(), &entity.User{Id: "ok", Email: "ok@example.com"}))
+
+		report, err := dataStore.Fsck(context.Background(), true)
+		require.NoError(t, err)
+
+		assert.Equal(t, 1, report.Users)
+		assert.Equal(t, 1, report.Emails)
+		assert.Empty(t, report.Problems)
+	})
+
+	t.Run("report-only", func(t *testing.T) {
+		dbClient, dataStore := setupFakeUserStore(t)
+		populate(t, dbClient, dataStore)
+
+		report, err := dataStore.Fsck(context.Background(), false)
+		require.NoError(t, err)
+
+		assert.Equal(t, map[store.ProblemKind]bool{
+			store.ProblemMissingEmail:    false,
+			store.ProblemOrphanedEmail:   false,
+			store.ProblemMismatchedEmail: false,
+			store.ProblemDuplicateEmail:  false,
+		}, kinds(report))
+		assert.Equal(t, 4, report.Unrepaired())
+
+		// nothing was changed
+		again, err := dataStore.Fsck(context.Background(), false)
+		require.NoError(t, err)
+		assert.Equal(t, report, again)
+	})
+
+	t.Run("repair", func(t *testing.T) {
+		dbClient, dataStore := setupFakeUserStore(t)
+		populate(t, dbClient, dataStore)
+
+		report, err := dataStore.Fsck(context.Background(), true)
+		require.NoError(t, err)
+
+		assert.Equal(t, map[store.ProblemKind]bool{
+			store.ProblemMissingEmail:    true,
+			store.ProblemOrphanedEmail:   true,
+			store.ProblemMismatchedEmail: true,
+			store.ProblemDuplicateEmail:  false,
+		}, kinds(report))
+		assert.Equal(t, 1, report.Unrepaired())
+
+		user, err := dataStore.GetByEmail(context.Background(), entity.DefaultTenant, "missing@example.com")
+		require.NoError(t, err)
+		assert.Equal(t, "missing", user.Id)
+
+		// released emails may be used again
+		require.NoError(t, dataStore.Create(context.Background(), &entity.User{Id: "new1", Email: "orphaned@example.com"}))
+		require.NoError(t, dataStore.Create(context.Background(), &entity.User{Id: "new2", Email: "old@example.com"}))
+
+		again, err := dataStore.Fsck(context.Background(), true)
+		require.NoError(t, err)
+		assert.Equal(t, map[store.ProblemKind]bool{store.ProblemDuplicateEmail: false}, kinds(again))
+	})
+
+	t.Run("stale-reservation", func(t *testing.T) {
+		dbClient, dataStore := setupFakeUserStore(t)
+
+		// the email of the user is reserved for one that no longer exists
+		user := entity.User{Id: "a", Email: "x@example.com"}
+		putItem(t, dbClient, userToUserAttributeValue(user))
+		putItem(t, dbClient, userToEmailAttributeValue(entity.User{Id: "gone", Email: user.Email}))
+
+		report, err := dataStore.Fsck(context.Background(), true)
+		require.NoError(t, err)
+
+		assert.Equal(t, map[store.ProblemKind]bool{
+			store.ProblemOrphanedEmail: true,
+			store.ProblemMissingEmail:  true,
+		}, kinds(report))
+
+		got, err := dataStore.GetByEmail(context.Background(), entity.DefaultTenant, user.Email)
+		require.NoError(t, err)
+		assert.Equal(t, user.Id, got.Id)
+
+		again, err := dataStore.Fsck(context.Background(), false)
+		require.NoError(t, err)
+		assert.Empty(t, again.Problems)
+	})
+}
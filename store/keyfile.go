@@ -0,0 +1,183 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+// keyFile is the JSON format of a local key file, holding base64 encoded
+// 256 bit keys. Keys that are no longer current are kept to decrypt the
+// items still using them.
+type keyFile struct {
+	Current  string            `json:"current"`
+	Keys     map[string]string `json:"keys"`
+	IndexKey string            `json:"index_key"`
+}
+
+// KeyFileProvider is a KeyProvider with the master keys read from a local
+// file, intended for development or where a KMS is not available.
+type KeyFileProvider struct {
+	current  string
+	keys     map[string][]byte
+	indexKey []byte
+}
+
+// NewKeyFileProvider reads the keys from a JSON file of the form:
+//
+//	{"current": "1", "keys": {"1": "<base64>"}, "index_key": "<base64>"}
+func NewKeyFileProvider(path string) (*KeyFileProvider, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file keyFile
+
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key file %s: %w", path, err)
+	}
+
+	kp := &KeyFileProvider{
+		current: file.Current,
+		keys:    make(map[string][]byte, len(file.Keys)),
+	}
+
+	for id, encoded := range file.Keys {
+		kp.keys[id], err = decodeKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key '%s' in %s: %w", id, path, err)
+		}
+	}
+
+	if _, ok := kp.keys[kp.current]; !ok {
+		return nil, fmt.Errorf("current key '%s' not found in %s", kp.current, path)
+	}
+
+	kp.indexKey, err = decodeKey(file.IndexKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid index key in %s: %w", path, err)
+	}
+
+	return kp, nil
+}
+
+func decodeKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(key) != dataKeySize {
+		return nil, fmt.Errorf("must be %d bytes, got %d", dataKeySize, len(key))
+	}
+
+	return key, nil
+}
+
+func (kp *KeyFileProvider) CurrentKeyId() string {
+	return kp.current
+}
+
+func (kp *KeyFileProvider) WrapKey(ctx context.Context, dataKey []byte) ([]byte, string, error) {
+	aead, err := newAEAD(kp.keys[kp.current])
+	if err != nil {
+		return nil, "", err
+	}
+
+	wrapped, err := seal(aead, dataKey, []byte(kp.current))
+	if err != nil {
+		return nil, "", err
+	}
+
+	return wrapped, kp.current, nil
+}
+
+func (kp *KeyFileProvider) UnwrapKey(ctx context.Context, wrapped []byte, keyId string) ([]byte, error) {
+	key, ok := kp.keys[keyId]
+	if !ok {
+		return nil, fmt.Errorf("unknown key '%s'", keyId)
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return open(aead, wrapped, []byte(keyId))
+}
+
+func (kp *KeyFileProvider) IndexKey() []byte {
+	return kp.indexKey
+}
+
+// AddKeyFileKey generates a new master key in the key file and makes it the
+// current key, returning its id. The file is created, along with the index
+// key, if it does not exist.
+func AddKeyFileKey(path string) (string, error) {
+	file := keyFile{Keys: map[string]string{}}
+
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil:
+		err = json.Unmarshal(data, &file)
+		if err != nil {
+			return "", fmt.Errorf("invalid key file %s: %w", path, err)
+		}
+	case os.IsNotExist(err):
+		file.IndexKey, err = generateKey()
+		if err != nil {
+			return "", err
+		}
+	default:
+		return "", err
+	}
+
+	// ids are sequential so that the newest is easily identified
+	next := 1
+	for id := range file.Keys {
+		if version, err := strconv.Atoi(id); err == nil && version >= next {
+			next = version + 1
+		}
+	}
+
+	id := strconv.Itoa(next)
+
+	file.Keys[id], err = generateKey()
+	if err != nil {
+		return "", err
+	}
+
+	file.Current = id
+
+	data, err = json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	// replace the file in one step, so that it is never seen half written
+	tmp := path + ".tmp"
+
+	err = ioutil.WriteFile(tmp, append(data, '\n'), 0600)
+	if err != nil {
+		return "", err
+	}
+
+	return id, os.Rename(tmp, path)
+}
+
+func generateKey() (string, error) {
+	key := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(key), nil
+}
@@ -0,0 +1,128 @@
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"github.com/electrofelix/gin-demo/entity"
+)
+
+// loginFields are the attributes of the user item updated in place when
+// recording a login, which cannot be encrypted as the update replaces them
+// without the data key of the item.
+var loginFields = []string{"LastLogin", "LastLoginIp", "LoginCount"}
+
+// isLoginAttribute reports whether the attribute of the user item is changed
+// by recording a login, which includes the sort key derived from LastLogin.
+func isLoginAttribute(name string) bool {
+	if name == lastLoginSortAttribute {
+		return true
+	}
+
+	for _, field := range loginFields {
+		if field == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RecordLogin sets the last login time and source address of the user and
+// increments its login count with a single UpdateItem, leaving the rest of
+// the user and its Version untouched so that it never conflicts with a
+// concurrent change of the user. Any audit entries are recorded in the same
+// transaction, entity.ErrNotFound is returned if the user does not exist.
+func (us *UserStore) RecordLogin(
+	ctx context.Context, tenant, id string, login entity.Login, audit ...entity.AuditEntry,
+) error {
+	if id == "" {
+		return entity.ErrIDMissing
+	}
+
+	if us.encryption != nil {
+		for _, field := range loginFields {
+			if us.encryption.encrypts(field) {
+				return fmt.Errorf("cannot record logins with %s encrypted", field)
+			}
+		}
+	}
+
+	lastLogin, err := attributevalue.Marshal(login.Time)
+	if err != nil {
+		return err
+	}
+
+	values := map[string]types.AttributeValue{
+		":lastLogin":     lastLogin,
+		":lastLoginSort": &types.AttributeValueMemberS{Value: lastLoginSortKey(login.Time)},
+		":one":           &types.AttributeValueMemberN{Value: "1"},
+	}
+
+	// an unknown address is removed rather than leaving that of an earlier
+	// login in place
+	expression := "SET LastLogin = :lastLogin, LastLoginSort = :lastLoginSort REMOVE LastLoginIp ADD LoginCount :one"
+	if login.SourceIp != "" {
+		expression = "SET LastLogin = :lastLogin, LastLoginSort = :lastLoginSort, LastLoginIp = :sourceIp " +
+			"ADD LoginCount :one"
+		values[":sourceIp"] = &types.AttributeValueMemberS{Value: login.SourceIp}
+	}
+
+	update := types.Update{
+		Key:                       userKey(tenant, id),
+		TableName:                 aws.String(us.tableName),
+		UpdateExpression:          aws.String(expression),
+		ConditionExpression:       aws.String("attribute_exists(Id)"),
+		ExpressionAttributeValues: values,
+	}
+
+	if len(audit) == 0 {
+		_, err = us.dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			Key:                       update.Key,
+			TableName:                 update.TableName,
+			UpdateExpression:          update.UpdateExpression,
+			ConditionExpression:       update.ConditionExpression,
+			ExpressionAttributeValues: update.ExpressionAttributeValues,
+		})
+	} else {
+		err = us.transactLogin(ctx, tenant, &update, audit)
+	}
+
+	if err != nil {
+		if isConditionalCheckFailed(err) {
+			return entity.ErrNotFound
+		}
+
+		if isAuditConflict(err, 1) {
+			return entity.ErrConflict
+		}
+
+		us.logger.Errorf("error recording login of %s: %v", id, err)
+
+		return err
+	}
+
+	return nil
+}
+
+// transactLogin performs the update of the user item in a transaction with
+// the audit entries recording the login.
+func (us *UserStore) transactLogin(
+	ctx context.Context, tenant string, update *types.Update, audit []entity.AuditEntry,
+) error {
+	auditPuts, err := us.auditPuts(ctx, tenant, audit)
+	if err != nil {
+		return err
+	}
+
+	_, err = us.dbClient.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: append([]types.TransactWriteItem{{Update: update}}, auditPuts...),
+	})
+
+	return err
+}
@@ -0,0 +1,458 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/electrofelix/gin-demo/entity"
+)
+
+// MemoryUserStore keeps users in process memory with the same uniqueness
+// guarantees as the DynamoDB backed UserStore. It is intended for local
+// development and tests, all data is lost when the process exits.
+type MemoryUserStore struct {
+	mu sync.RWMutex
+
+	tenants map[string]*memoryTenant
+}
+
+// memoryTenant holds the users of a single tenant, which share nothing with
+// those of any other tenant.
+type memoryTenant struct {
+	// users are held without their password, which is kept in credentials
+	// by user Id
+	users       map[string]entity.User
+	credentials map[string]entity.Credentials
+	// emails maps the canonical form of each email address in use to the
+	// Id of the owning user, mirroring the UserInfo#email items in DynamoDB
+	emails map[string]string
+	// audit holds the entries for each user Id in the order recorded
+	audit map[string][]entity.AuditEntry
+}
+
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{
+		tenants: map[string]*memoryTenant{},
+	}
+}
+
+// tenant returns the users of the tenant, creating it if needed. It must be
+// called with the lock held.
+func (ms *MemoryUserStore) tenant(name string) *memoryTenant {
+	name = entity.TenantOrDefault(name)
+
+	tenant, ok := ms.tenants[name]
+	if !ok {
+		tenant = &memoryTenant{
+			users:       map[string]entity.User{},
+			credentials: map[string]entity.Credentials{},
+			emails:      map[string]string{},
+			audit:       map[string][]entity.AuditEntry{},
+		}
+		ms.tenants[name] = tenant
+	}
+
+	return tenant
+}
+
+// lookup returns the users of the tenant without creating it, so it may be
+// called with only the read lock held.
+func (ms *MemoryUserStore) lookup(name string) *memoryTenant {
+	if tenant, ok := ms.tenants[entity.TenantOrDefault(name)]; ok {
+		return tenant
+	}
+
+	// reading the nil maps of an empty tenant finds nothing
+	return &memoryTenant{}
+}
+
+func (ms *MemoryUserStore) Create(ctx context.Context, user *entity.User, audit ...entity.AuditEntry) error {
+	if user.Id == "" {
+		return entity.ErrIDMissing
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	user.TenantId = entity.TenantOrDefault(user.TenantId)
+	tenant := ms.tenant(user.TenantId)
+
+	if _, ok := tenant.users[user.Id]; ok {
+		return fmt.Errorf("user %s already exists", user.Id)
+	}
+
+	email := entity.CanonicalEmail(user.Email)
+	if _, ok := tenant.emails[email]; ok {
+		return entity.ErrEmailDuplicate
+	}
+
+	if tenant.hasAudit(audit) {
+		return entity.ErrConflict
+	}
+
+	user.Version = 1
+	tenant.putUser(*user)
+	tenant.emails[email] = user.Id
+	tenant.recordAudit(audit)
+
+	return nil
+}
+
+// CreateBatch creates each of the users in turn, returning the error for
+// each user in the same order.
+func (ms *MemoryUserStore) CreateBatch(ctx context.Context, users []*entity.User, audit []entity.AuditEntry) []error {
+	errs := make([]error, len(users))
+
+	for idx, user := range users {
+		var entries []entity.AuditEntry
+		if len(audit) > 0 {
+			entries = audit[idx : idx+1]
+		}
+
+		errs[idx] = ms.Create(ctx, user, entries...)
+	}
+
+	return errs
+}
+
+func (ms *MemoryUserStore) GetByEmail(ctx context.Context, tenantName, email string) (*entity.User, error) {
+	if email == "" {
+		return nil, entity.ErrIDMissing
+	}
+
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	tenant := ms.lookup(tenantName)
+
+	id, ok := tenant.emails[entity.CanonicalEmail(email)]
+	if !ok {
+		return nil, entity.ErrNotFound
+	}
+
+	user := tenant.users[id]
+
+	return &user, nil
+}
+
+func (ms *MemoryUserStore) GetById(ctx context.Context, tenantName, id string) (*entity.User, error) {
+	if id == "" {
+		return nil, entity.ErrIDMissing
+	}
+
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	user, ok := ms.lookup(tenantName).users[id]
+	if !ok {
+		return nil, entity.ErrNotFound
+	}
+
+	return &user, nil
+}
+
+// GetMany returns the users with the given ids in the order requested,
+// skipping any that do not exist.
+func (ms *MemoryUserStore) GetMany(ctx context.Context, tenantName string, ids []string) ([]entity.User, error) {
+	ids, err := uniqueIds(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	tenant := ms.lookup(tenantName)
+	users := make([]entity.User, 0, len(ids))
+
+	for _, id := range ids {
+		if user, ok := tenant.users[id]; ok {
+			users = append(users, user)
+		}
+	}
+
+	return users, nil
+}
+
+// GetCredentials returns the credentials of the user.
+func (ms *MemoryUserStore) GetCredentials(ctx context.Context, tenantName, id string) (*entity.Credentials, error) {
+	if id == "" {
+		return nil, entity.ErrIDMissing
+	}
+
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	credentials, ok := ms.lookup(tenantName).credentials[id]
+	if !ok {
+		return nil, entity.ErrNotFound
+	}
+
+	return &credentials, nil
+}
+
+// List returns users of the tenant ordered by Id, matching the order of the
+// objectType index used by the DynamoDB store.
+func (ms *MemoryUserStore) List(ctx context.Context, tenantName string, opts entity.ListOptions) (entity.UserPage, error) {
+	lastKey, err := decodeCursor(opts.Cursor)
+	if err != nil {
+		return entity.UserPage{}, err
+	}
+
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	tenant := ms.lookup(tenantName)
+
+	ids := make([]string, 0, len(tenant.users))
+	for id, user := range tenant.users {
+		if id > lastKey["Id"] && (user.DeletedAt != nil) == opts.Deleted && opts.Matches(&user) {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Strings(ids)
+
+	page := entity.UserPage{Users: []entity.User{}}
+
+	if opts.Limit > 0 && len(ids) > int(opts.Limit) {
+		ids = ids[:opts.Limit]
+
+		page.NextCursor, err = encodeCursor(map[string]string{"Id": ids[len(ids)-1]})
+		if err != nil {
+			return entity.UserPage{}, err
+		}
+	}
+
+	for _, id := range ids {
+		page.Users = append(page.Users, tenant.users[id])
+	}
+
+	return page, nil
+}
+
+// Purge removes the user and releases its email, provided the user has not
+// been modified since it was read.
+func (ms *MemoryUserStore) Purge(ctx context.Context, user *entity.User) error {
+	if user.Id == "" {
+		return entity.ErrIDMissing
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	tenant := ms.lookup(user.TenantId)
+
+	currentUser, ok := tenant.users[user.Id]
+	if !ok {
+		return entity.ErrNotFound
+	}
+
+	if currentUser.Version != user.Version {
+		return entity.ErrConflict
+	}
+
+	delete(tenant.users, user.Id)
+	delete(tenant.credentials, user.Id)
+	delete(tenant.emails, entity.CanonicalEmail(currentUser.Email))
+
+	return nil
+}
+
+// ListAudit returns the audit entries recorded for the user, newest first.
+func (ms *MemoryUserStore) ListAudit(
+	ctx context.Context, tenantName, id string, opts entity.ListOptions,
+) (entity.AuditPage, error) {
+	if id == "" {
+		return entity.AuditPage{}, entity.ErrIDMissing
+	}
+
+	before, err := decodeAuditCursor(opts.Cursor, tenantName, id)
+	if err != nil {
+		return entity.AuditPage{}, err
+	}
+
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	page := entity.AuditPage{Entries: []entity.AuditEntry{}}
+
+	entries := ms.lookup(tenantName).audit[id]
+	for idx := len(entries) - 1; idx >= 0; idx-- {
+		if !before.IsZero() && !entries[idx].Timestamp.Before(before) {
+			continue
+		}
+
+		if opts.Limit > 0 && len(page.Entries) == int(opts.Limit) {
+			page.NextCursor, err = encodeAuditCursor(tenantName, page.Entries[len(page.Entries)-1])
+			if err != nil {
+				return entity.AuditPage{}, err
+			}
+
+			break
+		}
+
+		page.Entries = append(page.Entries, entries[idx])
+	}
+
+	return page, nil
+}
+
+// RecordLogin sets the last login time and source address of the user and
+// increments its login count, leaving its version unchanged.
+func (ms *MemoryUserStore) RecordLogin(
+	ctx context.Context, tenantName, id string, login entity.Login, audit ...entity.AuditEntry,
+) error {
+	if id == "" {
+		return entity.ErrIDMissing
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	tenant := ms.lookup(tenantName)
+
+	user, ok := tenant.users[id]
+	if !ok {
+		return entity.ErrNotFound
+	}
+
+	if tenant.hasAudit(audit) {
+		return entity.ErrConflict
+	}
+
+	user.LastLogin = login.Time
+	user.LastLoginIp = login.SourceIp
+	user.LoginCount++
+	tenant.users[id] = user
+	tenant.recordAudit(audit)
+
+	return nil
+}
+
+// PutCredentials replaces the credentials of an existing user, leaving the
+// user and its version unchanged. A non-zero version must match that of the
+// user and the stored credentials must still be at credentials.Version.
+func (ms *MemoryUserStore) PutCredentials(
+	ctx context.Context, tenantName, id string, version int64, credentials *entity.Credentials,
+	audit ...entity.AuditEntry,
+) error {
+	if id == "" {
+		return entity.ErrIDMissing
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	tenant := ms.lookup(tenantName)
+
+	user, ok := tenant.users[id]
+	if !ok {
+		return entity.ErrNotFound
+	}
+
+	if (version != 0 && user.Version != version) || tenant.hasAudit(audit) {
+		return entity.ErrConflict
+	}
+
+	if tenant.credentials[id].Version != credentials.Version {
+		return entity.ErrConflict
+	}
+
+	credentials.Version++
+	tenant.credentials[id] = *credentials
+	tenant.recordAudit(audit)
+
+	return nil
+}
+
+func (ms *MemoryUserStore) Update(ctx context.Context, user *entity.User, audit ...entity.AuditEntry) error {
+	if user.Id == "" {
+		return entity.ErrIDMissing
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	user.TenantId = entity.TenantOrDefault(user.TenantId)
+	tenant := ms.tenant(user.TenantId)
+
+	currentUser, ok := tenant.users[user.Id]
+	if !ok {
+		return entity.ErrNotFound
+	}
+
+	if currentUser.Version != user.Version || tenant.hasAudit(audit) {
+		return entity.ErrConflict
+	}
+
+	email, currentEmail := entity.CanonicalEmail(user.Email), entity.CanonicalEmail(currentUser.Email)
+	if email != currentEmail {
+		if _, ok := tenant.emails[email]; ok {
+			return entity.ErrEmailDuplicate
+		}
+
+		delete(tenant.emails, currentEmail)
+		tenant.emails[email] = user.Id
+	}
+
+	// the login fields are only changed by RecordLogin, without a new version
+	user.LastLogin = currentUser.LastLogin
+	user.LastLoginIp = currentUser.LastLoginIp
+	user.LoginCount = currentUser.LoginCount
+
+	user.Version++
+	tenant.putUser(*user)
+	tenant.recordAudit(audit)
+
+	return nil
+}
+
+// putUser stores the user without its password, which replaces that of the
+// credentials of the user when set. It must be called with the lock held.
+func (mt *memoryTenant) putUser(user entity.User) {
+	if user.Password != "" {
+		credentials := mt.credentials[user.Id]
+		credentials.Password = user.Password
+		credentials.Version++
+		mt.credentials[user.Id] = credentials
+	}
+
+	user.Password = ""
+	mt.users[user.Id] = user
+}
+
+// hasAudit reports whether an entry of the same user and timestamp as any of
+// audit has already been recorded, as the DynamoDB store never writes an
+// entry over another. It must be called with the lock held.
+func (mt *memoryTenant) hasAudit(audit []entity.AuditEntry) bool {
+	for _, entry := range audit {
+		for _, recorded := range mt.audit[entry.UserId] {
+			if recorded.Timestamp.Equal(entry.Timestamp) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// recordAudit keeps entries ordered by timestamp, must be called with the
+// lock held.
+func (mt *memoryTenant) recordAudit(audit []entity.AuditEntry) {
+	for _, entry := range audit {
+		entries := mt.audit[entry.UserId]
+
+		idx := sort.Search(len(entries), func(idx int) bool {
+			return entries[idx].Timestamp.After(entry.Timestamp)
+		})
+
+		entries = append(entries, entity.AuditEntry{})
+		copy(entries[idx+1:], entries[idx:])
+		entries[idx] = entry
+
+		mt.audit[entry.UserId] = entries
+	}
+}
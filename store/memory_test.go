@@ -0,0 +1,15 @@
+package store_test
+
+import (
+	"testing"
+
+	"github.com/electrofelix/gin-demo/service"
+	"github.com/electrofelix/gin-demo/store"
+	"github.com/electrofelix/gin-demo/store/storetest"
+)
+
+func TestMemoryUserStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) service.UserStore {
+		return store.NewMemoryUserStore()
+	})
+}
@@ -0,0 +1,538 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/electrofelix/gin-demo/entity"
+	"github.com/electrofelix/gin-demo/service"
+)
+
+const (
+	metricsNamespace = "gin_demo"
+	metricsSubsystem = "store"
+
+	// otherOperation labels DynamoDB calls made outside of a store
+	// operation, such as by migrations.
+	otherOperation = "other"
+)
+
+// expectedErrors are returned for the request made or the users stored, such
+// as a duplicate email, rather than a failure of the store, so they are not
+// counted as errors.
+var expectedErrors = []error{
+	entity.ErrNotFound,
+	entity.ErrEmailDuplicate,
+	entity.ErrConflict,
+	entity.ErrCursorInvalid,
+	entity.ErrIDMissing,
+	entity.ErrFilterUnsupported,
+}
+
+// Metrics are the Prometheus collectors recording the store operations, by
+// the name of the operation such as Create or GetById.
+type Metrics struct {
+	duration            *prometheus.HistogramVec
+	errors              *prometheus.CounterVec
+	readCapacity        *prometheus.CounterVec
+	writeCapacity       *prometheus.CounterVec
+	conditionalFailures *prometheus.CounterVec
+}
+
+// NewMetrics creates the store collectors and registers them with reg, which
+// panics if they are already registered.
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	labels := []string{"operation"}
+
+	m := &Metrics{
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "operation_duration_seconds",
+			Help:      "Time taken by store operations, including any retries.",
+			Buckets:   prometheus.DefBuckets,
+		}, labels),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "operation_errors_total",
+			Help:      "Store operations that failed, excluding expected errors such as users not found.",
+		}, labels),
+		readCapacity: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "consumed_read_capacity_units_total",
+			Help:      "DynamoDB read capacity units consumed by store operations.",
+		}, labels),
+		writeCapacity: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "consumed_write_capacity_units_total",
+			Help:      "DynamoDB write capacity units consumed by store operations.",
+		}, labels),
+		conditionalFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "conditional_check_failures_total",
+			Help:      "DynamoDB writes rejected by their condition, such as a duplicate email.",
+		}, labels),
+	}
+
+	reg.MustRegister(m.duration, m.errors, m.readCapacity, m.writeCapacity, m.conditionalFailures)
+
+	return m
+}
+
+// WithMetrics records the capacity consumed by the DynamoDB calls of the
+// store and any that fail their condition, attributed to the operation
+// named by a MetricsUserStore wrapping it.
+func WithMetrics(m *Metrics) Option {
+	return func(us *UserStore) {
+		us.metrics = m
+	}
+}
+
+type operationKey struct{}
+
+// withOperation names the store operation that DynamoDB calls made with the
+// context are for, keeping the name of the outermost operation.
+func withOperation(ctx context.Context, operation string) context.Context {
+	if _, ok := ctx.Value(operationKey{}).(string); ok {
+		return ctx
+	}
+
+	return context.WithValue(ctx, operationKey{}, operation)
+}
+
+func operationFrom(ctx context.Context) string {
+	if operation, ok := ctx.Value(operationKey{}).(string); ok {
+		return operation
+	}
+
+	return otherOperation
+}
+
+func (m *Metrics) observe(operation string, start time.Time, errs ...error) {
+	m.duration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+
+	for _, err := range errs {
+		if err != nil && !isExpectedError(err) {
+			m.errors.WithLabelValues(operation).Inc()
+		}
+	}
+}
+
+func isExpectedError(err error) bool {
+	for _, expected := range expectedErrors {
+		if errors.Is(err, expected) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MetricsUserStore decorates another service.UserStore, recording the time
+// taken by each operation and those that fail.
+type MetricsUserStore struct {
+	next    service.UserStore
+	metrics *Metrics
+}
+
+func NewMetricsUserStore(next service.UserStore, m *Metrics) *MetricsUserStore {
+	return &MetricsUserStore{
+		next:    next,
+		metrics: m,
+	}
+}
+
+func (ms *MetricsUserStore) Create(ctx context.Context, user *entity.User, audit ...entity.AuditEntry) error {
+	start := time.Now()
+	err := ms.next.Create(withOperation(ctx, "Create"), user, audit...)
+	ms.metrics.observe("Create", start, err)
+
+	return err
+}
+
+// CreateBatch counts each user that failed to be created as an error.
+func (ms *MetricsUserStore) CreateBatch(ctx context.Context, users []*entity.User, audit []entity.AuditEntry) []error {
+	start := time.Now()
+	errs := ms.next.CreateBatch(withOperation(ctx, "CreateBatch"), users, audit)
+	ms.metrics.observe("CreateBatch", start, errs...)
+
+	return errs
+}
+
+func (ms *MetricsUserStore) GetByEmail(ctx context.Context, tenant, email string) (*entity.User, error) {
+	start := time.Now()
+	user, err := ms.next.GetByEmail(withOperation(ctx, "GetByEmail"), tenant, email)
+	ms.metrics.observe("GetByEmail", start, err)
+
+	return user, err
+}
+
+func (ms *MetricsUserStore) GetById(ctx context.Context, tenant, id string) (*entity.User, error) {
+	start := time.Now()
+	user, err := ms.next.GetById(withOperation(ctx, "GetById"), tenant, id)
+	ms.metrics.observe("GetById", start, err)
+
+	return user, err
+}
+
+func (ms *MetricsUserStore) GetMany(ctx context.Context, tenant string, ids []string) ([]entity.User, error) {
+	start := time.Now()
+	users, err := ms.next.GetMany(withOperation(ctx, "GetMany"), tenant, ids)
+	ms.metrics.observe("GetMany", start, err)
+
+	return users, err
+}
+
+func (ms *MetricsUserStore) GetCredentials(ctx context.Context, tenant, id string) (*entity.Credentials, error) {
+	start := time.Now()
+	credentials, err := ms.next.GetCredentials(withOperation(ctx, "GetCredentials"), tenant, id)
+	ms.metrics.observe("GetCredentials", start, err)
+
+	return credentials, err
+}
+
+func (ms *MetricsUserStore) List(ctx context.Context, tenant string, opts entity.ListOptions) (entity.UserPage, error) {
+	start := time.Now()
+	page, err := ms.next.List(withOperation(ctx, "List"), tenant, opts)
+	ms.metrics.observe("List", start, err)
+
+	return page, err
+}
+
+func (ms *MetricsUserStore) ListAudit(ctx context.Context, tenant, id string, opts entity.ListOptions) (entity.AuditPage, error) {
+	start := time.Now()
+	page, err := ms.next.ListAudit(withOperation(ctx, "ListAudit"), tenant, id, opts)
+	ms.metrics.observe("ListAudit", start, err)
+
+	return page, err
+}
+
+func (ms *MetricsUserStore) Purge(ctx context.Context, user *entity.User) error {
+	start := time.Now()
+	err := ms.next.Purge(withOperation(ctx, "Purge"), user)
+	ms.metrics.observe("Purge", start, err)
+
+	return err
+}
+
+func (ms *MetricsUserStore) PutCredentials(
+	ctx context.Context, tenant, id string, version int64, credentials *entity.Credentials,
+	audit ...entity.AuditEntry,
+) error {
+	start := time.Now()
+	err := ms.next.PutCredentials(withOperation(ctx, "PutCredentials"), tenant, id, version, credentials, audit...)
+	ms.metrics.observe("PutCredentials", start, err)
+
+	return err
+}
+
+func (ms *MetricsUserStore) RecordLogin(
+	ctx context.Context, tenant, id string, login entity.Login, audit ...entity.AuditEntry,
+) error {
+	start := time.Now()
+	err := ms.next.RecordLogin(withOperation(ctx, "RecordLogin"), tenant, id, login, audit...)
+	ms.metrics.observe("RecordLogin", start, err)
+
+	return err
+}
+
+func (ms *MetricsUserStore) Update(ctx context.Context, user *entity.User, audit ...entity.AuditEntry) error {
+	start := time.Now()
+	err := ms.next.Update(withOperation(ctx, "Update"), user, audit...)
+	ms.metrics.observe("Update", start, err)
+
+	return err
+}
+
+// metricsDynamoDB requests the consumed capacity of every call that reports
+// it, adding it to the metrics of the store operation making the call. The
+// request is made with a copy of the input, leaving that of the caller as
+// given.
+type metricsDynamoDB struct {
+	next    DynamoDBAPI
+	metrics *Metrics
+}
+
+func newMetricsDynamoDB(next DynamoDBAPI, m *Metrics) *metricsDynamoDB {
+	return &metricsDynamoDB{
+		next:    next,
+		metrics: m,
+	}
+}
+
+// consumed adds the capacity to the operation, total capacity is counted as
+// read or write depending on the call when it is not broken down.
+func (md *metricsDynamoDB) consumed(ctx context.Context, write bool, capacity ...types.ConsumedCapacity) {
+	operation := operationFrom(ctx)
+
+	for _, c := range capacity {
+		read, written := aws.ToFloat64(c.ReadCapacityUnits), aws.ToFloat64(c.WriteCapacityUnits)
+		if read == 0 && written == 0 {
+			if write {
+				written = aws.ToFloat64(c.CapacityUnits)
+			} else {
+				read = aws.ToFloat64(c.CapacityUnits)
+			}
+		}
+
+		md.metrics.readCapacity.WithLabelValues(operation).Add(read)
+		md.metrics.writeCapacity.WithLabelValues(operation).Add(written)
+	}
+}
+
+// failed counts calls rejected because an item did not meet its condition.
+func (md *metricsDynamoDB) failed(ctx context.Context, err error) {
+	var (
+		errCondition   *types.ConditionalCheckFailedException
+		errTransaction *types.TransactionCanceledException
+	)
+
+	switch {
+	case errors.As(err, &errCondition):
+	case errors.As(err, &errTransaction):
+		if !hasCancellationReason(errTransaction, "ConditionalCheckFailed") {
+			return
+		}
+	default:
+		return
+	}
+
+	md.metrics.conditionalFailures.WithLabelValues(operationFrom(ctx)).Inc()
+}
+
+func hasCancellationReason(err *types.TransactionCanceledException, code string) bool {
+	for _, reason := range err.CancellationReasons {
+		if aws.ToString(reason.Code) == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (md *metricsDynamoDB) BatchGetItem(
+	ctx context.Context, input *dynamodb.BatchGetItemInput, opts ...DynamoDBOptions,
+) (*dynamodb.BatchGetItemOutput, error) {
+	request := *input
+	request.ReturnConsumedCapacity = types.ReturnConsumedCapacityTotal
+	input = &request
+
+	output, err := md.next.BatchGetItem(ctx, input, opts...)
+	if err != nil {
+		return output, err
+	}
+
+	md.consumed(ctx, false, output.ConsumedCapacity...)
+
+	return output, nil
+}
+
+func (md *metricsDynamoDB) CreateTable(
+	ctx context.Context, input *dynamodb.CreateTableInput, opts ...DynamoDBOptions,
+) (*dynamodb.CreateTableOutput, error) {
+	return md.next.CreateTable(ctx, input, opts...)
+}
+
+func (md *metricsDynamoDB) GetItem(
+	ctx context.Context, input *dynamodb.GetItemInput, opts ...DynamoDBOptions,
+) (*dynamodb.GetItemOutput, error) {
+	request := *input
+	request.ReturnConsumedCapacity = types.ReturnConsumedCapacityTotal
+	input = &request
+
+	output, err := md.next.GetItem(ctx, input, opts...)
+	if err != nil {
+		return output, err
+	}
+
+	if output.ConsumedCapacity != nil {
+		md.consumed(ctx, false, *output.ConsumedCapacity)
+	}
+
+	return output, nil
+}
+
+func (md *metricsDynamoDB) DeleteItem(
+	ctx context.Context, input *dynamodb.DeleteItemInput, opts ...DynamoDBOptions,
+) (*dynamodb.DeleteItemOutput, error) {
+	request := *input
+	request.ReturnConsumedCapacity = types.ReturnConsumedCapacityTotal
+	input = &request
+
+	output, err := md.next.DeleteItem(ctx, input, opts...)
+	if err != nil {
+		md.failed(ctx, err)
+
+		return output, err
+	}
+
+	if output.ConsumedCapacity != nil {
+		md.consumed(ctx, true, *output.ConsumedCapacity)
+	}
+
+	return output, nil
+}
+
+func (md *metricsDynamoDB) DescribeTable(
+	ctx context.Context, input *dynamodb.DescribeTableInput, opts ...DynamoDBOptions,
+) (*dynamodb.DescribeTableOutput, error) {
+	return md.next.DescribeTable(ctx, input, opts...)
+}
+
+func (md *metricsDynamoDB) PutItem(
+	ctx context.Context, input *dynamodb.PutItemInput, opts ...DynamoDBOptions,
+) (*dynamodb.PutItemOutput, error) {
+	request := *input
+	request.ReturnConsumedCapacity = types.ReturnConsumedCapacityTotal
+	input = &request
+
+	output, err := md.next.PutItem(ctx, input, opts...)
+	if err != nil {
+		md.failed(ctx, err)
+
+		return output, err
+	}
+
+	if output.ConsumedCapacity != nil {
+		md.consumed(ctx, true, *output.ConsumedCapacity)
+	}
+
+	return output, nil
+}
+
+func (md *metricsDynamoDB) Query(
+	ctx context.Context, input *dynamodb.QueryInput, opts ...DynamoDBOptions,
+) (*dynamodb.QueryOutput, error) {
+	request := *input
+	request.ReturnConsumedCapacity = types.ReturnConsumedCapacityTotal
+	input = &request
+
+	output, err := md.next.Query(ctx, input, opts...)
+	if err != nil {
+		return output, err
+	}
+
+	if output.ConsumedCapacity != nil {
+		md.consumed(ctx, false, *output.ConsumedCapacity)
+	}
+
+	return output, nil
+}
+
+func (md *metricsDynamoDB) Scan(
+	ctx context.Context, input *dynamodb.ScanInput, opts ...DynamoDBOptions,
+) (*dynamodb.ScanOutput, error) {
+	request := *input
+	request.ReturnConsumedCapacity = types.ReturnConsumedCapacityTotal
+	input = &request
+
+	output, err := md.next.Scan(ctx, input, opts...)
+	if err != nil {
+		return output, err
+	}
+
+	if output.ConsumedCapacity != nil {
+		md.consumed(ctx, false, *output.ConsumedCapacity)
+	}
+
+	return output, nil
+}
+
+func (md *metricsDynamoDB) TransactWriteItems(
+	ctx context.Context, input *dynamodb.TransactWriteItemsInput, opts ...DynamoDBOptions,
+) (*dynamodb.TransactWriteItemsOutput, error) {
+	request := *input
+	request.ReturnConsumedCapacity = types.ReturnConsumedCapacityTotal
+	input = &request
+
+	output, err := md.next.TransactWriteItems(ctx, input, opts...)
+	if err != nil {
+		md.failed(ctx, err)
+
+		return output, err
+	}
+
+	md.consumed(ctx, true, output.ConsumedCapacity...)
+
+	return output, nil
+}
+
+func (md *metricsDynamoDB) UpdateItem(
+	ctx context.Context, input *dynamodb.UpdateItemInput, opts ...DynamoDBOptions,
+) (*dynamodb.UpdateItemOutput, error) {
+	request := *input
+	request.ReturnConsumedCapacity = types.ReturnConsumedCapacityTotal
+	input = &request
+
+	output, err := md.next.UpdateItem(ctx, input, opts...)
+	if err != nil {
+		md.failed(ctx, err)
+
+		return output, err
+	}
+
+	if output.ConsumedCapacity != nil {
+		md.consumed(ctx, true, *output.ConsumedCapacity)
+	}
+
+	return output, nil
+}
+
+func (md *metricsDynamoDB) UpdateTable(
+	ctx context.Context, input *dynamodb.UpdateTableInput, opts ...DynamoDBOptions,
+) (*dynamodb.UpdateTableOutput, error) {
+	return md.next.UpdateTable(ctx, input, opts...)
+}
+
+// cacheCollector reports the totals of a CachingUserStore when gathered,
+// rather than keeping counters of its own alongside them.
+type cacheCollector struct {
+	cache     *CachingUserStore
+	hits      *prometheus.Desc
+	misses    *prometheus.Desc
+	evictions *prometheus.Desc
+	size      *prometheus.Desc
+}
+
+// RegisterCacheMetrics registers collectors of the hits, misses, evictions
+// and size of the cache with reg, which panics if they are already
+// registered.
+func RegisterCacheMetrics(reg prometheus.Registerer, cache *CachingUserStore) {
+	name := func(metric string) string {
+		return prometheus.BuildFQName(metricsNamespace, "cache", metric)
+	}
+
+	reg.MustRegister(&cacheCollector{
+		cache:     cache,
+		hits:      prometheus.NewDesc(name("hits_total"), "Users read from the cache.", nil, nil),
+		misses:    prometheus.NewDesc(name("misses_total"), "Users read from the store as they were not cached.", nil, nil),
+		evictions: prometheus.NewDesc(name("evictions_total"), "Users dropped from the cache to make room for others.", nil, nil),
+		size:      prometheus.NewDesc(name("entries"), "Users, and absences of users, held in the cache.", nil, nil),
+	})
+}
+
+func (c *cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.hits
+	ch <- c.misses
+	ch <- c.evictions
+	ch <- c.size
+}
+
+func (c *cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.cache.Stats()
+
+	ch <- prometheus.MustNewConstMetric(c.hits, prometheus.CounterValue, float64(stats.Hits))
+	ch <- prometheus.MustNewConstMetric(c.misses, prometheus.CounterValue, float64(stats.Misses))
+	ch <- prometheus.MustNewConstMetric(c.evictions, prometheus.CounterValue, float64(stats.Evictions))
+	ch <- prometheus.MustNewConstMetric(c.size, prometheus.GaugeValue, float64(stats.Size))
+}
@@ -0,0 +1,207 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/electrofelix/gin-demo/entity"
+	"github.com/electrofelix/gin-demo/mocks"
+	"github.com/electrofelix/gin-demo/service"
+	"github.com/electrofelix/gin-demo/store"
+	"github.com/electrofelix/gin-demo/store/storetest"
+)
+
+func TestMetricsUserStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) service.UserStore {
+		metrics := store.NewMetrics(prometheus.NewRegistry())
+		_, dataStore := setupFakeUserStore(t, store.WithMetrics(metrics))
+
+		return store.NewMetricsUserStore(dataStore, metrics)
+	})
+}
+
+func TestMetricsUserStore_Operations(t *testing.T) {
+	t.Run("errors", func(t *testing.T) {
+		registry := prometheus.NewRegistry()
+		metrics := store.NewMetrics(registry)
+		mockStore := mocks.NewMockUserStore(gomock.NewController(t))
+		dataStore := store.NewMetricsUserStore(mockStore, metrics)
+
+		mockStore.EXPECT().GetById(gomock.Any(), entity.DefaultTenant, "user1").Return(nil, errors.New("failed lookup"))
+
+		_, err := dataStore.GetById(context.Background(), entity.DefaultTenant, "user1")
+		assert.Error(t, err)
+
+		count, err := testutil.GatherAndCount(registry, "gin_demo_store_operation_duration_seconds")
+		require.NoError(t, err)
+		assert.Equal(t, 1, count, "expected a histogram for each operation")
+
+		expected := `
+# HELP gin_demo_store_operation_errors_total Store operations that failed, excluding expected errors such as users not found.
+# TYPE gin_demo_store_operation_errors_total counter
+gin_demo_store_operation_errors_total{operation="GetById"} 1
+`
+		assert.NoError(t, testutil.GatherAndCompare(
+			registry, strings.NewReader(expected), "gin_demo_store_operation_errors_total",
+		))
+	})
+
+	t.Run("expected-errors", func(t *testing.T) {
+		registry := prometheus.NewRegistry()
+		metrics := store.NewMetrics(registry)
+		dataStore := store.NewMetricsUserStore(store.NewMemoryUserStore(), metrics)
+
+		user := entity.User{Id: xid.New().String(), Email: "user1@example.com"}
+		require.NoError(t, dataStore.Create(context.Background(), &user))
+
+		duplicate := entity.User{Id: xid.New().String(), Email: "user1@example.com"}
+		assert.ErrorIs(t, dataStore.Create(context.Background(), &duplicate), entity.ErrEmailDuplicate)
+
+		stale := user
+		stale.Version--
+		assert.ErrorIs(t, dataStore.Update(context.Background(), &stale), entity.ErrConflict)
+
+		_, err := dataStore.GetById(context.Background(), entity.DefaultTenant, xid.New().String())
+		assert.ErrorIs(t, err, entity.ErrNotFound)
+
+		_, err = dataStore.List(context.Background(), entity.DefaultTenant, entity.ListOptions{Cursor: "not-a-cursor"})
+		assert.ErrorIs(t, err, entity.ErrCursorInvalid)
+
+		count, err := testutil.GatherAndCount(registry, "gin_demo_store_operation_errors_total")
+		require.NoError(t, err)
+		assert.Zero(t, count, "expected errors should not be counted")
+	})
+}
+
+func TestUserStore_Metrics(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	user := entity.User{Id: xid.New().String(), Email: "user1@example.com", Name: "test-user"}
+
+	t.Run("consumed-capacity", func(t *testing.T) {
+		registry := prometheus.NewRegistry()
+		metrics := store.NewMetrics(registry)
+		mockDBClient := mocks.NewMockDynamoDBAPI(ctrl)
+		dataStore := store.NewMetricsUserStore(
+			store.NewUserStore(mockDBClient, tableName, store.WithMetrics(metrics)), metrics,
+		)
+
+		mockDBClient.EXPECT().GetItem(gomock.Any(), gomock.Any()).DoAndReturn(
+			func(_ context.Context, input *dynamodb.GetItemInput, _ ...store.DynamoDBOptions) (*dynamodb.GetItemOutput, error) {
+				assert.Equal(t, types.ReturnConsumedCapacityTotal, input.ReturnConsumedCapacity)
+
+				return &dynamodb.GetItemOutput{
+					Item:             userToUserAttributeValue(user),
+					ConsumedCapacity: &types.ConsumedCapacity{CapacityUnits: aws.Float64(0.5)},
+				}, nil
+			},
+		)
+		mockDBClient.EXPECT().TransactWriteItems(gomock.Any(), gomock.Any()).DoAndReturn(
+			func(
+				_ context.Context, input *dynamodb.TransactWriteItemsInput, _ ...store.DynamoDBOptions,
+			) (*dynamodb.TransactWriteItemsOutput, error) {
+				assert.Equal(t, types.ReturnConsumedCapacityTotal, input.ReturnConsumedCapacity)
+
+				return &dynamodb.TransactWriteItemsOutput{
+					ConsumedCapacity: []types.ConsumedCapacity{
+						{CapacityUnits: aws.Float64(4)},
+					},
+				}, nil
+			},
+		)
+
+		_, err := dataStore.GetById(context.Background(), entity.DefaultTenant, user.Id)
+		require.NoError(t, err)
+
+		create := user
+		require.NoError(t, dataStore.Create(context.Background(), &create))
+
+		expected := `
+# HELP gin_demo_store_consumed_read_capacity_units_total DynamoDB read capacity units consumed by store operations.
+# TYPE gin_demo_store_consumed_read_capacity_units_total counter
+gin_demo_store_consumed_read_capacity_units_total{operation="Create"} 0
+gin_demo_store_consumed_read_capacity_units_total{operation="GetById"} 0.5
+# HELP gin_demo_store_consumed_write_capacity_units_total DynamoDB write capacity units consumed by store operations.
+# TYPE gin_demo_store_consumed_write_capacity_units_total counter
+gin_demo_store_consumed_write_capacity_units_total{operation="Create"} 4
+gin_demo_store_consumed_write_capacity_units_total{operation="GetById"} 0
+`
+		assert.NoError(t, testutil.GatherAndCompare(
+			registry, strings.NewReader(expected),
+			"gin_demo_store_consumed_read_capacity_units_total", "gin_demo_store_consumed_write_capacity_units_total",
+		))
+	})
+
+	t.Run("conditional-check-failed", func(t *testing.T) {
+		registry := prometheus.NewRegistry()
+		metrics := store.NewMetrics(registry)
+		mockDBClient := mocks.NewMockDynamoDBAPI(ctrl)
+		dataStore := store.NewMetricsUserStore(
+			store.NewUserStore(mockDBClient, tableName, store.WithMetrics(metrics)), metrics,
+		)
+
+		mockDBClient.EXPECT().TransactWriteItems(gomock.Any(), gomock.Any()).Return(
+			nil, &types.TransactionCanceledException{
+				CancellationReasons: []types.CancellationReason{
+					{Code: aws.String("None")},
+					{Code: aws.String("ConditionalCheckFailed")},
+				},
+			},
+		)
+
+		create := user
+		assert.ErrorIs(t, dataStore.Create(context.Background(), &create), entity.ErrEmailDuplicate)
+
+		expected := `
+# HELP gin_demo_store_conditional_check_failures_total DynamoDB writes rejected by their condition, such as a duplicate email.
+# TYPE gin_demo_store_conditional_check_failures_total counter
+gin_demo_store_conditional_check_failures_total{operation="Create"} 1
+`
+		assert.NoError(t, testutil.GatherAndCompare(
+			registry, strings.NewReader(expected), "gin_demo_store_conditional_check_failures_total",
+		))
+	})
+}
+
+func TestRegisterCacheMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	cache := store.NewCachingUserStore(store.NewMemoryUserStore())
+	store.RegisterCacheMetrics(registry, cache)
+
+	user := entity.User{Id: xid.New().String(), Email: "user1@example.com"}
+	require.NoError(t, cache.Create(context.Background(), &user))
+
+	for idx := 0; idx < 2; idx++ {
+		_, err := cache.GetById(context.Background(), entity.DefaultTenant, user.Id)
+		require.NoError(t, err)
+	}
+
+	expected := `
+# HELP gin_demo_cache_entries Users, and absences of users, held in the cache.
+# TYPE gin_demo_cache_entries gauge
+gin_demo_cache_entries 1
+# HELP gin_demo_cache_hits_total Users read from the cache.
+# TYPE gin_demo_cache_hits_total counter
+gin_demo_cache_hits_total 1
+# HELP gin_demo_cache_misses_total Users read from the store as they were not cached.
+# TYPE gin_demo_cache_misses_total counter
+gin_demo_cache_misses_total 1
+`
+
+	assert.NoError(t, testutil.GatherAndCompare(
+		registry, strings.NewReader(expected),
+		"gin_demo_cache_entries", "gin_demo_cache_hits_total", "gin_demo_cache_misses_total",
+	))
+}
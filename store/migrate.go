@@ -0,0 +1,914 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"github.com/electrofelix/gin-demo/entity"
+)
+
+const (
+	// the applied schema version is recorded in a single item of the table,
+	// the Id cannot collide with a user Id or an email address
+	schemaId         = "#schema"
+	schemaObjectType = "SchemaVersion"
+
+	defaultMigrationBatchSize    = 100
+	defaultMigrationPollInterval = 5 * time.Second
+)
+
+// Migration is a single step in the evolution of the table schema. Each must
+// be safe to re-run, as a failure part way leaves the previous version
+// recorded and another instance may be applying it concurrently.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, m *Migrator) error
+}
+
+// MigrationStatus reports the schema version recorded in the table, along
+// with the migrations still to be applied.
+type MigrationStatus struct {
+	Current int
+	Latest  int
+	Pending []Migration
+}
+
+// Migrator brings the DynamoDB table up to the latest schema version,
+// replacing the creation of a fixed schema on startup.
+type Migrator struct {
+	store        *UserStore
+	migrations   []Migration
+	batchSize    int32
+	pollInterval time.Duration
+}
+
+type MigratorOption func(*Migrator)
+
+func NewMigrator(us *UserStore, options ...MigratorOption) *Migrator {
+	m := &Migrator{
+		store:        us,
+		migrations:   migrations,
+		batchSize:    defaultMigrationBatchSize,
+		pollInterval: defaultMigrationPollInterval,
+	}
+
+	for _, opt := range options {
+		opt(m)
+	}
+
+	return m
+}
+
+// WithMigrations replaces the migrations to apply, intended for tests.
+func WithMigrations(migrations []Migration) MigratorOption {
+	return func(m *Migrator) {
+		m.migrations = migrations
+	}
+}
+
+// WithBatchSize sets how many items are read per page when transforming.
+func WithBatchSize(size int32) MigratorOption {
+	return func(m *Migrator) {
+		m.batchSize = size
+	}
+}
+
+// WithPollInterval sets how often to check whether the table or an index
+// being created has become active.
+func WithPollInterval(d time.Duration) MigratorOption {
+	return func(m *Migrator) {
+		m.pollInterval = d
+	}
+}
+
+// migrations must be kept in order of version, never modify or remove a
+// migration once released, add another to correct it instead.
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "create table keyed on Id and objectType",
+		Up:          createTable,
+	},
+	{
+		Version:     2,
+		Description: fmt.Sprintf("add %s to page through objects of a type", objectTypeIndex),
+		Up: func(ctx context.Context, m *Migrator) error {
+			return m.AddGlobalSecondaryIndex(ctx, types.GlobalSecondaryIndex{
+				IndexName: aws.String(objectTypeIndex),
+				KeySchema: []types.KeySchemaElement{
+					{
+						AttributeName: aws.String("objectType"),
+						KeyType:       types.KeyTypeHash,
+					},
+					{
+						AttributeName: aws.String("Id"),
+						KeyType:       types.KeyTypeRange,
+					},
+				},
+				Projection: &types.Projection{
+					ProjectionType: types.ProjectionTypeAll,
+				},
+				ProvisionedThroughput: &types.ProvisionedThroughput{
+					ReadCapacityUnits:  aws.Int64(5),
+					WriteCapacityUnits: aws.Int64(5),
+				},
+			})
+		},
+	},
+	{
+		Version:     3,
+		Description: "backfill Version on users written before versioning",
+		Up: func(ctx context.Context, m *Migrator) error {
+			return m.TransformItems(
+				ctx,
+				"objectType = :type AND attribute_not_exists(Version)",
+				map[string]types.AttributeValue{
+					":type": &types.AttributeValueMemberS{Value: key},
+				},
+				func(item map[string]types.AttributeValue) bool {
+					item["Version"] = &types.AttributeValueMemberN{Value: "0"}
+
+					return true
+				},
+			)
+		},
+	},
+	{
+		Version:     4,
+		Description: "re-key email items by the canonical form of the email",
+		Up:          canonicalizeEmails,
+	},
+	{
+		Version:     5,
+		Description: "move the password hash of each user to a separate credentials item",
+		Up:          splitCredentials,
+	},
+	{
+		Version:     6,
+		Description: "add the attributes keying the search indexes to users",
+		Up:          backfillSearchAttributes,
+	},
+	{
+		Version:     7,
+		Description: fmt.Sprintf("add %s to filter users by email prefix", searchEmailIndex),
+		Up: func(ctx context.Context, m *Migrator) error {
+			return m.AddGlobalSecondaryIndex(ctx, userSearchIndex(searchEmailIndex, searchEmailAttribute))
+		},
+	},
+	{
+		Version:     8,
+		Description: fmt.Sprintf("add %s to filter users by name prefix", searchNameIndex),
+		Up: func(ctx context.Context, m *Migrator) error {
+			return m.AddGlobalSecondaryIndex(ctx, userSearchIndex(searchNameIndex, searchNameAttribute))
+		},
+	},
+	{
+		Version:     9,
+		Description: fmt.Sprintf("add %s to filter users by last login", lastLoginSortIndex),
+		Up: func(ctx context.Context, m *Migrator) error {
+			return m.AddGlobalSecondaryIndex(ctx, userSearchIndex(lastLoginSortIndex, lastLoginSortAttribute))
+		},
+	},
+	{
+		Version:     10,
+		Description: "enable the stream of changes consumed by StreamConsumer",
+		Up: func(ctx context.Context, m *Migrator) error {
+			return m.EnableStream(ctx, types.StreamViewTypeNewAndOldImages)
+		},
+	},
+}
+
+// userSearchIndex returns an index of the users of each tenant ordered by
+// the attribute, which only holds the items that have it.
+func userSearchIndex(name, attribute string) types.GlobalSecondaryIndex {
+	return types.GlobalSecondaryIndex{
+		IndexName: aws.String(name),
+		KeySchema: []types.KeySchemaElement{
+			{
+				AttributeName: aws.String("objectType"),
+				KeyType:       types.KeyTypeHash,
+			},
+			{
+				AttributeName: aws.String(attribute),
+				KeyType:       types.KeyTypeRange,
+			},
+		},
+		Projection: &types.Projection{
+			ProjectionType: types.ProjectionTypeAll,
+		},
+		ProvisionedThroughput: &types.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(5),
+			WriteCapacityUnits: aws.Int64(5),
+		},
+	}
+}
+
+// backfillSearchAttributes adds the search attributes to users written
+// before they existed, other than those derived from encrypted fields which
+// are never stored in the clear. Those users are read again on every run, as
+// they still lack the attributes.
+func backfillSearchAttributes(ctx context.Context, m *Migrator) error {
+	return m.TransformItems(
+		ctx,
+		fmt.Sprintf(
+			"begins_with(objectType, :prefix) AND (attribute_not_exists(%s) OR attribute_not_exists(%s))",
+			searchEmailAttribute, searchNameAttribute,
+		),
+		map[string]types.AttributeValue{
+			":prefix": &types.AttributeValueMemberS{Value: key},
+		},
+		func(item map[string]types.AttributeValue) bool {
+			if _, kind, ok := itemTenant(item); !ok || kind != kindUser {
+				return false
+			}
+
+			attributes := len(item)
+			addSearchAttributes(item, itemEncryptedFields(item))
+
+			return len(item) != attributes
+		},
+	)
+}
+
+// canonicalizeEmails moves the reservation of each email stored as given to
+// its canonical form, so that emails differing only by case are treated as
+// the same. Where two users now share a canonical email the second is left
+// as it was and logged, for fsck to report until one of them is changed.
+func canonicalizeEmails(ctx context.Context, m *Migrator) error {
+	scanInput := dynamodb.ScanInput{
+		TableName:        aws.String(m.store.tableName),
+		FilterExpression: aws.String("objectType = :type"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":type": &types.AttributeValueMemberS{Value: key},
+		},
+		Limit:          aws.Int32(m.batchSize),
+		ConsistentRead: aws.Bool(true),
+	}
+
+	moved := 0
+
+	for {
+		result, err := m.store.dbClient.Scan(ctx, &scanInput)
+		if err != nil {
+			return err
+		}
+
+		page := make([]userSummary, 0, len(result.Items))
+
+		for _, item := range result.Items {
+			// encrypted users were written after emails were reserved by
+			// their canonical form
+			if isEncrypted(item) {
+				continue
+			}
+
+			var user userSummary
+
+			err = attributevalue.UnmarshalMap(item, &user)
+			if err != nil {
+				return err
+			}
+
+			page = append(page, user)
+		}
+
+		for _, user := range page {
+			canonical := entity.CanonicalEmail(user.Email)
+			if canonical == user.Email {
+				continue
+			}
+
+			err := m.moveEmail(ctx, user, canonical)
+			if err != nil {
+				var errTransaction *types.TransactionCanceledException
+				if !errors.As(err, &errTransaction) {
+					return err
+				}
+
+				m.store.logger.Warnf(
+					"unable to move email '%s' of user %s to '%s', changed or already in use: %v",
+					user.Email, user.Id, canonical, err,
+				)
+
+				continue
+			}
+
+			moved++
+		}
+
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+
+		scanInput.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+
+	m.store.logger.Infof("moved %d emails to their canonical form", moved)
+
+	return nil
+}
+
+// moveEmail only applies to the default tenant, as emails were canonical
+// before other tenants were introduced.
+func (m *Migrator) moveEmail(ctx context.Context, user userSummary, canonical string) error {
+	item := emailKey(entity.DefaultTenant, canonical)
+	item["UserId"] = &types.AttributeValueMemberS{Value: user.Id}
+
+	_, err := m.store.dbClient.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{
+				ConditionCheck: &types.ConditionCheck{
+					Key:                 userKey(entity.DefaultTenant, user.Id),
+					TableName:           aws.String(m.store.tableName),
+					ConditionExpression: aws.String("Email = :email"),
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":email": &types.AttributeValueMemberS{Value: user.Email},
+					},
+				},
+			},
+			{
+				Put: &types.Put{
+					Item:                item,
+					TableName:           aws.String(m.store.tableName),
+					ConditionExpression: aws.String("attribute_not_exists(Id)"),
+				},
+			},
+			{
+				Delete: &types.Delete{
+					Key:                 emailKey(entity.DefaultTenant, user.Email),
+					TableName:           aws.String(m.store.tableName),
+					ConditionExpression: aws.String("UserId = :id"),
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":id": &types.AttributeValueMemberS{Value: user.Id},
+					},
+				},
+			},
+		},
+	})
+
+	return err
+}
+
+// splitCredentials moves the password hash held on each user item to the
+// credentials item of the user, so that it is no longer read with the user.
+func splitCredentials(ctx context.Context, m *Migrator) error {
+	scanInput := dynamodb.ScanInput{
+		TableName:        aws.String(m.store.tableName),
+		FilterExpression: aws.String("begins_with(objectType, :prefix) AND attribute_exists(Password)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":prefix": &types.AttributeValueMemberS{Value: key},
+		},
+		Limit:          aws.Int32(m.batchSize),
+		ConsistentRead: aws.Bool(true),
+	}
+
+	moved := 0
+
+	for {
+		result, err := m.store.dbClient.Scan(ctx, &scanInput)
+		if err != nil {
+			return err
+		}
+
+		for _, item := range result.Items {
+			tenant, kind, ok := itemTenant(item)
+			if !ok || kind != kindUser {
+				continue
+			}
+
+			err := m.moveCredentials(ctx, tenant, item)
+			if err != nil {
+				if isConditionalCheckFailed(err) {
+					return fmt.Errorf("item %v modified during migration, retry to apply again", item["Id"])
+				}
+
+				return err
+			}
+
+			moved++
+		}
+
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+
+		scanInput.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+
+	m.store.logger.Infof("moved the credentials of %d users", moved)
+
+	return nil
+}
+
+// moveCredentials writes the credentials item along with the changes to the
+// user item removing the password, provided the user is unchanged since it
+// was read.
+func (m *Migrator) moveCredentials(ctx context.Context, tenant string, item map[string]types.AttributeValue) error {
+	decrypted := copyAttributes(item)
+
+	err := m.store.decryptItem(ctx, decrypted)
+	if err != nil {
+		return err
+	}
+
+	var (
+		user        entity.User
+		credentials entity.Credentials
+	)
+
+	if err := attributevalue.UnmarshalMap(decrypted, &user); err != nil {
+		return err
+	}
+
+	if err := attributevalue.UnmarshalMap(decrypted, &credentials); err != nil {
+		return err
+	}
+
+	user.TenantId = tenant
+
+	// the version is kept, as the user is unchanged
+	userItem, err := m.store.marshalUser(ctx, &user)
+	if err != nil {
+		return err
+	}
+
+	credentialsItem, err := m.store.marshalCredentials(ctx, tenant, user.Id, &credentials)
+	if err != nil {
+		return err
+	}
+
+	set, remove := changedAttributes(item, userItem)
+	expression, names, values := itemUpdate(set, remove)
+
+	condition, conditionValues := unchangedCondition(item, set, remove)
+	for name, value := range conditionValues {
+		values[name] = value
+	}
+
+	_, err = m.store.dbClient.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{
+				Update: &types.Update{
+					Key:                       itemKey(item),
+					TableName:                 aws.String(m.store.tableName),
+					UpdateExpression:          expression,
+					ConditionExpression:       aws.String(condition),
+					ExpressionAttributeNames:  names,
+					ExpressionAttributeValues: values,
+				},
+			},
+			{
+				Put: &types.Put{
+					Item:      credentialsItem,
+					TableName: aws.String(m.store.tableName),
+				},
+			},
+		},
+	})
+
+	return err
+}
+
+func createTable(ctx context.Context, m *Migrator) error {
+	_, err := m.describeTable(ctx)
+	if err == nil {
+		m.store.logger.Infof("table '%s' already exists", m.store.tableName)
+
+		return nil
+	}
+
+	var notFound *types.ResourceNotFoundException
+	if !errors.As(err, &notFound) {
+		return err
+	}
+
+	m.store.logger.Infof("table '%s' not found, creating", m.store.tableName)
+
+	_, err = m.store.dbClient.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(m.store.tableName),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{
+				AttributeName: aws.String("Id"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+			{
+				AttributeName: aws.String("objectType"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{
+				AttributeName: aws.String("Id"),
+				KeyType:       types.KeyTypeHash,
+			},
+			{
+				AttributeName: aws.String("objectType"),
+				KeyType:       types.KeyTypeRange,
+			},
+		},
+		ProvisionedThroughput: &types.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(5),
+			WriteCapacityUnits: aws.Int64(5),
+		},
+	})
+	if err != nil {
+		var inUse *types.ResourceInUseException
+		if !errors.As(err, &inUse) {
+			return err
+		}
+	}
+
+	return m.waitUntil(ctx, func(table *types.TableDescription) bool {
+		return table.TableStatus == types.TableStatusActive
+	})
+}
+
+// Status returns the recorded schema version without applying anything.
+func (m *Migrator) Status(ctx context.Context) (MigrationStatus, error) {
+	current, err := m.currentVersion(ctx)
+	if err != nil {
+		return MigrationStatus{}, err
+	}
+
+	status := MigrationStatus{Current: current}
+
+	for _, migration := range m.migrations {
+		if migration.Version > current {
+			status.Pending = append(status.Pending, migration)
+		}
+
+		status.Latest = migration.Version
+	}
+
+	return status, nil
+}
+
+// Up applies any pending migrations in order, recording the version in the
+// table after each succeeds.
+func (m *Migrator) Up(ctx context.Context) error {
+	status, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(status.Pending) == 0 {
+		m.store.logger.Infof("table '%s' schema is up to date at version %d", m.store.tableName, status.Current)
+
+		return nil
+	}
+
+	current := status.Current
+
+	for _, migration := range status.Pending {
+		m.store.logger.Infof("applying migration %d: %s", migration.Version, migration.Description)
+
+		if err := migration.Up(ctx, m); err != nil {
+			return fmt.Errorf("migration %d failed: %w", migration.Version, err)
+		}
+
+		if err := m.recordVersion(ctx, current, migration.Version); err != nil {
+			return err
+		}
+
+		current = migration.Version
+	}
+
+	m.store.logger.Infof("table '%s' schema migrated to version %d", m.store.tableName, current)
+
+	return nil
+}
+
+func (m *Migrator) describeTable(ctx context.Context) (*types.TableDescription, error) {
+	result, err := m.store.dbClient.DescribeTable(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(m.store.tableName),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Table, nil
+}
+
+// currentVersion returns 0 when the table or the schema item do not exist,
+// both for new deployments and tables created before migrations.
+func (m *Migrator) currentVersion(ctx context.Context) (int, error) {
+	result, err := m.store.dbClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(m.store.tableName),
+		Key:            schemaKey(),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		var notFound *types.ResourceNotFoundException
+		if errors.As(err, &notFound) {
+			return 0, nil
+		}
+
+		return 0, err
+	}
+
+	value, ok := result.Item["SchemaVersion"].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0, nil
+	}
+
+	return strconv.Atoi(value.Value)
+}
+
+// recordVersion only moves the version forward from the one the migration
+// was applied on top of, so that concurrent runs cannot move it backwards.
+func (m *Migrator) recordVersion(ctx context.Context, previous, version int) error {
+	item := schemaKey()
+	item["SchemaVersion"] = &types.AttributeValueMemberN{Value: strconv.Itoa(version)}
+	item["UpdatedAt"] = &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)}
+
+	_, err := m.store.dbClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(m.store.tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(SchemaVersion) OR SchemaVersion = :previous"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":previous": &types.AttributeValueMemberN{Value: strconv.Itoa(previous)},
+		},
+	})
+	if err != nil {
+		var ccfe *types.ConditionalCheckFailedException
+		if errors.As(err, &ccfe) {
+			return fmt.Errorf("schema version changed while applying migration %d, another migration is running", version)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func schemaKey() map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"Id":         &types.AttributeValueMemberS{Value: schemaId},
+		"objectType": &types.AttributeValueMemberS{Value: schemaObjectType},
+	}
+}
+
+// EnableStream enables the stream of the table with the view type if it is
+// not already enabled. A stream enabled with another view type is an error,
+// as changing it starts a new stream and so would lose any unread changes.
+func (m *Migrator) EnableStream(ctx context.Context, viewType types.StreamViewType) error {
+	table, err := m.describeTable(ctx)
+	if err != nil {
+		return err
+	}
+
+	if spec := table.StreamSpecification; spec != nil && aws.ToBool(spec.StreamEnabled) {
+		if spec.StreamViewType != viewType {
+			return fmt.Errorf(
+				"table '%s' has a stream of %s, disable it to enable one of %s",
+				m.store.tableName, spec.StreamViewType, viewType,
+			)
+		}
+
+		return nil
+	}
+
+	_, err = m.store.dbClient.UpdateTable(ctx, &dynamodb.UpdateTableInput{
+		TableName: aws.String(m.store.tableName),
+		StreamSpecification: &types.StreamSpecification{
+			StreamEnabled:  aws.Bool(true),
+			StreamViewType: viewType,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return m.waitUntil(ctx, func(table *types.TableDescription) bool {
+		return table.TableStatus == types.TableStatusActive && table.LatestStreamArn != nil
+	})
+}
+
+// AddGlobalSecondaryIndex creates the index if the table does not already
+// have one of the same name, waiting until it has finished backfilling.
+func (m *Migrator) AddGlobalSecondaryIndex(ctx context.Context, index types.GlobalSecondaryIndex) error {
+	table, err := m.describeTable(ctx)
+	if err != nil {
+		return err
+	}
+
+	exists := false
+
+	for _, gsi := range table.GlobalSecondaryIndexes {
+		if aws.ToString(gsi.IndexName) == aws.ToString(index.IndexName) {
+			exists = true
+		}
+	}
+
+	if !exists {
+		// index keys are always string attributes in this table
+		var definitions []types.AttributeDefinition
+		for _, element := range index.KeySchema {
+			definitions = append(definitions, types.AttributeDefinition{
+				AttributeName: element.AttributeName,
+				AttributeType: types.ScalarAttributeTypeS,
+			})
+		}
+
+		_, err = m.store.dbClient.UpdateTable(ctx, &dynamodb.UpdateTableInput{
+			TableName:            aws.String(m.store.tableName),
+			AttributeDefinitions: definitions,
+			GlobalSecondaryIndexUpdates: []types.GlobalSecondaryIndexUpdate{
+				{
+					Create: &types.CreateGlobalSecondaryIndexAction{
+						IndexName:             index.IndexName,
+						KeySchema:             index.KeySchema,
+						Projection:            index.Projection,
+						ProvisionedThroughput: index.ProvisionedThroughput,
+					},
+				},
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return m.waitUntil(ctx, func(table *types.TableDescription) bool {
+		for _, gsi := range table.GlobalSecondaryIndexes {
+			if aws.ToString(gsi.IndexName) == aws.ToString(index.IndexName) {
+				return gsi.IndexStatus == types.IndexStatusActive && !aws.ToBool(gsi.Backfilling)
+			}
+		}
+
+		return false
+	})
+}
+
+// TransformItems scans the table in batches, passing each item matching the
+// filter to transform which modifies it in place and reports whether it
+// should be written back. Only the attributes the transform changed are
+// written, conditional on the item not having been changed since it was
+// read, using the Version of users and otherwise only the presence of the
+// item, so that concurrent requests are never lost.
+func (m *Migrator) TransformItems(
+	ctx context.Context, filter string, values map[string]types.AttributeValue,
+	transform func(map[string]types.AttributeValue) bool,
+) error {
+	scanInput := dynamodb.ScanInput{
+		TableName:                 aws.String(m.store.tableName),
+		FilterExpression:          aws.String(filter),
+		ExpressionAttributeValues: values,
+		Limit:                     aws.Int32(m.batchSize),
+		ConsistentRead:            aws.Bool(true),
+	}
+
+	transformed := 0
+
+	for {
+		result, err := m.store.dbClient.Scan(ctx, &scanInput)
+		if err != nil {
+			return err
+		}
+
+		for _, item := range result.Items {
+			original := copyAttributes(item)
+
+			if !transform(item) {
+				continue
+			}
+
+			set, remove := changedAttributes(original, item)
+			if len(set) == 0 && len(remove) == 0 {
+				continue
+			}
+
+			expression, names, updateValues := itemUpdate(set, remove)
+
+			condition, conditionValues := unchangedCondition(original, set, remove)
+			for name, value := range conditionValues {
+				updateValues[name] = value
+			}
+
+			_, err := m.store.dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+				Key:                       itemKey(item),
+				TableName:                 aws.String(m.store.tableName),
+				UpdateExpression:          expression,
+				ConditionExpression:       aws.String(condition),
+				ExpressionAttributeNames:  names,
+				ExpressionAttributeValues: updateValues,
+			})
+			if err != nil {
+				var ccfe *types.ConditionalCheckFailedException
+				if errors.As(err, &ccfe) {
+					return fmt.Errorf("item %v modified during migration, retry to apply again", item["Id"])
+				}
+
+				return err
+			}
+
+			transformed++
+		}
+
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+
+		scanInput.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+
+	m.store.logger.Infof("transformed %d items", transformed)
+
+	return nil
+}
+
+// changedAttributes returns the attributes the transform of an item set or
+// changed and the names of those it removed, so that only they are written
+// and attributes changed concurrently, such as by RecordLogin, are kept.
+func changedAttributes(
+	original, item map[string]types.AttributeValue,
+) (map[string]types.AttributeValue, []string) {
+	set := map[string]types.AttributeValue{}
+
+	for name, value := range item {
+		if !reflect.DeepEqual(original[name], value) {
+			set[name] = value
+		}
+	}
+
+	var remove []string
+
+	for name := range original {
+		if _, ok := item[name]; !ok {
+			remove = append(remove, name)
+		}
+	}
+
+	sort.Strings(remove)
+
+	return set, remove
+}
+
+// unchangedCondition is determined from the item as it was read. When the
+// transform changes any login attributes, which are updated without a new
+// Version, the LoginCount must be unchanged as well so that they are not
+// derived from a login since replaced.
+func unchangedCondition(
+	item, set map[string]types.AttributeValue, remove []string,
+) (string, map[string]types.AttributeValue) {
+	condition := "attribute_exists(Id) AND attribute_not_exists(Version)"
+	values := map[string]types.AttributeValue{}
+
+	if version, ok := item["Version"].(*types.AttributeValueMemberN); ok {
+		condition = "Version = :version"
+		values[":version"] = &types.AttributeValueMemberN{Value: version.Value}
+	}
+
+	changesLogin := false
+
+	for name := range set {
+		changesLogin = changesLogin || isLoginAttribute(name)
+	}
+
+	for _, name := range remove {
+		changesLogin = changesLogin || isLoginAttribute(name)
+	}
+
+	if !changesLogin {
+		return condition, values
+	}
+
+	if count, ok := item["LoginCount"].(*types.AttributeValueMemberN); ok {
+		condition += " AND LoginCount = :loginCount"
+		values[":loginCount"] = &types.AttributeValueMemberN{Value: count.Value}
+	} else {
+		condition += " AND attribute_not_exists(LoginCount)"
+	}
+
+	return condition, values
+}
+
+func (m *Migrator) waitUntil(ctx context.Context, ready func(*types.TableDescription) bool) error {
+	for {
+		table, err := m.describeTable(ctx)
+		if err != nil {
+			return err
+		}
+
+		if ready(table) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(m.pollInterval):
+		}
+	}
+}
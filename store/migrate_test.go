@@ -0,0 +1,249 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/electrofelix/gin-demo/entity"
+	"github.com/electrofelix/gin-demo/store"
+	"github.com/electrofelix/gin-demo/store/dynamotest"
+)
+
+// createLegacyTable creates the table as it was before the objectType index
+// and versioning were introduced, containing a single user.
+func createLegacyTable(t *testing.T, fake *dynamotest.FakeDynamoDB) entity.User {
+	t.Helper()
+
+	_, err := fake.CreateTable(context.Background(), &dynamodb.CreateTableInput{
+		TableName: aws.String(tableName),
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("Id"), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String("objectType"), KeyType: types.KeyTypeRange},
+		},
+	})
+	require.NoError(t, err)
+
+	user := entity.User{Id: xid.New().String(), Email: "legacy@example.com", Name: "legacy"}
+
+	for _, item := range []map[string]types.AttributeValue{
+		userToUserAttributeValue(user), userToEmailAttributeValue(user),
+	} {
+		_, err = fake.PutItem(context.Background(), &dynamodb.PutItemInput{TableName: aws.String(tableName), Item: item})
+		require.NoError(t, err)
+	}
+
+	return user
+}
+
+func TestMigrator_Up(t *testing.T) {
+	t.Run("new-table", func(t *testing.T) {
+		fake := dynamotest.New()
+		dataStore := store.NewUserStore(fake, tableName)
+		migrator := store.NewMigrator(dataStore)
+
+		status, err := migrator.Status(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, 0, status.Current)
+		assert.Len(t, status.Pending, status.Latest)
+
+		require.NoError(t, migrator.Up(context.Background()))
+
+		status, err = migrator.Status(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, status.Latest, status.Current)
+		assert.Empty(t, status.Pending)
+
+		// nothing left to apply
+		require.NoError(t, migrator.Up(context.Background()))
+
+		table, err := fake.DescribeTable(context.Background(), &dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+		require.NoError(t, err)
+
+		indexes := []string{}
+		for _, index := range table.Table.GlobalSecondaryIndexes {
+			indexes = append(indexes, aws.ToString(index.IndexName))
+		}
+
+		assert.ElementsMatch(
+			t, []string{"objectType-index", "searchEmail-index", "searchName-index", "lastLogin-index"}, indexes,
+		)
+	})
+
+	t.Run("legacy-table", func(t *testing.T) {
+		fake := dynamotest.New()
+		user := createLegacyTable(t, fake)
+
+		dataStore := store.NewUserStore(fake, tableName)
+		require.NoError(t, store.NewMigrator(dataStore, store.WithBatchSize(1)).Up(context.Background()))
+
+		// listing requires the index added by the migrations
+		page, err := dataStore.List(context.Background(), entity.DefaultTenant, entity.ListOptions{})
+		require.NoError(t, err)
+		require.Len(t, page.Users, 1)
+		assert.Equal(t, user.Id, page.Users[0].Id)
+		assert.Equal(t, int64(0), page.Users[0].Version)
+
+		result, err := fake.GetItem(context.Background(), &dynamodb.GetItemInput{
+			TableName: aws.String(tableName),
+			Key: map[string]types.AttributeValue{
+				"Id":         &types.AttributeValueMemberS{Value: user.Id},
+				"objectType": &types.AttributeValueMemberS{Value: "UserInfo"},
+			},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, &types.AttributeValueMemberN{Value: "0"}, result.Item["Version"])
+
+		// the backfilled version must still be accepted by updates
+		updated := page.Users[0]
+		updated.Name = "updated"
+		require.NoError(t, dataStore.Update(context.Background(), &updated))
+		assert.Equal(t, int64(1), updated.Version)
+	})
+
+	t.Run("canonical-emails", func(t *testing.T) {
+		fake := dynamotest.New()
+		createLegacyTable(t, fake)
+
+		mixed := entity.User{Id: xid.New().String(), Email: "Mixed@Example.com", Name: "mixed"}
+		lower := entity.User{Id: xid.New().String(), Email: "dup@example.com", Name: "lower"}
+		upper := entity.User{Id: xid.New().String(), Email: "DUP@example.com", Name: "upper"}
+
+		for _, user := range []entity.User{mixed, lower, upper} {
+			for _, item := range []map[string]types.AttributeValue{
+				userToUserAttributeValue(user), userToEmailAttributeValue(user),
+			} {
+				_, err := fake.PutItem(context.Background(), &dynamodb.PutItemInput{TableName: aws.String(tableName), Item: item})
+				require.NoError(t, err)
+			}
+		}
+
+		dataStore := store.NewUserStore(fake, tableName)
+		require.NoError(t, store.NewMigrator(dataStore, store.WithBatchSize(2)).Up(context.Background()))
+
+		got, err := dataStore.GetByEmail(context.Background(), entity.DefaultTenant, "mixed@EXAMPLE.com")
+		require.NoError(t, err)
+		assert.Equal(t, mixed.Id, got.Id)
+		assert.Equal(t, mixed.Email, got.Email, "the email as given should be kept for display")
+
+		report, err := dataStore.Fsck(context.Background(), false)
+		require.NoError(t, err)
+
+		// the colliding users are left for fsck to report
+		duplicates := []store.Problem{}
+		for _, problem := range report.Problems {
+			if problem.Kind == store.ProblemDuplicateEmail {
+				duplicates = append(duplicates, problem)
+			}
+		}
+
+		require.Len(t, duplicates, 1)
+		assert.Equal(t, "dup@example.com", duplicates[0].Email)
+		assert.ElementsMatch(t, []string{lower.Id, upper.Id}, duplicates[0].UserIds)
+	})
+
+	t.Run("split-credentials", func(t *testing.T) {
+		fake := dynamotest.New()
+		createLegacyTable(t, fake)
+
+		user := entity.User{Id: xid.New().String(), Email: "hashed@example.com", Name: "hashed", Password: "hash"}
+
+		for _, item := range []map[string]types.AttributeValue{
+			userToUserAttributeValue(user), userToEmailAttributeValue(user),
+		} {
+			_, err := fake.PutItem(context.Background(), &dynamodb.PutItemInput{TableName: aws.String(tableName), Item: item})
+			require.NoError(t, err)
+		}
+
+		dataStore := store.NewUserStore(fake, tableName)
+		require.NoError(t, store.NewMigrator(dataStore, store.WithBatchSize(1)).Up(context.Background()))
+
+		credentials, err := dataStore.GetCredentials(context.Background(), entity.DefaultTenant, user.Id)
+		require.NoError(t, err)
+		assert.Equal(t, "hash", credentials.Password)
+
+		result, err := fake.GetItem(context.Background(), &dynamodb.GetItemInput{
+			TableName: aws.String(tableName),
+			Key: map[string]types.AttributeValue{
+				"Id":         &types.AttributeValueMemberS{Value: user.Id},
+				"objectType": &types.AttributeValueMemberS{Value: "UserInfo"},
+			},
+		})
+		require.NoError(t, err)
+		assert.NotContains(t, result.Item, "Password")
+		assert.Equal(t, &types.AttributeValueMemberN{Value: "0"}, result.Item["Version"], "version should be kept")
+	})
+
+	t.Run("search-attributes", func(t *testing.T) {
+		fake := dynamotest.New()
+		user := createLegacyTable(t, fake)
+
+		dataStore := store.NewUserStore(fake, tableName)
+		require.NoError(t, store.NewMigrator(dataStore, store.WithBatchSize(1)).Up(context.Background()))
+
+		page, err := dataStore.List(context.Background(), entity.DefaultTenant, entity.ListOptions{NamePrefix: "leg"})
+		require.NoError(t, err)
+		require.Len(t, page.Users, 1)
+		assert.Equal(t, user.Id, page.Users[0].Id)
+
+		page, err = dataStore.List(context.Background(), entity.DefaultTenant, entity.ListOptions{EmailPrefix: "legacy@"})
+		require.NoError(t, err)
+		assert.Len(t, page.Users, 1)
+	})
+
+	t.Run("failed-migration", func(t *testing.T) {
+		fake := dynamotest.New()
+		dataStore := store.NewUserStore(fake, tableName)
+
+		applied := []int{}
+		step := func(version int, err error) store.Migration {
+			return store.Migration{
+				Version:     version,
+				Description: fmt.Sprintf("step %d", version),
+				Up: func(ctx context.Context, m *store.Migrator) error {
+					applied = append(applied, version)
+
+					return err
+				},
+			}
+		}
+
+		// the table must exist to record the version
+		require.NoError(t, store.NewMigrator(dataStore).Up(context.Background()))
+
+		status, err := store.NewMigrator(dataStore).Status(context.Background())
+		require.NoError(t, err)
+
+		latest := status.Latest
+
+		migrations := []store.Migration{}
+		for version := 1; version <= latest; version++ {
+			migrations = append(migrations, step(version, nil))
+		}
+
+		migrations = append(migrations, step(latest+1, errors.New("failed")))
+		migrator := store.NewMigrator(dataStore, store.WithMigrations(migrations))
+
+		err = migrator.Up(context.Background())
+		assert.Error(t, err)
+		assert.Equal(t, []int{latest + 1}, applied)
+
+		status, err = migrator.Status(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, latest, status.Current)
+		assert.Equal(t, latest+1, status.Latest)
+
+		// retrying applies the failed step again
+		migrations[latest] = step(latest+1, nil)
+		require.NoError(t, store.NewMigrator(dataStore, store.WithMigrations(migrations)).Up(context.Background()))
+		assert.Equal(t, []int{latest + 1, latest + 1}, applied)
+	})
+}
@@ -0,0 +1,404 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+	"github.com/rs/xid"
+	"github.com/sirupsen/logrus"
+
+	"github.com/electrofelix/gin-demo/entity"
+)
+
+const (
+	defaultRetryMaxAttempts = 5
+	defaultRetryBaseDelay   = 25 * time.Millisecond
+	defaultRetryMaxDelay    = time.Second
+	defaultRetryBudget      = 100
+
+	// each retry costs more of the budget than a success returns, so that
+	// retries stop while most calls are failing instead of adding load
+	retryCost   = 5
+	retryRefund = 1
+)
+
+// WithRetries sets the most attempts made of a DynamoDB call that is
+// throttled or conflicts with a transaction, 1 disables retrying.
+func WithRetries(maxAttempts int) Option {
+	return func(us *UserStore) {
+		us.retry.maxAttempts = maxAttempts
+	}
+}
+
+// WithRetryBackoff sets the delay before the first retry, which doubles for
+// each attempt up to the max. A random delay up to this is used to spread
+// out retries from concurrent requests.
+func WithRetryBackoff(base, max time.Duration) Option {
+	return func(us *UserStore) {
+		us.retry.baseDelay = base
+		us.retry.maxDelay = max
+	}
+}
+
+// WithRetryBudget sets how many retries may be made before calls need to
+// start succeeding again, shared by all calls of the store.
+func WithRetryBudget(retries int) Option {
+	return func(us *UserStore) {
+		us.retry.budget = retries * retryCost
+	}
+}
+
+type retryPolicy struct {
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	budget      int
+}
+
+func defaultRetryPolicy() retryPolicy {
+	return retryPolicy{
+		maxAttempts: defaultRetryMaxAttempts,
+		baseDelay:   defaultRetryBaseDelay,
+		maxDelay:    defaultRetryMaxDelay,
+		budget:      defaultRetryBudget * retryCost,
+	}
+}
+
+// unavailableError is returned once a retryable error persists, it matches
+// entity.ErrUnavailable while still unwrapping to the DynamoDB error so the
+// store can inspect it as before.
+type unavailableError struct {
+	err error
+}
+
+func (e *unavailableError) Error() string {
+	return fmt.Sprintf("%v: %v", entity.ErrUnavailable, e.err)
+}
+
+func (e *unavailableError) Unwrap() error {
+	return e.err
+}
+
+func (e *unavailableError) Is(target error) bool {
+	return target == entity.ErrUnavailable
+}
+
+// retryingDynamoDB retries calls failing due to throttling or transaction
+// conflicts with jittered exponential backoff, limited by a shared budget.
+type retryingDynamoDB struct {
+	next   DynamoDBAPI
+	policy retryPolicy
+	logger *logrus.Logger
+
+	mu     sync.Mutex
+	tokens int
+	random *rand.Rand
+}
+
+func newRetryingDynamoDB(next DynamoDBAPI, policy retryPolicy, logger *logrus.Logger) *retryingDynamoDB {
+	return &retryingDynamoDB{
+		next:   next,
+		policy: policy,
+		logger: logger,
+		tokens: policy.budget,
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// do makes the call until it succeeds or fails with an error that cannot be
+// retried. An internal server error leaves it unknown whether the call was
+// applied, so is only retried when making the call again has no further
+// effect.
+func (r *retryingDynamoDB) do(ctx context.Context, operation string, idempotent bool, call func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := call()
+		if err == nil {
+			r.refund()
+
+			return nil
+		}
+
+		var errInternal *types.InternalServerError
+		if !isRetryable(err) && !(idempotent && errors.As(err, &errInternal)) {
+			return err
+		}
+
+		if attempt >= r.policy.maxAttempts || !r.withdraw() {
+			r.logger.Warnf("%s unavailable after %d attempts: %v", operation, attempt, err)
+
+			return &unavailableError{err: err}
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(r.delay(attempt)):
+		}
+	}
+}
+
+// delay returns a random duration up to the exponential backoff of the
+// attempt, so that concurrent retries are spread out.
+func (r *retryingDynamoDB) delay(attempt int) time.Duration {
+	backoff := r.policy.maxDelay
+	if attempt < 32 && r.policy.baseDelay<<uint(attempt-1) < backoff {
+		backoff = r.policy.baseDelay << uint(attempt-1)
+	}
+
+	if backoff <= 0 {
+		return 0
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return time.Duration(r.random.Int63n(int64(backoff) + 1))
+}
+
+func (r *retryingDynamoDB) withdraw() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.tokens < retryCost {
+		return false
+	}
+
+	r.tokens -= retryCost
+
+	return true
+}
+
+func (r *retryingDynamoDB) refund() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.tokens += retryRefund
+	if r.tokens > r.policy.budget {
+		r.tokens = r.policy.budget
+	}
+}
+
+// isRetryable reports whether the call was rejected without being applied
+// due to load or contention, which may succeed if tried again.
+func isRetryable(err error) bool {
+	var (
+		errThroughput   *types.ProvisionedThroughputExceededException
+		errRequestLimit *types.RequestLimitExceeded
+		errConflict     *types.TransactionConflictException
+		errTransaction  *types.TransactionCanceledException
+		errAPI          smithy.APIError
+	)
+
+	switch {
+	case errors.As(err, &errThroughput), errors.As(err, &errRequestLimit), errors.As(err, &errConflict):
+		return true
+	case errors.As(err, &errTransaction):
+		// only when no item failed its condition, as retrying would fail
+		// the same way
+		retryable := false
+
+		for _, reason := range errTransaction.CancellationReasons {
+			switch aws.ToString(reason.Code) {
+			case "", "None":
+			case "TransactionConflict", "ThrottlingError", "ProvisionedThroughputExceeded":
+				retryable = true
+			default:
+				return false
+			}
+		}
+
+		return retryable
+	case errors.As(err, &errAPI):
+		return errAPI.ErrorCode() == "ThrottlingException"
+	}
+
+	return false
+}
+
+// BatchGetItem also retries any keys DynamoDB left unprocessed, which it
+// does rather than failing when throttled, merging the items returned by each
+// attempt. Keys still unprocessed once attempts or the budget are exhausted
+// are returned as UnprocessedKeys for the caller to handle.
+func (r *retryingDynamoDB) BatchGetItem(
+	ctx context.Context, input *dynamodb.BatchGetItemInput, opts ...DynamoDBOptions,
+) (*dynamodb.BatchGetItemOutput, error) {
+	merged := &dynamodb.BatchGetItemOutput{Responses: map[string][]map[string]types.AttributeValue{}}
+	request := input
+
+	for attempt := 1; ; attempt++ {
+		var output *dynamodb.BatchGetItemOutput
+
+		err := r.do(ctx, "BatchGetItem", true, func() (err error) {
+			output, err = r.next.BatchGetItem(ctx, request, opts...)
+
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for table, items := range output.Responses {
+			merged.Responses[table] = append(merged.Responses[table], items...)
+		}
+
+		merged.ConsumedCapacity = append(merged.ConsumedCapacity, output.ConsumedCapacity...)
+		merged.UnprocessedKeys = output.UnprocessedKeys
+
+		if len(output.UnprocessedKeys) == 0 {
+			return merged, nil
+		}
+
+		if attempt >= r.policy.maxAttempts || !r.withdraw() {
+			r.logger.Warnf("BatchGetItem left keys unprocessed after %d attempts", attempt)
+
+			return merged, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(r.delay(attempt)):
+		}
+
+		request = &dynamodb.BatchGetItemInput{
+			RequestItems:           output.UnprocessedKeys,
+			ReturnConsumedCapacity: input.ReturnConsumedCapacity,
+		}
+	}
+}
+
+func (r *retryingDynamoDB) CreateTable(
+	ctx context.Context, input *dynamodb.CreateTableInput, opts ...DynamoDBOptions,
+) (output *dynamodb.CreateTableOutput, err error) {
+	err = r.do(ctx, "CreateTable", false, func() error {
+		output, err = r.next.CreateTable(ctx, input, opts...)
+
+		return err
+	})
+
+	return output, err
+}
+
+func (r *retryingDynamoDB) GetItem(
+	ctx context.Context, input *dynamodb.GetItemInput, opts ...DynamoDBOptions,
+) (output *dynamodb.GetItemOutput, err error) {
+	err = r.do(ctx, "GetItem", true, func() error {
+		output, err = r.next.GetItem(ctx, input, opts...)
+
+		return err
+	})
+
+	return output, err
+}
+
+func (r *retryingDynamoDB) DeleteItem(
+	ctx context.Context, input *dynamodb.DeleteItemInput, opts ...DynamoDBOptions,
+) (output *dynamodb.DeleteItemOutput, err error) {
+	err = r.do(ctx, "DeleteItem", false, func() error {
+		output, err = r.next.DeleteItem(ctx, input, opts...)
+
+		return err
+	})
+
+	return output, err
+}
+
+func (r *retryingDynamoDB) DescribeTable(
+	ctx context.Context, input *dynamodb.DescribeTableInput, opts ...DynamoDBOptions,
+) (output *dynamodb.DescribeTableOutput, err error) {
+	err = r.do(ctx, "DescribeTable", true, func() error {
+		output, err = r.next.DescribeTable(ctx, input, opts...)
+
+		return err
+	})
+
+	return output, err
+}
+
+func (r *retryingDynamoDB) PutItem(
+	ctx context.Context, input *dynamodb.PutItemInput, opts ...DynamoDBOptions,
+) (output *dynamodb.PutItemOutput, err error) {
+	err = r.do(ctx, "PutItem", false, func() error {
+		output, err = r.next.PutItem(ctx, input, opts...)
+
+		return err
+	})
+
+	return output, err
+}
+
+func (r *retryingDynamoDB) Query(
+	ctx context.Context, input *dynamodb.QueryInput, opts ...DynamoDBOptions,
+) (output *dynamodb.QueryOutput, err error) {
+	err = r.do(ctx, "Query", true, func() error {
+		output, err = r.next.Query(ctx, input, opts...)
+
+		return err
+	})
+
+	return output, err
+}
+
+func (r *retryingDynamoDB) Scan(
+	ctx context.Context, input *dynamodb.ScanInput, opts ...DynamoDBOptions,
+) (output *dynamodb.ScanOutput, err error) {
+	err = r.do(ctx, "Scan", true, func() error {
+		output, err = r.next.Scan(ctx, input, opts...)
+
+		return err
+	})
+
+	return output, err
+}
+
+// TransactWriteItems gives the transaction a client request token unless it
+// has one, so that DynamoDB applies it only once however often it is retried.
+func (r *retryingDynamoDB) TransactWriteItems(
+	ctx context.Context, input *dynamodb.TransactWriteItemsInput, opts ...DynamoDBOptions,
+) (output *dynamodb.TransactWriteItemsOutput, err error) {
+	if input.ClientRequestToken == nil {
+		request := *input
+		request.ClientRequestToken = aws.String(xid.New().String())
+		input = &request
+	}
+
+	err = r.do(ctx, "TransactWriteItems", true, func() error {
+		output, err = r.next.TransactWriteItems(ctx, input, opts...)
+
+		return err
+	})
+
+	return output, err
+}
+
+func (r *retryingDynamoDB) UpdateItem(
+	ctx context.Context, input *dynamodb.UpdateItemInput, opts ...DynamoDBOptions,
+) (output *dynamodb.UpdateItemOutput, err error) {
+	err = r.do(ctx, "UpdateItem", false, func() error {
+		output, err = r.next.UpdateItem(ctx, input, opts...)
+
+		return err
+	})
+
+	return output, err
+}
+
+func (r *retryingDynamoDB) UpdateTable(
+	ctx context.Context, input *dynamodb.UpdateTableInput, opts ...DynamoDBOptions,
+) (output *dynamodb.UpdateTableOutput, err error) {
+	err = r.do(ctx, "UpdateTable", false, func() error {
+		output, err = r.next.UpdateTable(ctx, input, opts...)
+
+		return err
+	})
+
+	return output, err
+}
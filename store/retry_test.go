@@ -0,0 +1,259 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+	"github.com/golang/mock/gomock"
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/electrofelix/gin-demo/entity"
+	"github.com/electrofelix/gin-demo/mocks"
+	"github.com/electrofelix/gin-demo/store"
+)
+
+func TestUserStore_Retries(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	newStore := func(mockDBClient *mocks.MockDynamoDBAPI, options ...store.Option) *store.UserStore {
+		options = append([]store.Option{store.WithRetryBackoff(time.Millisecond, 5*time.Millisecond)}, options...)
+
+		return store.NewUserStore(mockDBClient, tableName, options...)
+	}
+
+	user := entity.User{Id: xid.New().String(), Email: "user1@example.com", Name: "test-user"}
+	throttled := &types.ProvisionedThroughputExceededException{Message: aws.String("slow down")}
+
+	t.Run("throttled", func(t *testing.T) {
+		mockDBClient := mocks.NewMockDynamoDBAPI(ctrl)
+		dataStore := newStore(mockDBClient)
+
+		gomock.InOrder(
+			mockDBClient.EXPECT().GetItem(gomock.Any(), gomock.Any()).Return(nil, throttled).Times(2),
+			mockDBClient.EXPECT().GetItem(gomock.Any(), gomock.Any()).Return(
+				&dynamodb.GetItemOutput{Item: userToUserAttributeValue(user)}, nil,
+			),
+		)
+
+		got, err := dataStore.GetById(context.Background(), entity.DefaultTenant, user.Id)
+		require.NoError(t, err)
+		assert.Equal(t, user.Id, got.Id)
+	})
+
+	t.Run("throttling-exception", func(t *testing.T) {
+		mockDBClient := mocks.NewMockDynamoDBAPI(ctrl)
+		dataStore := newStore(mockDBClient, store.WithRetries(2))
+
+		mockDBClient.EXPECT().GetItem(gomock.Any(), gomock.Any()).Return(
+			nil, &smithy.GenericAPIError{Code: "ThrottlingException", Message: "rate exceeded"},
+		).Times(2)
+
+		_, err := dataStore.GetById(context.Background(), entity.DefaultTenant, user.Id)
+		assert.ErrorIs(t, err, entity.ErrUnavailable)
+	})
+
+	t.Run("exhausted", func(t *testing.T) {
+		mockDBClient := mocks.NewMockDynamoDBAPI(ctrl)
+		dataStore := newStore(mockDBClient, store.WithRetries(3))
+
+		mockDBClient.EXPECT().GetItem(gomock.Any(), gomock.Any()).Return(nil, throttled).Times(3)
+
+		_, err := dataStore.GetById(context.Background(), entity.DefaultTenant, user.Id)
+		assert.ErrorIs(t, err, entity.ErrUnavailable)
+
+		var errThroughput *types.ProvisionedThroughputExceededException
+		assert.True(t, errors.As(err, &errThroughput), "the original error should still be available")
+	})
+
+	t.Run("not-retryable", func(t *testing.T) {
+		mockDBClient := mocks.NewMockDynamoDBAPI(ctrl)
+		dataStore := newStore(mockDBClient)
+
+		mockDBClient.EXPECT().GetItem(gomock.Any(), gomock.Any()).Return(nil, errors.New("failed")).Times(1)
+
+		_, err := dataStore.GetById(context.Background(), entity.DefaultTenant, user.Id)
+		require.Error(t, err)
+		assert.NotErrorIs(t, err, entity.ErrUnavailable)
+	})
+
+	t.Run("unprocessed-keys", func(t *testing.T) {
+		mockDBClient := mocks.NewMockDynamoDBAPI(ctrl)
+		dataStore := newStore(mockDBClient)
+
+		other := entity.User{Id: xid.New().String(), Email: "user2@example.com", Name: "other-user"}
+
+		gomock.InOrder(
+			mockDBClient.EXPECT().BatchGetItem(gomock.Any(), gomock.Any()).DoAndReturn(
+				func(ctx context.Context, input *dynamodb.BatchGetItemInput, opts ...store.DynamoDBOptions) (*dynamodb.BatchGetItemOutput, error) {
+					keys := input.RequestItems[tableName].Keys
+					require.Len(t, keys, 2)
+
+					return &dynamodb.BatchGetItemOutput{
+						Responses: map[string][]map[string]types.AttributeValue{
+							tableName: {userToUserAttributeValue(user)},
+						},
+						UnprocessedKeys: map[string]types.KeysAndAttributes{
+							tableName: {Keys: keys[1:]},
+						},
+					}, nil
+				},
+			),
+			// only the unprocessed keys are requested again
+			mockDBClient.EXPECT().BatchGetItem(gomock.Any(), gomock.Any()).DoAndReturn(
+				func(ctx context.Context, input *dynamodb.BatchGetItemInput, opts ...store.DynamoDBOptions) (*dynamodb.BatchGetItemOutput, error) {
+					assert.Len(t, input.RequestItems[tableName].Keys, 1)
+
+					return &dynamodb.BatchGetItemOutput{
+						Responses: map[string][]map[string]types.AttributeValue{
+							tableName: {userToUserAttributeValue(other)},
+						},
+					}, nil
+				},
+			),
+		)
+
+		got, err := dataStore.GetMany(context.Background(), entity.DefaultTenant, []string{user.Id, other.Id})
+		require.NoError(t, err)
+
+		if assert.Len(t, got, 2) {
+			assert.Equal(t, user.Id, got[0].Id)
+			assert.Equal(t, other.Id, got[1].Id)
+		}
+	})
+
+	t.Run("unprocessed-keys-exhausted", func(t *testing.T) {
+		mockDBClient := mocks.NewMockDynamoDBAPI(ctrl)
+		dataStore := newStore(mockDBClient, store.WithRetries(2))
+
+		mockDBClient.EXPECT().BatchGetItem(gomock.Any(), gomock.Any()).DoAndReturn(
+			func(ctx context.Context, input *dynamodb.BatchGetItemInput, opts ...store.DynamoDBOptions) (*dynamodb.BatchGetItemOutput, error) {
+				return &dynamodb.BatchGetItemOutput{UnprocessedKeys: input.RequestItems}, nil
+			},
+		).Times(2)
+
+		_, err := dataStore.GetMany(context.Background(), entity.DefaultTenant, []string{user.Id})
+		assert.ErrorIs(t, err, entity.ErrUnavailable)
+	})
+
+	t.Run("transaction-conflict", func(t *testing.T) {
+		mockDBClient := mocks.NewMockDynamoDBAPI(ctrl)
+		dataStore := newStore(mockDBClient)
+
+		conflict := &types.TransactionCanceledException{
+			CancellationReasons: []types.CancellationReason{
+				{Code: aws.String("None")},
+				{Code: aws.String("TransactionConflict")},
+			},
+		}
+
+		gomock.InOrder(
+			mockDBClient.EXPECT().TransactWriteItems(gomock.Any(), gomock.Any()).Return(nil, conflict),
+			mockDBClient.EXPECT().TransactWriteItems(gomock.Any(), gomock.Any()).Return(
+				&dynamodb.TransactWriteItemsOutput{}, nil,
+			),
+		)
+
+		create := user
+		assert.NoError(t, dataStore.Create(context.Background(), &create))
+	})
+
+	t.Run("internal-error-read", func(t *testing.T) {
+		mockDBClient := mocks.NewMockDynamoDBAPI(ctrl)
+		dataStore := newStore(mockDBClient)
+
+		gomock.InOrder(
+			mockDBClient.EXPECT().GetItem(gomock.Any(), gomock.Any()).Return(
+				nil, &types.InternalServerError{Message: aws.String("internal")},
+			),
+			mockDBClient.EXPECT().GetItem(gomock.Any(), gomock.Any()).Return(
+				&dynamodb.GetItemOutput{Item: userToUserAttributeValue(user)}, nil,
+			),
+		)
+
+		_, err := dataStore.GetById(context.Background(), entity.DefaultTenant, user.Id)
+		assert.NoError(t, err)
+	})
+
+	t.Run("internal-error-update", func(t *testing.T) {
+		mockDBClient := mocks.NewMockDynamoDBAPI(ctrl)
+		dataStore := newStore(mockDBClient)
+
+		// the login may already have been counted, so must not be again
+		mockDBClient.EXPECT().UpdateItem(gomock.Any(), gomock.Any()).Return(
+			nil, &types.InternalServerError{Message: aws.String("internal")},
+		).Times(1)
+
+		err := dataStore.RecordLogin(context.Background(), entity.DefaultTenant, user.Id, entity.Login{Time: time.Now()})
+		assert.Error(t, err)
+	})
+
+	t.Run("internal-error-transaction", func(t *testing.T) {
+		mockDBClient := mocks.NewMockDynamoDBAPI(ctrl)
+		dataStore := newStore(mockDBClient)
+
+		var tokens []string
+
+		record := func(ctx context.Context, input *dynamodb.TransactWriteItemsInput, opts ...store.DynamoDBOptions) {
+			tokens = append(tokens, aws.ToString(input.ClientRequestToken))
+		}
+
+		gomock.InOrder(
+			mockDBClient.EXPECT().TransactWriteItems(gomock.Any(), gomock.Any()).Do(record).Return(
+				nil, &types.InternalServerError{Message: aws.String("internal")},
+			),
+			mockDBClient.EXPECT().TransactWriteItems(gomock.Any(), gomock.Any()).Do(record).Return(
+				&dynamodb.TransactWriteItemsOutput{}, nil,
+			),
+		)
+
+		create := user
+		require.NoError(t, dataStore.Create(context.Background(), &create))
+
+		// retried with the same token so DynamoDB applies it only once
+		require.Len(t, tokens, 2)
+		assert.NotEmpty(t, tokens[0])
+		assert.Equal(t, tokens[0], tokens[1])
+	})
+
+	t.Run("condition-failed", func(t *testing.T) {
+		mockDBClient := mocks.NewMockDynamoDBAPI(ctrl)
+		dataStore := newStore(mockDBClient)
+
+		// the email condition failing must not be retried even alongside a
+		// conflict
+		mockDBClient.EXPECT().TransactWriteItems(gomock.Any(), gomock.Any()).Return(
+			nil, &types.TransactionCanceledException{
+				CancellationReasons: []types.CancellationReason{
+					{Code: aws.String("TransactionConflict")},
+					{Code: aws.String("ConditionalCheckFailed")},
+				},
+			},
+		).Times(1)
+
+		create := user
+		assert.ErrorIs(t, dataStore.Create(context.Background(), &create), entity.ErrEmailDuplicate)
+	})
+
+	t.Run("budget", func(t *testing.T) {
+		mockDBClient := mocks.NewMockDynamoDBAPI(ctrl)
+		dataStore := newStore(mockDBClient, store.WithRetryBudget(2))
+
+		// the budget allows two retries in total, after which calls fail
+		// on the first attempt
+		mockDBClient.EXPECT().GetItem(gomock.Any(), gomock.Any()).Return(nil, throttled).Times(4)
+
+		_, err := dataStore.GetById(context.Background(), entity.DefaultTenant, user.Id)
+		assert.ErrorIs(t, err, entity.ErrUnavailable)
+
+		_, err = dataStore.GetById(context.Background(), entity.DefaultTenant, user.Id)
+		assert.ErrorIs(t, err, entity.ErrUnavailable)
+	})
+}
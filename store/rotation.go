@@ -0,0 +1,479 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"github.com/electrofelix/gin-demo/entity"
+)
+
+const (
+	// the progress of a key rotation is recorded in a single item of the
+	// table so that it can be resumed, the Id cannot collide with a user Id
+	// or an email address
+	rotationId         = "#keyrotation"
+	rotationObjectType = "KeyRotation"
+
+	defaultRotationBatchSize = 100
+)
+
+// RotationProgress reports how far a key rotation has got through the
+// users, their credentials and their audit entries.
+type RotationProgress struct {
+	// KeyId is the master key items are being moved to.
+	KeyId   string
+	Scanned int
+	// Rewrapped items only had their data key wrapped by the new key.
+	Rewrapped int
+	// Reencrypted items were written in the clear, or with other fields
+	// encrypted, and have been encrypted with a new data key.
+	Reencrypted int
+	// Skipped items were written concurrently, which uses the current key.
+	Skipped int
+	Done    bool
+}
+
+func (p RotationProgress) String() string {
+	return fmt.Sprintf(
+		"key %s: scanned %d, rewrapped %d, re-encrypted %d, skipped %d",
+		p.KeyId, p.Scanned, p.Rewrapped, p.Reencrypted, p.Skipped,
+	)
+}
+
+// rotationCheckpoint is the recorded progress, along with where to resume
+// the scan of the table from.
+type rotationCheckpoint struct {
+	RotationProgress
+	Cursor    string
+	UpdatedAt time.Time
+}
+
+// KeyRotator moves all encrypted items to the current master key of the
+// store, and encrypts any items written before encryption was enabled. It
+// is safe to run against a table in use, as every item is written with a
+// condition that it has not changed since it was read.
+type KeyRotator struct {
+	store     *UserStore
+	batchSize int32
+	progress  func(RotationProgress)
+}
+
+type RotatorOption func(*KeyRotator)
+
+func NewKeyRotator(us *UserStore, options ...RotatorOption) *KeyRotator {
+	kr := &KeyRotator{
+		store:     us,
+		batchSize: defaultRotationBatchSize,
+		progress:  func(RotationProgress) {},
+	}
+
+	for _, opt := range options {
+		opt(kr)
+	}
+
+	return kr
+}
+
+// WithRotationBatchSize sets how many items are read per page, the progress
+// is recorded after each page.
+func WithRotationBatchSize(size int32) RotatorOption {
+	return func(kr *KeyRotator) {
+		kr.batchSize = size
+	}
+}
+
+// WithRotationProgress sets a func called with the progress after each page.
+func WithRotationProgress(fn func(RotationProgress)) RotatorOption {
+	return func(kr *KeyRotator) {
+		kr.progress = fn
+	}
+}
+
+// Rotate walks all users, credentials and audit entries, resuming an
+// interrupted rotation to the same key. A completed rotation is started
+// again from the beginning, to pick up items written with an old key since.
+func (kr *KeyRotator) Rotate(ctx context.Context) (RotationProgress, error) {
+	if kr.store.encryption == nil {
+		return RotationProgress{}, errors.New("encryption must be enabled to rotate keys")
+	}
+
+	keyId := kr.store.encryption.provider.CurrentKeyId()
+
+	checkpoint, err := kr.checkpoint(ctx)
+	if err != nil {
+		return RotationProgress{}, err
+	}
+
+	if checkpoint.KeyId != keyId || checkpoint.Done {
+		checkpoint = rotationCheckpoint{RotationProgress: RotationProgress{KeyId: keyId}}
+	} else {
+		kr.store.logger.Infof("resuming rotation to key %s after %d items", keyId, checkpoint.Scanned)
+	}
+
+	startKey, err := decodeDynamoDBCursor(checkpoint.Cursor)
+	if err != nil {
+		return RotationProgress{}, err
+	}
+
+	// users, credentials and audit entries of all tenants, the email
+	// reservations are skipped as they are never encrypted
+	scanInput := dynamodb.ScanInput{
+		TableName:        aws.String(kr.store.tableName),
+		FilterExpression: aws.String("begins_with(objectType, :prefix)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":prefix": &types.AttributeValueMemberS{Value: key},
+		},
+		ExclusiveStartKey: startKey,
+		Limit:             aws.Int32(kr.batchSize),
+		ConsistentRead:    aws.Bool(true),
+	}
+
+	for {
+		result, err := kr.store.dbClient.Scan(ctx, &scanInput)
+		if err != nil {
+			return checkpoint.RotationProgress, err
+		}
+
+		for _, item := range result.Items {
+			err := kr.rotateItem(ctx, item, keyId, &checkpoint.RotationProgress)
+			if err != nil {
+				return checkpoint.RotationProgress, err
+			}
+		}
+
+		checkpoint.Cursor, err = encodeDynamoDBCursor(result.LastEvaluatedKey)
+		if err != nil {
+			return checkpoint.RotationProgress, err
+		}
+
+		checkpoint.Done = checkpoint.Cursor == ""
+
+		err = kr.recordCheckpoint(ctx, checkpoint)
+		if err != nil {
+			return checkpoint.RotationProgress, err
+		}
+
+		kr.progress(checkpoint.RotationProgress)
+
+		if checkpoint.Done {
+			return checkpoint.RotationProgress, nil
+		}
+
+		scanInput.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+// rotateItem rewraps the data key of an item encrypted as configured, or
+// otherwise encrypts the item afresh, counting the outcome in progress.
+func (kr *KeyRotator) rotateItem(
+	ctx context.Context, item map[string]types.AttributeValue, keyId string, progress *RotationProgress,
+) error {
+	tenant, kind, ok := itemTenant(item)
+	if !ok || kind == kindEmail {
+		return nil
+	}
+
+	progress.Scanned++
+
+	fields := auditEncryptedFields
+	isUser := kind == kindUser
+
+	switch {
+	case isUser:
+		fields = kr.store.encryption.fields
+	case kind == kindCredentials:
+		fields = kr.store.encryption.credentialsFields()
+	}
+
+	wrapped, encrypted := item[dataKeyAttribute].(*types.AttributeValueMemberB)
+	rewrap := encrypted && encryptedFieldsMatch(item, fields)
+
+	if rewrap {
+		if current, _ := item[keyIdAttribute].(*types.AttributeValueMemberS); current != nil && current.Value == keyId {
+			return nil
+		}
+	}
+
+	var (
+		updated map[string]types.AttributeValue
+		err     error
+	)
+
+	switch {
+	case rewrap:
+		updated, err = kr.rewrap(ctx, item)
+	case isUser:
+		updated, err = kr.reencryptUser(ctx, tenant, item)
+	case kind == kindCredentials:
+		updated, err = kr.reencryptCredentials(ctx, tenant, item)
+	default:
+		updated, err = kr.reencryptAudit(ctx, tenant, item)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// every write uses a new data key, so an unchanged data key means the
+	// item is unchanged
+	condition := fmt.Sprintf("%s = :dataKey", dataKeyAttribute)
+	values := map[string]types.AttributeValue{":dataKey": wrapped}
+
+	if !encrypted {
+		condition = fmt.Sprintf("attribute_exists(Id) AND attribute_not_exists(%s)", dataKeyAttribute)
+		values = nil
+
+		if isUser {
+			var version int64
+			if value, ok := item["Version"]; ok {
+				if err := attributevalue.Unmarshal(value, &version); err != nil {
+					return err
+				}
+			}
+
+			versionCond, versionValues := versionCondition(version)
+			condition += " AND " + versionCond
+			values = versionValues
+		}
+	}
+
+	if isUser {
+		err = kr.updateUser(ctx, updated, condition, values)
+	} else {
+		_, err = kr.store.dbClient.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName:                 aws.String(kr.store.tableName),
+			Item:                      updated,
+			ConditionExpression:       aws.String(condition),
+			ExpressionAttributeValues: values,
+		})
+	}
+
+	var errCondition *types.ConditionalCheckFailedException
+
+	switch {
+	case errors.As(err, &errCondition):
+		progress.Skipped++
+	case err != nil:
+		return err
+	case rewrap:
+		progress.Rewrapped++
+	default:
+		progress.Reencrypted++
+	}
+
+	return nil
+}
+
+// updateUser writes the rotated user over the stored one with the same
+// update as used for profile writes, so that a login recorded in place since
+// the user was read is kept rather than reverted.
+func (kr *KeyRotator) updateUser(
+	ctx context.Context, updated map[string]types.AttributeValue, condition string,
+	conditionValues map[string]types.AttributeValue,
+) error {
+	expression, names, values := profileUpdate(updated)
+
+	for name, value := range conditionValues {
+		values[name] = value
+	}
+
+	_, err := kr.store.dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		Key:                       itemKey(updated),
+		TableName:                 aws.String(kr.store.tableName),
+		UpdateExpression:          expression,
+		ConditionExpression:       aws.String(condition),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+
+	return err
+}
+
+// rewrap returns the item with its data key wrapped by the current key,
+// leaving the encrypted attributes as they are.
+func (kr *KeyRotator) rewrap(ctx context.Context, item map[string]types.AttributeValue) (map[string]types.AttributeValue, error) {
+	wrapped, _ := item[dataKeyAttribute].(*types.AttributeValueMemberB)
+	keyId, _ := item[keyIdAttribute].(*types.AttributeValueMemberS)
+
+	if keyId == nil {
+		return nil, errors.New("item is missing the attributes needed to decrypt it")
+	}
+
+	provider := kr.store.encryption.provider
+
+	dataKey, err := provider.UnwrapKey(ctx, wrapped.Value, keyId.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	rewrapped, newKeyId, err := provider.WrapKey(ctx, dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	updated := copyAttributes(item)
+	updated[dataKeyAttribute] = &types.AttributeValueMemberB{Value: rewrapped}
+	updated[keyIdAttribute] = &types.AttributeValueMemberS{Value: newKeyId}
+
+	return updated, nil
+}
+
+func (kr *KeyRotator) reencryptUser(
+	ctx context.Context, tenant string, item map[string]types.AttributeValue,
+) (map[string]types.AttributeValue, error) {
+	decrypted := copyAttributes(item)
+
+	err := kr.store.decryptItem(ctx, decrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	var user entity.User
+
+	err = attributevalue.UnmarshalMap(decrypted, &user)
+	if err != nil {
+		return nil, err
+	}
+
+	user.TenantId = tenant
+
+	// the version is kept, as the user is unchanged
+	return kr.store.marshalUser(ctx, &user)
+}
+
+func (kr *KeyRotator) reencryptCredentials(
+	ctx context.Context, tenant string, item map[string]types.AttributeValue,
+) (map[string]types.AttributeValue, error) {
+	decrypted := copyAttributes(item)
+
+	err := kr.store.decryptItem(ctx, decrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		id          string
+		credentials entity.Credentials
+	)
+
+	err = attributevalue.Unmarshal(decrypted["Id"], &id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = attributevalue.UnmarshalMap(decrypted, &credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	return kr.store.marshalCredentials(ctx, tenant, id, &credentials)
+}
+
+func (kr *KeyRotator) reencryptAudit(
+	ctx context.Context, tenant string, item map[string]types.AttributeValue,
+) (map[string]types.AttributeValue, error) {
+	entry, err := kr.store.unmarshalAuditEntry(ctx, copyAttributes(item))
+	if err != nil {
+		return nil, err
+	}
+
+	return kr.store.marshalAuditEntry(ctx, tenant, entry)
+}
+
+// encryptedFieldsMatch reports whether the item has exactly those of the
+// fields it holds encrypted.
+func encryptedFieldsMatch(item map[string]types.AttributeValue, fields []string) bool {
+	encrypted, _ := item[encryptedFieldsAttribute].(*types.AttributeValueMemberSS)
+	if encrypted == nil {
+		return false
+	}
+
+	wanted := make([]string, 0, len(fields))
+	for _, field := range fields {
+		if _, ok := item[field]; ok {
+			wanted = append(wanted, field)
+		}
+	}
+
+	have := append([]string(nil), encrypted.Value...)
+
+	sort.Strings(wanted)
+	sort.Strings(have)
+
+	if len(wanted) != len(have) {
+		return false
+	}
+
+	for idx := range wanted {
+		if wanted[idx] != have[idx] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func copyAttributes(item map[string]types.AttributeValue) map[string]types.AttributeValue {
+	copied := make(map[string]types.AttributeValue, len(item))
+	for name, value := range item {
+		copied[name] = value
+	}
+
+	return copied
+}
+
+func rotationKey() map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"Id":         &types.AttributeValueMemberS{Value: rotationId},
+		"objectType": &types.AttributeValueMemberS{Value: rotationObjectType},
+	}
+}
+
+func (kr *KeyRotator) checkpoint(ctx context.Context) (rotationCheckpoint, error) {
+	result, err := kr.store.dbClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(kr.store.tableName),
+		Key:            rotationKey(),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return rotationCheckpoint{}, err
+	}
+
+	var checkpoint rotationCheckpoint
+
+	if len(result.Item) == 0 {
+		return checkpoint, nil
+	}
+
+	err = attributevalue.UnmarshalMap(result.Item, &checkpoint)
+
+	return checkpoint, err
+}
+
+func (kr *KeyRotator) recordCheckpoint(ctx context.Context, checkpoint rotationCheckpoint) error {
+	checkpoint.UpdatedAt = time.Now().UTC()
+
+	item, err := attributevalue.MarshalMap(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	for name, value := range rotationKey() {
+		item[name] = value
+	}
+
+	_, err = kr.store.dbClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(kr.store.tableName),
+		Item:      item,
+	})
+
+	return err
+}
@@ -0,0 +1,310 @@
+package store_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/electrofelix/gin-demo/entity"
+	"github.com/electrofelix/gin-demo/store"
+	"github.com/electrofelix/gin-demo/store/dynamotest"
+)
+
+// failingScan fails scans after a number have succeeded, to interrupt
+// anything walking the table.
+type failingScan struct {
+	*dynamotest.FakeDynamoDB
+	remaining int
+}
+
+func (f *failingScan) Scan(
+	ctx context.Context, input *dynamodb.ScanInput, opts ...store.DynamoDBOptions,
+) (*dynamodb.ScanOutput, error) {
+	if f.remaining == 0 {
+		return nil, errors.New("interrupted")
+	}
+
+	f.remaining--
+
+	return f.FakeDynamoDB.Scan(ctx, input, opts...)
+}
+
+// afterScan calls fn once after the first scan, to change items after they
+// have been read by anything walking the table.
+type afterScan struct {
+	*dynamotest.FakeDynamoDB
+	fn func()
+}
+
+func (a *afterScan) Scan(
+	ctx context.Context, input *dynamodb.ScanInput, opts ...store.DynamoDBOptions,
+) (*dynamodb.ScanOutput, error) {
+	output, err := a.FakeDynamoDB.Scan(ctx, input, opts...)
+
+	if fn := a.fn; fn != nil {
+		a.fn = nil
+		fn()
+	}
+
+	return output, err
+}
+
+func TestKeyRotator_Rotate(t *testing.T) {
+	newProvider := func(t *testing.T, path string) *store.KeyFileProvider {
+		t.Helper()
+
+		provider, err := store.NewKeyFileProvider(path)
+		require.NoError(t, err)
+
+		return provider
+	}
+
+	// populate writes a user in the clear, then users encrypted with the
+	// current key of the file, each with an audit entry
+	populate := func(t *testing.T, dbClient store.DynamoDBAPI, keyFile string) int {
+		t.Helper()
+
+		plainStore := store.NewUserStore(dbClient, tableName)
+		require.NoError(t, store.NewMigrator(plainStore).Up(context.Background()))
+
+		dataStore := store.NewUserStore(dbClient, tableName, store.WithEncryption(newProvider(t, keyFile)))
+
+		for idx := 0; idx < 4; idx++ {
+			target := dataStore
+			if idx == 0 {
+				target = plainStore
+			}
+
+			user := entity.User{Id: fmt.Sprintf("user%d", idx), Email: fmt.Sprintf("user%d@example.com", idx)}
+			audit := entity.AuditEntry{
+				UserId:    user.Id,
+				Timestamp: time.Now().UTC(),
+				Actor:     "test",
+				Action:    entity.AuditActionCreate,
+				Changes:   map[string]entity.AuditChange{"email": {New: user.Email}},
+			}
+
+			require.NoError(t, target.Create(context.Background(), &user, audit))
+		}
+
+		// users and audit entries
+		return 8
+	}
+
+	keyIds := func(t *testing.T, dbClient *dynamotest.FakeDynamoDB) map[string]int {
+		t.Helper()
+
+		result, err := dbClient.Scan(context.Background(), &dynamodb.ScanInput{TableName: aws.String(tableName)})
+		require.NoError(t, err)
+
+		ids := map[string]int{}
+
+		for _, item := range result.Items {
+			if _, ok := item["DataKey"]; !ok {
+				continue
+			}
+
+			ids[item["KeyId"].(*types.AttributeValueMemberS).Value]++
+		}
+
+		return ids
+	}
+
+	// retireKey removes a key from the file, as done once rotated away from
+	retireKey := func(t *testing.T, path, id string) {
+		t.Helper()
+
+		data, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+
+		file := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(data, &file))
+		delete(file["keys"].(map[string]interface{}), id)
+
+		data, err = json.Marshal(file)
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(path, data, 0600))
+	}
+
+	t.Run("rotate", func(t *testing.T) {
+		dbClient := dynamotest.New()
+		keyFile := filepath.Join(t.TempDir(), "keys.json")
+
+		_, err := store.AddKeyFileKey(keyFile)
+		require.NoError(t, err)
+
+		items := populate(t, dbClient, keyFile)
+		assert.Equal(t, map[string]int{"1": 6}, keyIds(t, dbClient))
+
+		keyId, err := store.AddKeyFileKey(keyFile)
+		require.NoError(t, err)
+		assert.Equal(t, "2", keyId)
+
+		dataStore := store.NewUserStore(dbClient, tableName, store.WithEncryption(newProvider(t, keyFile)))
+
+		var reported []store.RotationProgress
+
+		progress, err := store.NewKeyRotator(
+			dataStore,
+			store.WithRotationBatchSize(3),
+			store.WithRotationProgress(func(p store.RotationProgress) { reported = append(reported, p) }),
+		).Rotate(context.Background())
+		require.NoError(t, err)
+
+		assert.Equal(t, store.RotationProgress{
+			KeyId: "2", Scanned: items, Rewrapped: 6, Reencrypted: 2, Done: true,
+		}, progress)
+		require.NotEmpty(t, reported)
+		assert.Equal(t, progress, reported[len(reported)-1])
+		assert.Equal(t, map[string]int{"2": items}, keyIds(t, dbClient))
+
+		// all items are readable once the old key is removed
+		retireKey(t, keyFile, "1")
+		dataStore = store.NewUserStore(dbClient, tableName, store.WithEncryption(newProvider(t, keyFile)))
+
+		for idx := 0; idx < 4; idx++ {
+			user, err := dataStore.GetById(context.Background(), entity.DefaultTenant, fmt.Sprintf("user%d", idx))
+			require.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("user%d@example.com", idx), user.Email)
+
+			page, err := dataStore.ListAudit(context.Background(), entity.DefaultTenant, user.Id, entity.ListOptions{})
+			require.NoError(t, err)
+			require.Len(t, page.Entries, 1)
+			assert.Equal(t, user.Email, page.Entries[0].Changes["email"].New)
+		}
+
+		// nothing left to do when run again
+		progress, err = store.NewKeyRotator(dataStore).Rotate(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, store.RotationProgress{KeyId: "2", Scanned: items, Done: true}, progress)
+	})
+
+	t.Run("resume", func(t *testing.T) {
+		fake := dynamotest.New()
+		keyFile := filepath.Join(t.TempDir(), "keys.json")
+
+		_, err := store.AddKeyFileKey(keyFile)
+		require.NoError(t, err)
+
+		items := populate(t, fake, keyFile)
+
+		_, err = store.AddKeyFileKey(keyFile)
+		require.NoError(t, err)
+
+		interrupted := &failingScan{FakeDynamoDB: fake, remaining: 2}
+		dataStore := store.NewUserStore(interrupted, tableName, store.WithEncryption(newProvider(t, keyFile)))
+
+		interruptedAt, err := store.NewKeyRotator(dataStore, store.WithRotationBatchSize(3)).Rotate(context.Background())
+		require.Error(t, err)
+		assert.NotZero(t, interruptedAt.Scanned)
+		assert.False(t, interruptedAt.Done)
+
+		dataStore = store.NewUserStore(fake, tableName, store.WithEncryption(newProvider(t, keyFile)))
+
+		var first *store.RotationProgress
+
+		progress, err := store.NewKeyRotator(
+			dataStore,
+			store.WithRotationBatchSize(3),
+			store.WithRotationProgress(func(p store.RotationProgress) {
+				if first == nil {
+					first = &p
+				}
+			}),
+		).Rotate(context.Background())
+		require.NoError(t, err)
+
+		// continued from the items already scanned rather than starting over
+		require.NotNil(t, first)
+		assert.Greater(t, first.Scanned, interruptedAt.Scanned)
+		assert.Equal(t, items, progress.Scanned)
+		assert.Equal(t, 6, progress.Rewrapped)
+		assert.Equal(t, 2, progress.Reencrypted)
+		assert.True(t, progress.Done)
+		assert.Equal(t, map[string]int{"2": items}, keyIds(t, fake))
+	})
+
+	t.Run("concurrent-login", func(t *testing.T) {
+		fake := dynamotest.New()
+		keyFile := filepath.Join(t.TempDir(), "keys.json")
+
+		_, err := store.AddKeyFileKey(keyFile)
+		require.NoError(t, err)
+
+		items := populate(t, fake, keyFile)
+
+		_, err = store.AddKeyFileKey(keyFile)
+		require.NoError(t, err)
+
+		loginStore := store.NewUserStore(fake, tableName, store.WithEncryption(newProvider(t, keyFile)))
+		login := entity.Login{Time: time.Now().UTC().Truncate(time.Second), SourceIp: "192.0.2.1"}
+
+		// logins land between the users being read and rotated
+		interleaved := &afterScan{FakeDynamoDB: fake, fn: func() {
+			for idx := 0; idx < 4; idx++ {
+				err := loginStore.RecordLogin(context.Background(), entity.DefaultTenant, fmt.Sprintf("user%d", idx), login)
+				require.NoError(t, err)
+			}
+		}}
+		dataStore := store.NewUserStore(interleaved, tableName, store.WithEncryption(newProvider(t, keyFile)))
+
+		progress, err := store.NewKeyRotator(dataStore).Rotate(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, items, progress.Rewrapped+progress.Reencrypted)
+		assert.Equal(t, map[string]int{"2": items}, keyIds(t, fake))
+
+		for idx := 0; idx < 4; idx++ {
+			user, err := dataStore.GetById(context.Background(), entity.DefaultTenant, fmt.Sprintf("user%d", idx))
+			require.NoError(t, err)
+			assert.Equal(t, int64(1), user.LoginCount, "the login of %s should be kept", user.Id)
+			assert.True(t, login.Time.Equal(user.LastLogin))
+			assert.Equal(t, login.SourceIp, user.LastLoginIp)
+		}
+	})
+
+	t.Run("not-encrypted", func(t *testing.T) {
+		_, dataStore := setupFakeUserStore(t)
+
+		_, err := store.NewKeyRotator(dataStore).Rotate(context.Background())
+		assert.Error(t, err)
+	})
+}
+
+func TestAddKeyFileKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+
+	id, err := store.AddKeyFileKey(path)
+	require.NoError(t, err)
+	assert.Equal(t, "1", id)
+
+	first, err := store.NewKeyFileProvider(path)
+	require.NoError(t, err)
+
+	id, err = store.AddKeyFileKey(path)
+	require.NoError(t, err)
+	assert.Equal(t, "2", id)
+
+	second, err := store.NewKeyFileProvider(path)
+	require.NoError(t, err)
+
+	assert.Equal(t, "2", second.CurrentKeyId())
+	assert.Equal(t, first.IndexKey(), second.IndexKey(), "the index key must not change")
+
+	// keys wrapped by the first key can still be unwrapped
+	wrapped, keyId, err := first.WrapKey(context.Background(), make([]byte, 32))
+	require.NoError(t, err)
+
+	_, err = second.UnwrapKey(context.Background(), wrapped, keyId)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,208 @@
+package store
+
+import (
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"github.com/electrofelix/gin-demo/entity"
+)
+
+// the filters of List are served by an index of each of the attributes
+// filtered on, partitioned the same as the objectType index so that only
+// the users of the tenant are read. The attributes hold the SearchForm of
+// the email and name, and the last login in a form that sorts
+// chronologically, they are left out wherever the field they are derived
+// from is encrypted.
+const (
+	searchEmailAttribute   = "SearchEmail"
+	searchNameAttribute    = "SearchName"
+	lastLoginSortAttribute = "LastLoginSort"
+
+	searchEmailIndex   = "searchEmail-index"
+	searchNameIndex    = "searchName-index"
+	lastLoginSortIndex = "lastLogin-index"
+
+	// lastLoginSortFormat is fixed width, unlike the RFC 3339 form of
+	// LastLogin which drops trailing zeros of the fraction
+	lastLoginSortFormat = "2006-01-02T15:04:05.000000000Z"
+)
+
+func lastLoginSortKey(t time.Time) string {
+	return t.UTC().Format(lastLoginSortFormat)
+}
+
+// addSearchAttributes sets the attributes the search indexes are keyed on
+// from the fields of the unencrypted item, other than any that encrypted
+// reports are to be encrypted or already are.
+func addSearchAttributes(item map[string]types.AttributeValue, encrypted func(field string) bool) {
+	for field, attribute := range map[string]string{
+		"Email": searchEmailAttribute,
+		"Name":  searchNameAttribute,
+	} {
+		value, ok := item[field].(*types.AttributeValueMemberS)
+		if !ok || encrypted(field) {
+			continue
+		}
+
+		// index keys cannot be empty strings
+		if form := entity.SearchForm(value.Value); form != "" {
+			item[attribute] = &types.AttributeValueMemberS{Value: form}
+		}
+	}
+
+	value, ok := item["LastLogin"].(*types.AttributeValueMemberS)
+	if !ok || encrypted("LastLogin") {
+		return
+	}
+
+	lastLogin, err := time.Parse(time.RFC3339Nano, value.Value)
+	if err != nil || lastLogin.IsZero() {
+		return
+	}
+
+	item[lastLoginSortAttribute] = &types.AttributeValueMemberS{Value: lastLoginSortKey(lastLogin)}
+}
+
+// itemEncryptedFields reports whether a field of the stored item is
+// encrypted.
+func itemEncryptedFields(item map[string]types.AttributeValue) func(string) bool {
+	fields, _ := item[encryptedFieldsAttribute].(*types.AttributeValueMemberSS)
+
+	return func(field string) bool {
+		if fields == nil {
+			return false
+		}
+
+		for _, f := range fields.Value {
+			if f == field {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// encrypts reports whether the field is encrypted when users are written.
+func (us *UserStore) encrypts(field string) bool {
+	return us.encryption != nil && us.encryption.encrypts(field)
+}
+
+// listQuery returns the query of the users matching the options, reading
+// the index of one of the filtered fields where possible and applying any
+// other filters to the items read. It also returns the attributes that a
+// cursor for the query must have. The query is nil when no user can match.
+func (us *UserStore) listQuery(tenant string, opts entity.ListOptions) (*dynamodb.QueryInput, []string, error) {
+	if (opts.EmailPrefix != "" && us.encrypts("Email")) || (opts.NamePrefix != "" && us.encrypts("Name")) ||
+		(opts.LastLoginFiltered() && us.encrypts("LastLogin")) {
+		return nil, nil, entity.ErrFilterUnsupported
+	}
+
+	query := dynamodb.QueryInput{
+		TableName: aws.String(us.tableName),
+		IndexName: aws.String(objectTypeIndex),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":type": &types.AttributeValueMemberS{Value: userType(tenant)},
+		},
+	}
+	keyConditions := []string{"objectType = :type"}
+	filters := []string{"attribute_not_exists(DeletedAt)"}
+	cursorAttributes := []string{"Id", "objectType"}
+
+	if opts.Deleted {
+		filters[0] = "attribute_exists(DeletedAt)"
+	}
+
+	// the first of the filters given selects the index read
+	keyed := false
+
+	for _, prefix := range []struct {
+		index, attribute, placeholder, value string
+	}{
+		{searchEmailIndex, searchEmailAttribute, ":emailPrefix", opts.EmailPrefix},
+		{searchNameIndex, searchNameAttribute, ":namePrefix", opts.NamePrefix},
+	} {
+		if prefix.value == "" {
+			continue
+		}
+
+		query.ExpressionAttributeValues[prefix.placeholder] = &types.AttributeValueMemberS{Value: prefix.value}
+		condition := "begins_with(" + prefix.attribute + ", " + prefix.placeholder + ")"
+
+		if keyed {
+			filters = append(filters, condition)
+
+			continue
+		}
+
+		keyed = true
+		query.IndexName = aws.String(prefix.index)
+		keyConditions = append(keyConditions, condition)
+		cursorAttributes = append(cursorAttributes, prefix.attribute)
+	}
+
+	if opts.LastLoginFiltered() {
+		if keyed {
+			filters = append(filters, lastLoginFilter(opts, query.ExpressionAttributeValues))
+		} else {
+			condition, ok := lastLoginKeyCondition(opts, query.ExpressionAttributeValues)
+			if !ok {
+				return nil, nil, nil
+			}
+
+			query.IndexName = aws.String(lastLoginSortIndex)
+			keyConditions = append(keyConditions, condition)
+			cursorAttributes = append(cursorAttributes, lastLoginSortAttribute)
+		}
+	}
+
+	query.KeyConditionExpression = aws.String(strings.Join(keyConditions, " AND "))
+	// the limit is applied before filtering, so pages of deleted or
+	// active users may be shorter than requested
+	query.FilterExpression = aws.String(strings.Join(filters, " AND "))
+
+	return &query, cursorAttributes, nil
+}
+
+// lastLoginFilter returns the filter of the range of last login, users that
+// have never logged in have no LastLoginSort and so never match.
+func lastLoginFilter(opts entity.ListOptions, values map[string]types.AttributeValue) string {
+	var conditions []string
+
+	if !opts.LastLoginAfter.IsZero() {
+		values[":lastLoginAfter"] = &types.AttributeValueMemberS{Value: lastLoginSortKey(opts.LastLoginAfter)}
+		conditions = append(conditions, lastLoginSortAttribute+" > :lastLoginAfter")
+	}
+
+	if !opts.LastLoginBefore.IsZero() {
+		values[":lastLoginBefore"] = &types.AttributeValueMemberS{Value: lastLoginSortKey(opts.LastLoginBefore)}
+		conditions = append(conditions, lastLoginSortAttribute+" < :lastLoginBefore")
+	}
+
+	return strings.Join(conditions, " AND ")
+}
+
+// lastLoginKeyCondition returns the condition on the range key of the last
+// login index, which allows only a single comparison. A closed range is
+// converted to the inclusive BETWEEN, ok is false if it is then empty.
+func lastLoginKeyCondition(opts entity.ListOptions, values map[string]types.AttributeValue) (string, bool) {
+	if opts.LastLoginAfter.IsZero() || opts.LastLoginBefore.IsZero() {
+		return lastLoginFilter(opts, values), true
+	}
+
+	from := opts.LastLoginAfter.Add(time.Nanosecond)
+	to := opts.LastLoginBefore.Add(-time.Nanosecond)
+
+	if to.Before(from) {
+		return "", false
+	}
+
+	values[":lastLoginFrom"] = &types.AttributeValueMemberS{Value: lastLoginSortKey(from)}
+	values[":lastLoginTo"] = &types.AttributeValueMemberS{Value: lastLoginSortKey(to)}
+
+	return lastLoginSortAttribute + " BETWEEN :lastLoginFrom AND :lastLoginTo", true
+}
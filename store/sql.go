@@ -0,0 +1,1053 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	// without cgo the driver is registered, but fails to open databases
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/sirupsen/logrus"
+
+	"github.com/electrofelix/gin-demo/entity"
+)
+
+const (
+	SQLDriverPostgres = "postgres"
+	SQLDriverSQLite   = "sqlite3"
+
+	sqlUserTable  = "users"
+	sqlEmailIndex = "users_tenant_canonical_email_key"
+	sqlAuditTable = "user_audit"
+
+	// columns are always selected in the same order so that rows can be
+	// scanned by a single helper
+	// the password, lockout and MFA columns are left out, so that they are
+	// only ever read by GetCredentials
+	sqlUserColumns = "id, email, name, last_login, login_count, last_login_ip, version, deleted_at, tenant_id"
+)
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// SQLUserStore persists users to a relational database, email uniqueness
+// within a tenant is enforced by a unique index instead of the separate email
+// items needed for DynamoDB. Both PostgreSQL and SQLite are supported, the latter mainly for
+// running tests without external services.
+type SQLUserStore struct {
+	db     *sql.DB
+	logger *logrus.Logger
+}
+
+type SQLOption func(*SQLUserStore)
+
+func NewSQLUserStore(db *sql.DB, driver string, options ...SQLOption) (*SQLUserStore, error) {
+	if driver != SQLDriverPostgres && driver != SQLDriverSQLite {
+		return nil, fmt.Errorf("unsupported sql driver '%s'", driver)
+	}
+
+	ss := &SQLUserStore{
+		db:     db,
+		logger: logrus.StandardLogger(),
+	}
+
+	for _, opt := range options {
+		opt(ss)
+	}
+
+	return ss, nil
+}
+
+func WithSQLLogger(l *logrus.Logger) SQLOption {
+	return func(ss *SQLUserStore) {
+		ss.logger = l
+	}
+}
+
+// InitializeSchema creates the users table and the unique email index if
+// they do not already exist, the equivalent of running the Migrator for the
+// DynamoDB store. Rows from before tenants were introduced belong to the
+// entity.DefaultTenant.
+func (ss *SQLUserStore) InitializeSchema(ctx context.Context) error {
+	ss.logger.Infoln("Schema initializing")
+
+	// canonical_email is only nullable to allow adding it to existing tables
+	_, err := ss.db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			id TEXT PRIMARY KEY,
+			email TEXT NOT NULL,
+			name TEXT NOT NULL,
+			password TEXT NOT NULL,
+			last_login TIMESTAMP NULL,
+			login_count BIGINT NOT NULL DEFAULT 0,
+			last_login_ip TEXT NULL,
+			version BIGINT NOT NULL DEFAULT 0,
+			deleted_at TIMESTAMP NULL,
+			canonical_email TEXT NULL,
+			tenant_id TEXT NOT NULL DEFAULT '%s',
+			search_email TEXT NULL,
+			search_name TEXT NULL,
+			last_login_at BIGINT NULL,
+			failed_logins BIGINT NOT NULL DEFAULT 0,
+			locked_until TIMESTAMP NULL,
+			mfa_secret TEXT NULL,
+			credentials_version BIGINT NOT NULL DEFAULT 0
+		)`, sqlUserTable, entity.DefaultTenant))
+	if err != nil {
+		ss.logger.Errorf("error initializing schema: %v", err)
+
+		return err
+	}
+
+	if err := ss.backfillCanonicalEmail(ctx); err != nil {
+		ss.logger.Errorf("error adding canonical emails: %v", err)
+
+		return err
+	}
+
+	// before the unique index of emails within each tenant is created
+	if err := ss.addTenantColumn(ctx, sqlUserTable); err != nil {
+		ss.logger.Errorf("error adding tenants: %v", err)
+
+		return err
+	}
+
+	for _, column := range []struct{ name, definition string }{
+		{"login_count", "BIGINT NOT NULL DEFAULT 0"},
+		{"last_login_ip", "TEXT NULL"},
+		{"search_email", "TEXT NULL"},
+		{"search_name", "TEXT NULL"},
+		{"last_login_at", "BIGINT NULL"},
+		{"failed_logins", "BIGINT NOT NULL DEFAULT 0"},
+		{"locked_until", "TIMESTAMP NULL"},
+		{"mfa_secret", "TEXT NULL"},
+		{"credentials_version", "BIGINT NOT NULL DEFAULT 0"},
+	} {
+		if err := ss.addColumn(ctx, sqlUserTable, column.name, column.definition); err != nil {
+			ss.logger.Errorf("error adding %s: %v", column.name, err)
+
+			return err
+		}
+	}
+
+	if err := ss.backfillSearchColumns(ctx); err != nil {
+		ss.logger.Errorf("error adding search columns: %v", err)
+
+		return err
+	}
+
+	statements := []string{
+		fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %s ON %s (tenant_id, canonical_email)", sqlEmailIndex, sqlUserTable),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS users_tenant_last_login_at ON %s (tenant_id, last_login_at)", sqlUserTable),
+		// replaced by the index of canonical emails within each tenant
+		"DROP INDEX IF EXISTS users_email_key",
+		"DROP INDEX IF EXISTS users_canonical_email_key",
+		// recorded_at holds nanoseconds since the epoch, as sqlite stores
+		// timestamps as text that does not sort chronologically
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			user_id TEXT NOT NULL,
+			recorded_at BIGINT NOT NULL,
+			actor TEXT NOT NULL,
+			action TEXT NOT NULL,
+			changes TEXT NOT NULL,
+			tenant_id TEXT NOT NULL DEFAULT '%s',
+			PRIMARY KEY (user_id, recorded_at)
+		)`, sqlAuditTable, entity.DefaultTenant),
+	}
+
+	for _, statement := range statements {
+		if _, err := ss.db.ExecContext(ctx, statement); err != nil {
+			ss.logger.Errorf("error initializing schema: %v", err)
+
+			return err
+		}
+	}
+
+	if err := ss.addTenantColumn(ctx, sqlAuditTable); err != nil {
+		ss.logger.Errorf("error adding tenants: %v", err)
+
+		return err
+	}
+
+	ss.logger.Infof("table '%s' ready", sqlUserTable)
+
+	return nil
+}
+
+// addTenantColumn adds the tenant_id column to tables created before it
+// existed, assigning the existing rows to the default tenant.
+func (ss *SQLUserStore) addTenantColumn(ctx context.Context, table string) error {
+	return ss.addColumn(ctx, table, "tenant_id", fmt.Sprintf("TEXT NOT NULL DEFAULT '%s'", entity.DefaultTenant))
+}
+
+// addColumn adds the column to tables created before it existed.
+func (ss *SQLUserStore) addColumn(ctx context.Context, table, column, definition string) error {
+	if _, err := ss.db.ExecContext(ctx, fmt.Sprintf("SELECT %s FROM %s WHERE 1 = 0", column, table)); err == nil {
+		return nil
+	}
+
+	_, err := ss.db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+
+	return err
+}
+
+// backfillCanonicalEmail adds the canonical_email column to tables created
+// before it existed and populates it, as the canonical form cannot be
+// computed in SQL.
+func (ss *SQLUserStore) backfillCanonicalEmail(ctx context.Context) error {
+	if _, err := ss.db.ExecContext(ctx, fmt.Sprintf("SELECT canonical_email FROM %s WHERE 1 = 0", sqlUserTable)); err != nil {
+		_, err = ss.db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN canonical_email TEXT NULL", sqlUserTable))
+		if err != nil {
+			return err
+		}
+	}
+
+	rows, err := ss.db.QueryContext(
+		ctx, fmt.Sprintf("SELECT id, email FROM %s WHERE canonical_email IS NULL", sqlUserTable),
+	)
+	if err != nil {
+		return err
+	}
+
+	emails := map[string]string{}
+
+	for rows.Next() {
+		var id, email string
+		if err := rows.Scan(&id, &email); err != nil {
+			rows.Close()
+
+			return err
+		}
+
+		emails[id] = email
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, email := range emails {
+		_, err := ss.db.ExecContext(
+			ctx, fmt.Sprintf("UPDATE %s SET canonical_email = $1 WHERE id = $2", sqlUserTable),
+			entity.CanonicalEmail(email), id,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(emails) > 0 {
+		ss.logger.Infof("added canonical emails for %d users", len(emails))
+	}
+
+	return nil
+}
+
+// backfillSearchColumns populates the columns matched by the filters of
+// List for users written before they existed, as the SearchForm cannot be
+// computed in SQL and sqlite stores timestamps as text that does not sort
+// chronologically.
+func (ss *SQLUserStore) backfillSearchColumns(ctx context.Context) error {
+	rows, err := ss.db.QueryContext(
+		ctx, fmt.Sprintf("SELECT id, email, name, last_login FROM %s WHERE search_name IS NULL", sqlUserTable),
+	)
+	if err != nil {
+		return err
+	}
+
+	var users []entity.User
+
+	for rows.Next() {
+		var (
+			user      entity.User
+			lastLogin sql.NullTime
+		)
+
+		if err := rows.Scan(&user.Id, &user.Email, &user.Name, &lastLogin); err != nil {
+			rows.Close()
+
+			return err
+		}
+
+		user.LastLogin = lastLogin.Time
+		users = append(users, user)
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		_, err := ss.db.ExecContext(
+			ctx,
+			fmt.Sprintf(
+				"UPDATE %s SET search_email = $1, search_name = $2, last_login_at = $3 WHERE id = $4", sqlUserTable,
+			),
+			entity.SearchForm(user.Email), entity.SearchForm(user.Name), nullUnixNano(user.LastLogin), user.Id,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(users) > 0 {
+		ss.logger.Infof("added search columns for %d users", len(users))
+	}
+
+	return nil
+}
+
+func (ss *SQLUserStore) Create(ctx context.Context, user *entity.User, audit ...entity.AuditEntry) error {
+	if user.Id == "" {
+		return entity.ErrIDMissing
+	}
+
+	tx, err := ss.db.BeginTx(ctx, nil)
+	if err != nil {
+		ss.logger.Errorf("error starting transaction for %s: %v", user.Id, err)
+
+		return err
+	}
+	// rollback is a no-op once the transaction has been committed
+	defer func() { _ = tx.Rollback() }()
+
+	tenant := entity.TenantOrDefault(user.TenantId)
+
+	_, err = tx.ExecContext(
+		ctx,
+		fmt.Sprintf(
+			"INSERT INTO %s (%s, password, canonical_email, search_email, search_name, last_login_at, "+
+				"credentials_version) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, 1)",
+			sqlUserTable, sqlUserColumns,
+		),
+		user.Id, user.Email, user.Name, nullTime(user.LastLogin), user.LoginCount, nullString(user.LastLoginIp), 1,
+		nullTimePtr(user.DeletedAt), tenant, user.Password, entity.CanonicalEmail(user.Email),
+		entity.SearchForm(user.Email), entity.SearchForm(user.Name), nullUnixNano(user.LastLogin),
+	)
+	if err != nil {
+		if ss.isEmailConflict(err) {
+			return entity.ErrEmailDuplicate
+		}
+
+		ss.logger.Errorf("error inserting user %s for %s: %v", user.Id, user.Email, err)
+
+		return err
+	}
+
+	if err := ss.insertAudit(ctx, tx, tenant, audit); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	user.TenantId = tenant
+	user.Version = 1
+
+	return nil
+}
+
+// CreateBatch creates each of the users in turn, returning the error for
+// each user in the same order.
+func (ss *SQLUserStore) CreateBatch(ctx context.Context, users []*entity.User, audit []entity.AuditEntry) []error {
+	errs := make([]error, len(users))
+
+	for idx, user := range users {
+		var entries []entity.AuditEntry
+		if len(audit) > 0 {
+			entries = audit[idx : idx+1]
+		}
+
+		errs[idx] = ss.Create(ctx, user, entries...)
+	}
+
+	return errs
+}
+
+func (ss *SQLUserStore) GetByEmail(ctx context.Context, tenant, email string) (*entity.User, error) {
+	if email == "" {
+		return nil, entity.ErrIDMissing
+	}
+
+	row := ss.db.QueryRowContext(
+		ctx,
+		fmt.Sprintf("SELECT %s FROM %s WHERE tenant_id = $1 AND canonical_email = $2", sqlUserColumns, sqlUserTable),
+		entity.TenantOrDefault(tenant), entity.CanonicalEmail(email),
+	)
+
+	return ss.scanUser(row)
+}
+
+func (ss *SQLUserStore) GetById(ctx context.Context, tenant, id string) (*entity.User, error) {
+	if id == "" {
+		return nil, entity.ErrIDMissing
+	}
+
+	return ss.getById(ctx, ss.db, tenant, id)
+}
+
+// GetMany returns the users with the given ids in the order requested,
+// skipping any that do not exist, reading up to 100 users per query.
+func (ss *SQLUserStore) GetMany(ctx context.Context, tenant string, ids []string) ([]entity.User, error) {
+	ids, err := uniqueIds(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]entity.User, len(ids))
+
+	for start := 0; start < len(ids); start += maxBatchGetKeys {
+		end := start + maxBatchGetKeys
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		placeholders := make([]string, 0, end-start)
+		args := []interface{}{entity.TenantOrDefault(tenant)}
+
+		for _, id := range ids[start:end] {
+			args = append(args, id)
+			placeholders = append(placeholders, fmt.Sprintf("$%d", len(args)))
+		}
+
+		err := ss.queryUsers(ctx, found, fmt.Sprintf(
+			"SELECT %s FROM %s WHERE tenant_id = $1 AND id IN (%s)",
+			sqlUserColumns, sqlUserTable, strings.Join(placeholders, ", "),
+		), args...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	users := make([]entity.User, 0, len(found))
+	for _, id := range ids {
+		if user, ok := found[id]; ok {
+			users = append(users, user)
+		}
+	}
+
+	return users, nil
+}
+
+// queryUsers adds the users returned by the query to found by Id.
+func (ss *SQLUserStore) queryUsers(ctx context.Context, found map[string]entity.User, query string, args ...interface{}) error {
+	rows, err := ss.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		ss.logger.Errorf("error during batch get: %v", err)
+
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		user, err := ss.scanUser(rows)
+		if err != nil {
+			return err
+		}
+
+		found[user.Id] = *user
+	}
+
+	if err := rows.Err(); err != nil {
+		ss.logger.Errorf("error during batch get: %v", err)
+
+		return err
+	}
+
+	return nil
+}
+
+// queryRower is satisfied by both *sql.DB and *sql.Tx
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func (ss *SQLUserStore) getById(ctx context.Context, db queryRower, tenant, id string) (*entity.User, error) {
+	row := db.QueryRowContext(
+		ctx, fmt.Sprintf("SELECT %s FROM %s WHERE id = $1 AND tenant_id = $2", sqlUserColumns, sqlUserTable),
+		id, entity.TenantOrDefault(tenant),
+	)
+
+	return ss.scanUser(row)
+}
+
+// List returns users of the tenant ordered by id, using keyset pagination on
+// the id so that the cursor format is shared with the other stores.
+func (ss *SQLUserStore) List(ctx context.Context, tenant string, opts entity.ListOptions) (entity.UserPage, error) {
+	lastKey, err := decodeCursor(opts.Cursor)
+	if err != nil {
+		return entity.UserPage{}, err
+	}
+
+	deletedFilter := "deleted_at IS NULL"
+	if opts.Deleted {
+		deletedFilter = "deleted_at IS NOT NULL"
+	}
+
+	filters, args := sqlListFilters(opts, entity.TenantOrDefault(tenant), lastKey["Id"])
+
+	query := fmt.Sprintf(
+		"SELECT %s FROM %s WHERE tenant_id = $1 AND id > $2 AND %s%s ORDER BY id",
+		sqlUserColumns, sqlUserTable, deletedFilter, filters,
+	)
+
+	if opts.Limit > 0 {
+		// fetch one more than requested to determine if there is a next page
+		query += fmt.Sprintf(" LIMIT $%d", len(args)+1)
+		args = append(args, opts.Limit+1)
+	}
+
+	rows, err := ss.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		ss.logger.Errorf("error during list: %v", err)
+
+		return entity.UserPage{}, err
+	}
+	defer rows.Close()
+
+	page := entity.UserPage{Users: []entity.User{}}
+
+	for rows.Next() {
+		user, err := ss.scanUser(rows)
+		if err != nil {
+			return entity.UserPage{}, err
+		}
+
+		page.Users = append(page.Users, *user)
+	}
+
+	if err := rows.Err(); err != nil {
+		ss.logger.Errorf("error during list: %v", err)
+
+		return entity.UserPage{}, err
+	}
+
+	if opts.Limit > 0 && len(page.Users) > int(opts.Limit) {
+		page.Users = page.Users[:opts.Limit]
+
+		page.NextCursor, err = encodeCursor(map[string]string{"Id": page.Users[opts.Limit-1].Id})
+		if err != nil {
+			return entity.UserPage{}, err
+		}
+	}
+
+	return page, nil
+}
+
+// sqlListFilters returns the conditions selecting the users matched by the
+// filters of the options, along with the arguments of the query including
+// those given.
+func sqlListFilters(opts entity.ListOptions, args ...interface{}) (string, []interface{}) {
+	var filters strings.Builder
+
+	// prefixes are matched with LIKE, so its wildcards must be escaped
+	escaper := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+	for _, prefix := range []struct{ column, value string }{
+		{"search_email", opts.EmailPrefix},
+		{"search_name", opts.NamePrefix},
+	} {
+		if prefix.value != "" {
+			args = append(args, escaper.Replace(prefix.value)+"%")
+			fmt.Fprintf(&filters, ` AND %s LIKE $%d ESCAPE '\'`, prefix.column, len(args))
+		}
+	}
+
+	if opts.LastLoginFiltered() {
+		filters.WriteString(" AND last_login_at IS NOT NULL")
+	}
+
+	if !opts.LastLoginAfter.IsZero() {
+		args = append(args, opts.LastLoginAfter.UnixNano())
+		fmt.Fprintf(&filters, " AND last_login_at > $%d", len(args))
+	}
+
+	if !opts.LastLoginBefore.IsZero() {
+		args = append(args, opts.LastLoginBefore.UnixNano())
+		fmt.Fprintf(&filters, " AND last_login_at < $%d", len(args))
+	}
+
+	return filters.String(), args
+}
+
+// Purge removes the user provided it has not been modified since it was
+// read, the unique index entry for the email is removed along with the row.
+func (ss *SQLUserStore) Purge(ctx context.Context, user *entity.User) error {
+	if user.Id == "" {
+		return entity.ErrIDMissing
+	}
+
+	tenant := entity.TenantOrDefault(user.TenantId)
+
+	result, err := ss.db.ExecContext(
+		ctx, fmt.Sprintf("DELETE FROM %s WHERE id = $1 AND tenant_id = $2 AND version = $3", sqlUserTable),
+		user.Id, tenant, user.Version,
+	)
+	if err != nil {
+		ss.logger.Errorf("error during purge of %s: %v", user.Id, err)
+
+		return err
+	}
+
+	if err := checkRowsAffected(result); err != nil {
+		if errors.Is(err, entity.ErrNotFound) {
+			// distinguish between already removed and modified since read
+			if _, err := ss.GetById(ctx, tenant, user.Id); err != nil {
+				return err
+			}
+
+			return entity.ErrConflict
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// ListAudit returns the audit entries recorded for the user, newest first.
+func (ss *SQLUserStore) ListAudit(ctx context.Context, tenant, id string, opts entity.ListOptions) (entity.AuditPage, error) {
+	if id == "" {
+		return entity.AuditPage{}, entity.ErrIDMissing
+	}
+
+	before, err := decodeAuditCursor(opts.Cursor, tenant, id)
+	if err != nil {
+		return entity.AuditPage{}, err
+	}
+
+	query := fmt.Sprintf(
+		"SELECT recorded_at, actor, action, changes FROM %s WHERE user_id = $1 AND tenant_id = $2", sqlAuditTable,
+	)
+	args := []interface{}{id, entity.TenantOrDefault(tenant)}
+
+	if !before.IsZero() {
+		query += " AND recorded_at < $3"
+		args = append(args, before.UnixNano())
+	}
+
+	query += " ORDER BY recorded_at DESC"
+
+	if opts.Limit > 0 {
+		// fetch one more than requested to determine if there is a next page
+		query += fmt.Sprintf(" LIMIT $%d", len(args)+1)
+		args = append(args, opts.Limit+1)
+	}
+
+	rows, err := ss.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		ss.logger.Errorf("error during audit list for %s: %v", id, err)
+
+		return entity.AuditPage{}, err
+	}
+	defer rows.Close()
+
+	page := entity.AuditPage{Entries: []entity.AuditEntry{}}
+
+	for rows.Next() {
+		var (
+			recordedAt int64
+			changes    string
+		)
+
+		entry := entity.AuditEntry{UserId: id}
+
+		if err := rows.Scan(&recordedAt, &entry.Actor, &entry.Action, &changes); err != nil {
+			ss.logger.Errorf("error reading audit entry for %s: %v", id, err)
+
+			return entity.AuditPage{}, err
+		}
+
+		entry.Timestamp = time.Unix(0, recordedAt).UTC()
+
+		if err := json.Unmarshal([]byte(changes), &entry.Changes); err != nil {
+			ss.logger.Errorf("error decoding audit changes for %s: %v", id, err)
+
+			return entity.AuditPage{}, err
+		}
+
+		page.Entries = append(page.Entries, entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		ss.logger.Errorf("error during audit list for %s: %v", id, err)
+
+		return entity.AuditPage{}, err
+	}
+
+	if opts.Limit > 0 && len(page.Entries) > int(opts.Limit) {
+		page.Entries = page.Entries[:opts.Limit]
+
+		page.NextCursor, err = encodeAuditCursor(tenant, page.Entries[opts.Limit-1])
+		if err != nil {
+			return entity.AuditPage{}, err
+		}
+	}
+
+	return page, nil
+}
+
+// GetCredentials returns the credentials of the user, which are kept in the
+// password, lockout and MFA columns of the user row.
+func (ss *SQLUserStore) GetCredentials(ctx context.Context, tenant, id string) (*entity.Credentials, error) {
+	if id == "" {
+		return nil, entity.ErrIDMissing
+	}
+
+	var (
+		credentials entity.Credentials
+		lockedUntil sql.NullTime
+		mfaSecret   sql.NullString
+	)
+
+	err := ss.db.QueryRowContext(
+		ctx,
+		fmt.Sprintf(
+			"SELECT password, failed_logins, locked_until, mfa_secret, credentials_version FROM %s "+
+				"WHERE id = $1 AND tenant_id = $2",
+			sqlUserTable,
+		),
+		id, entity.TenantOrDefault(tenant),
+	).Scan(&credentials.Password, &credentials.FailedLogins, &lockedUntil, &mfaSecret, &credentials.Version)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, entity.ErrNotFound
+		}
+
+		ss.logger.Errorf("error reading credentials of %s: %v", id, err)
+
+		return nil, err
+	}
+
+	if lockedUntil.Valid {
+		credentials.LockedUntil = &lockedUntil.Time
+	}
+
+	credentials.MfaSecret = mfaSecret.String
+
+	return &credentials, nil
+}
+
+// PutCredentials replaces the credentials of the user, leaving the version
+// of the user unchanged. A non-zero version must match that of the user and
+// the stored credentials must still be at credentials.Version.
+func (ss *SQLUserStore) PutCredentials(
+	ctx context.Context, tenant, id string, version int64, credentials *entity.Credentials,
+	audit ...entity.AuditEntry,
+) error {
+	if id == "" {
+		return entity.ErrIDMissing
+	}
+
+	tx, err := ss.db.BeginTx(ctx, nil)
+	if err != nil {
+		ss.logger.Errorf("error starting transaction for %s: %v", id, err)
+
+		return err
+	}
+	// rollback is a no-op once the transaction has been committed
+	defer func() { _ = tx.Rollback() }()
+
+	tenant = entity.TenantOrDefault(tenant)
+
+	result, err := tx.ExecContext(
+		ctx,
+		fmt.Sprintf(
+			"UPDATE %s SET password = $1, failed_logins = $2, locked_until = $3, mfa_secret = $4, "+
+				"credentials_version = $5 "+
+				"WHERE id = $6 AND tenant_id = $7 AND (version = $8 OR $8 = 0) AND credentials_version = $9",
+			sqlUserTable,
+		),
+		credentials.Password, credentials.FailedLogins, nullTimePtr(credentials.LockedUntil),
+		nullString(credentials.MfaSecret), credentials.Version+1, id, tenant, version, credentials.Version,
+	)
+	if err != nil {
+		ss.logger.Errorf("error updating credentials of %s: %v", id, err)
+
+		return err
+	}
+
+	if err := checkRowsAffected(result); err != nil {
+		if errors.Is(err, entity.ErrNotFound) {
+			// distinguish between the row missing and a version mismatch
+			_, err = ss.getById(ctx, tx, tenant, id)
+			if err == nil {
+				return entity.ErrConflict
+			}
+		}
+
+		return err
+	}
+
+	if err := ss.insertAudit(ctx, tx, tenant, audit); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	credentials.Version++
+
+	return nil
+}
+
+// RecordLogin sets the last login time and source address of the user and
+// increments its login count in a single statement, leaving the version of
+// the user unchanged.
+func (ss *SQLUserStore) RecordLogin(
+	ctx context.Context, tenant, id string, login entity.Login, audit ...entity.AuditEntry,
+) error {
+	if id == "" {
+		return entity.ErrIDMissing
+	}
+
+	tx, err := ss.db.BeginTx(ctx, nil)
+	if err != nil {
+		ss.logger.Errorf("error starting transaction for %s: %v", id, err)
+
+		return err
+	}
+	// rollback is a no-op once the transaction has been committed
+	defer func() { _ = tx.Rollback() }()
+
+	tenant = entity.TenantOrDefault(tenant)
+
+	result, err := tx.ExecContext(
+		ctx,
+		fmt.Sprintf(
+			"UPDATE %s SET last_login = $1, last_login_ip = $2, login_count = login_count + 1, "+
+				"last_login_at = $3 WHERE id = $4 AND tenant_id = $5",
+			sqlUserTable,
+		),
+		nullTime(login.Time), nullString(login.SourceIp), nullUnixNano(login.Time), id, tenant,
+	)
+	if err != nil {
+		ss.logger.Errorf("error recording login of %s: %v", id, err)
+
+		return err
+	}
+
+	if err := checkRowsAffected(result); err != nil {
+		return err
+	}
+
+	if err := ss.insertAudit(ctx, tx, tenant, audit); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Update replaces the stored user within a transaction, any change of email
+// is checked against the unique index as part of the same statement. The row
+// is only updated while its version matches that of the user passed in, and
+// the stored password is kept unless the user has one set. The login columns
+// are left to RecordLogin, which changes them without a new version.
+func (ss *SQLUserStore) Update(ctx context.Context, user *entity.User, audit ...entity.AuditEntry) error {
+	if user.Id == "" {
+		return entity.ErrIDMissing
+	}
+
+	tx, err := ss.db.BeginTx(ctx, nil)
+	if err != nil {
+		ss.logger.Errorf("error starting transaction for %s: %v", user.Id, err)
+
+		return err
+	}
+	// rollback is a no-op once the transaction has been committed
+	defer func() { _ = tx.Rollback() }()
+
+	user.TenantId = entity.TenantOrDefault(user.TenantId)
+
+	result, err := tx.ExecContext(
+		ctx,
+		fmt.Sprintf(
+			"UPDATE %s SET email = $1, name = $2, password = COALESCE(NULLIF($3, ''), password), "+
+				"credentials_version = credentials_version + CASE WHEN $3 = '' THEN 0 ELSE 1 END, "+
+				"version = $4, deleted_at = $5, canonical_email = $6, search_email = $7, search_name = $8 "+
+				"WHERE id = $9 AND tenant_id = $10 AND version = $11",
+			sqlUserTable,
+		),
+		user.Email, user.Name, user.Password, user.Version+1, nullTimePtr(user.DeletedAt),
+		entity.CanonicalEmail(user.Email), entity.SearchForm(user.Email), entity.SearchForm(user.Name),
+		user.Id, user.TenantId, user.Version,
+	)
+	if err != nil {
+		if ss.isEmailConflict(err) {
+			return entity.ErrEmailDuplicate
+		}
+
+		ss.logger.Errorf("error updating user %s: %v", user.Id, err)
+
+		return err
+	}
+
+	if err := checkRowsAffected(result); err != nil {
+		if errors.Is(err, entity.ErrNotFound) {
+			// distinguish between the row missing and a version mismatch
+			_, err = ss.getById(ctx, tx, user.TenantId, user.Id)
+			if err == nil {
+				return entity.ErrConflict
+			}
+		}
+
+		return err
+	}
+
+	if err := ss.insertAudit(ctx, tx, user.TenantId, audit); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	user.Version++
+
+	return nil
+}
+
+func (ss *SQLUserStore) insertAudit(ctx context.Context, tx *sql.Tx, tenant string, audit []entity.AuditEntry) error {
+	for _, entry := range audit {
+		changes, err := json.Marshal(entry.Changes)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(
+			ctx,
+			fmt.Sprintf(
+				"INSERT INTO %s (user_id, recorded_at, actor, action, changes, tenant_id) VALUES ($1, $2, $3, $4, $5, $6)",
+				sqlAuditTable,
+			),
+			entry.UserId, entry.Timestamp.UnixNano(), entry.Actor, entry.Action, string(changes), tenant,
+		)
+		if err != nil {
+			if ss.isAuditConflict(err) {
+				// an entry of the same user and timestamp is never
+				// replaced, the same as by the DynamoDB store
+				return entity.ErrConflict
+			}
+
+			ss.logger.Errorf("error inserting audit entry for %s: %v", entry.UserId, err)
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ss *SQLUserStore) scanUser(row rowScanner) (*entity.User, error) {
+	var (
+		user        entity.User
+		lastLogin   sql.NullTime
+		lastLoginIp sql.NullString
+		deletedAt   sql.NullTime
+	)
+
+	err := row.Scan(
+		&user.Id, &user.Email, &user.Name, &lastLogin, &user.LoginCount, &lastLoginIp, &user.Version, &deletedAt,
+		&user.TenantId,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, entity.ErrNotFound
+		}
+
+		ss.logger.Errorf("error reading user: %v", err)
+
+		return nil, err
+	}
+
+	if lastLogin.Valid {
+		user.LastLogin = lastLogin.Time
+	}
+
+	user.LastLoginIp = lastLoginIp.String
+
+	if deletedAt.Valid {
+		user.DeletedAt = &deletedAt.Time
+	}
+
+	return &user, nil
+}
+
+// isEmailConflict reports whether the error is from a violation of the
+// unique email index rather than any other constraint.
+func (ss *SQLUserStore) isEmailConflict(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505" && pqErr.Constraint == sqlEmailIndex
+	}
+
+	return isSQLiteEmailConflict(err)
+}
+
+// isAuditConflict reports whether the error is from a violation of the
+// primary key of the audit entries.
+func (ss *SQLUserStore) isAuditConflict(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505" && pqErr.Constraint == sqlAuditTable+"_pkey"
+	}
+
+	return isSQLiteAuditConflict(err)
+}
+
+func checkRowsAffected(result sql.Result) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return entity.ErrNotFound
+	}
+
+	return nil
+}
+
+// nullTime stores the zero time as NULL, timestamps are always written as
+// UTC as postgres discards the offset for columns without a time zone.
+func nullTime(t time.Time) sql.NullTime {
+	if t.IsZero() {
+		return sql.NullTime{}
+	}
+
+	return sql.NullTime{Time: t.UTC(), Valid: true}
+}
+
+func nullTimePtr(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+
+	return nullTime(*t)
+}
+
+// nullUnixNano is the time in nanoseconds since the epoch, as compared by
+// the last login filters.
+func nullUnixNano(t time.Time) sql.NullInt64 {
+	if t.IsZero() {
+		return sql.NullInt64{}
+	}
+
+	return sql.NullInt64{Int64: t.UnixNano(), Valid: true}
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
@@ -0,0 +1,15 @@
+//go:build !cgo
+// +build !cgo
+
+package store
+
+// isSQLiteEmailConflict is always false without cgo, as SQLite databases
+// cannot be opened to return any errors.
+func isSQLiteEmailConflict(err error) bool {
+	return false
+}
+
+// isSQLiteAuditConflict is always false without cgo, for the same reason.
+func isSQLiteAuditConflict(err error) bool {
+	return false
+}
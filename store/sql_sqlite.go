@@ -0,0 +1,37 @@
+//go:build cgo
+// +build cgo
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// isSQLiteEmailConflict reports whether the error is from a violation of the
+// unique email index of a SQLite database, sqlite3 only defines its errors
+// when built with cgo.
+func isSQLiteEmailConflict(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique &&
+			strings.Contains(sqliteErr.Error(), fmt.Sprintf("%s.canonical_email", sqlUserTable))
+	}
+
+	return false
+}
+
+// isSQLiteAuditConflict reports whether the error is from a violation of the
+// primary key of the audit entries of a SQLite database.
+func isSQLiteAuditConflict(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey &&
+			strings.Contains(sqliteErr.Error(), fmt.Sprintf("%s.recorded_at", sqlAuditTable))
+	}
+
+	return false
+}
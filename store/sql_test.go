@@ -0,0 +1,108 @@
+//go:build cgo
+// +build cgo
+
+package store_test
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/electrofelix/gin-demo/entity"
+	"github.com/electrofelix/gin-demo/service"
+	"github.com/electrofelix/gin-demo/store"
+	"github.com/electrofelix/gin-demo/store/storetest"
+)
+
+func setupSQLiteStore(t *testing.T) *store.SQLUserStore {
+	t.Helper()
+
+	db, err := sql.Open(store.SQLDriverSQLite, filepath.Join(t.TempDir(), "users.db"))
+	require.NoError(t, err)
+
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	dataStore, err := store.NewSQLUserStore(db, store.SQLDriverSQLite)
+	require.NoError(t, err)
+
+	require.NoError(t, dataStore.InitializeSchema(context.Background()))
+
+	return dataStore
+}
+
+func TestNewSQLUserStore(t *testing.T) {
+	_, err := store.NewSQLUserStore(nil, "mysql")
+	assert.Error(t, err)
+}
+
+func TestSQLUserStore_InitializeSchema(t *testing.T) {
+	dataStore := setupSQLiteStore(t)
+
+	// must be safe to run on every startup
+	assert.NoError(t, dataStore.InitializeSchema(context.Background()))
+}
+
+func TestSQLUserStore_InitializeSchema_CanonicalEmail(t *testing.T) {
+	db, err := sql.Open(store.SQLDriverSQLite, filepath.Join(t.TempDir(), "users.db"))
+	require.NoError(t, err)
+
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	// the schema before emails were canonicalized
+	for _, statement := range []string{
+		`CREATE TABLE users (
+			id TEXT PRIMARY KEY,
+			email TEXT NOT NULL,
+			name TEXT NOT NULL,
+			password TEXT NOT NULL,
+			last_login TIMESTAMP NULL,
+			version BIGINT NOT NULL DEFAULT 0,
+			deleted_at TIMESTAMP NULL
+		)`,
+		"CREATE UNIQUE INDEX users_email_key ON users (email)",
+		"INSERT INTO users (id, email, name, password) VALUES ('c0000000000000000000', 'Legacy@Example.com', 'legacy', 'hash')",
+	} {
+		_, err := db.Exec(statement)
+		require.NoError(t, err)
+	}
+
+	dataStore, err := store.NewSQLUserStore(db, store.SQLDriverSQLite)
+	require.NoError(t, err)
+
+	require.NoError(t, dataStore.InitializeSchema(context.Background()))
+
+	got, err := dataStore.GetByEmail(context.Background(), entity.DefaultTenant, "legacy@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "Legacy@Example.com", got.Email)
+
+	duplicate := entity.User{Id: xid.New().String(), Email: "LEGACY@example.com"}
+	assert.ErrorIs(t, dataStore.Create(context.Background(), &duplicate), entity.ErrEmailDuplicate)
+}
+
+func TestSQLUserStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) service.UserStore {
+		return setupSQLiteStore(t)
+	})
+}
+
+func TestSQLUserStore_Create(t *testing.T) {
+	t.Run("duplicate-id", func(t *testing.T) {
+		dataStore := setupSQLiteStore(t)
+
+		user := entity.User{Id: xid.New().String(), Email: "user1@example.com"}
+		require.NoError(t, dataStore.Create(context.Background(), &user))
+
+		user.Email = "user2@example.com"
+
+		err := dataStore.Create(context.Background(), &user)
+		require.Error(t, err)
+		assert.NotErrorIs(t, err, entity.ErrEmailDuplicate)
+	})
+}
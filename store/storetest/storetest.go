@@ -0,0 +1,1479 @@
+// Package storetest provides a conformance suite that any implementation of
+// service.UserStore can be run against, to confirm it behaves the same as
+// the DynamoDB backed store.
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/electrofelix/gin-demo/entity"
+	"github.com/electrofelix/gin-demo/service"
+)
+
+// concurrency is the number of simultaneous writers used when checking that
+// uniqueness is preserved under contention.
+const concurrency = 10
+
+// Factory must return a new, empty store on each call so that tests are
+// isolated from each other.
+type Factory func(t *testing.T) service.UserStore
+
+// Run executes the full conformance suite as subtests of t.
+func Run(t *testing.T, factory Factory) {
+	t.Run("Create", func(t *testing.T) { testCreate(t, factory) })
+	t.Run("CreateBatch", func(t *testing.T) { testCreateBatch(t, factory) })
+	t.Run("Credentials", func(t *testing.T) { testCredentials(t, factory) })
+	t.Run("GetByEmail", func(t *testing.T) { testGetByEmail(t, factory) })
+	t.Run("GetById", func(t *testing.T) { testGetById(t, factory) })
+	t.Run("GetMany", func(t *testing.T) { testGetMany(t, factory) })
+	t.Run("List", func(t *testing.T) { testList(t, factory) })
+	t.Run("ListAudit", func(t *testing.T) { testListAudit(t, factory) })
+	t.Run("Purge", func(t *testing.T) { testPurge(t, factory) })
+	t.Run("RecordLogin", func(t *testing.T) { testRecordLogin(t, factory) })
+	t.Run("Tenants", func(t *testing.T) { testTenants(t, factory) })
+	t.Run("Update", func(t *testing.T) { testUpdate(t, factory) })
+}
+
+func newUser(email string) entity.User {
+	return entity.User{
+		Id:       xid.New().String(),
+		TenantId: entity.DefaultTenant,
+		Email:    email,
+		Name:     fmt.Sprintf("name of %s", email),
+		Password: "hashed-password",
+		// stores are not required to preserve more than microseconds
+		LastLogin: time.Now().UTC().Truncate(time.Microsecond),
+	}
+}
+
+func createUser(t *testing.T, userStore service.UserStore, email string) entity.User {
+	t.Helper()
+
+	user := newUser(email)
+
+	require.NoError(t, userStore.Create(context.Background(), &user))
+
+	return user
+}
+
+func assertUserEqual(t *testing.T, expected entity.User, actual *entity.User) {
+	t.Helper()
+
+	if !assert.NotNil(t, actual) {
+		return
+	}
+
+	assert.Equal(t, expected.Id, actual.Id)
+	assert.Equal(t, expected.TenantId, actual.TenantId)
+	assert.Equal(t, expected.Email, actual.Email)
+	assert.Equal(t, expected.Name, actual.Name)
+	assert.Empty(t, actual.Password, "password must only be returned with the credentials")
+	assert.Equal(t, expected.Version, actual.Version)
+	assert.Equal(t, expected.LoginCount, actual.LoginCount)
+	assert.Equal(t, expected.LastLoginIp, actual.LastLoginIp)
+	assert.True(
+		t, expected.LastLogin.Equal(actual.LastLogin),
+		"expected last login %s, got %s", expected.LastLogin, actual.LastLogin,
+	)
+
+	if expected.DeletedAt == nil || actual.DeletedAt == nil {
+		assert.Equal(t, expected.DeletedAt, actual.DeletedAt)
+	} else {
+		assert.True(
+			t, expected.DeletedAt.Equal(*actual.DeletedAt),
+			"expected deleted at %s, got %s", expected.DeletedAt, actual.DeletedAt,
+		)
+	}
+}
+
+// deleteUser soft deletes the user in the same way as the service.
+func deleteUser(t *testing.T, userStore service.UserStore, user *entity.User) {
+	t.Helper()
+
+	deletedAt := time.Now().UTC().Truncate(time.Microsecond)
+	user.DeletedAt = &deletedAt
+
+	require.NoError(t, userStore.Update(context.Background(), user))
+}
+
+// listAll collects the users from every page, as pages may be shorter than
+// the limit requested when filtering on deletion.
+func listAll(t *testing.T, userStore service.UserStore, opts entity.ListOptions) []entity.User {
+	t.Helper()
+
+	users := []entity.User{}
+
+	for {
+		page, err := userStore.List(context.Background(), entity.DefaultTenant, opts)
+		require.NoError(t, err)
+
+		users = append(users, page.Users...)
+
+		if page.NextCursor == "" {
+			return users
+		}
+
+		opts.Cursor = page.NextCursor
+	}
+}
+
+// listFilteredIds returns the ids of the users matching the filters, read a
+// page of one at a time, skipping the test where the store does not support
+// the filters.
+func listFilteredIds(t *testing.T, userStore service.UserStore, opts entity.ListOptions) []string {
+	t.Helper()
+
+	opts.Limit = 1
+	ids := []string{}
+
+	for {
+		page, err := userStore.List(context.Background(), entity.DefaultTenant, opts)
+		if errors.Is(err, entity.ErrFilterUnsupported) {
+			t.Skipf("filters not supported: %v", err)
+		}
+
+		require.NoError(t, err)
+
+		for _, user := range page.Users {
+			ids = append(ids, user.Id)
+		}
+
+		if page.NextCursor == "" {
+			return ids
+		}
+
+		opts.Cursor = page.NextCursor
+	}
+}
+
+func testCreate(t *testing.T, factory Factory) {
+	t.Run("success", func(t *testing.T) {
+		userStore := factory(t)
+
+		user := createUser(t, userStore, "user1@example.com")
+
+		got, err := userStore.GetById(context.Background(), entity.DefaultTenant, user.Id)
+		require.NoError(t, err)
+
+		assertUserEqual(t, user, got)
+	})
+
+	t.Run("duplicate-email", func(t *testing.T) {
+		userStore := factory(t)
+
+		user := createUser(t, userStore, "user1@example.com")
+		duplicate := newUser(user.Email)
+
+		err := userStore.Create(context.Background(), &duplicate)
+		assert.ErrorIs(t, err, entity.ErrEmailDuplicate)
+
+		_, err = userStore.GetById(context.Background(), entity.DefaultTenant, duplicate.Id)
+		assert.ErrorIs(t, err, entity.ErrNotFound, "failed create must not leave a partial user")
+	})
+
+	t.Run("duplicate-email-ignoring-case", func(t *testing.T) {
+		userStore := factory(t)
+
+		createUser(t, userStore, "User1@Example.com")
+		duplicate := newUser("user1@EXAMPLE.COM")
+
+		err := userStore.Create(context.Background(), &duplicate)
+		assert.ErrorIs(t, err, entity.ErrEmailDuplicate)
+	})
+
+	t.Run("concurrent-duplicate-email", func(t *testing.T) {
+		userStore := factory(t)
+
+		errs := make([]error, concurrency)
+
+		var wg sync.WaitGroup
+
+		for i := 0; i < concurrency; i++ {
+			wg.Add(1)
+
+			go func(idx int) {
+				defer wg.Done()
+
+				user := newUser("user1@example.com")
+				errs[idx] = userStore.Create(context.Background(), &user)
+			}(i)
+		}
+
+		wg.Wait()
+
+		created := 0
+
+		for _, err := range errs {
+			if err == nil {
+				created++
+			}
+		}
+
+		assert.Equal(t, 1, created, "exactly one writer should claim the email: %v", errs)
+	})
+}
+
+func testCreateBatch(t *testing.T, factory Factory) {
+	t.Run("success", func(t *testing.T) {
+		userStore := factory(t)
+
+		// enough users to need more than one transaction
+		users := make([]*entity.User, 30)
+		audit := make([]entity.AuditEntry, len(users))
+
+		for idx := range users {
+			user := newUser(fmt.Sprintf("user%02d@example.com", idx))
+			users[idx] = &user
+			audit[idx] = newAuditEntry(user, entity.AuditActionCreate, 0)
+		}
+
+		errs := userStore.CreateBatch(context.Background(), users, audit)
+		require.Len(t, errs, len(users))
+
+		for idx, user := range users {
+			require.NoError(t, errs[idx])
+			assert.Equal(t, int64(1), user.Version)
+
+			got, err := userStore.GetById(context.Background(), entity.DefaultTenant, user.Id)
+			require.NoError(t, err)
+			assertUserEqual(t, *user, got)
+
+			page, err := userStore.ListAudit(context.Background(), entity.DefaultTenant, user.Id, entity.ListOptions{Limit: 10})
+			require.NoError(t, err)
+			assert.Len(t, page.Entries, 1)
+		}
+	})
+
+	t.Run("duplicate-email", func(t *testing.T) {
+		userStore := factory(t)
+
+		existing := createUser(t, userStore, "user05@example.com")
+
+		users := make([]*entity.User, 10)
+		for idx := range users {
+			user := newUser(fmt.Sprintf("user%02d@example.com", idx))
+			users[idx] = &user
+		}
+
+		errs := userStore.CreateBatch(context.Background(), users, nil)
+		require.Len(t, errs, len(users))
+
+		for idx, user := range users {
+			if user.Email == existing.Email {
+				assert.ErrorIs(t, errs[idx], entity.ErrEmailDuplicate)
+
+				_, err := userStore.GetById(context.Background(), entity.DefaultTenant, user.Id)
+				assert.ErrorIs(t, err, entity.ErrNotFound)
+
+				continue
+			}
+
+			// the rest of the batch must still be created
+			require.NoError(t, errs[idx])
+
+			_, err := userStore.GetById(context.Background(), entity.DefaultTenant, user.Id)
+			assert.NoError(t, err)
+		}
+	})
+
+	t.Run("mixed-passwords", func(t *testing.T) {
+		userStore := factory(t)
+
+		existing := createUser(t, userStore, "existing@example.com")
+
+		// users written without a password have no credentials, so the
+		// conflicts must still be blamed on the users causing them
+		for name, conflict := range map[string]func(user *entity.User){
+			"duplicate-id":    func(user *entity.User) { user.Id = existing.Id },
+			"duplicate-email": func(user *entity.User) { user.Email = existing.Email },
+		} {
+			t.Run(name, func(t *testing.T) {
+				users := make([]*entity.User, 3)
+				for idx := range users {
+					user := newUser(fmt.Sprintf("%s%d@example.com", name, idx))
+					users[idx] = &user
+				}
+
+				users[2].Password = ""
+				conflict(users[2])
+
+				errs := userStore.CreateBatch(context.Background(), users, nil)
+				require.Len(t, errs, len(users))
+
+				for idx, user := range users[:2] {
+					require.NoError(t, errs[idx])
+					assertCredentials(t, userStore, *user, user.Password)
+				}
+
+				require.Error(t, errs[2])
+
+				if name == "duplicate-email" {
+					assert.ErrorIs(t, errs[2], entity.ErrEmailDuplicate)
+				}
+
+				got, err := userStore.GetById(context.Background(), entity.DefaultTenant, existing.Id)
+				require.NoError(t, err)
+				assertUserEqual(t, existing, got)
+			})
+		}
+	})
+}
+
+func assertCredentials(t *testing.T, userStore service.UserStore, user entity.User, password string) {
+	t.Helper()
+
+	credentials, err := userStore.GetCredentials(context.Background(), user.TenantId, user.Id)
+	if assert.NoError(t, err) {
+		assert.Equal(t, password, credentials.Password)
+	}
+}
+
+func testCredentials(t *testing.T, factory Factory) {
+	t.Run("stored-separately", func(t *testing.T) {
+		userStore := factory(t)
+
+		user := createUser(t, userStore, "user1@example.com")
+
+		assertCredentials(t, userStore, user, "hashed-password")
+
+		got, err := userStore.GetByEmail(context.Background(), entity.DefaultTenant, user.Email)
+		require.NoError(t, err)
+		assert.Empty(t, got.Password)
+
+		for _, listed := range listAll(t, userStore, entity.ListOptions{}) {
+			assert.Empty(t, listed.Password)
+		}
+	})
+
+	t.Run("put-credentials", func(t *testing.T) {
+		userStore := factory(t)
+
+		user := createUser(t, userStore, "user1@example.com")
+		audit := newAuditEntry(user, entity.AuditActionUpdate, 0)
+
+		credentials, err := userStore.GetCredentials(context.Background(), entity.DefaultTenant, user.Id)
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), credentials.Version)
+
+		credentials.Password = "new-hash"
+		err = userStore.PutCredentials(context.Background(), user.TenantId, user.Id, user.Version, credentials, audit)
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), credentials.Version)
+
+		assertCredentials(t, userStore, user, "new-hash")
+
+		// the user itself is left untouched
+		got, err := userStore.GetById(context.Background(), entity.DefaultTenant, user.Id)
+		require.NoError(t, err)
+		assertUserEqual(t, user, got)
+
+		page, err := userStore.ListAudit(context.Background(), entity.DefaultTenant, user.Id, entity.ListOptions{})
+		require.NoError(t, err)
+		assertAuditEqual(t, []entity.AuditEntry{audit}, page.Entries)
+	})
+
+	t.Run("put-credentials-conflict", func(t *testing.T) {
+		userStore := factory(t)
+
+		user := createUser(t, userStore, "user1@example.com")
+
+		changed := user
+		changed.Name = "renamed"
+		require.NoError(t, userStore.Update(context.Background(), &changed))
+
+		// the user was changed since the version read
+		err := userStore.PutCredentials(
+			context.Background(), user.TenantId, user.Id, user.Version,
+			&entity.Credentials{Password: "new-hash", Version: 1}, newAuditEntry(user, entity.AuditActionUpdate, 0),
+		)
+		assert.ErrorIs(t, err, entity.ErrConflict)
+
+		assertCredentials(t, userStore, user, "hashed-password")
+
+		page, err := userStore.ListAudit(context.Background(), entity.DefaultTenant, user.Id, entity.ListOptions{})
+		require.NoError(t, err)
+		assert.Empty(t, page.Entries)
+	})
+
+	t.Run("put-credentials-stale", func(t *testing.T) {
+		userStore := factory(t)
+
+		user := createUser(t, userStore, "user1@example.com")
+
+		first, err := userStore.GetCredentials(context.Background(), entity.DefaultTenant, user.Id)
+		require.NoError(t, err)
+
+		second := *first
+
+		first.MfaSecret = "mfa-secret"
+		require.NoError(t, userStore.PutCredentials(context.Background(), user.TenantId, user.Id, 0, first))
+
+		// the credentials were changed since they were read by the second
+		// writer, which must not revert the first
+		second.FailedLogins++
+		err = userStore.PutCredentials(context.Background(), user.TenantId, user.Id, 0, &second)
+		assert.ErrorIs(t, err, entity.ErrConflict)
+
+		got, err := userStore.GetCredentials(context.Background(), entity.DefaultTenant, user.Id)
+		require.NoError(t, err)
+		assert.Equal(t, "mfa-secret", got.MfaSecret)
+		assert.Zero(t, got.FailedLogins)
+
+		// a password change through the user keeps both
+		user.Password = "new-hash"
+		require.NoError(t, userStore.Update(context.Background(), &user))
+
+		got, err = userStore.GetCredentials(context.Background(), entity.DefaultTenant, user.Id)
+		require.NoError(t, err)
+		assert.Equal(t, "new-hash", got.Password)
+		assert.Equal(t, "mfa-secret", got.MfaSecret)
+		assert.Equal(t, first.Version+1, got.Version)
+	})
+
+	t.Run("update-without-password", func(t *testing.T) {
+		userStore := factory(t)
+
+		user := createUser(t, userStore, "user1@example.com")
+
+		user.Password = ""
+		user.Name = "renamed"
+		require.NoError(t, userStore.Update(context.Background(), &user))
+
+		assertCredentials(t, userStore, user, "hashed-password")
+	})
+
+	t.Run("update-with-password", func(t *testing.T) {
+		userStore := factory(t)
+
+		user := createUser(t, userStore, "user1@example.com")
+
+		user.Password = "new-hash"
+		require.NoError(t, userStore.Update(context.Background(), &user))
+
+		assertCredentials(t, userStore, user, "new-hash")
+	})
+
+	t.Run("lockout-and-mfa", func(t *testing.T) {
+		userStore := factory(t)
+
+		user := createUser(t, userStore, "user1@example.com")
+		lockedUntil := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+		credentials := entity.Credentials{
+			Password:     "hashed-password",
+			FailedLogins: 3,
+			LockedUntil:  &lockedUntil,
+			MfaSecret:    "mfa-secret",
+			Version:      1,
+		}
+
+		err := userStore.PutCredentials(
+			context.Background(), user.TenantId, user.Id, user.Version, &credentials,
+			newAuditEntry(user, entity.AuditActionUpdate, 0),
+		)
+		require.NoError(t, err)
+
+		got, err := userStore.GetCredentials(context.Background(), entity.DefaultTenant, user.Id)
+		require.NoError(t, err)
+		assert.Equal(t, credentials.FailedLogins, got.FailedLogins)
+		require.NotNil(t, got.LockedUntil)
+		assert.True(t, lockedUntil.Equal(*got.LockedUntil))
+		assert.Equal(t, credentials.MfaSecret, got.MfaSecret)
+
+		// changing the password keeps the rest of the credentials
+		user.Password = "new-hash"
+		require.NoError(t, userStore.Update(context.Background(), &user))
+
+		got, err = userStore.GetCredentials(context.Background(), entity.DefaultTenant, user.Id)
+		require.NoError(t, err)
+		assert.Equal(t, "new-hash", got.Password)
+		assert.Equal(t, credentials.FailedLogins, got.FailedLogins)
+		assert.Equal(t, credentials.MfaSecret, got.MfaSecret)
+	})
+
+	t.Run("removed-with-user", func(t *testing.T) {
+		userStore := factory(t)
+
+		purged := createUser(t, userStore, "user1@example.com")
+		deleteUser(t, userStore, &purged)
+		require.NoError(t, userStore.Purge(context.Background(), &purged))
+
+		_, err := userStore.GetCredentials(context.Background(), entity.DefaultTenant, purged.Id)
+		assert.ErrorIs(t, err, entity.ErrNotFound)
+	})
+
+	t.Run("not-found", func(t *testing.T) {
+		userStore := factory(t)
+
+		_, err := userStore.GetCredentials(context.Background(), entity.DefaultTenant, xid.New().String())
+		assert.ErrorIs(t, err, entity.ErrNotFound)
+
+		err = userStore.PutCredentials(
+			context.Background(), entity.DefaultTenant, xid.New().String(), 0, &entity.Credentials{Password: "hash"},
+		)
+		assert.ErrorIs(t, err, entity.ErrNotFound)
+	})
+
+	t.Run("missing-id", func(t *testing.T) {
+		userStore := factory(t)
+
+		_, err := userStore.GetCredentials(context.Background(), entity.DefaultTenant, "")
+		assert.ErrorIs(t, err, entity.ErrIDMissing)
+
+		err = userStore.PutCredentials(context.Background(), entity.DefaultTenant, "", 0, &entity.Credentials{})
+		assert.ErrorIs(t, err, entity.ErrIDMissing)
+	})
+}
+
+func testGetByEmail(t *testing.T, factory Factory) {
+	t.Run("success", func(t *testing.T) {
+		userStore := factory(t)
+
+		user := createUser(t, userStore, "user1@example.com")
+		createUser(t, userStore, "user2@example.com")
+
+		got, err := userStore.GetByEmail(context.Background(), entity.DefaultTenant, user.Email)
+		require.NoError(t, err)
+
+		assertUserEqual(t, user, got)
+	})
+
+	t.Run("ignores-case", func(t *testing.T) {
+		userStore := factory(t)
+
+		user := createUser(t, userStore, "User1@Example.com")
+
+		got, err := userStore.GetByEmail(context.Background(), entity.DefaultTenant, "USER1@example.COM")
+		require.NoError(t, err)
+
+		assertUserEqual(t, user, got)
+		assert.Equal(t, "User1@Example.com", got.Email, "the email as given should be kept")
+	})
+
+	t.Run("not-found", func(t *testing.T) {
+		userStore := factory(t)
+
+		_, err := userStore.GetByEmail(context.Background(), entity.DefaultTenant, "user1@example.com")
+		assert.ErrorIs(t, err, entity.ErrNotFound)
+	})
+
+	t.Run("missing-email", func(t *testing.T) {
+		userStore := factory(t)
+
+		_, err := userStore.GetByEmail(context.Background(), entity.DefaultTenant, "")
+		assert.ErrorIs(t, err, entity.ErrIDMissing)
+	})
+}
+
+func testGetById(t *testing.T, factory Factory) {
+	t.Run("not-found", func(t *testing.T) {
+		userStore := factory(t)
+
+		got, err := userStore.GetById(context.Background(), entity.DefaultTenant, xid.New().String())
+		assert.ErrorIs(t, err, entity.ErrNotFound)
+		assert.Nil(t, got)
+	})
+
+	t.Run("missing-id", func(t *testing.T) {
+		userStore := factory(t)
+
+		_, err := userStore.GetById(context.Background(), entity.DefaultTenant, "")
+		assert.ErrorIs(t, err, entity.ErrIDMissing)
+	})
+}
+
+func testGetMany(t *testing.T, factory Factory) {
+	t.Run("found-and-missing", func(t *testing.T) {
+		userStore := factory(t)
+
+		user1 := createUser(t, userStore, "user1@example.com")
+		user2 := createUser(t, userStore, "user2@example.com")
+
+		got, err := userStore.GetMany(
+			context.Background(), entity.DefaultTenant, []string{user2.Id, xid.New().String(), user1.Id},
+		)
+		require.NoError(t, err)
+
+		// in the order requested
+		if assert.Len(t, got, 2) {
+			assertUserEqual(t, user2, &got[0])
+			assertUserEqual(t, user1, &got[1])
+		}
+	})
+
+	t.Run("repeated-id", func(t *testing.T) {
+		userStore := factory(t)
+
+		user := createUser(t, userStore, "user1@example.com")
+
+		got, err := userStore.GetMany(context.Background(), entity.DefaultTenant, []string{user.Id, user.Id})
+		require.NoError(t, err)
+
+		if assert.Len(t, got, 1) {
+			assertUserEqual(t, user, &got[0])
+		}
+	})
+
+	t.Run("isolated", func(t *testing.T) {
+		userStore := factory(t)
+
+		user := createTenantUser(t, userStore, "acme", "user1@example.com")
+
+		got, err := userStore.GetMany(context.Background(), "globex", []string{user.Id})
+		require.NoError(t, err)
+		assert.Empty(t, got)
+	})
+
+	t.Run("more-than-one-request", func(t *testing.T) {
+		userStore := factory(t)
+
+		// more than are read in a single request to DynamoDB
+		users := make([]entity.User, 0, 110)
+		ids := make([]string, 0, 110)
+
+		for idx := 0; idx < 110; idx++ {
+			user := createUser(t, userStore, fmt.Sprintf("user%d@example.com", idx))
+			users = append(users, user)
+			ids = append(ids, user.Id)
+		}
+
+		got, err := userStore.GetMany(context.Background(), entity.DefaultTenant, ids)
+		require.NoError(t, err)
+
+		if assert.Len(t, got, len(users)) {
+			for idx := range users {
+				assertUserEqual(t, users[idx], &got[idx])
+			}
+		}
+	})
+
+	t.Run("missing-id", func(t *testing.T) {
+		userStore := factory(t)
+
+		_, err := userStore.GetMany(context.Background(), entity.DefaultTenant, []string{xid.New().String(), ""})
+		assert.ErrorIs(t, err, entity.ErrIDMissing)
+	})
+}
+
+func testList(t *testing.T, factory Factory) {
+	t.Run("empty", func(t *testing.T) {
+		userStore := factory(t)
+
+		page, err := userStore.List(context.Background(), entity.DefaultTenant, entity.ListOptions{})
+		require.NoError(t, err)
+
+		assert.Empty(t, page.Users)
+		assert.Empty(t, page.NextCursor)
+	})
+
+	t.Run("all-pages", func(t *testing.T) {
+		userStore := factory(t)
+
+		expected := map[string]entity.User{}
+
+		for i := 0; i < 5; i++ {
+			user := createUser(t, userStore, fmt.Sprintf("user%d@example.com", i))
+			expected[user.Id] = user
+		}
+
+		seen := map[string]bool{}
+		opts := entity.ListOptions{Limit: 2}
+
+		// stores are permitted to return a final empty page, so guard
+		// against looping forever rather than asserting the page count
+		for pages := 0; pages <= len(expected); pages++ {
+			page, err := userStore.List(context.Background(), entity.DefaultTenant, opts)
+			require.NoError(t, err)
+			assert.LessOrEqual(t, len(page.Users), int(opts.Limit))
+
+			for _, user := range page.Users {
+				user := user
+
+				assert.False(t, seen[user.Id], "user %s returned on multiple pages", user.Id)
+				seen[user.Id] = true
+
+				assertUserEqual(t, expected[user.Id], &user)
+			}
+
+			if page.NextCursor == "" {
+				break
+			}
+
+			opts.Cursor = page.NextCursor
+		}
+
+		assert.Len(t, seen, len(expected))
+	})
+
+	t.Run("deleted", func(t *testing.T) {
+		userStore := factory(t)
+
+		active := createUser(t, userStore, "user1@example.com")
+		deleted := createUser(t, userStore, "user2@example.com")
+		deleteUser(t, userStore, &deleted)
+
+		for _, limit := range []int32{0, 1} {
+			users := listAll(t, userStore, entity.ListOptions{Limit: limit})
+			if assert.Len(t, users, 1) {
+				assertUserEqual(t, active, &users[0])
+			}
+
+			users = listAll(t, userStore, entity.ListOptions{Limit: limit, Deleted: true})
+			if assert.Len(t, users, 1) {
+				assertUserEqual(t, deleted, &users[0])
+			}
+		}
+	})
+
+	t.Run("email-prefix", func(t *testing.T) {
+		userStore := factory(t)
+
+		alice := createUser(t, userStore, "alice@example.com")
+		albert := createUser(t, userStore, "Albert@Example.com")
+		createUser(t, userStore, "bob@example.com")
+
+		assert.ElementsMatch(
+			t, []string{alice.Id, albert.Id}, listFilteredIds(t, userStore, entity.ListOptions{EmailPrefix: "al"}),
+		)
+		assert.ElementsMatch(
+			t, []string{albert.Id}, listFilteredIds(t, userStore, entity.ListOptions{EmailPrefix: "albert@ex"}),
+		)
+		assert.Empty(t, listFilteredIds(t, userStore, entity.ListOptions{EmailPrefix: "carol"}))
+	})
+
+	t.Run("name-prefix", func(t *testing.T) {
+		userStore := factory(t)
+
+		ids := []string{}
+
+		for idx, name := range []string{"Ann Smith", "anna jones", "Bob Annsley"} {
+			user := newUser(fmt.Sprintf("user%d@example.com", idx))
+			user.Name = name
+			require.NoError(t, userStore.Create(context.Background(), &user))
+
+			ids = append(ids, user.Id)
+		}
+
+		assert.ElementsMatch(t, ids[:2], listFilteredIds(t, userStore, entity.ListOptions{NamePrefix: "ann"}))
+		assert.ElementsMatch(t, ids[1:2], listFilteredIds(t, userStore, entity.ListOptions{NamePrefix: "anna "}))
+	})
+
+	t.Run("last-login-range", func(t *testing.T) {
+		userStore := factory(t)
+
+		start := time.Now().UTC().Truncate(time.Microsecond).Add(-time.Hour)
+		ids := []string{}
+
+		for idx := 0; idx < 3; idx++ {
+			user := newUser(fmt.Sprintf("user%d@example.com", idx))
+			user.LastLogin = start.Add(time.Duration(idx) * time.Minute)
+			require.NoError(t, userStore.Create(context.Background(), &user))
+
+			ids = append(ids, user.Id)
+		}
+
+		// never matched by a range
+		never := newUser("never@example.com")
+		never.LastLogin = time.Time{}
+		require.NoError(t, userStore.Create(context.Background(), &never))
+
+		assert.ElementsMatch(t, ids[1:2], listFilteredIds(t, userStore, entity.ListOptions{
+			LastLoginAfter: start, LastLoginBefore: start.Add(2 * time.Minute),
+		}))
+		assert.ElementsMatch(t, ids[1:], listFilteredIds(t, userStore, entity.ListOptions{LastLoginAfter: start}))
+		assert.ElementsMatch(t, ids[:2], listFilteredIds(t, userStore, entity.ListOptions{
+			LastLoginBefore: start.Add(2 * time.Minute),
+		}))
+		assert.Empty(t, listFilteredIds(t, userStore, entity.ListOptions{
+			LastLoginAfter: start, LastLoginBefore: start.Add(time.Nanosecond),
+		}))
+	})
+
+	t.Run("recorded-login", func(t *testing.T) {
+		userStore := factory(t)
+
+		user := createUser(t, userStore, "user1@example.com")
+
+		login := entity.Login{Time: user.LastLogin.Add(time.Hour)}
+		require.NoError(t, userStore.RecordLogin(context.Background(), entity.DefaultTenant, user.Id, login))
+
+		assert.ElementsMatch(t, []string{user.Id}, listFilteredIds(t, userStore, entity.ListOptions{
+			LastLoginAfter: user.LastLogin.Add(time.Minute),
+		}))
+	})
+
+	t.Run("combined-filters", func(t *testing.T) {
+		userStore := factory(t)
+
+		recent := createUser(t, userStore, "alice@example.com")
+
+		old := newUser("albert@example.com")
+		old.LastLogin = recent.LastLogin.Add(-time.Hour)
+		require.NoError(t, userStore.Create(context.Background(), &old))
+
+		deleted := createUser(t, userStore, "alfred@example.com")
+		deleteUser(t, userStore, &deleted)
+
+		assert.ElementsMatch(t, []string{recent.Id}, listFilteredIds(t, userStore, entity.ListOptions{
+			EmailPrefix: "al", LastLoginAfter: recent.LastLogin.Add(-time.Minute),
+		}))
+		assert.ElementsMatch(t, []string{deleted.Id}, listFilteredIds(t, userStore, entity.ListOptions{
+			EmailPrefix: "al", Deleted: true,
+		}))
+	})
+
+	t.Run("bad-cursor", func(t *testing.T) {
+		userStore := factory(t)
+
+		_, err := userStore.List(context.Background(), entity.DefaultTenant, entity.ListOptions{Cursor: "not-a-cursor"})
+		assert.ErrorIs(t, err, entity.ErrCursorInvalid)
+	})
+}
+
+func newAuditEntry(user entity.User, action string, offset time.Duration) entity.AuditEntry {
+	return entity.AuditEntry{
+		UserId:    user.Id,
+		Timestamp: time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC).Add(offset),
+		Actor:     "admin@example.com",
+		Action:    action,
+		Changes: map[string]entity.AuditChange{
+			"name": {Old: "old name", New: "new name"},
+		},
+	}
+}
+
+func assertAuditEqual(t *testing.T, expected, actual []entity.AuditEntry) {
+	t.Helper()
+
+	if !assert.Len(t, actual, len(expected)) {
+		return
+	}
+
+	for idx := range expected {
+		assert.Equal(t, expected[idx].UserId, actual[idx].UserId)
+		assert.Equal(t, expected[idx].Actor, actual[idx].Actor)
+		assert.Equal(t, expected[idx].Action, actual[idx].Action)
+		assert.Equal(t, expected[idx].Changes, actual[idx].Changes)
+		assert.True(
+			t, expected[idx].Timestamp.Equal(actual[idx].Timestamp),
+			"expected timestamp %s, got %s", expected[idx].Timestamp, actual[idx].Timestamp,
+		)
+	}
+}
+
+func testListAudit(t *testing.T, factory Factory) {
+	t.Run("recorded-with-writes", func(t *testing.T) {
+		userStore := factory(t)
+
+		user := newUser("user1@example.com")
+		created := newAuditEntry(user, entity.AuditActionCreate, 0)
+		require.NoError(t, userStore.Create(context.Background(), &user, created))
+
+		user.Email = "user2@example.com"
+		updated := newAuditEntry(user, entity.AuditActionUpdate, time.Second)
+		require.NoError(t, userStore.Update(context.Background(), &user, updated))
+
+		login := newAuditEntry(user, entity.AuditActionLogin, 2*time.Second)
+		login.Changes = nil
+		require.NoError(t, userStore.RecordLogin(
+			context.Background(), entity.DefaultTenant, user.Id, entity.Login{Time: login.Timestamp}, login,
+		))
+
+		page, err := userStore.ListAudit(context.Background(), entity.DefaultTenant, user.Id, entity.ListOptions{})
+		require.NoError(t, err)
+
+		assertAuditEqual(t, []entity.AuditEntry{login, updated, created}, page.Entries)
+		assert.Empty(t, page.NextCursor)
+	})
+
+	t.Run("not-recorded-on-failure", func(t *testing.T) {
+		userStore := factory(t)
+
+		user := createUser(t, userStore, "user1@example.com")
+		other := createUser(t, userStore, "user2@example.com")
+
+		stale := user
+		stale.Version++
+		err := userStore.Update(context.Background(), &stale, newAuditEntry(user, entity.AuditActionUpdate, 0))
+		assert.ErrorIs(t, err, entity.ErrConflict)
+
+		duplicate := user
+		duplicate.Email = other.Email
+		err = userStore.Update(context.Background(), &duplicate, newAuditEntry(user, entity.AuditActionUpdate, 0))
+		assert.ErrorIs(t, err, entity.ErrEmailDuplicate)
+
+		page, err := userStore.ListAudit(context.Background(), entity.DefaultTenant, user.Id, entity.ListOptions{})
+		require.NoError(t, err)
+
+		assert.Empty(t, page.Entries)
+	})
+
+	t.Run("same-timestamp", func(t *testing.T) {
+		userStore := factory(t)
+
+		user := newUser("user1@example.com")
+		created := newAuditEntry(user, entity.AuditActionCreate, 0)
+		require.NoError(t, userStore.Create(context.Background(), &user, created))
+
+		// an entry of the same user and time is never written over the
+		// first, whichever write records it
+		entry := newAuditEntry(user, entity.AuditActionUpdate, 0)
+
+		renamed := user
+		renamed.Name = "renamed"
+		err := userStore.Update(context.Background(), &renamed, entry)
+		assert.ErrorIs(t, err, entity.ErrConflict)
+
+		err = userStore.RecordLogin(
+			context.Background(), entity.DefaultTenant, user.Id, entity.Login{Time: time.Now().UTC()}, entry,
+		)
+		assert.ErrorIs(t, err, entity.ErrConflict)
+
+		err = userStore.PutCredentials(
+			context.Background(), entity.DefaultTenant, user.Id, 0, &entity.Credentials{Password: "new-hash"}, entry,
+		)
+		assert.ErrorIs(t, err, entity.ErrConflict)
+
+		page, err := userStore.ListAudit(context.Background(), entity.DefaultTenant, user.Id, entity.ListOptions{})
+		require.NoError(t, err)
+		assertAuditEqual(t, []entity.AuditEntry{created}, page.Entries)
+
+		// nor is the rest of the write made
+		got, err := userStore.GetById(context.Background(), entity.DefaultTenant, user.Id)
+		require.NoError(t, err)
+		assertUserEqual(t, user, got)
+		assertCredentials(t, userStore, user, user.Password)
+	})
+
+	t.Run("all-pages", func(t *testing.T) {
+		userStore := factory(t)
+
+		user := createUser(t, userStore, "user1@example.com")
+		other := createUser(t, userStore, "user2@example.com")
+
+		var expected []entity.AuditEntry
+
+		for i := 0; i < 5; i++ {
+			entry := newAuditEntry(user, entity.AuditActionLogin, time.Duration(i)*time.Minute)
+			require.NoError(t, userStore.RecordLogin(
+				context.Background(), entity.DefaultTenant, user.Id, entity.Login{Time: entry.Timestamp}, entry,
+			))
+
+			// entries of other users must not be included
+			otherEntry := newAuditEntry(other, entity.AuditActionLogin, time.Duration(i)*time.Minute)
+			require.NoError(t, userStore.RecordLogin(
+				context.Background(), entity.DefaultTenant, other.Id, entity.Login{Time: otherEntry.Timestamp}, otherEntry,
+			))
+
+			expected = append([]entity.AuditEntry{entry}, expected...)
+		}
+
+		var (
+			entries []entity.AuditEntry
+			opts    = entity.ListOptions{Limit: 2}
+		)
+
+		for pages := 0; pages < 5; pages++ {
+			page, err := userStore.ListAudit(context.Background(), entity.DefaultTenant, user.Id, opts)
+			require.NoError(t, err)
+
+			assert.LessOrEqual(t, len(page.Entries), 2)
+			entries = append(entries, page.Entries...)
+
+			if page.NextCursor == "" {
+				break
+			}
+
+			opts.Cursor = page.NextCursor
+		}
+
+		assertAuditEqual(t, expected, entries)
+	})
+
+	t.Run("cursor-of-other-user", func(t *testing.T) {
+		userStore := factory(t)
+
+		user := createUser(t, userStore, "user1@example.com")
+		other := createUser(t, userStore, "user2@example.com")
+
+		for i := 0; i < 2; i++ {
+			entry := newAuditEntry(user, entity.AuditActionLogin, time.Duration(i)*time.Minute)
+			require.NoError(t, userStore.RecordLogin(
+				context.Background(), entity.DefaultTenant, user.Id, entity.Login{Time: entry.Timestamp}, entry,
+			))
+		}
+
+		page, err := userStore.ListAudit(context.Background(), entity.DefaultTenant, user.Id, entity.ListOptions{Limit: 1})
+		require.NoError(t, err)
+		require.NotEmpty(t, page.NextCursor)
+
+		_, err = userStore.ListAudit(context.Background(), entity.DefaultTenant, other.Id, entity.ListOptions{Cursor: page.NextCursor})
+		assert.ErrorIs(t, err, entity.ErrCursorInvalid)
+	})
+
+	t.Run("missing-id", func(t *testing.T) {
+		userStore := factory(t)
+
+		_, err := userStore.ListAudit(context.Background(), entity.DefaultTenant, "", entity.ListOptions{})
+		assert.ErrorIs(t, err, entity.ErrIDMissing)
+	})
+}
+
+func testPurge(t *testing.T, factory Factory) {
+	t.Run("releases-email", func(t *testing.T) {
+		userStore := factory(t)
+
+		user := createUser(t, userStore, "user1@example.com")
+		deleteUser(t, userStore, &user)
+
+		require.NoError(t, userStore.Purge(context.Background(), &user))
+
+		_, err := userStore.GetById(context.Background(), entity.DefaultTenant, user.Id)
+		assert.ErrorIs(t, err, entity.ErrNotFound)
+
+		_, err = userStore.GetByEmail(context.Background(), entity.DefaultTenant, user.Email)
+		assert.ErrorIs(t, err, entity.ErrNotFound)
+
+		createUser(t, userStore, user.Email)
+	})
+
+	t.Run("stale-version", func(t *testing.T) {
+		userStore := factory(t)
+
+		user := createUser(t, userStore, "user1@example.com")
+		deleteUser(t, userStore, &user)
+
+		// restored after being read for purging
+		restored := user
+		restored.DeletedAt = nil
+		require.NoError(t, userStore.Update(context.Background(), &restored))
+
+		err := userStore.Purge(context.Background(), &user)
+		assert.ErrorIs(t, err, entity.ErrConflict)
+
+		got, err := userStore.GetById(context.Background(), entity.DefaultTenant, user.Id)
+		require.NoError(t, err)
+		assertUserEqual(t, restored, got)
+
+		_, err = userStore.GetByEmail(context.Background(), entity.DefaultTenant, user.Email)
+		assert.NoError(t, err)
+	})
+
+	t.Run("not-found", func(t *testing.T) {
+		userStore := factory(t)
+
+		user := newUser("user1@example.com")
+
+		err := userStore.Purge(context.Background(), &user)
+		assert.ErrorIs(t, err, entity.ErrNotFound)
+	})
+
+	t.Run("missing-id", func(t *testing.T) {
+		userStore := factory(t)
+
+		err := userStore.Purge(context.Background(), &entity.User{Email: "user1@example.com"})
+		assert.ErrorIs(t, err, entity.ErrIDMissing)
+	})
+}
+
+func testRecordLogin(t *testing.T, factory Factory) {
+	t.Run("updates-in-place", func(t *testing.T) {
+		userStore := factory(t)
+
+		user := createUser(t, userStore, "user1@example.com")
+
+		for idx, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+			login := entity.Login{
+				Time:     time.Now().UTC().Truncate(time.Microsecond).Add(time.Duration(idx) * time.Second),
+				SourceIp: ip,
+			}
+			require.NoError(t, userStore.RecordLogin(context.Background(), entity.DefaultTenant, user.Id, login))
+
+			user.LastLogin = login.Time
+			user.LastLoginIp = login.SourceIp
+			user.LoginCount++
+		}
+
+		// the version is unchanged, so that logins do not conflict with
+		// other writes
+		got, err := userStore.GetById(context.Background(), entity.DefaultTenant, user.Id)
+		require.NoError(t, err)
+		assertUserEqual(t, user, got)
+		assert.Equal(t, int64(2), got.LoginCount)
+	})
+
+	t.Run("unknown-source", func(t *testing.T) {
+		userStore := factory(t)
+
+		user := createUser(t, userStore, "user1@example.com")
+
+		for _, ip := range []string{"192.0.2.1", ""} {
+			login := entity.Login{Time: time.Now().UTC(), SourceIp: ip}
+			require.NoError(t, userStore.RecordLogin(context.Background(), entity.DefaultTenant, user.Id, login))
+		}
+
+		got, err := userStore.GetById(context.Background(), entity.DefaultTenant, user.Id)
+		require.NoError(t, err)
+		assert.Empty(t, got.LastLoginIp)
+	})
+
+	t.Run("concurrent-update", func(t *testing.T) {
+		userStore := factory(t)
+
+		created := createUser(t, userStore, "user1@example.com")
+
+		user, err := userStore.GetById(context.Background(), entity.DefaultTenant, created.Id)
+		require.NoError(t, err)
+
+		login := entity.Login{Time: time.Now().UTC().Truncate(time.Microsecond), SourceIp: "192.0.2.1"}
+		require.NoError(t, userStore.RecordLogin(context.Background(), entity.DefaultTenant, user.Id, login))
+
+		// updating the user as read before the login must still succeed,
+		// without reverting the login
+		user.Name = "updated"
+		require.NoError(t, userStore.Update(context.Background(), user))
+
+		got, err := userStore.GetById(context.Background(), entity.DefaultTenant, user.Id)
+		require.NoError(t, err)
+		assert.Equal(t, "updated", got.Name)
+		assert.Equal(t, int64(1), got.LoginCount)
+		assert.Equal(t, "192.0.2.1", got.LastLoginIp)
+		assert.True(t, login.Time.Equal(got.LastLogin))
+	})
+
+	t.Run("recorded-with-audit", func(t *testing.T) {
+		userStore := factory(t)
+
+		user := createUser(t, userStore, "user1@example.com")
+
+		audit := newAuditEntry(user, entity.AuditActionLogin, 0)
+		audit.Changes = nil
+
+		login := entity.Login{Time: time.Now().UTC()}
+		require.NoError(t, userStore.RecordLogin(context.Background(), entity.DefaultTenant, user.Id, login, audit))
+
+		page, err := userStore.ListAudit(context.Background(), entity.DefaultTenant, user.Id, entity.ListOptions{})
+		require.NoError(t, err)
+		assertAuditEqual(t, []entity.AuditEntry{audit}, page.Entries)
+	})
+
+	t.Run("not-found", func(t *testing.T) {
+		userStore := factory(t)
+
+		login := entity.Login{Time: time.Now().UTC()}
+		err := userStore.RecordLogin(context.Background(), entity.DefaultTenant, xid.New().String(), login)
+		assert.ErrorIs(t, err, entity.ErrNotFound)
+
+		// with an audit entry the login must not be recorded either
+		user := newUser("user1@example.com")
+		err = userStore.RecordLogin(
+			context.Background(), entity.DefaultTenant, user.Id, login, newAuditEntry(user, entity.AuditActionLogin, 0),
+		)
+		assert.ErrorIs(t, err, entity.ErrNotFound)
+
+		page, err := userStore.ListAudit(context.Background(), entity.DefaultTenant, user.Id, entity.ListOptions{})
+		require.NoError(t, err)
+		assert.Empty(t, page.Entries)
+	})
+
+	t.Run("missing-id", func(t *testing.T) {
+		userStore := factory(t)
+
+		err := userStore.RecordLogin(context.Background(), entity.DefaultTenant, "", entity.Login{Time: time.Now()})
+		assert.ErrorIs(t, err, entity.ErrIDMissing)
+	})
+}
+
+// createTenantUser creates a user with the email in the tenant.
+func createTenantUser(t *testing.T, userStore service.UserStore, tenant, email string) entity.User {
+	t.Helper()
+
+	user := newUser(email)
+	user.TenantId = tenant
+
+	require.NoError(t, userStore.Create(context.Background(), &user, entity.AuditEntry{
+		UserId: user.Id, Timestamp: time.Now().UTC(), Actor: "test", Action: entity.AuditActionCreate,
+	}))
+
+	return user
+}
+
+func testTenants(t *testing.T, factory Factory) {
+	t.Run("same-email", func(t *testing.T) {
+		userStore := factory(t)
+
+		acme := createTenantUser(t, userStore, "acme", "user1@example.com")
+		globex := createTenantUser(t, userStore, "globex", "USER1@example.com")
+
+		got, err := userStore.GetByEmail(context.Background(), "acme", "user1@example.com")
+		require.NoError(t, err)
+		assertUserEqual(t, acme, got)
+
+		got, err = userStore.GetByEmail(context.Background(), "globex", "user1@example.com")
+		require.NoError(t, err)
+		assertUserEqual(t, globex, got)
+
+		// still unique within each tenant
+		duplicate := newUser("user1@example.com")
+		duplicate.TenantId = "acme"
+		assert.ErrorIs(t, userStore.Create(context.Background(), &duplicate), entity.ErrEmailDuplicate)
+	})
+
+	t.Run("isolated", func(t *testing.T) {
+		userStore := factory(t)
+
+		user := createTenantUser(t, userStore, "acme", "user1@example.com")
+		createTenantUser(t, userStore, "globex", "user2@example.com")
+
+		_, err := userStore.GetById(context.Background(), "globex", user.Id)
+		assert.ErrorIs(t, err, entity.ErrNotFound)
+
+		_, err = userStore.GetByEmail(context.Background(), "globex", user.Email)
+		assert.ErrorIs(t, err, entity.ErrNotFound)
+
+		audit, err := userStore.ListAudit(context.Background(), "globex", user.Id, entity.ListOptions{})
+		require.NoError(t, err)
+		assert.Empty(t, audit.Entries)
+
+		page, err := userStore.List(context.Background(), "globex", entity.ListOptions{})
+		require.NoError(t, err)
+		require.Len(t, page.Users, 1)
+		assert.Equal(t, "user2@example.com", page.Users[0].Email)
+
+		moved := user
+		moved.TenantId = "globex"
+		assert.ErrorIs(t, userStore.Update(context.Background(), &moved), entity.ErrNotFound)
+		assert.ErrorIs(t, userStore.Purge(context.Background(), &moved), entity.ErrNotFound)
+
+		got, err := userStore.GetById(context.Background(), "acme", user.Id)
+		require.NoError(t, err)
+		assertUserEqual(t, user, got)
+	})
+
+	t.Run("default-tenant", func(t *testing.T) {
+		userStore := factory(t)
+
+		user := newUser("user1@example.com")
+		user.TenantId = ""
+
+		require.NoError(t, userStore.Create(context.Background(), &user))
+		assert.Equal(t, entity.DefaultTenant, user.TenantId)
+
+		got, err := userStore.GetById(context.Background(), entity.DefaultTenant, user.Id)
+		require.NoError(t, err)
+		assertUserEqual(t, user, got)
+	})
+}
+
+func testUpdate(t *testing.T, factory Factory) {
+	t.Run("modified-email", func(t *testing.T) {
+		userStore := factory(t)
+
+		user := createUser(t, userStore, "user1@example.com")
+		oldEmail := user.Email
+		user.Email = "user2@example.com"
+
+		require.NoError(t, userStore.Update(context.Background(), &user))
+
+		got, err := userStore.GetByEmail(context.Background(), entity.DefaultTenant, user.Email)
+		require.NoError(t, err)
+		assertUserEqual(t, user, got)
+
+		_, err = userStore.GetByEmail(context.Background(), entity.DefaultTenant, oldEmail)
+		assert.ErrorIs(t, err, entity.ErrNotFound)
+
+		// the previous email must be released for other users
+		createUser(t, userStore, oldEmail)
+	})
+
+	t.Run("modified-email-case", func(t *testing.T) {
+		userStore := factory(t)
+
+		user := createUser(t, userStore, "user1@example.com")
+		user.Email = "User1@Example.com"
+
+		require.NoError(t, userStore.Update(context.Background(), &user))
+
+		got, err := userStore.GetByEmail(context.Background(), entity.DefaultTenant, "user1@example.com")
+		require.NoError(t, err)
+		assertUserEqual(t, user, got)
+
+		// still reserved for the user
+		duplicate := newUser("USER1@example.com")
+		assert.ErrorIs(t, userStore.Create(context.Background(), &duplicate), entity.ErrEmailDuplicate)
+	})
+
+	t.Run("duplicate-email", func(t *testing.T) {
+		userStore := factory(t)
+
+		user1 := createUser(t, userStore, "user1@example.com")
+		user2 := createUser(t, userStore, "user2@example.com")
+
+		update := user2
+		update.Email = user1.Email
+
+		err := userStore.Update(context.Background(), &update)
+		assert.ErrorIs(t, err, entity.ErrEmailDuplicate)
+
+		// neither user should have been modified
+		got, err := userStore.GetByEmail(context.Background(), entity.DefaultTenant, user2.Email)
+		require.NoError(t, err)
+		assertUserEqual(t, user2, got)
+
+		got, err = userStore.GetByEmail(context.Background(), entity.DefaultTenant, user1.Email)
+		require.NoError(t, err)
+		assertUserEqual(t, user1, got)
+	})
+
+	t.Run("concurrent-email-claims", func(t *testing.T) {
+		userStore := factory(t)
+
+		users := make([]entity.User, concurrency)
+		for i := range users {
+			users[i] = createUser(t, userStore, fmt.Sprintf("user%d@example.com", i))
+		}
+
+		errs := make([]error, concurrency)
+
+		var wg sync.WaitGroup
+
+		for i := range users {
+			wg.Add(1)
+
+			go func(idx int) {
+				defer wg.Done()
+
+				update := users[idx]
+				update.Email = "contested@example.com"
+				errs[idx] = userStore.Update(context.Background(), &update)
+			}(i)
+		}
+
+		wg.Wait()
+
+		updated := 0
+
+		for _, err := range errs {
+			if err == nil {
+				updated++
+			}
+		}
+
+		assert.Equal(t, 1, updated, "exactly one writer should claim the email: %v", errs)
+
+		owner, err := userStore.GetByEmail(context.Background(), entity.DefaultTenant, "contested@example.com")
+		require.NoError(t, err)
+
+		page, err := userStore.List(context.Background(), entity.DefaultTenant, entity.ListOptions{})
+		require.NoError(t, err)
+
+		for _, user := range page.Users {
+			if user.Id != owner.Id {
+				assert.NotEqual(t, "contested@example.com", user.Email)
+			}
+		}
+	})
+
+	t.Run("increments-version", func(t *testing.T) {
+		userStore := factory(t)
+
+		user := createUser(t, userStore, "user1@example.com")
+		assert.Equal(t, int64(1), user.Version)
+
+		user.Name = "updated name"
+		require.NoError(t, userStore.Update(context.Background(), &user))
+		assert.Equal(t, int64(2), user.Version)
+
+		got, err := userStore.GetById(context.Background(), entity.DefaultTenant, user.Id)
+		require.NoError(t, err)
+		assertUserEqual(t, user, got)
+	})
+
+	t.Run("stale-version", func(t *testing.T) {
+		userStore := factory(t)
+
+		user := createUser(t, userStore, "user1@example.com")
+
+		first := user
+		first.Name = "first update"
+		require.NoError(t, userStore.Update(context.Background(), &first))
+
+		stale := user
+		stale.Email = "user2@example.com"
+
+		err := userStore.Update(context.Background(), &stale)
+		assert.ErrorIs(t, err, entity.ErrConflict)
+
+		got, err := userStore.GetById(context.Background(), entity.DefaultTenant, user.Id)
+		require.NoError(t, err)
+		assertUserEqual(t, first, got)
+
+		// the email from the rejected update must not have been claimed
+		_, err = userStore.GetByEmail(context.Background(), entity.DefaultTenant, stale.Email)
+		assert.ErrorIs(t, err, entity.ErrNotFound)
+	})
+
+	t.Run("concurrent-updates", func(t *testing.T) {
+		userStore := factory(t)
+
+		user := createUser(t, userStore, "user1@example.com")
+
+		errs := make([]error, concurrency)
+
+		var wg sync.WaitGroup
+
+		for i := 0; i < concurrency; i++ {
+			wg.Add(1)
+
+			go func(idx int) {
+				defer wg.Done()
+
+				update := user
+				update.Name = fmt.Sprintf("writer %d", idx)
+				errs[idx] = userStore.Update(context.Background(), &update)
+			}(i)
+		}
+
+		wg.Wait()
+
+		updated := 0
+
+		for _, err := range errs {
+			if err == nil {
+				updated++
+			} else {
+				assert.ErrorIs(t, err, entity.ErrConflict)
+			}
+		}
+
+		assert.Equal(t, 1, updated, "exactly one writer should succeed: %v", errs)
+
+		got, err := userStore.GetById(context.Background(), entity.DefaultTenant, user.Id)
+		require.NoError(t, err)
+		assert.Equal(t, user.Version+1, got.Version)
+	})
+
+	t.Run("not-found", func(t *testing.T) {
+		userStore := factory(t)
+
+		user := newUser("user1@example.com")
+
+		err := userStore.Update(context.Background(), &user)
+		assert.ErrorIs(t, err, entity.ErrNotFound)
+	})
+
+	t.Run("missing-id", func(t *testing.T) {
+		userStore := factory(t)
+
+		err := userStore.Update(context.Background(), &entity.User{Email: "user1@example.com"})
+		assert.ErrorIs(t, err, entity.ErrIDMissing)
+	})
+}
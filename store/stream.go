@@ -0,0 +1,589 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodbstreams"
+	streamtypes "github.com/aws/aws-sdk-go-v2/service/dynamodbstreams/types"
+	"github.com/sirupsen/logrus"
+
+	"github.com/electrofelix/gin-demo/entity"
+)
+
+const (
+	// the position of each consumer in the stream is recorded in a single
+	// item of the table, the Id cannot collide with a user Id or an email
+	// address
+	streamCheckpointPrefix     = "#stream#"
+	streamCheckpointObjectType = "StreamCheckpoint"
+
+	defaultStreamPollInterval = time.Second
+	defaultStreamBatchSize    = 100
+)
+
+type DynamoDBStreamsOptions = func(*dynamodbstreams.Options)
+
+type DynamoDBStreamsAPI interface {
+	DescribeStream(context.Context, *dynamodbstreams.DescribeStreamInput, ...DynamoDBStreamsOptions) (*dynamodbstreams.DescribeStreamOutput, error)
+	GetRecords(context.Context, *dynamodbstreams.GetRecordsInput, ...DynamoDBStreamsOptions) (*dynamodbstreams.GetRecordsOutput, error)
+	GetShardIterator(context.Context, *dynamodbstreams.GetShardIteratorInput, ...DynamoDBStreamsOptions) (*dynamodbstreams.GetShardIteratorOutput, error)
+}
+
+// UserEventHandler is called with each change to a user in the order the
+// changes were made to that user. Changes are only recorded as consumed
+// once handled, so a handler must tolerate receiving an event again after
+// failing or the consumer being restarted.
+type UserEventHandler func(context.Context, entity.UserEvent) error
+
+// handlerError is returned by a handler, stopping the consumer rather than
+// being retried as failures to read the stream are.
+type handlerError struct {
+	err error
+}
+
+func (e handlerError) Error() string {
+	return fmt.Sprintf("event handler failed: %v", e.err)
+}
+
+func (e handlerError) Unwrap() error {
+	return e.err
+}
+
+// StreamConsumer turns the changes to users recorded in the stream of the
+// table into events, enabled by the migrations. Its position in each shard
+// of the stream is recorded in the table under its name, so that it resumes
+// from where it stopped. Only one consumer of each name may run at a time.
+type StreamConsumer struct {
+	store        *UserStore
+	streams      DynamoDBStreamsAPI
+	name         string
+	pollInterval time.Duration
+	batchSize    int32
+	logger       *logrus.Logger
+}
+
+type ConsumerOption func(*StreamConsumer)
+
+func NewStreamConsumer(us *UserStore, streams DynamoDBStreamsAPI, name string, options ...ConsumerOption) *StreamConsumer {
+	sc := &StreamConsumer{
+		store:        us,
+		streams:      streams,
+		name:         name,
+		pollInterval: defaultStreamPollInterval,
+		batchSize:    defaultStreamBatchSize,
+		logger:       us.logger,
+	}
+
+	for _, opt := range options {
+		opt(sc)
+	}
+
+	return sc
+}
+
+// WithConsumerPollInterval sets how long to wait before reading the stream
+// again once all changes have been consumed.
+func WithConsumerPollInterval(d time.Duration) ConsumerOption {
+	return func(sc *StreamConsumer) {
+		sc.pollInterval = d
+	}
+}
+
+// WithConsumerBatchSize sets how many records are read from a shard at a
+// time, the position is recorded after each batch.
+func WithConsumerBatchSize(size int32) ConsumerOption {
+	return func(sc *StreamConsumer) {
+		sc.batchSize = size
+	}
+}
+
+// streamCheckpoint is the position of the consumer in each shard of the
+// stream, Version guards against another consumer of the same name.
+type streamCheckpoint struct {
+	StreamArn string
+	Shards    map[string]shardCheckpoint
+	Version   int
+	UpdatedAt time.Time
+}
+
+// shardCheckpoint holds the last record of the shard handled, Finished is
+// set once a closed shard has been read to its end, allowing its children
+// to be read.
+type shardCheckpoint struct {
+	SequenceNumber string `dynamodbav:",omitempty"`
+	Finished       bool   `dynamodbav:",omitempty"`
+}
+
+// Run consumes the stream until the context is cancelled, returning nil,
+// or the handler fails. Failures to read the stream are logged and retried
+// after the poll interval.
+func (sc *StreamConsumer) Run(ctx context.Context, handler UserEventHandler) error {
+	for {
+		consumed, err := sc.Poll(ctx, handler)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		var errHandler handlerError
+		if errors.As(err, &errHandler) {
+			return err
+		}
+
+		if err != nil {
+			sc.logger.Errorf("failed to read stream for consumer %s, will retry: %v", sc.name, err)
+		}
+
+		if consumed > 0 && err == nil {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(sc.pollInterval):
+		}
+	}
+}
+
+// Poll reads every shard of the stream that is ready to be read up to its
+// latest record, parents before their children, returning the number of
+// records consumed.
+func (sc *StreamConsumer) Poll(ctx context.Context, handler UserEventHandler) (int, error) {
+	arn, err := sc.streamArn(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	shards, err := sc.shards(ctx, arn)
+	if err != nil {
+		return 0, err
+	}
+
+	checkpoint, err := sc.checkpoint(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	if checkpoint.StreamArn != arn {
+		if checkpoint.StreamArn != "" {
+			sc.logger.Warnf("stream of table '%s' replaced, consumer %s starting from the new stream", sc.store.tableName, sc.name)
+		}
+
+		checkpoint.StreamArn = arn
+		checkpoint.Shards = map[string]shardCheckpoint{}
+	}
+
+	// shards trimmed from the stream can no longer be read
+	current := make(map[string]bool, len(shards))
+	for _, shard := range shards {
+		current[aws.ToString(shard.ShardId)] = true
+	}
+
+	for id := range checkpoint.Shards {
+		if !current[id] {
+			delete(checkpoint.Shards, id)
+		}
+	}
+
+	consumed := 0
+
+	for progressed := true; progressed; {
+		progressed = false
+
+		for _, shard := range shards {
+			id := aws.ToString(shard.ShardId)
+			parent := aws.ToString(shard.ParentShardId)
+
+			if checkpoint.Shards[id].Finished || (current[parent] && !checkpoint.Shards[parent].Finished) {
+				continue
+			}
+
+			count, err := sc.readShard(ctx, &checkpoint, id, handler)
+			consumed += count
+
+			if err != nil {
+				return consumed, err
+			}
+
+			progressed = progressed || checkpoint.Shards[id].Finished
+		}
+	}
+
+	return consumed, nil
+}
+
+func (sc *StreamConsumer) streamArn(ctx context.Context) (string, error) {
+	result, err := sc.store.dbClient.DescribeTable(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(sc.store.tableName),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if result.Table.LatestStreamArn == nil {
+		return "", fmt.Errorf("table '%s' has no stream, apply the migrations to enable it", sc.store.tableName)
+	}
+
+	return aws.ToString(result.Table.LatestStreamArn), nil
+}
+
+func (sc *StreamConsumer) shards(ctx context.Context, arn string) ([]streamtypes.Shard, error) {
+	var shards []streamtypes.Shard
+
+	input := dynamodbstreams.DescribeStreamInput{StreamArn: aws.String(arn)}
+
+	for {
+		result, err := sc.streams.DescribeStream(ctx, &input)
+		if err != nil {
+			return nil, err
+		}
+
+		shards = append(shards, result.StreamDescription.Shards...)
+
+		if result.StreamDescription.LastEvaluatedShardId == nil {
+			return shards, nil
+		}
+
+		input.ExclusiveStartShardId = result.StreamDescription.LastEvaluatedShardId
+	}
+}
+
+// readShard delivers the records of the shard after those already handled,
+// recording the position after each batch. It returns once it has caught up
+// with an open shard or reached the end of a closed one.
+func (sc *StreamConsumer) readShard(
+	ctx context.Context, checkpoint *streamCheckpoint, id string, handler UserEventHandler,
+) (int, error) {
+	state := checkpoint.Shards[id]
+
+	iterator, err := sc.shardIterator(ctx, checkpoint.StreamArn, id, state.SequenceNumber)
+	if err != nil {
+		return 0, err
+	}
+
+	// records of checkpoints, including those written by this consumer, are
+	// passed over without recording the position, otherwise each checkpoint
+	// would be followed by another recording having read it
+	consumed := 0
+	pending := false
+
+	save := func() error {
+		checkpoint.Shards[id] = state
+		pending = false
+
+		return sc.recordCheckpoint(ctx, checkpoint)
+	}
+
+	for {
+		result, err := sc.streams.GetRecords(ctx, &dynamodbstreams.GetRecordsInput{
+			ShardIterator: iterator,
+			Limit:         aws.Int32(sc.batchSize),
+		})
+
+		var expired *streamtypes.ExpiredIteratorException
+		if errors.As(err, &expired) {
+			iterator, err = sc.shardIterator(ctx, checkpoint.StreamArn, id, state.SequenceNumber)
+			if err != nil {
+				return consumed, err
+			}
+
+			continue
+		}
+
+		if err != nil {
+			return consumed, err
+		}
+
+		for _, record := range result.Records {
+			if isCheckpointRecord(record) {
+				state.SequenceNumber = aws.ToString(record.Dynamodb.SequenceNumber)
+
+				continue
+			}
+
+			event, ok, err := sc.event(ctx, record)
+			if err == nil && ok {
+				err = handler(ctx, event)
+				if err != nil {
+					err = handlerError{err: err}
+				}
+			}
+
+			if err != nil {
+				// keep the position of the records already handled
+				if pending {
+					if saveErr := save(); saveErr != nil {
+						sc.logger.Errorf("failed to record position of consumer %s: %v", sc.name, saveErr)
+					}
+				}
+
+				return consumed, err
+			}
+
+			state.SequenceNumber = aws.ToString(record.Dynamodb.SequenceNumber)
+			consumed++
+			pending = true
+		}
+
+		if result.NextShardIterator == nil {
+			state.Finished = true
+			pending = true
+		}
+
+		if pending {
+			err = save()
+			if err != nil {
+				return consumed, err
+			}
+		}
+
+		if state.Finished || len(result.Records) == 0 {
+			return consumed, nil
+		}
+
+		iterator = result.NextShardIterator
+	}
+}
+
+func isCheckpointRecord(record streamtypes.Record) bool {
+	objectType, ok := record.Dynamodb.Keys["objectType"].(*streamtypes.AttributeValueMemberS)
+
+	return ok && objectType.Value == streamCheckpointObjectType
+}
+
+// shardIterator starts after the sequence number, or at the oldest record
+// of the shard when there is none. Records trimmed from the stream before
+// they were read are lost, which is logged.
+func (sc *StreamConsumer) shardIterator(ctx context.Context, arn, id, sequence string) (*string, error) {
+	input := dynamodbstreams.GetShardIteratorInput{
+		StreamArn:         aws.String(arn),
+		ShardId:           aws.String(id),
+		ShardIteratorType: streamtypes.ShardIteratorTypeTrimHorizon,
+	}
+
+	if sequence != "" {
+		input.ShardIteratorType = streamtypes.ShardIteratorTypeAfterSequenceNumber
+		input.SequenceNumber = aws.String(sequence)
+	}
+
+	result, err := sc.streams.GetShardIterator(ctx, &input)
+
+	var trimmed *streamtypes.TrimmedDataAccessException
+	if errors.As(err, &trimmed) {
+		sc.logger.Warnf("records of shard %s after %s were trimmed before consumer %s read them", id, sequence, sc.name)
+
+		input.ShardIteratorType = streamtypes.ShardIteratorTypeTrimHorizon
+		input.SequenceNumber = nil
+
+		result, err = sc.streams.GetShardIterator(ctx, &input)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result.ShardIterator, nil
+}
+
+// event converts a record of a change to a user item into an event, ok is
+// false for records of other items and of changes that left the user as
+// it was, such as a migration adding an attribute.
+func (sc *StreamConsumer) event(ctx context.Context, record streamtypes.Record) (entity.UserEvent, bool, error) {
+	tenant, kind, ok := itemTenant(fromStreamItem(record.Dynamodb.Keys))
+	if !ok || kind != kindUser {
+		return entity.UserEvent{}, false, nil
+	}
+
+	previous, err := sc.streamUser(ctx, tenant, record.Dynamodb.OldImage)
+	if err != nil {
+		return entity.UserEvent{}, false, err
+	}
+
+	user, err := sc.streamUser(ctx, tenant, record.Dynamodb.NewImage)
+	if err != nil {
+		return entity.UserEvent{}, false, err
+	}
+
+	event := entity.UserEvent{
+		Id:       aws.ToString(record.EventID),
+		TenantId: tenant,
+		Time:     aws.ToTime(record.Dynamodb.ApproximateCreationDateTime),
+		User:     user,
+		Previous: previous,
+	}
+
+	switch record.EventName {
+	case streamtypes.OperationTypeInsert:
+		event.Type = entity.UserCreated
+	case streamtypes.OperationTypeModify:
+		if reflect.DeepEqual(previous, user) {
+			return entity.UserEvent{}, false, nil
+		}
+
+		event.Type = entity.UserUpdated
+		if previous != nil && previous.DeletedAt == nil && user != nil && user.DeletedAt != nil {
+			event.Type = entity.UserDeleted
+		}
+	case streamtypes.OperationTypeRemove:
+		event.Type = entity.UserDeleted
+		event.Purged = true
+	default:
+		return entity.UserEvent{}, false, nil
+	}
+
+	if user != nil {
+		event.UserId = user.Id
+	} else if previous != nil {
+		event.UserId = previous.Id
+	}
+
+	return event, true, nil
+}
+
+// streamUser returns the user of an image of a user item, or nil when there
+// is no image.
+func (sc *StreamConsumer) streamUser(
+	ctx context.Context, tenant string, image map[string]streamtypes.AttributeValue,
+) (*entity.User, error) {
+	if len(image) == 0 {
+		return nil, nil
+	}
+
+	item := fromStreamItem(image)
+
+	err := sc.store.decryptItem(ctx, item)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting user of stream: %w", err)
+	}
+
+	user := entity.User{}
+
+	err = attributevalue.UnmarshalMap(item, &user)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshaling user of stream: %w", err)
+	}
+
+	user.TenantId = tenant
+	user.Password = ""
+
+	return &user, nil
+}
+
+func streamCheckpointKey(name string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"Id":         &types.AttributeValueMemberS{Value: streamCheckpointPrefix + name},
+		"objectType": &types.AttributeValueMemberS{Value: streamCheckpointObjectType},
+	}
+}
+
+func (sc *StreamConsumer) checkpoint(ctx context.Context) (streamCheckpoint, error) {
+	result, err := sc.store.dbClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(sc.store.tableName),
+		Key:            streamCheckpointKey(sc.name),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return streamCheckpoint{}, err
+	}
+
+	checkpoint := streamCheckpoint{Shards: map[string]shardCheckpoint{}}
+
+	if len(result.Item) == 0 {
+		return checkpoint, nil
+	}
+
+	err = attributevalue.UnmarshalMap(result.Item, &checkpoint)
+	if checkpoint.Shards == nil {
+		checkpoint.Shards = map[string]shardCheckpoint{}
+	}
+
+	return checkpoint, err
+}
+
+// recordCheckpoint only replaces the checkpoint the consumer read, so that
+// two consumers of the same name cannot both advance it.
+func (sc *StreamConsumer) recordCheckpoint(ctx context.Context, checkpoint *streamCheckpoint) error {
+	previous := checkpoint.Version
+	checkpoint.Version++
+	checkpoint.UpdatedAt = time.Now().UTC()
+
+	item, err := attributevalue.MarshalMap(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	for name, value := range streamCheckpointKey(sc.name) {
+		item[name] = value
+	}
+
+	_, err = sc.store.dbClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(sc.store.tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(Id) OR Version = :previous"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":previous": &types.AttributeValueMemberN{Value: strconv.Itoa(previous)},
+		},
+	})
+	if err != nil {
+		var ccfe *types.ConditionalCheckFailedException
+		if errors.As(err, &ccfe) {
+			return fmt.Errorf("position of consumer %s changed, another consumer of the same name is running", sc.name)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func fromStreamItem(image map[string]streamtypes.AttributeValue) map[string]types.AttributeValue {
+	item := make(map[string]types.AttributeValue, len(image))
+	for name, value := range image {
+		item[name] = fromStreamValue(value)
+	}
+
+	return item
+}
+
+// fromStreamValue converts an attribute of a stream record to the same
+// attribute as read from the table.
+func fromStreamValue(value streamtypes.AttributeValue) types.AttributeValue {
+	switch v := value.(type) {
+	case *streamtypes.AttributeValueMemberS:
+		return &types.AttributeValueMemberS{Value: v.Value}
+	case *streamtypes.AttributeValueMemberN:
+		return &types.AttributeValueMemberN{Value: v.Value}
+	case *streamtypes.AttributeValueMemberB:
+		return &types.AttributeValueMemberB{Value: v.Value}
+	case *streamtypes.AttributeValueMemberSS:
+		return &types.AttributeValueMemberSS{Value: v.Value}
+	case *streamtypes.AttributeValueMemberNS:
+		return &types.AttributeValueMemberNS{Value: v.Value}
+	case *streamtypes.AttributeValueMemberBS:
+		return &types.AttributeValueMemberBS{Value: v.Value}
+	case *streamtypes.AttributeValueMemberBOOL:
+		return &types.AttributeValueMemberBOOL{Value: v.Value}
+	case *streamtypes.AttributeValueMemberNULL:
+		return &types.AttributeValueMemberNULL{Value: v.Value}
+	case *streamtypes.AttributeValueMemberM:
+		return &types.AttributeValueMemberM{Value: fromStreamItem(v.Value)}
+	case *streamtypes.AttributeValueMemberL:
+		list := make([]types.AttributeValue, len(v.Value))
+		for idx, element := range v.Value {
+			list[idx] = fromStreamValue(element)
+		}
+
+		return &types.AttributeValueMemberL{Value: list}
+	}
+
+	return nil
+}
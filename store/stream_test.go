@@ -0,0 +1,219 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/electrofelix/gin-demo/entity"
+	"github.com/electrofelix/gin-demo/store"
+	"github.com/electrofelix/gin-demo/store/dynamotest"
+)
+
+// collect returns a handler appending the events it is given.
+func collect(events *[]entity.UserEvent) store.UserEventHandler {
+	return func(ctx context.Context, event entity.UserEvent) error {
+		*events = append(*events, event)
+
+		return nil
+	}
+}
+
+func eventTypes(events []entity.UserEvent) []entity.UserEventType {
+	eventTypes := make([]entity.UserEventType, len(events))
+	for idx, event := range events {
+		eventTypes[idx] = event.Type
+	}
+
+	return eventTypes
+}
+
+func TestStreamConsumer_Poll(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("lifecycle", func(t *testing.T) {
+		fake, dataStore := setupFakeUserStore(t)
+		consumer := store.NewStreamConsumer(dataStore, fake, "test")
+
+		user := entity.User{Id: "user1", Name: "John Smith", Email: "john@example.com"}
+		require.NoError(t, dataStore.Create(ctx, &user))
+
+		user.Name = "Jon Smith"
+		require.NoError(t, dataStore.Update(ctx, &user))
+
+		now := time.Now().UTC()
+		user.DeletedAt = &now
+		require.NoError(t, dataStore.Update(ctx, &user))
+
+		require.NoError(t, dataStore.Purge(ctx, &user))
+
+		var events []entity.UserEvent
+
+		_, err := consumer.Poll(ctx, collect(&events))
+		require.NoError(t, err)
+
+		require.Equal(t, []entity.UserEventType{
+			entity.UserCreated, entity.UserUpdated, entity.UserDeleted, entity.UserDeleted,
+		}, eventTypes(events))
+
+		for _, event := range events {
+			assert.Equal(t, "user1", event.UserId)
+			assert.Equal(t, entity.DefaultTenant, event.TenantId)
+			assert.NotEmpty(t, event.Id)
+		}
+
+		assert.Nil(t, events[0].Previous)
+		assert.Equal(t, "John Smith", events[1].Previous.Name)
+		assert.Equal(t, "Jon Smith", events[1].User.Name)
+		assert.False(t, events[2].Purged)
+		assert.True(t, events[3].Purged)
+		assert.Nil(t, events[3].User)
+	})
+
+	t.Run("resumes", func(t *testing.T) {
+		fake, dataStore := setupFakeUserStore(t)
+
+		require.NoError(t, dataStore.Create(ctx, &entity.User{Id: "user1", Email: "user1@example.com"}))
+
+		var events []entity.UserEvent
+
+		_, err := store.NewStreamConsumer(dataStore, fake, "test").Poll(ctx, collect(&events))
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+
+		require.NoError(t, dataStore.Create(ctx, &entity.User{Id: "user2", Email: "user2@example.com"}))
+
+		events = nil
+
+		consumed, err := store.NewStreamConsumer(dataStore, fake, "test").Poll(ctx, collect(&events))
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+		assert.Equal(t, "user2", events[0].UserId)
+		assert.Greater(t, consumed, 0)
+
+		// consumers of other names have their own position
+		events = nil
+
+		_, err = store.NewStreamConsumer(dataStore, fake, "other").Poll(ctx, collect(&events))
+		require.NoError(t, err)
+		assert.Len(t, events, 2)
+	})
+
+	t.Run("parent-before-child", func(t *testing.T) {
+		fake, dataStore := setupFakeUserStore(t)
+
+		user := entity.User{Id: "user1", Name: "First", Email: "user1@example.com"}
+		require.NoError(t, dataStore.Create(ctx, &user))
+		require.NoError(t, fake.SplitShard(tableName))
+
+		user.Name = "Second"
+		require.NoError(t, dataStore.Update(ctx, &user))
+		require.NoError(t, fake.SplitShard(tableName))
+
+		user.Name = "Third"
+		require.NoError(t, dataStore.Update(ctx, &user))
+
+		var events []entity.UserEvent
+
+		_, err := store.NewStreamConsumer(dataStore, fake, "test", store.WithConsumerBatchSize(1)).
+			Poll(ctx, collect(&events))
+		require.NoError(t, err)
+
+		require.Len(t, events, 3)
+		assert.Equal(t, "First", events[0].User.Name)
+		assert.Equal(t, "Second", events[1].User.Name)
+		assert.Equal(t, "Third", events[2].User.Name)
+	})
+
+	t.Run("redelivers-after-handler-error", func(t *testing.T) {
+		fake, dataStore := setupFakeUserStore(t)
+
+		for _, id := range []string{"user1", "user2", "user3"} {
+			require.NoError(t, dataStore.Create(ctx, &entity.User{Id: id, Email: id + "@example.com"}))
+		}
+
+		failure := errors.New("unavailable")
+
+		var handled []string
+
+		_, err := store.NewStreamConsumer(dataStore, fake, "test").Poll(ctx,
+			func(ctx context.Context, event entity.UserEvent) error {
+				if event.UserId == "user2" {
+					return failure
+				}
+
+				handled = append(handled, event.UserId)
+
+				return nil
+			})
+		require.ErrorIs(t, err, failure)
+		assert.Equal(t, []string{"user1"}, handled)
+
+		var events []entity.UserEvent
+
+		_, err = store.NewStreamConsumer(dataStore, fake, "test").Poll(ctx, collect(&events))
+		require.NoError(t, err)
+		require.Len(t, events, 2)
+		assert.Equal(t, "user2", events[0].UserId)
+		assert.Equal(t, "user3", events[1].UserId)
+	})
+
+	t.Run("encrypted", func(t *testing.T) {
+		fake, dataStore := setupFakeUserStore(t, store.WithEncryption(setupKeyProvider(t), "Email", "Name"))
+
+		require.NoError(t, dataStore.Create(ctx, &entity.User{Id: "user1", Name: "John", Email: "john@example.com"}))
+
+		var events []entity.UserEvent
+
+		_, err := store.NewStreamConsumer(dataStore, fake, "test").Poll(ctx, collect(&events))
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+		assert.Equal(t, "John", events[0].User.Name)
+		assert.Equal(t, "john@example.com", events[0].User.Email)
+	})
+
+	t.Run("stream-disabled", func(t *testing.T) {
+		fake := dynamotest.New()
+		dataStore := store.NewUserStore(fake, tableName)
+
+		_, err := fake.CreateTable(ctx, &dynamodb.CreateTableInput{
+			TableName: aws.String(tableName),
+			KeySchema: []types.KeySchemaElement{
+				{AttributeName: aws.String("Id"), KeyType: types.KeyTypeHash},
+				{AttributeName: aws.String("objectType"), KeyType: types.KeyTypeRange},
+			},
+		})
+		require.NoError(t, err)
+
+		_, err = store.NewStreamConsumer(dataStore, fake, "test").Poll(ctx, collect(new([]entity.UserEvent)))
+		assert.Error(t, err)
+	})
+}
+
+func TestStreamConsumer_Run(t *testing.T) {
+	fake, dataStore := setupFakeUserStore(t)
+	require.NoError(t, dataStore.Create(context.Background(), &entity.User{Id: "user1", Email: "user1@example.com"}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	consumer := store.NewStreamConsumer(dataStore, fake, "test", store.WithConsumerPollInterval(time.Millisecond))
+
+	var events []entity.UserEvent
+
+	err := consumer.Run(ctx, func(ctx context.Context, event entity.UserEvent) error {
+		events = append(events, event)
+		cancel()
+
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Len(t, events, 1)
+}
@@ -0,0 +1,135 @@
+package store
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"github.com/electrofelix/gin-demo/entity"
+)
+
+const (
+	// tenantSeparator follows key in the object types of the items of a
+	// tenant, it cannot appear in a valid tenant
+	tenantSeparator = "@"
+
+	emailSuffix       = "#email"
+	auditSuffix       = "#audit#"
+	credentialsSuffix = "#credentials"
+)
+
+// itemKind identifies which of the items belonging to a tenant an object
+// type is for.
+type itemKind int
+
+const (
+	kindUser itemKind = iota + 1
+	kindEmail
+	kindAudit
+	kindCredentials
+)
+
+// userType returns the object type of the users of the tenant, which is also
+// the partition of the objectType index listing them. The default tenant
+// keeps the object types used before tenants were introduced, so that
+// existing items need no migration.
+func userType(tenant string) string {
+	tenant = entity.TenantOrDefault(tenant)
+	if tenant == entity.DefaultTenant {
+		return key
+	}
+
+	return key + tenantSeparator + tenant
+}
+
+func emailType(tenant string) string {
+	return userType(tenant) + emailSuffix
+}
+
+// credentialsType returns the object type of the items holding the
+// credentials of users of the tenant, which share the Id of the user.
+func credentialsType(tenant string) string {
+	return userType(tenant) + credentialsSuffix
+}
+
+// auditPrefix is the start of the sort keys of the audit entries of users
+// of the tenant.
+func auditPrefix(tenant string) string {
+	return userType(tenant) + auditSuffix
+}
+
+// parseObjectType returns the tenant and kind of the item with the object
+// type, ok is false for any items that do not belong to a tenant.
+func parseObjectType(objectType string) (tenant string, kind itemKind, ok bool) {
+	if !strings.HasPrefix(objectType, key) {
+		return "", 0, false
+	}
+
+	rest := objectType[len(key):]
+	tenant = entity.DefaultTenant
+
+	if strings.HasPrefix(rest, tenantSeparator) {
+		rest = rest[len(tenantSeparator):]
+
+		end := strings.Index(rest, "#")
+		if end < 0 {
+			end = len(rest)
+		}
+
+		tenant, rest = rest[:end], rest[end:]
+		if !entity.ValidTenant(tenant) {
+			return "", 0, false
+		}
+	}
+
+	switch {
+	case rest == "":
+		return tenant, kindUser, true
+	case rest == emailSuffix:
+		return tenant, kindEmail, true
+	case rest == credentialsSuffix:
+		return tenant, kindCredentials, true
+	case strings.HasPrefix(rest, auditSuffix):
+		return tenant, kindAudit, true
+	default:
+		return "", 0, false
+	}
+}
+
+// itemTenant returns the tenant and kind of a raw item.
+func itemTenant(item map[string]types.AttributeValue) (string, itemKind, bool) {
+	objectType, _ := item["objectType"].(*types.AttributeValueMemberS)
+	if objectType == nil {
+		return "", 0, false
+	}
+
+	return parseObjectType(objectType.Value)
+}
+
+// itemKey returns the key of an item read from the table.
+func itemKey(item map[string]types.AttributeValue) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{"Id": item["Id"], "objectType": item["objectType"]}
+}
+
+func userKey(tenant, id string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"Id":         &types.AttributeValueMemberS{Value: id},
+		"objectType": &types.AttributeValueMemberS{Value: userType(tenant)},
+	}
+}
+
+// emailKey returns the key of the item reserving the email for a user of
+// the tenant, where email is the Id returned by UserStore.emailId.
+func emailKey(tenant, email string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"Id":         &types.AttributeValueMemberS{Value: email},
+		"objectType": &types.AttributeValueMemberS{Value: emailType(tenant)},
+	}
+}
+
+func credentialsKey(tenant, id string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"Id":         &types.AttributeValueMemberS{Value: id},
+		"objectType": &types.AttributeValueMemberS{Value: credentialsType(tenant)},
+	}
+}
@@ -6,6 +6,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
@@ -18,32 +21,49 @@ import (
 
 const (
 	key = "UserInfo"
+
+	// objectTypeIndex allows retrieving all objects of a given type in
+	// order of their Id without needing to scan the whole table.
+	objectTypeIndex = "objectType-index"
+
+	// maxTransactItems is the most items DynamoDB accepts in a transaction.
+	maxTransactItems = 25
+	// maxBatchGetKeys is the limit of keys DynamoDB accepts in a single
+	// BatchGetItem call.
+	maxBatchGetKeys = 100
 )
 
 type DynamoDBOptions = func(*dynamodb.Options)
 
 type DynamoDBAPI interface {
+	BatchGetItem(context.Context, *dynamodb.BatchGetItemInput, ...DynamoDBOptions) (*dynamodb.BatchGetItemOutput, error)
 	CreateTable(context.Context, *dynamodb.CreateTableInput, ...DynamoDBOptions) (*dynamodb.CreateTableOutput, error)
 	GetItem(context.Context, *dynamodb.GetItemInput, ...DynamoDBOptions) (*dynamodb.GetItemOutput, error)
 	DeleteItem(context.Context, *dynamodb.DeleteItemInput, ...DynamoDBOptions) (*dynamodb.DeleteItemOutput, error)
-	ListTables(context.Context, *dynamodb.ListTablesInput, ...DynamoDBOptions) (*dynamodb.ListTablesOutput, error)
+	DescribeTable(context.Context, *dynamodb.DescribeTableInput, ...DynamoDBOptions) (*dynamodb.DescribeTableOutput, error)
 	PutItem(context.Context, *dynamodb.PutItemInput, ...DynamoDBOptions) (*dynamodb.PutItemOutput, error)
+	Query(context.Context, *dynamodb.QueryInput, ...DynamoDBOptions) (*dynamodb.QueryOutput, error)
 	Scan(context.Context, *dynamodb.ScanInput, ...DynamoDBOptions) (*dynamodb.ScanOutput, error)
 	TransactWriteItems(context.Context, *dynamodb.TransactWriteItemsInput, ...DynamoDBOptions) (*dynamodb.TransactWriteItemsOutput, error)
+	UpdateItem(context.Context, *dynamodb.UpdateItemInput, ...DynamoDBOptions) (*dynamodb.UpdateItemOutput, error)
+	UpdateTable(context.Context, *dynamodb.UpdateTableInput, ...DynamoDBOptions) (*dynamodb.UpdateTableOutput, error)
 }
 
 type UserStore struct {
-	dbClient  DynamoDBAPI
-	tableName string
-	logger    *logrus.Logger
+	dbClient   DynamoDBAPI
+	tableName  string
+	retry      retryPolicy
+	metrics    *Metrics
+	encryption *fieldEncryption
+	logger     *logrus.Logger
 }
 
 type Option func(*UserStore)
 
 func NewUserStore(dbClient DynamoDBAPI, dbTable string, options ...Option) *UserStore {
 	us := &UserStore{
-		dbClient:  dbClient,
 		tableName: dbTable,
+		retry:     defaultRetryPolicy(),
 		logger:    logrus.StandardLogger(),
 	}
 
@@ -51,190 +71,266 @@ func NewUserStore(dbClient DynamoDBAPI, dbTable string, options ...Option) *User
 		opt(us)
 	}
 
+	if us.metrics != nil {
+		dbClient = newMetricsDynamoDB(dbClient, us.metrics)
+	}
+
+	// all calls are retried when throttled, including by the Migrator
+	us.dbClient = newRetryingDynamoDB(dbClient, us.retry, us.logger)
+
 	return us
 }
 
-func (us *UserStore) InitializeTable(ctx context.Context) error {
-	us.logger.Infoln("Table initializing")
-	// useful for dev environment, probably better to avoid granting
-	// permissions in a production environment if the data is critical
-	result, err := us.dbClient.ListTables(ctx, &dynamodb.ListTablesInput{})
+func (us *UserStore) Create(ctx context.Context, user *entity.User, audit ...entity.AuditEntry) error {
+	user.TenantId = entity.TenantOrDefault(user.TenantId)
+	user.Version = 1
+
+	items, err := us.createItems(ctx, user, passwordCredentials(user), audit)
 	if err != nil {
 		return err
 	}
 
-	us.logger.Infoln("Found tables:", result.TableNames)
+	_, err = us.dbClient.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	if err != nil {
+		var errTransaction *types.TransactionCanceledException
+		if errors.As(err, &errTransaction) {
+			failedReasons := errTransaction.CancellationReasons
 
-	for _, name := range result.TableNames {
-		if name == us.tableName {
-			us.logger.Infof("table '%s' already exists, skipping initialization", us.tableName)
+			if len(failedReasons) >= 2 && aws.ToString(failedReasons[1].Code) == "ConditionalCheckFailed" {
+				// second item insertion failed means email already in use
 
-			return nil
+				return entity.ErrEmailDuplicate
+			}
 		}
-	}
 
-	us.logger.Infof("table '%s' not found, attemting bootstrap", us.tableName)
+		// some other error, such as capacity provisioned exceeded or failure
+		// to talk to the endpoint
+		us.logger.Errorf("error putting item %s %s for %s: %v", key, user.Id, user.Email, err)
 
-	_, err = us.dbClient.CreateTable(ctx, &dynamodb.CreateTableInput{
-		TableName: &us.tableName,
-		AttributeDefinitions: []types.AttributeDefinition{
-			{
-				AttributeName: aws.String("Id"),
-				AttributeType: types.ScalarAttributeTypeS,
-			},
-			{
-				AttributeName: aws.String("objectType"),
-				AttributeType: types.ScalarAttributeTypeS,
-			},
-		},
-		KeySchema: []types.KeySchemaElement{
-			{
-				AttributeName: aws.String("Id"),
-				KeyType:       types.KeyTypeHash,
-			},
-			{
-				AttributeName: aws.String("objectType"),
-				KeyType:       types.KeyTypeRange,
-			},
-		},
-		ProvisionedThroughput: &types.ProvisionedThroughput{
-			ReadCapacityUnits:  aws.Int64(5),
-			WriteCapacityUnits: aws.Int64(5),
-		},
-	})
-	if err != nil {
 		return err
 	}
 
-	us.logger.Infof("table %s created successfully", us.tableName)
-
 	return nil
 }
 
-func (us *UserStore) Create(ctx context.Context, user *entity.User) error {
-	item, err := attributevalue.MarshalMap(user)
-	if err != nil {
-		us.logger.Errorf("Marshal failed for user (%s): %v", user.Email, err)
+// CreateBatch creates the users in transactions of as many users as fit,
+// returning the error for each user in the same order. Where a transaction
+// is cancelled by a condition, only the users that caused it are failed and
+// the rest are retried. audit is either empty or holds the entry to record
+// with the user at the same index.
+func (us *UserStore) CreateBatch(ctx context.Context, users []*entity.User, audit []entity.AuditEntry) []error {
+	for _, user := range users {
+		user.TenantId = entity.TenantOrDefault(user.TenantId)
+		user.Version = 1
+	}
 
-		return err
+	return us.writeBatch(ctx, users, nil, audit)
+}
+
+// writeBatch creates the users as CreateBatch does. credentials is either
+// empty, when each user is written with the credentials of its password, or
+// holds the credentials, if any, to write with the user at the same index.
+func (us *UserStore) writeBatch(
+	ctx context.Context, users []*entity.User, credentials []*entity.Credentials, audit []entity.AuditEntry,
+) []error {
+	errs := make([]error, len(users))
+	items := make([][]types.TransactWriteItem, len(users))
+
+	for idx, user := range users {
+		userCredentials := passwordCredentials(user)
+		if len(credentials) > 0 {
+			userCredentials = credentials[idx]
+		}
+
+		var entries []entity.AuditEntry
+		if len(audit) > 0 {
+			entries = audit[idx : idx+1]
+		}
+
+		items[idx], errs[idx] = us.createItems(ctx, user, userCredentials, entries)
 	}
 
-	item["objectType"] = &types.AttributeValueMemberS{Value: key}
+	// users are chunked by the items they need, as only those written with
+	// a password have a credentials item
+	var pending []int
 
-	transaction := dynamodb.TransactWriteItemsInput{
-		TransactItems: []types.TransactWriteItem{
-			{
-				Put: &types.Put{
-					Item:                item,
-					TableName:           aws.String(us.tableName),
-					ConditionExpression: aws.String("attribute_not_exists(Id)"),
-				},
-			},
-			{
-				// save a second object at the same time where the email is the Id
-				Put: &types.Put{
-					Item: map[string]types.AttributeValue{
-						"Id": &types.AttributeValueMemberS{
-							Value: user.Email,
-						},
-						"UserId": &types.AttributeValueMemberS{
-							Value: user.Id,
-						},
-						"objectType": &types.AttributeValueMemberS{
-							Value: fmt.Sprintf("%s#email", key),
-						},
-					},
-					TableName:           aws.String(us.tableName),
-					ConditionExpression: aws.String("attribute_not_exists(Id)"),
-				},
-			},
-		},
+	size := 0
+
+	for idx := range users {
+		if errs[idx] != nil {
+			continue
+		}
+
+		if size+len(items[idx]) > maxTransactItems {
+			us.createChunks(ctx, users, items, pending, errs)
+
+			pending, size = nil, 0
+		}
+
+		pending = append(pending, idx)
+		size += len(items[idx])
 	}
 
-	_, err = us.dbClient.TransactWriteItems(ctx, &transaction)
-	if err != nil {
-		var errTransaction *types.TransactionCanceledException
-		if errors.As(err, &errTransaction) {
-			if *errTransaction.CancellationReasons[1].Code == "ConditionalCheckFailed" {
-				// second item insertion failed means email already in use
+	us.createChunks(ctx, users, items, pending, errs)
 
-				return entity.ErrEmailDuplicate
+	return errs
+}
+
+// createChunks writes the pending users until each has either been created
+// or failed.
+func (us *UserStore) createChunks(
+	ctx context.Context, users []*entity.User, items [][]types.TransactWriteItem, pending []int, errs []error,
+) {
+	for len(pending) > 0 {
+		pending = us.createChunk(ctx, users, items, pending, errs)
+	}
+}
+
+// createChunk writes the items of the pending users in a single transaction,
+// recording the outcome in errs and returning any users that should be
+// retried.
+func (us *UserStore) createChunk(
+	ctx context.Context, users []*entity.User, items [][]types.TransactWriteItem, pending []int, errs []error,
+) []int {
+	var transaction dynamodb.TransactWriteItemsInput
+
+	// the position in the transaction of the first item of each user
+	offsets := make([]int, len(pending))
+
+	for pos, idx := range pending {
+		offsets[pos] = len(transaction.TransactItems)
+		transaction.TransactItems = append(transaction.TransactItems, items[idx]...)
+	}
+
+	_, err := us.dbClient.TransactWriteItems(ctx, &transaction)
+	if err == nil {
+		return nil
+	}
+
+	var errTransaction *types.TransactionCanceledException
+	if errors.As(err, &errTransaction) {
+		failed := map[int]error{}
+
+		for item, reason := range errTransaction.CancellationReasons {
+			if aws.ToString(reason.Code) != "ConditionalCheckFailed" {
+				continue
+			}
+
+			pos := sort.SearchInts(offsets, item+1) - 1
+			if item == offsets[pos]+1 {
+				// the second item of each user reserves its email
+				failed[pos] = entity.ErrEmailDuplicate
+			} else if _, ok := failed[pos]; !ok {
+				failed[pos] = fmt.Errorf("user %s already exists", users[pending[pos]].Id)
 			}
 		}
 
-		// some other error, such as capacity provisioned exceeded or failure
-		// to talk to the endpoint
-		us.logger.Errorf("error putting item %s %s for %s: %v", key, user.Id, user.Email, err)
+		if len(failed) > 0 {
+			retry := make([]int, 0, len(pending)-len(failed))
 
-		return err
+			for pos, idx := range pending {
+				if failedErr, ok := failed[pos]; ok {
+					errs[idx] = failedErr
+				} else {
+					retry = append(retry, idx)
+				}
+			}
+
+			return retry
+		}
+	}
+
+	us.logger.Errorf("error creating batch of %d users: %v", len(pending), err)
+
+	for _, idx := range pending {
+		errs[idx] = err
 	}
 
 	return nil
 }
 
-func (us *UserStore) Delete(ctx context.Context, id string) error {
-	// should update Delete to require the object not just the id, for
-	// now retrieve first to have access to the email for the delete
-	user, err := us.GetById(ctx, id)
+// createItems returns the transaction items to create the user along with
+// the item reserving its email, its credentials unless nil and any audit
+// entries.
+func (us *UserStore) createItems(
+	ctx context.Context, user *entity.User, credentials *entity.Credentials, audit []entity.AuditEntry,
+) ([]types.TransactWriteItem, error) {
+	item, err := us.marshalUser(ctx, user)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	transaction := dynamodb.TransactWriteItemsInput{
-		TransactItems: []types.TransactWriteItem{
-			{
-				// main object
-				Delete: &types.Delete{
-					Key: map[string]types.AttributeValue{
-						"Id":         &types.AttributeValueMemberS{Value: id},
-						"objectType": &types.AttributeValueMemberS{Value: key},
-					},
-					TableName: aws.String(us.tableName),
-				},
+	items := []types.TransactWriteItem{
+		{
+			Put: &types.Put{
+				Item:                item,
+				TableName:           aws.String(us.tableName),
+				ConditionExpression: aws.String("attribute_not_exists(Id)"),
 			},
-			{
-				// secondary object for unique email
-				Delete: &types.Delete{
-					Key: map[string]types.AttributeValue{
-						"Id": &types.AttributeValueMemberS{
-							Value: user.Email,
-						},
-						"objectType": &types.AttributeValueMemberS{
-							Value: fmt.Sprintf("%s#email", key),
-						},
-					},
-					TableName: aws.String(us.tableName),
-				},
+		},
+		{
+			// save a second object at the same time where the email is the Id
+			Put: &types.Put{
+				Item:                us.emailItem(user),
+				TableName:           aws.String(us.tableName),
+				ConditionExpression: aws.String("attribute_not_exists(Id)"),
 			},
 		},
 	}
 
-	// output, ignored, includes metrics such as capacity consumed, which would be
-	// use to emit via prometheus
-	_, err = us.dbClient.TransactWriteItems(ctx, &transaction)
+	credentialsPuts, err := us.credentialsPuts(ctx, user.TenantId, user.Id, credentials)
 	if err != nil {
-		us.logger.Errorf("error during delete: %v", err)
+		return nil, err
+	}
 
-		return err
+	auditPuts, err := us.auditPuts(ctx, user.TenantId, audit)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	items = append(items, credentialsPuts...)
+
+	return append(items, auditPuts...), nil
+}
+
+// emailItem returns the item reserving the email of the user within its
+// tenant.
+func (us *UserStore) emailItem(user *entity.User) map[string]types.AttributeValue {
+	item := emailKey(user.TenantId, us.emailId(user.Email))
+	item["UserId"] = &types.AttributeValueMemberS{Value: user.Id}
+
+	return item
+}
+
+// marshalUser returns the item storing the user, with any configured fields
+// encrypted.
+func (us *UserStore) marshalUser(ctx context.Context, user *entity.User) (map[string]types.AttributeValue, error) {
+	item, err := attributevalue.MarshalMap(user)
+	if err != nil {
+		us.logger.Errorf("Marshal failed for user (%s): %v", user.Id, err)
+
+		return nil, err
+	}
+
+	item["objectType"] = &types.AttributeValueMemberS{Value: userType(user.TenantId)}
+
+	addSearchAttributes(item, us.encrypts)
+
+	err = us.encryptUserItem(ctx, item, user.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	return item, nil
 }
 
-func (us *UserStore) GetByEmail(ctx context.Context, email string) (*entity.User, error) {
+func (us *UserStore) GetByEmail(ctx context.Context, tenant, email string) (*entity.User, error) {
 	if email == "" {
 		return nil, entity.ErrIDMissing
 	}
 
 	getItem := dynamodb.GetItemInput{
-		Key: map[string]types.AttributeValue{
-			"Id": &types.AttributeValueMemberS{
-				Value: email,
-			},
-			"objectType": &types.AttributeValueMemberS{
-				Value: fmt.Sprintf("%s#email", key),
-			},
-		},
+		Key:       emailKey(tenant, us.emailId(email)),
 		TableName: aws.String(us.tableName),
 	}
 
@@ -246,6 +342,21 @@ func (us *UserStore) GetByEmail(ctx context.Context, email string) (*entity.User
 	}
 
 	id := result.Item["UserId"]
+	if id == nil && us.encryptsEmail() {
+		// reservations made before emails were encrypted are keyed by the
+		// canonical email until moved by fsck
+		getItem.Key["Id"] = &types.AttributeValueMemberS{Value: entity.CanonicalEmail(email)}
+
+		result, err = us.dbClient.GetItem(ctx, &getItem)
+		if err != nil {
+			us.logger.Errorf("error during get: %v", err)
+
+			return nil, err
+		}
+
+		id = result.Item["UserId"]
+	}
+
 	if id == nil {
 		return nil, entity.ErrNotFound
 	}
@@ -259,21 +370,19 @@ func (us *UserStore) GetByEmail(ctx context.Context, email string) (*entity.User
 		return nil, err
 	}
 
-	return us.GetById(ctx, userId)
+	return us.GetById(ctx, tenant, userId)
 }
 
-func (us *UserStore) GetById(ctx context.Context, id string) (*entity.User, error) {
+func (us *UserStore) GetById(ctx context.Context, tenant, id string) (*entity.User, error) {
 	if id == "" {
 		return nil, entity.ErrIDMissing
 	}
 
 	getItem := dynamodb.GetItemInput{
-		Key: map[string]types.AttributeValue{
-			"Id": &types.AttributeValueMemberS{Value: id},
-			// using a sort key makes it easier to split the object into
-			// multiple pieces for storing if needed in the future as the object grows
-			"objectType": &types.AttributeValueMemberS{Value: key},
-		},
+		// using a sort key splits the object into multiple pieces, with
+		// the credentials stored separately so they are not read here, it
+		// also holds the tenant so users are only found in theirs
+		Key:       userKey(tenant, id),
 		TableName: aws.String(us.tableName),
 	}
 
@@ -284,6 +393,13 @@ func (us *UserStore) GetById(ctx context.Context, id string) (*entity.User, erro
 		return nil, err
 	}
 
+	err = us.decryptItem(ctx, result.Item)
+	if err != nil {
+		us.logger.Errorf("error decrypting %s %s: %v", key, id, err)
+
+		return nil, err
+	}
+
 	user := entity.User{}
 
 	err = attributevalue.UnmarshalMap(result.Item, &user)
@@ -297,27 +413,147 @@ func (us *UserStore) GetById(ctx context.Context, id string) (*entity.User, erro
 		return nil, entity.ErrNotFound
 	}
 
+	user.TenantId = entity.TenantOrDefault(tenant)
+
 	return &user, nil
 }
 
-func (us *UserStore) List(ctx context.Context) ([]entity.User, error) {
-	scanInput := dynamodb.ScanInput{
-		TableName:        aws.String(us.tableName),
-		FilterExpression: aws.String("objectType = :type"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":type": &types.AttributeValueMemberS{
-				Value: key,
-			},
-		},
+// GetMany returns the users with the given ids, in the order requested and
+// skipping any that do not exist, using BatchGetItem to read up to 100 users
+// per call. Keys left unprocessed once retries are exhausted fail the call
+// with entity.ErrUnavailable rather than reporting those users as missing.
+func (us *UserStore) GetMany(ctx context.Context, tenant string, ids []string) ([]entity.User, error) {
+	ids, err := uniqueIds(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]entity.User, len(ids))
+
+	for start := 0; start < len(ids); start += maxBatchGetKeys {
+		end := start + maxBatchGetKeys
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		keys := make([]map[string]types.AttributeValue, 0, end-start)
+		for _, id := range ids[start:end] {
+			keys = append(keys, userKey(tenant, id))
+		}
+
+		result, err := us.dbClient.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{
+			RequestItems: map[string]types.KeysAndAttributes{us.tableName: {Keys: keys}},
+		})
+		if err != nil {
+			us.logger.Errorf("error during batch get: %v", err)
+
+			return nil, err
+		}
+
+		if unprocessed := len(result.UnprocessedKeys[us.tableName].Keys); unprocessed > 0 {
+			return nil, &unavailableError{err: fmt.Errorf("%d of %d keys unprocessed", unprocessed, len(keys))}
+		}
+
+		items := result.Responses[us.tableName]
+		for _, item := range items {
+			err = us.decryptItem(ctx, item)
+			if err != nil {
+				us.logger.Errorf("error decrypting %s: %v", key, err)
+
+				return nil, err
+			}
+		}
+
+		users := make([]entity.User, len(items))
+
+		err = attributevalue.UnmarshalListOfMaps(items, &users)
+		if err != nil {
+			us.logger.Errorf("error unmarshaling %s: %v", key, err)
+
+			return nil, err
+		}
+
+		for _, user := range users {
+			user.TenantId = entity.TenantOrDefault(tenant)
+			found[user.Id] = user
+		}
+	}
+
+	users := make([]entity.User, 0, len(found))
+	for _, id := range ids {
+		if user, ok := found[id]; ok {
+			users = append(users, user)
+		}
 	}
 
-	// ideally switch to using a secondary index based on the objectType
-	// and use query instead of scan.
-	result, err := us.dbClient.Scan(ctx, &scanInput)
+	return users, nil
+}
+
+// uniqueIds drops repeated ids keeping the first of each, as a batch may not
+// request the same key twice.
+func uniqueIds(ids []string) ([]string, error) {
+	seen := make(map[string]bool, len(ids))
+	unique := make([]string, 0, len(ids))
+
+	for _, id := range ids {
+		if id == "" {
+			return nil, entity.ErrIDMissing
+		}
+
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+
+	return unique, nil
+}
+
+// List returns a single page of users using the objectType index, so that
+// only user objects of the tenant are read rather than every item in the
+// table.
+func (us *UserStore) List(ctx context.Context, tenant string, opts entity.ListOptions) (entity.UserPage, error) {
+	startKey, err := decodeDynamoDBCursor(opts.Cursor)
 	if err != nil {
-		us.logger.Errorf("error during scan: %v", err)
+		return entity.UserPage{}, err
+	}
 
-		return nil, err
+	queryInput, cursorAttributes, err := us.listQuery(tenant, opts)
+	if err != nil {
+		return entity.UserPage{}, err
+	}
+
+	if queryInput == nil {
+		return entity.UserPage{Users: []entity.User{}}, nil
+	}
+
+	// a cursor from another tenant would continue from a different
+	// partition, and one from another filter from a different index
+	if objectType, ok := startKey["objectType"].(*types.AttributeValueMemberS); startKey != nil &&
+		(!ok || objectType.Value != userType(tenant) || !hasAttributes(startKey, cursorAttributes)) {
+		return entity.UserPage{}, entity.ErrCursorInvalid
+	}
+
+	queryInput.ExclusiveStartKey = startKey
+
+	if opts.Limit > 0 {
+		queryInput.Limit = aws.Int32(opts.Limit)
+	}
+
+	result, err := us.dbClient.Query(ctx, queryInput)
+	if err != nil {
+		us.logger.Errorf("error during query: %v", err)
+
+		return entity.UserPage{}, err
+	}
+
+	for _, item := range result.Items {
+		err = us.decryptItem(ctx, item)
+		if err != nil {
+			us.logger.Errorf("error decrypting %s: %v", key, err)
+
+			return entity.UserPage{}, err
+		}
 	}
 
 	users := make([]entity.User, result.Count)
@@ -326,51 +562,115 @@ func (us *UserStore) List(ctx context.Context) ([]entity.User, error) {
 	if err != nil {
 		us.logger.Errorf("error unmarshaling %s: %v", key, err)
 
-		return nil, err
+		return entity.UserPage{}, err
 	}
 
-	return users, nil
+	for idx := range users {
+		users[idx].TenantId = entity.TenantOrDefault(tenant)
+	}
+
+	nextCursor, err := encodeDynamoDBCursor(result.LastEvaluatedKey)
+	if err != nil {
+		us.logger.Errorf("error encoding cursor for %s: %v", key, err)
+
+		return entity.UserPage{}, err
+	}
+
+	return entity.UserPage{Users: users, NextCursor: nextCursor}, nil
 }
 
-func (us *UserStore) Put(ctx context.Context, user *entity.User) error {
-	if user.Id == "" {
-		return entity.ErrIDMissing
+// hasAttributes reports whether the key has exactly the attributes named.
+func hasAttributes(key map[string]types.AttributeValue, names []string) bool {
+	if len(key) != len(names) {
+		return false
 	}
 
-	item, err := attributevalue.MarshalMap(user)
-	if err != nil {
-		us.logger.Errorf("Marshal failed for user (%s): %v", user.Id, err)
+	for _, name := range names {
+		if _, ok := key[name]; !ok {
+			return false
+		}
+	}
 
-		return err
+	return true
+}
+
+// isConditionalCheckFailed reports whether a write of the user item failed its
+// condition, whether performed on its own or as the first item of a
+// transaction.
+func isConditionalCheckFailed(err error) bool {
+	var ccfe *types.ConditionalCheckFailedException
+	if errors.As(err, &ccfe) {
+		return true
+	}
+
+	var errTransaction *types.TransactionCanceledException
+	if errors.As(err, &errTransaction) {
+		failedReasons := errTransaction.CancellationReasons
+
+		return len(failedReasons) >= 1 && aws.ToString(failedReasons[0].Code) == "ConditionalCheckFailed"
+	}
+
+	return false
+}
+
+// Purge removes the user, its credentials and the reservation of its email,
+// provided the user has not been modified since it was read. This allows soft
+// deleted users to be removed without racing against a concurrent restore.
+func (us *UserStore) Purge(ctx context.Context, user *entity.User) error {
+	if user.Id == "" {
+		return entity.ErrIDMissing
 	}
 
-	item["objectType"] = &types.AttributeValueMemberS{Value: key}
+	tenant := entity.TenantOrDefault(user.TenantId)
+	condition, values := versionCondition(user.Version)
 
-	// attempt a put item first with the optimistic view that it'll be
-	// rare to update the email address field.
-	putItem := dynamodb.PutItemInput{
-		Item:                item,
-		TableName:           aws.String(us.tableName),
-		ConditionExpression: aws.String("Email = :email"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":email": &types.AttributeValueMemberS{
-				Value: user.Email,
+	transaction := dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{
+				Delete: &types.Delete{
+					Key:                       userKey(tenant, user.Id),
+					TableName:                 aws.String(us.tableName),
+					ConditionExpression:       aws.String(condition),
+					ExpressionAttributeValues: values,
+				},
+			},
+			{
+				// only release the email if still reserved for this user
+				Delete: &types.Delete{
+					Key:                 emailKey(tenant, us.emailId(user.Email)),
+					TableName:           aws.String(us.tableName),
+					ConditionExpression: aws.String("UserId = :id"),
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":id": &types.AttributeValueMemberS{Value: user.Id},
+					},
+				},
+			},
+			{
+				Delete: &types.Delete{
+					Key:       credentialsKey(tenant, user.Id),
+					TableName: aws.String(us.tableName),
+				},
 			},
 		},
 	}
 
-	_, err = us.dbClient.PutItem(ctx, &putItem)
+	_, err := us.dbClient.TransactWriteItems(ctx, &transaction)
 	if err != nil {
-		var ccfe *types.ConditionalCheckFailedException
-		if errors.As(err, &ccfe) {
-			// email is being modified, fall back to attempting an Update
-			// can invert this later once switched to using update which
-			// can determine whether it can simply call put or needs to
-			// perform a full transact multiple entry update
-			return us.Update(ctx, user)
+		var errTransaction *types.TransactionCanceledException
+		if errors.As(err, &errTransaction) {
+			failedReasons := errTransaction.CancellationReasons
+
+			if len(failedReasons) >= 1 && aws.ToString(failedReasons[0].Code) == "ConditionalCheckFailed" {
+				// distinguish between already removed and modified since read
+				if _, err := us.GetById(ctx, tenant, user.Id); err != nil {
+					return err
+				}
+
+				return entity.ErrConflict
+			}
 		}
 
-		us.logger.Errorf("error putting item %s %s: %v", key, item, err)
+		us.logger.Errorf("error during purge of %s: %v", user.Id, err)
 
 		return err
 	}
@@ -380,59 +680,69 @@ func (us *UserStore) Put(ctx context.Context, user *entity.User) error {
 
 // Update performs a get first in order to determine if additional operations
 // must be performed in case the field requires special handling.
-// Emails must be unique in addition to the Id, therefore for dynamodb
+// Emails must be unique ignoring case in addition to the Id, therefore for dynamodb
 // that means being a primary key and requires two PutItems to be
-// performed as well as a DeleteItem to remove the old email
-func (us *UserStore) Update(ctx context.Context, user *entity.User) error {
+// performed as well as a DeleteItem to remove the old email.
+// The user item is only written if the stored Version still matches that of
+// the user passed in, otherwise entity.ErrConflict is returned. The stored
+// credentials are only replaced when the user has a Password.
+func (us *UserStore) Update(ctx context.Context, user *entity.User, audit ...entity.AuditEntry) error {
 	if user.Id == "" {
 		return entity.ErrIDMissing
 	}
 
-	currentUser, err := us.GetById(ctx, user.Id)
+	user.TenantId = entity.TenantOrDefault(user.TenantId)
+
+	currentUser, err := us.GetById(ctx, user.TenantId, user.Id)
 	if err != nil {
 		us.logger.Errorf("failed to retrieve requested user to update: %s", user.Id)
 
 		return err
 	}
 
-	item, err := attributevalue.MarshalMap(user)
-	if err != nil {
-		us.logger.Errorf("Marshal failed for user (%s): %v", user.Id, err)
+	if currentUser.Version != user.Version {
+		return entity.ErrConflict
+	}
+
+	updated := *user
+	updated.Version++
 
+	item, err := us.marshalUser(ctx, &updated)
+	if err != nil {
 		return err
 	}
 
-	item["objectType"] = &types.AttributeValueMemberS{Value: key}
+	expression, names, values := profileUpdate(item)
+
+	condition, conditionValues := versionCondition(user.Version)
+	for name, value := range conditionValues {
+		values[name] = value
+	}
 
 	transaction := dynamodb.TransactWriteItemsInput{
 		TransactItems: []types.TransactWriteItem{
 			{
-				Put: &types.Put{
-					Item:      item,
-					TableName: aws.String(us.tableName),
+				Update: &types.Update{
+					Key:                       userKey(user.TenantId, user.Id),
+					TableName:                 aws.String(us.tableName),
+					UpdateExpression:          expression,
+					ConditionExpression:       aws.String(condition),
+					ExpressionAttributeNames:  names,
+					ExpressionAttributeValues: values,
 				},
 			},
 		},
 	}
 
-	if user.Email != currentUser.Email {
+	emailChanged := us.emailId(user.Email) != us.emailId(currentUser.Email)
+	if emailChanged {
 		// need to append insertion of the new entry for an email address
 		// and removal of the old as a single transaction
 		transaction.TransactItems = append(
 			transaction.TransactItems,
 			types.TransactWriteItem{
 				Put: &types.Put{
-					Item: map[string]types.AttributeValue{
-						"Id": &types.AttributeValueMemberS{
-							Value: user.Email,
-						},
-						"UserId": &types.AttributeValueMemberS{
-							Value: user.Id,
-						},
-						"objectType": &types.AttributeValueMemberS{
-							Value: fmt.Sprintf("%s#email", key),
-						},
-					},
+					Item:                us.emailItem(user),
 					TableName:           aws.String(us.tableName),
 					ConditionExpression: aws.String("attribute_not_exists(Id)"),
 				},
@@ -440,37 +750,161 @@ func (us *UserStore) Update(ctx context.Context, user *entity.User) error {
 			types.TransactWriteItem{
 				// secondary object for unique email
 				Delete: &types.Delete{
-					Key: map[string]types.AttributeValue{
-						"Id": &types.AttributeValueMemberS{
-							Value: currentUser.Email,
-						},
-						"objectType": &types.AttributeValueMemberS{
-							Value: fmt.Sprintf("%s#email", key),
-						},
-					},
+					Key:       emailKey(user.TenantId, us.emailId(currentUser.Email)),
 					TableName: aws.String(us.tableName),
 				},
 			},
 		)
 	}
 
+	// credentials and audit entries are added last so that the positions of
+	// the items above in the cancellation reasons are unchanged
+	conditioned := len(transaction.TransactItems)
+
+	credentialsPuts, err := us.passwordPuts(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	auditPuts, err := us.auditPuts(ctx, user.TenantId, audit)
+	if err != nil {
+		return err
+	}
+
+	transaction.TransactItems = append(transaction.TransactItems, credentialsPuts...)
+	transaction.TransactItems = append(transaction.TransactItems, auditPuts...)
+
 	_, err = us.dbClient.TransactWriteItems(ctx, &transaction)
 	if err != nil {
 		var errTransaction *types.TransactionCanceledException
 		if errors.As(err, &errTransaction) {
 			failedReasons := errTransaction.CancellationReasons
 
-			if len(failedReasons) >= 2 && *failedReasons[1].Code == "ConditionalCheckFailed" {
+			if len(failedReasons) >= 1 && aws.ToString(failedReasons[0].Code) == "ConditionalCheckFailed" {
+				// user item was written by someone else since it was read
+
+				return entity.ErrConflict
+			}
+
+			if emailChanged && len(failedReasons) >= 2 && aws.ToString(failedReasons[1].Code) == "ConditionalCheckFailed" {
 				// second item insertion failed means email already in use
 
 				return entity.ErrEmailDuplicate
 			}
 		}
 
+		if isAuditConflict(err, conditioned) {
+			return entity.ErrConflict
+		}
+
 		us.logger.Errorf("error putting item %s: %v", key, user.Id)
 
 		return err
 	}
 
+	user.Version = updated.Version
+
 	return nil
 }
+
+// optionalUserAttributes are the attributes of the user item only present
+// for some users, which are removed when a user written lacks them.
+var optionalUserAttributes = []string{
+	"DeletedAt",
+	searchEmailAttribute,
+	searchNameAttribute,
+	emailIndexAttribute,
+	dataKeyAttribute,
+	keyIdAttribute,
+	encryptedFieldsAttribute,
+}
+
+// profileUpdate returns the update writing the marshaled user item over the
+// stored one. The login attributes are left as stored, as RecordLogin changes
+// them without a new Version and they would otherwise be reverted to those of
+// the user as it was read, unless encrypted, as they must then be written
+// under the same data key as the rest of the item.
+func profileUpdate(item map[string]types.AttributeValue) (*string, map[string]string, map[string]types.AttributeValue) {
+	encrypted := itemEncryptedFields(item)
+
+	set := make(map[string]types.AttributeValue, len(item))
+
+	for name, value := range item {
+		if name == "Id" || name == "objectType" || (isLoginAttribute(name) && !encrypted(name)) {
+			continue
+		}
+
+		set[name] = value
+	}
+
+	var remove []string
+
+	for _, name := range optionalUserAttributes {
+		if _, ok := item[name]; !ok {
+			remove = append(remove, name)
+		}
+	}
+
+	if _, ok := item["LastLoginIp"]; !ok && encrypted("LastLoginIp") {
+		remove = append(remove, "LastLoginIp")
+	}
+
+	return itemUpdate(set, remove)
+}
+
+// itemUpdate returns the update expression setting the attributes given and
+// removing those named, along with the names and values it refers to. All
+// attributes are referred to by placeholders, as some such as Name are
+// reserved words.
+func itemUpdate(
+	set map[string]types.AttributeValue, remove []string,
+) (*string, map[string]string, map[string]types.AttributeValue) {
+	names := make(map[string]string, len(set)+len(remove))
+	values := make(map[string]types.AttributeValue, len(set))
+
+	// sorted so that the same update always has the same expression
+	attributes := make([]string, 0, len(set))
+	for name := range set {
+		attributes = append(attributes, name)
+	}
+
+	sort.Strings(attributes)
+
+	actions := make([]string, 0, len(attributes))
+
+	for idx, name := range attributes {
+		names[fmt.Sprintf("#s%d", idx)] = name
+		values[fmt.Sprintf(":s%d", idx)] = set[name]
+		actions = append(actions, fmt.Sprintf("#s%d = :s%d", idx, idx))
+	}
+
+	expression := "SET " + strings.Join(actions, ", ")
+
+	if len(remove) > 0 {
+		removals := make([]string, 0, len(remove))
+
+		for idx, name := range remove {
+			names[fmt.Sprintf("#r%d", idx)] = name
+			removals = append(removals, fmt.Sprintf("#r%d", idx))
+		}
+
+		expression += " REMOVE " + strings.Join(removals, ", ")
+	}
+
+	return aws.String(expression), names, values
+}
+
+// versionCondition returns a condition expression that only matches when the
+// stored user is still at the given version. Items written before versioning
+// was introduced may have no Version attribute and are treated as version 0.
+func versionCondition(version int64) (string, map[string]types.AttributeValue) {
+	values := map[string]types.AttributeValue{
+		":version": &types.AttributeValueMemberN{Value: strconv.FormatInt(version, 10)},
+	}
+
+	if version == 0 {
+		return "attribute_exists(Id) AND (attribute_not_exists(Version) OR Version = :version)", values
+	}
+
+	return "Version = :version", values
+}
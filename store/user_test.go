@@ -2,7 +2,10 @@ package store_test
 
 import (
 	"context"
+	"fmt"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
@@ -14,16 +17,69 @@ import (
 
 	"github.com/electrofelix/gin-demo/entity"
 	"github.com/electrofelix/gin-demo/mocks"
+	"github.com/electrofelix/gin-demo/service"
 	"github.com/electrofelix/gin-demo/store"
+	"github.com/electrofelix/gin-demo/store/dynamotest"
+	"github.com/electrofelix/gin-demo/store/storetest"
 )
 
 const (
 	tableName = "test-table"
 )
 
+// setupFakeUserStore returns a migrated store backed by a new fake, along
+// with the fake so that tests can reach the items directly.
+func setupFakeUserStore(t *testing.T, options ...store.Option) (*dynamotest.FakeDynamoDB, *store.UserStore) {
+	t.Helper()
+
+	fake := dynamotest.New()
+	dataStore := store.NewUserStore(fake, tableName, options...)
+
+	require.NoError(t, store.NewMigrator(dataStore).Up(context.Background()))
+
+	return fake, dataStore
+}
+
+func TestUserStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) service.UserStore {
+		_, dataStore := setupFakeUserStore(t)
+
+		return dataStore
+	})
+}
+
 // Would be more useful tests for success paths to be able to execute the
 // tests against an automatically spun up DB instance and confirm the general
-// behaviour matches.
+// behaviour matches. Until then the conformance suite can be run against
+// dynamodb-local by setting DYNAMODB_ENDPOINT, e.g. http://localhost:8000
+func TestUserStore_Conformance(t *testing.T) {
+	endpoint := os.Getenv("DYNAMODB_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("DYNAMODB_ENDPOINT not set")
+	}
+
+	dbClient := dynamodb.New(dynamodb.Options{
+		Region:           "us-west-2",
+		EndpointResolver: dynamodb.EndpointResolverFromURL(endpoint),
+		Credentials: aws.CredentialsProviderFunc(
+			func(c context.Context) (aws.Credentials, error) {
+				return aws.Credentials{AccessKeyID: "AK1", SecretAccessKey: "SK1"}, nil
+			},
+		),
+	})
+
+	storetest.Run(t, func(t *testing.T) service.UserStore {
+		table := fmt.Sprintf("conformance-%s", xid.New().String())
+		dataStore := store.NewUserStore(dbClient, table)
+
+		require.NoError(t, store.NewMigrator(dataStore).Up(context.Background()))
+		t.Cleanup(func() {
+			_, _ = dbClient.DeleteTable(context.Background(), &dynamodb.DeleteTableInput{TableName: aws.String(table)})
+		})
+
+		return dataStore
+	})
+}
 
 func userToUserAttributeValue(user entity.User) map[string]types.AttributeValue {
 	return map[string]types.AttributeValue{
@@ -76,32 +132,16 @@ func TestUserStore_Create(t *testing.T) {
 		err := dataStore.Create(context.Background(), &entity.User{})
 		assert.Equal(t, err, entity.ErrEmailDuplicate)
 	})
-}
-
-func TestUserStore_Delete(t *testing.T) {
-	ctrl := gomock.NewController(t)
 
-	t.Run("success", func(t *testing.T) {
+	t.Run("cancelled-without-reasons", func(t *testing.T) {
 		mockDBClient := mocks.NewMockDynamoDBAPI(ctrl)
 		dataStore := store.NewUserStore(mockDBClient, tableName)
 
-		user := entity.User{
-			Email: "user1@example.com",
-			Name:  "test-user",
-		}
-
-		mockDBClient.EXPECT().GetItem(gomock.Any(), gomock.Any()).Return(
-			&dynamodb.GetItemOutput{Item: userToUserAttributeValue(user)}, nil,
-		)
-		mockDBClient.EXPECT().TransactWriteItems(gomock.Any(), gomock.Any()).Return(&dynamodb.TransactWriteItemsOutput{}, nil)
-
-		err := dataStore.Delete(context.Background(), user.Email)
-		require.NoError(t, err)
-	})
+		cancelled := &types.TransactionCanceledException{Message: aws.String("simulated cancellation")}
+		mockDBClient.EXPECT().TransactWriteItems(gomock.Any(), gomock.Any()).Return(nil, cancelled)
 
-	t.Run("not-found", func(t *testing.T) {
-		mockDBClient := mocks.NewMockDynamoDBAPI(ctrl)
-		_ = store.NewUserStore(mockDBClient, tableName)
+		err := dataStore.Create(context.Background(), &entity.User{})
+		assert.Equal(t, cancelled, err)
 	})
 }
 
@@ -113,9 +153,10 @@ func TestUserStore_GetByEmail(t *testing.T) {
 		dataStore := store.NewUserStore(mockDBClient, tableName)
 
 		user := entity.User{
-			Id:    xid.New().String(),
-			Email: "user1@example.com",
-			Name:  "test-user",
+			Id:       xid.New().String(),
+			TenantId: entity.DefaultTenant,
+			Email:    "user1@example.com",
+			Name:     "test-user",
 		}
 
 		mockDBClient.EXPECT().GetItem(gomock.Any(), gomock.Any()).Return(
@@ -125,7 +166,7 @@ func TestUserStore_GetByEmail(t *testing.T) {
 			&dynamodb.GetItemOutput{Item: userToUserAttributeValue(user)}, nil,
 		)
 
-		got, err := dataStore.GetByEmail(context.Background(), user.Email)
+		got, err := dataStore.GetByEmail(context.Background(), entity.DefaultTenant, user.Email)
 		require.NoError(t, err)
 
 		assert.Equal(t, user, *got)
@@ -140,15 +181,16 @@ func TestUserStore_GetById(t *testing.T) {
 		dataStore := store.NewUserStore(mockDBClient, tableName)
 
 		user := entity.User{
-			Email: "user1@example.com",
-			Name:  "test-user",
+			TenantId: entity.DefaultTenant,
+			Email:    "user1@example.com",
+			Name:     "test-user",
 		}
 
 		mockDBClient.EXPECT().GetItem(gomock.Any(), gomock.Any()).Return(
 			&dynamodb.GetItemOutput{Item: userToUserAttributeValue(user)}, nil,
 		)
 
-		got, err := dataStore.GetById(context.Background(), user.Email)
+		got, err := dataStore.GetById(context.Background(), entity.DefaultTenant, user.Email)
 		require.NoError(t, err)
 
 		assert.Equal(t, user, *got)
@@ -158,7 +200,7 @@ func TestUserStore_GetById(t *testing.T) {
 		mockDBClient := mocks.NewMockDynamoDBAPI(ctrl)
 		dataStore := store.NewUserStore(mockDBClient, tableName)
 
-		_, err := dataStore.GetById(context.Background(), "")
+		_, err := dataStore.GetById(context.Background(), entity.DefaultTenant, "")
 		assert.Error(t, err)
 	})
 
@@ -170,7 +212,7 @@ func TestUserStore_GetById(t *testing.T) {
 			&dynamodb.GetItemOutput{}, nil,
 		)
 
-		user, err := dataStore.GetById(context.Background(), xid.New().String())
+		user, err := dataStore.GetById(context.Background(), entity.DefaultTenant, xid.New().String())
 		require.Error(t, err)
 
 		assert.Equal(t, entity.ErrNotFound, err)
@@ -187,17 +229,24 @@ func TestUserStore_List(t *testing.T) {
 
 		users := []entity.User{
 			{
-				Email: "user1@example.com",
-				Name:  "test-user1",
+				TenantId: entity.DefaultTenant,
+				Email:    "user1@example.com",
+				Name:     "test-user1",
 			},
 			{
-				Email: "user2@example.com",
-				Name:  "test-user2",
+				TenantId: entity.DefaultTenant,
+				Email:    "user2@example.com",
+				Name:     "test-user2",
 			},
 		}
 
-		mockDBClient.EXPECT().Scan(gomock.Any(), gomock.Any()).Return(
-			&dynamodb.ScanOutput{
+		mockDBClient.EXPECT().Query(gomock.Any(), gomock.Any()).Do(
+			func(ctx context.Context, input *dynamodb.QueryInput) {
+				assert.Equal(t, "objectType-index", *input.IndexName)
+				assert.Nil(t, input.ExclusiveStartKey)
+			},
+		).Return(
+			&dynamodb.QueryOutput{
 				Items: []map[string]types.AttributeValue{
 					userToUserAttributeValue(users[0]),
 					userToUserAttributeValue(users[1]),
@@ -207,74 +256,221 @@ func TestUserStore_List(t *testing.T) {
 			nil,
 		)
 
-		got, err := dataStore.List(context.Background())
+		got, err := dataStore.List(context.Background(), entity.DefaultTenant, entity.ListOptions{})
 		require.NoError(t, err)
 
-		assert.ElementsMatch(t, users, got)
+		assert.ElementsMatch(t, users, got.Users)
+		assert.Empty(t, got.NextCursor)
 	})
-}
 
-func TestUserStore_Put(t *testing.T) {
-	ctrl := gomock.NewController(t)
-
-	t.Run("success", func(t *testing.T) {
+	t.Run("pagination", func(t *testing.T) {
 		mockDBClient := mocks.NewMockDynamoDBAPI(ctrl)
 		dataStore := store.NewUserStore(mockDBClient, tableName)
 
 		user := entity.User{
 			Id:    xid.New().String(),
-			Email: "user1@exmaple.com",
+			Email: "user1@example.com",
 			Name:  "test-user1",
 		}
+		lastKey := map[string]types.AttributeValue{
+			"Id":         &types.AttributeValueMemberS{Value: user.Id},
+			"objectType": &types.AttributeValueMemberS{Value: "UserInfo"},
+		}
+
+		mockDBClient.EXPECT().Query(gomock.Any(), gomock.Any()).Do(
+			func(ctx context.Context, input *dynamodb.QueryInput) {
+				assert.Equal(t, int32(1), *input.Limit)
+			},
+		).Return(
+			&dynamodb.QueryOutput{
+				Items:            []map[string]types.AttributeValue{userToUserAttributeValue(user)},
+				Count:            1,
+				LastEvaluatedKey: lastKey,
+			},
+			nil,
+		)
 
-		mockDBClient.EXPECT().PutItem(gomock.Any(), gomock.Any()).Do(
-			func(ctx context.Context, input *dynamodb.PutItemInput) {
-				id := input.Item["Id"].(*types.AttributeValueMemberS)
-				email := input.Item["Email"].(*types.AttributeValueMemberS)
+		page, err := dataStore.List(context.Background(), entity.DefaultTenant, entity.ListOptions{Limit: 1})
+		require.NoError(t, err)
+		require.NotEmpty(t, page.NextCursor)
 
-				assert.Equal(t, user.Id, id.Value)
-				assert.Equal(t, user.Email, email.Value)
+		mockDBClient.EXPECT().Query(gomock.Any(), gomock.Any()).Do(
+			func(ctx context.Context, input *dynamodb.QueryInput) {
+				assert.Equal(t, lastKey, input.ExclusiveStartKey)
 			},
-		).Return(nil, nil)
+		).Return(&dynamodb.QueryOutput{}, nil)
 
-		err := dataStore.Put(context.Background(), &user)
+		page, err = dataStore.List(context.Background(), entity.DefaultTenant, entity.ListOptions{Limit: 1, Cursor: page.NextCursor})
 		require.NoError(t, err)
+
+		assert.Empty(t, page.Users)
+		assert.Empty(t, page.NextCursor)
 	})
 
-	t.Run("fallback-update", func(t *testing.T) {
+	t.Run("bad-cursor", func(t *testing.T) {
 		mockDBClient := mocks.NewMockDynamoDBAPI(ctrl)
 		dataStore := store.NewUserStore(mockDBClient, tableName)
 
-		user := entity.User{
-			Id:    xid.New().String(),
-			Email: "user1@exmaple.com",
-			Name:  "test-user1",
+		_, err := dataStore.List(context.Background(), entity.DefaultTenant, entity.ListOptions{Cursor: "not-a-cursor"})
+		assert.ErrorIs(t, err, entity.ErrCursorInvalid)
+	})
+
+	t.Run("filtered", func(t *testing.T) {
+		mockDBClient := mocks.NewMockDynamoDBAPI(ctrl)
+		dataStore := store.NewUserStore(mockDBClient, tableName)
+
+		after := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+
+		// the index of the first filter is read, the rest are applied to
+		// the users read from it
+		mockDBClient.EXPECT().Query(gomock.Any(), gomock.Any()).Do(
+			func(ctx context.Context, input *dynamodb.QueryInput) {
+				assert.Equal(t, "searchEmail-index", aws.ToString(input.IndexName))
+				assert.Equal(
+					t, "objectType = :type AND begins_with(SearchEmail, :emailPrefix)",
+					aws.ToString(input.KeyConditionExpression),
+				)
+				assert.Equal(
+					t, "attribute_not_exists(DeletedAt) AND LastLoginSort > :lastLoginAfter",
+					aws.ToString(input.FilterExpression),
+				)
+				assert.Equal(
+					t, &types.AttributeValueMemberS{Value: "2024-05-06T07:08:09.000000000Z"},
+					input.ExpressionAttributeValues[":lastLoginAfter"],
+				)
+			},
+		).Return(&dynamodb.QueryOutput{}, nil)
+
+		_, err := dataStore.List(context.Background(), entity.DefaultTenant, entity.ListOptions{
+			EmailPrefix: "user", LastLoginAfter: after,
+		})
+		require.NoError(t, err)
+	})
+
+	t.Run("cursor-of-other-filter", func(t *testing.T) {
+		_, dataStore := setupFakeUserStore(t)
+
+		for _, email := range []string{"user1@example.com", "user2@example.com"} {
+			user := entity.User{Id: xid.New().String(), Email: email, Name: email}
+			require.NoError(t, dataStore.Create(context.Background(), &user))
 		}
-		updateUser := user
-		updateUser.Email = "user2@example.com"
 
-		mockDBClient.EXPECT().PutItem(gomock.Any(), gomock.Any()).Return(
-			nil, &types.ConditionalCheckFailedException{
-				Message: aws.String("simulated conditional check failed"),
+		page, err := dataStore.List(context.Background(), entity.DefaultTenant, entity.ListOptions{
+			Limit: 1, EmailPrefix: "user",
+		})
+		require.NoError(t, err)
+		require.NotEmpty(t, page.NextCursor)
+
+		// continuing would start from a key of another index
+		_, err = dataStore.List(context.Background(), entity.DefaultTenant, entity.ListOptions{
+			Limit: 1, NamePrefix: "user", Cursor: page.NextCursor,
+		})
+		assert.ErrorIs(t, err, entity.ErrCursorInvalid)
+	})
+
+	t.Run("encrypted-filter", func(t *testing.T) {
+		mockDBClient := mocks.NewMockDynamoDBAPI(ctrl)
+		dataStore := store.NewUserStore(mockDBClient, tableName, store.WithEncryption(setupKeyProvider(t), "Name"))
+
+		_, err := dataStore.List(context.Background(), entity.DefaultTenant, entity.ListOptions{NamePrefix: "user"})
+		assert.ErrorIs(t, err, entity.ErrFilterUnsupported)
+	})
+}
+
+func mapValues(m map[string]string) []string {
+	values := make([]string, 0, len(m))
+	for _, value := range m {
+		values = append(values, value)
+	}
+
+	return values
+}
+
+func TestUserStore_RecordLogin(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	t.Run("update-item", func(t *testing.T) {
+		mockDBClient := mocks.NewMockDynamoDBAPI(ctrl)
+		dataStore := store.NewUserStore(mockDBClient, tableName)
+
+		mockDBClient.EXPECT().UpdateItem(gomock.Any(), gomock.Any()).Do(
+			func(ctx context.Context, input *dynamodb.UpdateItemInput) {
+				assert.Equal(
+					t, "SET LastLogin = :lastLogin, LastLoginSort = :lastLoginSort, LastLoginIp = :sourceIp "+
+						"ADD LoginCount :one",
+					aws.ToString(input.UpdateExpression),
+				)
+				assert.Equal(t, &types.AttributeValueMemberS{Value: "192.0.2.1"}, input.ExpressionAttributeValues[":sourceIp"])
+				// fixed width, so that it sorts chronologically
+				assert.Equal(
+					t, &types.AttributeValueMemberS{Value: "2024-05-06T07:08:09.500000000Z"},
+					input.ExpressionAttributeValues[":lastLoginSort"],
+				)
 			},
-		)
-		mockDBClient.EXPECT().GetItem(gomock.Any(), gomock.Any()).Return(
-			&dynamodb.GetItemOutput{Item: userToUserAttributeValue(user)}, nil,
-		)
+		).Return(&dynamodb.UpdateItemOutput{}, nil)
+
+		login := entity.Login{Time: time.Date(2024, 5, 6, 7, 8, 9, 500000000, time.UTC), SourceIp: "192.0.2.1"}
+		require.NoError(t, dataStore.RecordLogin(context.Background(), entity.DefaultTenant, "user1", login))
+	})
+
+	t.Run("with-audit", func(t *testing.T) {
+		mockDBClient := mocks.NewMockDynamoDBAPI(ctrl)
+		dataStore := store.NewUserStore(mockDBClient, tableName)
+
 		mockDBClient.EXPECT().TransactWriteItems(gomock.Any(), gomock.Any()).Do(
 			func(ctx context.Context, input *dynamodb.TransactWriteItemsInput) {
-				assert.Len(t, input.TransactItems, 3)
+				require.Len(t, input.TransactItems, 2)
+				assert.NotNil(t, input.TransactItems[0].Update)
+				assert.NotNil(t, input.TransactItems[1].Put)
 			},
-		).Return(nil, nil)
+		).Return(&dynamodb.TransactWriteItemsOutput{}, nil)
 
-		err := dataStore.Put(context.Background(), &updateUser)
+		audit := entity.AuditEntry{UserId: "user1", Timestamp: time.Now(), Action: entity.AuditActionLogin}
+		err := dataStore.RecordLogin(
+			context.Background(), entity.DefaultTenant, "user1", entity.Login{Time: time.Now()}, audit,
+		)
 		require.NoError(t, err)
 	})
+
+	t.Run("encrypted-field", func(t *testing.T) {
+		mockDBClient := mocks.NewMockDynamoDBAPI(ctrl)
+		dataStore := store.NewUserStore(mockDBClient, tableName, store.WithEncryption(nil, "Name", "LastLoginIp"))
+
+		err := dataStore.RecordLogin(context.Background(), entity.DefaultTenant, "user1", entity.Login{Time: time.Now()})
+		assert.Error(t, err)
+	})
 }
 
 func TestUserStore_Update(t *testing.T) {
 	ctrl := gomock.NewController(t)
 
+	t.Run("audit-same-timestamp", func(t *testing.T) {
+		_, dataStore := setupFakeUserStore(t)
+
+		user := entity.User{Id: xid.New().String(), Email: "user1@example.com", Name: "first"}
+		require.NoError(t, dataStore.Create(context.Background(), &user))
+
+		timestamp := time.Now().UTC()
+		audit := entity.AuditEntry{UserId: user.Id, Timestamp: timestamp, Actor: "first", Action: entity.AuditActionUpdate}
+
+		require.NoError(t, dataStore.Update(context.Background(), &user, audit))
+
+		// an entry of the same time must not replace the first
+		user.Name = "second"
+		audit.Actor = "second"
+		err := dataStore.Update(context.Background(), &user, audit)
+		assert.ErrorIs(t, err, entity.ErrConflict)
+
+		page, err := dataStore.ListAudit(context.Background(), entity.DefaultTenant, user.Id, entity.ListOptions{})
+		require.NoError(t, err)
+		require.Len(t, page.Entries, 1)
+		assert.Equal(t, "first", page.Entries[0].Actor)
+
+		got, err := dataStore.GetById(context.Background(), entity.DefaultTenant, user.Id)
+		require.NoError(t, err)
+		assert.Equal(t, "first", got.Name)
+	})
+
 	t.Run("success-same-email", func(t *testing.T) {
 		mockDBClient := mocks.NewMockDynamoDBAPI(ctrl)
 		dataStore := store.NewUserStore(mockDBClient, tableName)
@@ -323,4 +519,51 @@ func TestUserStore_Update(t *testing.T) {
 		err := dataStore.Update(context.Background(), &updateUser)
 		require.NoError(t, err)
 	})
+	t.Run("stale-version", func(t *testing.T) {
+		mockDBClient := mocks.NewMockDynamoDBAPI(ctrl)
+		dataStore := store.NewUserStore(mockDBClient, tableName)
+
+		user := entity.User{
+			Id:    xid.New().String(),
+			Email: "user1@exmaple.com",
+			Name:  "test-user1",
+		}
+
+		updateUser := user
+		updateUser.Version = 3
+
+		mockDBClient.EXPECT().GetItem(gomock.Any(), gomock.Any()).Return(
+			&dynamodb.GetItemOutput{Item: userToUserAttributeValue(user)}, nil,
+		)
+
+		err := dataStore.Update(context.Background(), &updateUser)
+		assert.Equal(t, entity.ErrConflict, err)
+	})
+
+	t.Run("concurrent-write", func(t *testing.T) {
+		mockDBClient := mocks.NewMockDynamoDBAPI(ctrl)
+		dataStore := store.NewUserStore(mockDBClient, tableName)
+
+		user := entity.User{
+			Id:    xid.New().String(),
+			Email: "user1@exmaple.com",
+			Name:  "test-user1",
+		}
+
+		mockDBClient.EXPECT().GetItem(gomock.Any(), gomock.Any()).Return(
+			&dynamodb.GetItemOutput{Item: userToUserAttributeValue(user)}, nil,
+		)
+		mockDBClient.EXPECT().TransactWriteItems(gomock.Any(), gomock.Any()).Return(
+			nil, &types.TransactionCanceledException{
+				CancellationReasons: []types.CancellationReason{
+					{
+						Code: aws.String("ConditionalCheckFailed"),
+					},
+				},
+			},
+		)
+
+		err := dataStore.Update(context.Background(), &user)
+		assert.Equal(t, entity.ErrConflict, err)
+	})
 }